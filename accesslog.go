@@ -0,0 +1,127 @@
+package ftpserver
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log: with the AccessLog setting, each command is written in the W3C extended log format
+// (https://www.w3.org/TR/WD-logfile.html), which the web log analyzers read:
+//
+//	#Software: ftpserverlib
+//	#Version: 1.0
+//	#Fields: date time c-ip cs-username cs-method cs-uri-stem sc-status sc-bytes time-taken
+//	2026-10-16 08:12:44 192.0.2.10 alice RETR /reports/2026.csv 226 48213 0.412
+//
+// The dates are in UTC, time-taken is in seconds and sc-bytes counts the bytes of the file transfers.
+// The empty fields are "-", the credentials aren't written. A RotatingFile bounds the disk usage.
+
+// accessLogHeader is written at the top of the access log, and of each file of a RotatingFile
+const accessLogHeader = "#Software: ftpserverlib\n" +
+	"#Version: 1.0\n" +
+	"#Fields: date time c-ip cs-username cs-method cs-uri-stem sc-status sc-bytes time-taken\n"
+
+// accessLogEscaper keeps each field a single token
+var accessLogEscaper = strings.NewReplacer("%", "%25", " ", "%20", "\t", "%09", "\r", "%0D", "\n", "%0A")
+
+// accessLog writes the commands of all the sessions to the AccessLog setting
+type accessLog struct {
+	writer        io.Writer
+	headerWritten bool       // the header was written, by the log or by the RotatingFile
+	mu            sync.Mutex // serializes the entries
+}
+
+// newAccessLog creates the access log, nil if there is no writer
+func newAccessLog(writer io.Writer) *accessLog {
+	if writer == nil {
+		return nil
+	}
+
+	log := &accessLog{writer: writer}
+
+	if file, ok := writer.(*RotatingFile); ok {
+		file.setHeader(accessLogHeader)
+		log.headerWritten = true
+	}
+
+	return log
+}
+
+// accessLogEntry is a line of the access log
+type accessLogEntry struct {
+	date     time.Time
+	clientIP string
+	user     string
+	command  string
+	param    string
+	status   int
+	bytes    int64
+	duration time.Duration
+}
+
+func (l *accessLog) write(entry *accessLogEntry) error {
+	line := fmt.Sprintf("%s %s %s %s %s %d %d %.3f\n",
+		entry.date.UTC().Format("2006-01-02 15:04:05"),
+		accessLogField(entry.clientIP),
+		accessLogField(entry.user),
+		accessLogField(entry.command),
+		accessLogField(entry.param),
+		entry.status,
+		entry.bytes,
+		entry.duration.Seconds(),
+	)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.headerWritten {
+		if _, err := io.WriteString(l.writer, accessLogHeader); err != nil {
+			return err
+		}
+
+		l.headerWritten = true
+	}
+
+	_, err := io.WriteString(l.writer, line)
+
+	return err
+}
+
+// accessLogField escapes a field, "-" if it is empty
+func accessLogField(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return accessLogEscaper.Replace(value)
+}
+
+// logAccess writes a command to the access log, once its replies are sent
+func (c *clientHandler) logAccess(command, param string, start time.Time, replyCode int, bytes int64) {
+	log := c.server.accessLog
+	if log == nil {
+		return
+	}
+
+	if isCredentialCommand(command, param) {
+		param = ""
+	}
+
+	entry := &accessLogEntry{
+		date:     start,
+		clientIP: c.remoteIP(),
+		user:     c.user,
+		command:  command,
+		param:    param,
+		status:   replyCode,
+		bytes:    bytes,
+		duration: time.Since(start),
+	}
+
+	if err := log.write(entry); err != nil {
+		c.logger.Warn("Could not write the access log", "err", err)
+	}
+}
@@ -0,0 +1,168 @@
+package ftpserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+// lockedBuffer is a buffer written by the sessions and read by the test
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	mu     sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buffer.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	accessLog := &lockedBuffer{}
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{AccessLog: accessLog},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("STOR my file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	// a command sent during the transfer has its own entry
+	rc, response, err = raw.SendCommand("STAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc, response)
+
+	_, err = dc.Write(make([]byte, 2048))
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	rc, _, err = raw.SendCommand("SIZE missing")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc)
+
+	require.NoError(t, raw.Close())
+
+	// the entries are written once the replies are sent
+	require.Eventually(t, func() bool {
+		return strings.Contains(accessLog.String(), " SIZE ")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	lines := strings.Split(accessLog.String(), "\n")
+	require.Equal(t, "#Software: ftpserverlib", lines[0])
+	require.Equal(t, "#Version: 1.0", lines[1])
+	require.Equal(t, "#Fields: date time c-ip cs-username cs-method cs-uri-stem sc-status sc-bytes time-taken", lines[2])
+
+	log := strings.Join(lines[3:], "\n")
+	require.Regexp(t, `(?m)^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d 127\.0\.0\.1 test USER test 331 0 \d+\.\d{3}$`, log)
+	require.Regexp(t, `(?m)^\S+ \S+ 127\.0\.0\.1 test PASS - 230 0 \S+$`, log)
+	require.Regexp(t, `(?m)^\S+ \S+ 127\.0\.0\.1 test STOR my%20file 226 2048 \S+$`, log)
+	require.Regexp(t, `(?m)^\S+ \S+ 127\.0\.0\.1 test STAT - 211 0 \S+$`, log)
+	require.Regexp(t, `(?m)^\S+ \S+ 127\.0\.0\.1 test SIZE missing 550 0 \S+$`, log)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ftpserver")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { require.NoError(t, os.RemoveAll(dir)) })
+
+	now := time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC)
+	file := &RotatingFile{
+		Path:           filepath.Join(dir, "access.log"),
+		MaxSize:        20,
+		RotateInterval: 24 * time.Hour,
+		Compress:       true,
+		MaxBackups:     2,
+		now:            func() time.Time { return now },
+	}
+	file.setHeader("#header\n")
+
+	write := func(line string) {
+		_, errWrite := file.Write([]byte(line))
+		require.NoError(t, errWrite)
+	}
+
+	write("first\n")
+	write("second\n")
+
+	// the size limit is reached
+	write("third\n")
+
+	// a new day starts
+	now = now.Add(2 * time.Minute)
+	write("fourth\n")
+
+	now = now.Add(24 * time.Hour)
+	write("fifth\n")
+
+	require.NoError(t, file.Close())
+
+	_, err = file.Write([]byte("closed\n"))
+	require.Equal(t, ErrRotatingFileClosed, err)
+
+	content, err := ioutil.ReadFile(file.Path)
+	require.NoError(t, err)
+	require.Equal(t, "#header\nfifth\n", string(content))
+
+	// the oldest rotated file was removed
+	require.NoFileExists(t, file.Path+".20261016-235900.gz")
+
+	readGzip := func(path string) string {
+		compressed, errRead := os.Open(filepath.Clean(path))
+		require.NoError(t, errRead)
+
+		defer func() { require.NoError(t, compressed.Close()) }()
+
+		reader, errRead := gzip.NewReader(compressed)
+		require.NoError(t, errRead)
+
+		data, errRead := ioutil.ReadAll(reader)
+		require.NoError(t, errRead)
+
+		return string(data)
+	}
+
+	require.Equal(t, "#header\nthird\n", readGzip(file.Path+".20261017-000100.gz"))
+	require.Equal(t, "#header\nfourth\n", readGzip(file.Path+".20261018-000100.gz"))
+}
@@ -0,0 +1,160 @@
+package ftpserver
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TransferUsage is the cumulative transfers of a user over a period
+type TransferUsage struct {
+	BytesIn   int64 // Bytes uploaded
+	BytesOut  int64 // Bytes downloaded
+	Uploads   int64 // Number of uploads (STOR, APPE)
+	Downloads int64 // Number of downloads (RETR)
+}
+
+// TransferAccounting records the transfers of the users, for billing or to enforce the TransferQuota
+// setting. It is called concurrently by the sessions. NewMemoryAccounting returns an in memory
+// implementation, the fleets of servers can share an external store (a database, Redis...).
+type TransferAccounting interface {
+
+	// RecordTransfer adds a transfer that ended at date, failed and aborted transfers included
+	RecordTransfer(user string, date time.Time, upload bool, bytes int64) error
+
+	// GetUsage returns the transfers of a user since a date
+	GetUsage(user string, since time.Time) (TransferUsage, error)
+}
+
+// MemoryAccounting is a TransferAccounting keeping the transfers per user and per day (UTC)
+type MemoryAccounting struct {
+	mu    sync.Mutex
+	usage map[string]map[time.Time]*TransferUsage // per user and per day
+}
+
+// NewMemoryAccounting creates an empty MemoryAccounting
+func NewMemoryAccounting() *MemoryAccounting {
+	return &MemoryAccounting{usage: make(map[string]map[time.Time]*TransferUsage)}
+}
+
+// RecordTransfer adds a transfer to the day of date
+func (a *MemoryAccounting) RecordTransfer(user string, date time.Time, upload bool, bytes int64) error {
+	day := date.UTC().Truncate(24 * time.Hour)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	days := a.usage[user]
+	if days == nil {
+		days = make(map[time.Time]*TransferUsage)
+		a.usage[user] = days
+	}
+
+	usage := days[day]
+	if usage == nil {
+		usage = &TransferUsage{}
+		days[day] = usage
+	}
+
+	if upload {
+		usage.BytesIn += bytes
+		usage.Uploads++
+	} else {
+		usage.BytesOut += bytes
+		usage.Downloads++
+	}
+
+	return nil
+}
+
+// GetUsage returns the transfers of a user since the day of since
+func (a *MemoryAccounting) GetUsage(user string, since time.Time) (TransferUsage, error) {
+	first := since.UTC().Truncate(24 * time.Hour)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var total TransferUsage
+
+	for day, usage := range a.usage[user] {
+		if day.Before(first) {
+			continue
+		}
+
+		total.BytesIn += usage.BytesIn
+		total.BytesOut += usage.BytesOut
+		total.Uploads += usage.Uploads
+		total.Downloads += usage.Downloads
+	}
+
+	return total, nil
+}
+
+// Prune forgets the days before a date
+func (a *MemoryAccounting) Prune(before time.Time) {
+	first := before.UTC().Truncate(24 * time.Hour)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for user, days := range a.usage {
+		for day := range days {
+			if day.Before(first) {
+				delete(days, day)
+			}
+		}
+
+		if len(days) == 0 {
+			delete(a.usage, user)
+		}
+	}
+}
+
+// getTransferQuota returns the monthly transfer quota of the user, 0 if there is none
+func (c *clientHandler) getTransferQuota() int64 {
+	if quota, ok := c.driver.(ClientDriverExtensionTransferQuota); ok {
+		return quota.GetTransferQuota()
+	}
+
+	return c.server.settings.TransferQuota
+}
+
+// checkTransferQuota refuses a transfer with a 552 reply if the user exceeded its monthly quota
+func (c *clientHandler) checkTransferQuota() bool {
+	accounting := c.server.settings.TransferAccounting
+	quota := c.getTransferQuota()
+
+	if accounting == nil || quota <= 0 {
+		return true
+	}
+
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	usage, err := accounting.GetUsage(c.user, month)
+	if err != nil {
+		c.writeMessage(StatusLocalError, fmt.Sprintf("Could not check the transfer quota: %v", err))
+
+		return false
+	}
+
+	if usage.BytesIn+usage.BytesOut >= quota {
+		c.writeMessage(StatusActionAborted, fmt.Sprintf("Monthly transfer quota of %d bytes exceeded", quota))
+
+		return false
+	}
+
+	return true
+}
+
+// recordTransfer adds a transfer to the accounting
+func (c *clientHandler) recordTransfer(upload bool, bytes int64) {
+	accounting := c.server.settings.TransferAccounting
+	if accounting == nil {
+		return
+	}
+
+	if err := accounting.RecordTransfer(c.user, time.Now(), upload, bytes); err != nil {
+		c.logger.Warn("Could not record the transfer", "err", err)
+	}
+}
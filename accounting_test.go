@@ -0,0 +1,76 @@
+package ftpserver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryAccounting(t *testing.T) {
+	accounting := NewMemoryAccounting()
+	day := time.Date(2021, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, accounting.RecordTransfer("user", day.Add(-48*time.Hour), true, 100))
+	require.NoError(t, accounting.RecordTransfer("user", day, true, 10))
+	require.NoError(t, accounting.RecordTransfer("user", day, false, 20))
+	require.NoError(t, accounting.RecordTransfer("other", day, false, 1000))
+
+	usage, err := accounting.GetUsage("user", day.Add(-24*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, TransferUsage{BytesIn: 10, BytesOut: 20, Uploads: 1, Downloads: 1}, usage)
+
+	// the whole day of since is counted
+	usage, err = accounting.GetUsage("user", day.Add(-60*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, TransferUsage{BytesIn: 110, BytesOut: 20, Uploads: 2, Downloads: 1}, usage)
+
+	accounting.Prune(day)
+
+	usage, err = accounting.GetUsage("user", time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, TransferUsage{BytesIn: 10, BytesOut: 20, Uploads: 1, Downloads: 1}, usage)
+}
+
+func TestTransferQuota(t *testing.T) {
+	accounting := NewMemoryAccounting()
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			TransferAccounting: accounting,
+			TransferQuota:      30,
+		},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	// the quota is checked before the transfers, the one exceeding it completes
+	require.NoError(t, c.Store("file", bytes.NewReader(make([]byte, 20))))
+	require.NoError(t, c.Retrieve("file", &bytes.Buffer{}))
+
+	usage, err := accounting.GetUsage(authUser, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, TransferUsage{BytesIn: 20, BytesOut: 20, Uploads: 1, Downloads: 1}, usage)
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	_, err = raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("RETR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAborted, rc, response)
+	require.Contains(t, response, "quota")
+}
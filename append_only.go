@@ -0,0 +1,115 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// AppendOnlyOverwritePolicy defines what happens to the uploads replacing a file of an append-only directory
+type AppendOnlyOverwritePolicy int
+
+// Append-only directories overwrite policies
+const (
+	// AppendOnlyOverwriteReject refuses the upload with a 553 reply
+	AppendOnlyOverwriteReject AppendOnlyOverwritePolicy = iota
+	// AppendOnlyOverwriteVersion stores the upload under the first free versioned name: "report.1.csv",
+	// "report.2.csv"... The 150 reply gives the name ("FILE: /path/report.1.csv"), as for STOU
+	AppendOnlyOverwriteVersion
+)
+
+// maxUploadVersions is the number of versioned names tried for an upload to an append-only directory
+const maxUploadVersions = 1000
+
+var (
+	// errAppendOnly is returned when a file of an append-only directory would be deleted or replaced
+	errAppendOnly = errors.New("append-only directory, existing files can't be deleted or replaced")
+	// errNoFreeVersion is returned when no versioned name is free for an upload
+	errNoFreeVersion = errors.New("no free versioned name")
+)
+
+// isAppendOnly tells if a path is in one of the AppendOnlyPaths, or is one of them
+func (c *clientHandler) isAppendOnly(filePath string) bool {
+	for _, dir := range c.server.settings.AppendOnlyPaths {
+		dir = path.Clean("/" + dir)
+		if filePath == dir || strings.HasPrefix(filePath, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// containsAppendOnly tells if a path is in one of the AppendOnlyPaths or contains one of them
+func (c *clientHandler) containsAppendOnly(filePath string) bool {
+	if c.isAppendOnly(filePath) {
+		return true
+	}
+
+	for _, dir := range c.server.settings.AppendOnlyPaths {
+		if filePath == "/" || strings.HasPrefix(path.Clean("/"+dir), filePath+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkAppendOnlyRemoval refuses, with a 550 reply, the removal or the move of a path of an append-only
+// directory or containing one
+func (c *clientHandler) checkAppendOnlyRemoval(filePath string) bool {
+	if !c.containsAppendOnly(filePath) {
+		return true
+	}
+
+	c.writeMessage(StatusActionNotTaken, fmt.Sprintf("%s: %v", filePath, errAppendOnly))
+
+	return false
+}
+
+// getAppendOnlyUploadPath returns the path where an upload (STOR) to an append-only directory is stored,
+// a versioned name if the file exists. It replies 553 and returns false if the upload is refused.
+func (c *clientHandler) getAppendOnlyUploadPath(filePath string) (string, bool) {
+	if !c.isAppendOnly(filePath) {
+		return filePath, true
+	}
+
+	if _, err := c.stat(filePath); err != nil {
+		// the file doesn't exist, or the opening will report the error
+		return filePath, true
+	}
+
+	if c.server.settings.AppendOnlyOverwrite == AppendOnlyOverwriteVersion {
+		versionedPath, err := c.getFreeVersionedPath(filePath)
+		if err == nil {
+			c.ctxUploadPath = versionedPath
+
+			return versionedPath, true
+		}
+
+		c.writeMessage(StatusActionNotTakenNoFile, fmt.Sprintf("%s: %v", filePath, err))
+
+		return "", false
+	}
+
+	c.writeMessage(StatusActionNotTakenNoFile, fmt.Sprintf("%s: %v", filePath, errAppendOnly))
+
+	return "", false
+}
+
+func (c *clientHandler) getFreeVersionedPath(filePath string) (string, error) {
+	ext := path.Ext(filePath)
+	stem := strings.TrimSuffix(filePath, ext)
+
+	for version := 1; version <= maxUploadVersions; version++ {
+		versionedPath := fmt.Sprintf("%s.%d%s", stem, version, ext)
+
+		if _, err := c.stat(versionedPath); errors.Is(err, os.ErrNotExist) {
+			return versionedPath, nil
+		}
+	}
+
+	return "", errNoFreeVersion
+}
@@ -0,0 +1,124 @@
+package ftpserver
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newAppendOnlyTestServer(t *testing.T, policy AppendOnlyOverwritePolicy) (*TestServerDriver, goftp.RawConn) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{AppendOnlyPaths: []string{"ingest"}, AppendOnlyOverwrite: policy},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, driver.fs.Mkdir("/ingest", 0750))
+	require.NoError(t, afero.WriteFile(driver.fs, "/ingest/a.txt", []byte("original"), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, "/other.txt", []byte("other"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	t.Cleanup(func() { panicOnError(c.Close()) })
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	t.Cleanup(func() { require.NoError(t, raw.Close()) })
+
+	return driver, raw
+}
+
+func TestAppendOnlyPaths(t *testing.T) {
+	driver, raw := newAppendOnlyTestServer(t, AppendOnlyOverwriteReject)
+
+	for _, step := range []struct {
+		command string
+		code    int
+	}{
+		{"DELE /ingest/a.txt", StatusActionNotTaken},
+		{"RNFR /ingest/a.txt", StatusActionNotTaken},
+		{"RMD /ingest", StatusActionNotTaken},
+		{"SITE RMDIR /", StatusActionNotTaken},
+		{"SITE MDEL /ingest/*", StatusActionNotTaken},
+		{"RNFR /other.txt", StatusFileActionPending},
+		{"RNTO /ingest/a.txt", StatusActionNotTaken},
+		{"STOR /ingest/a.txt", StatusActionNotTakenNoFile},
+	} {
+		rc, response, err := raw.SendCommand(step.command)
+		require.NoError(t, err)
+		require.Equal(t, step.code, rc, step.command+": "+response)
+	}
+
+	// new files can be created and appended to
+	ftpUploadWithRawConnection(t, raw, bytes.NewReader([]byte("new")), "/ingest/b.txt")
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("APPE /ingest/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dc.Write([]byte(" appended"))
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	content, err := afero.ReadFile(driver.fs, "/ingest/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "original appended", string(content))
+
+	// the files outside of the append-only directories can be deleted
+	rc, response, err = raw.SendCommand("DELE /other.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+}
+
+func TestAppendOnlyVersioning(t *testing.T) {
+	driver, raw := newAppendOnlyTestServer(t, AppendOnlyOverwriteVersion)
+
+	for version, name := range []string{"/ingest/a.1.txt", "/ingest/a.2.txt"} {
+		dcGetter, err := raw.PrepareDataConn()
+		require.NoError(t, err)
+
+		rc, response, err := raw.SendCommand("STOR /ingest/a.txt")
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatusOK, rc, response)
+		require.Equal(t, "FILE: "+name, response)
+
+		dc, err := dcGetter()
+		require.NoError(t, err)
+
+		_, err = dc.Write([]byte{byte('1' + version)})
+		require.NoError(t, err)
+		require.NoError(t, dc.Close())
+
+		rc, response, err = raw.ReadResponse()
+		require.NoError(t, err)
+		require.Equal(t, StatusClosingDataConn, rc, response)
+	}
+
+	content, err := afero.ReadFile(driver.fs, "/ingest/a.txt")
+	require.NoError(t, err)
+	require.Equal(t, "original", string(content))
+
+	content, err = afero.ReadFile(driver.fs, "/ingest/a.2.txt")
+	require.NoError(t, err)
+	require.Equal(t, "2", string(content))
+}
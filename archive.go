@@ -0,0 +1,258 @@
+package ftpserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Directory archives: "SITE DOWNLOAD-ARCHIVE <tar|zip> <dir>" sends a directory and its subdirectories as an
+// archive over the data connection, built on the fly from the listings and the files of the driver. The
+// regular files and the directories are archived, the other entries (symbolic links...) are skipped.
+
+var (
+	// errArchiveFormat is returned for the archive formats other than tar and zip
+	errArchiveFormat = errors.New("unsupported archive format")
+	// errArchiveTooLarge is returned when the files of the directory exceed MaxArchiveSize
+	errArchiveTooLarge = errors.New("archive too large")
+	// errArchiveNotDirectory is returned when the path to archive isn't a directory
+	errArchiveNotDirectory = errors.New("not a directory")
+)
+
+// siteTransferCommand describes the SITE subcommands opening a transfer connection, they run like RETR
+var siteTransferCommand = &CommandDescription{ //nolint:gochecknoglobals
+	Fn:              (*clientHandler).handleSITE,
+	TransferRelated: true,
+}
+
+// isSiteTransfer tells if the parameters of a SITE command are those of a subcommand opening a transfer
+func isSiteTransfer(param string) bool {
+	return strings.EqualFold(strings.SplitN(param, " ", 2)[0], "DOWNLOAD-ARCHIVE")
+}
+
+// archiveEntry is a file or a directory of an archive
+type archiveEntry struct {
+	path string // absolute path of the entry
+	name string // name of the entry in the archive
+	info os.FileInfo
+}
+
+func (c *clientHandler) handleDownloadArchive(params string) {
+	if !c.server.settings.EnableDownloadArchive {
+		c.writeMessage(StatusCommandNotImplemented, "SITE DOWNLOAD-ARCHIVE is disabled")
+
+		return
+	}
+
+	args, err := splitParamsValues(params, 2)
+	if err != nil || len(args) != 2 {
+		c.writeMessage(StatusSyntaxErrorParameters, "usage: SITE DOWNLOAD-ARCHIVE <tar|zip> <dir>")
+
+		return
+	}
+
+	format := strings.ToLower(args[0])
+	if format != "tar" && format != "zip" {
+		c.writeMessage(StatusNotImplementedParam, fmt.Sprintf("%v: %v", args[0], errArchiveFormat))
+
+		return
+	}
+
+	root := c.absPath(args[1])
+
+	entries, err := c.getArchiveEntries(root)
+	if err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not archive %v: %v", root, err))
+
+		return
+	}
+
+	if !c.checkTransferQuota() {
+		return
+	}
+
+	release, err := c.acquireTransfer()
+	if err != nil {
+		c.writeMessage(getErrorCode(err, StatusFileActionNotTaken), "Could not start transfer: "+err.Error())
+
+		return
+	}
+
+	defer release()
+
+	tr, err := c.TransferOpen(fmt.Sprintf("SITE DOWNLOAD-ARCHIVE %v %v", format, root))
+	if err != nil {
+		return
+	}
+
+	out, endThrottling := c.throttleTransfer(tr)
+	counter := &countingWriter{writer: out}
+
+	err = c.writeArchive(counter, format, entries)
+	endThrottling()
+
+	c.recordTransfer(false, counter.count)
+	c.countTransfer(false, counter.count, err == nil)
+	c.TransferClose(err)
+}
+
+// getArchiveEntries lists the directory and its subdirectories, their files can't exceed MaxArchiveSize
+func (c *clientHandler) getArchiveEntries(root string) ([]archiveEntry, error) {
+	info, err := c.stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%v: %w", root, errArchiveNotDirectory)
+	}
+
+	prefix := ""
+	if root != "/" {
+		prefix = path.Base(root) + "/"
+	}
+
+	var entries []archiveEntry
+	var size int64
+
+	directories := []archiveEntry{{path: root, name: prefix, info: info}}
+
+	for len(directories) > 0 {
+		directory := directories[0]
+		directories = directories[1:]
+		entries = append(entries, directory)
+
+		files, err := c.readDirectory(directory.path)
+		if err != nil {
+			return nil, err
+		}
+
+		files = c.hideTempUploads(files)
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+		for _, file := range files {
+			entry := archiveEntry{
+				path: path.Join(directory.path, file.Name()),
+				name: directory.name + file.Name(),
+				info: file,
+			}
+
+			switch {
+			case file.IsDir():
+				entry.name += "/"
+				directories = append(directories, entry)
+			case file.Mode().IsRegular():
+				size += file.Size()
+				entries = append(entries, entry)
+			}
+		}
+
+		if max := c.server.settings.MaxArchiveSize; max > 0 && size > max {
+			return nil, fmt.Errorf("%w: more than %d bytes", errArchiveTooLarge, max)
+		}
+	}
+
+	// the entries of an archive of the root directory have no prefix
+	if prefix == "" {
+		entries = entries[1:]
+	}
+
+	return entries, nil
+}
+
+// writeArchive writes the entries in the format
+func (c *clientHandler) writeArchive(w io.Writer, format string, entries []archiveEntry) error {
+	if format == "zip" {
+		archive := zip.NewWriter(w)
+
+		for _, entry := range entries {
+			if err := c.addZipEntry(archive, entry); err != nil {
+				return err
+			}
+		}
+
+		return archive.Close()
+	}
+
+	archive := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		if err := c.addTarEntry(archive, entry); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func (c *clientHandler) addTarEntry(archive *tar.Writer, entry archiveEntry) error {
+	header, err := tar.FileInfoHeader(entry.info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = entry.name
+
+	if err = archive.WriteHeader(header); err != nil {
+		return err
+	}
+
+	return c.copyArchiveFile(archive, entry)
+}
+
+func (c *clientHandler) addZipEntry(archive *zip.Writer, entry archiveEntry) error {
+	header, err := zip.FileInfoHeader(entry.info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = entry.name
+
+	if !entry.info.IsDir() {
+		header.Method = zip.Deflate
+	}
+
+	w, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	return c.copyArchiveFile(w, entry)
+}
+
+// copyArchiveFile writes the content of a file, exactly the size given in its header
+func (c *clientHandler) copyArchiveFile(w io.Writer, entry archiveEntry) error {
+	if entry.info.IsDir() {
+		return nil
+	}
+
+	file, err := c.getFileHandle(entry.path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer c.closeUnchecked(file)
+
+	_, err = io.CopyN(w, file, entry.info.Size())
+
+	return err
+}
+
+// countingWriter counts the bytes written
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.count += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,125 @@
+package ftpserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func downloadArchive(t *testing.T, raw goftp.RawConn, params string) []byte {
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("SITE DOWNLOAD-ARCHIVE " + params)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	return data
+}
+
+func TestDownloadArchive(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EnableDownloadArchive: true, MaxArchiveSize: 100},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, driver.fs.MkdirAll("/tree/sub/empty", 0755))
+	require.NoError(t, afero.WriteFile(driver.fs, "/tree/a.txt", []byte("first file"), 0644))
+	require.NoError(t, afero.WriteFile(driver.fs, "/tree/sub/b.txt", []byte("second file"), 0644))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	expected := map[string]string{
+		"tree/":           "",
+		"tree/a.txt":      "first file",
+		"tree/sub/":       "",
+		"tree/sub/b.txt":  "second file",
+		"tree/sub/empty/": "",
+	}
+
+	// tar
+	contents := map[string]string{}
+	reader := tar.NewReader(bytes.NewReader(downloadArchive(t, raw, "tar /tree")))
+
+	for {
+		header, errNext := reader.Next()
+		if errNext == io.EOF {
+			break
+		}
+
+		require.NoError(t, errNext)
+
+		content, errRead := ioutil.ReadAll(reader)
+		require.NoError(t, errRead)
+
+		contents[header.Name] = string(content)
+	}
+
+	require.Equal(t, expected, contents)
+
+	// zip
+	data := downloadArchive(t, raw, "ZIP tree")
+	zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	contents = map[string]string{}
+
+	for _, file := range zipReader.File {
+		content, errOpen := file.Open()
+		require.NoError(t, errOpen)
+
+		read, errRead := ioutil.ReadAll(content)
+		require.NoError(t, errRead)
+		require.NoError(t, content.Close())
+
+		contents[file.Name] = string(read)
+	}
+
+	require.Equal(t, expected, contents)
+
+	// the archive is refused before the transfer
+	require.NoError(t, afero.WriteFile(driver.fs, "/tree/big.bin", make([]byte, 100), 0644))
+
+	for params, code := range map[string]int{
+		"tar /tree":       StatusActionNotTaken,
+		"tar /tree/a.txt": StatusActionNotTaken,
+		"rar /tree":       StatusNotImplementedParam,
+		"tar":             StatusSyntaxErrorParameters,
+	} {
+		rc, response, errSend := raw.SendCommand("SITE DOWNLOAD-ARCHIVE " + params)
+		require.NoError(t, errSend)
+		require.Equal(t, code, rc, params+": "+response)
+	}
+}
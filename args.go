@@ -0,0 +1,124 @@
+package ftpserver
+
+import (
+	"errors"
+	"strings"
+)
+
+// Commands parameters tokenizer, shared by all the commands.
+//
+// Parameters are separated by spaces. A parameter can be enclosed in double quotes to contain spaces,
+// or to start with a dash without being taken for an option (LIST -al "-my dir"). Inside quotes, a
+// double quote is escaped by doubling it, the convention RFC 959 uses for the 257 replies pathnames.
+// The last parameter of a command (usually a path) is the rest of the line: it only needs quotes if
+// they are part of the name or if it is followed by other parameters.
+
+var (
+	// errInvalidQuotedParam is returned for an unterminated quoted parameter or a quote followed by characters
+	errInvalidQuotedParam = errors.New("invalid quoted parameter")
+	errNoParams           = errors.New("no parameters")
+)
+
+// paramToken is a parameter of a command
+type paramToken struct {
+	value  string // unquoted value
+	quoted bool   // the parameter was quoted, it can't be an option
+}
+
+// splitParams splits the parameters of a command. If n > 0, there are at most n parameters, the last
+// one being the rest of the line. It is unquoted if it is entirely quoted, taken as is otherwise.
+func splitParams(params string, n int) ([]paramToken, error) {
+	var tokens []paramToken
+
+	rest := strings.TrimLeft(params, " ")
+
+	for rest != "" {
+		if n > 0 && len(tokens) == n-1 {
+			return append(tokens, lastParam(rest)), nil
+		}
+
+		token, remaining, err := nextParam(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+		rest = strings.TrimLeft(remaining, " ")
+	}
+
+	return tokens, nil
+}
+
+// splitParamsValues is splitParams for the commands that don't have options
+func splitParamsValues(params string, n int) ([]string, error) {
+	tokens, err := splitParams(params, n)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]string, len(tokens))
+	for i, token := range tokens {
+		values[i] = token.value
+	}
+
+	return values, nil
+}
+
+// nextParam reads the first parameter of a non empty string not starting with a space
+func nextParam(s string) (paramToken, string, error) {
+	if s[0] != '"' {
+		if idx := strings.IndexByte(s, ' '); idx >= 0 {
+			return paramToken{value: s[:idx]}, s[idx:], nil
+		}
+
+		return paramToken{value: s}, "", nil
+	}
+
+	var value strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			value.WriteByte(s[i])
+
+			continue
+		}
+
+		// escaped quote
+		if i+1 < len(s) && s[i+1] == '"' {
+			value.WriteByte('"')
+			i++
+
+			continue
+		}
+
+		// the closing quote must end the parameter
+		if i+1 < len(s) && s[i+1] != ' ' {
+			return paramToken{}, "", errInvalidQuotedParam
+		}
+
+		return paramToken{value: value.String(), quoted: true}, s[i+1:], nil
+	}
+
+	return paramToken{}, "", errInvalidQuotedParam
+}
+
+// lastParam reads a parameter taking the rest of the line
+func lastParam(s string) paramToken {
+	if s != "" {
+		if token, remaining, err := nextParam(s); err == nil && token.quoted && strings.TrimLeft(remaining, " ") == "" {
+			return token
+		}
+	}
+
+	return paramToken{value: s}
+}
+
+// unquotePath returns the path given as the only parameter of a command
+func unquotePath(param string) string {
+	return lastParam(param).value
+}
+
+// paramPath returns the absolute path given as the only parameter of a command
+func (c *clientHandler) paramPath(param string) string {
+	return c.absPath(unquotePath(param))
+}
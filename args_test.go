@@ -0,0 +1,148 @@
+package ftpserver
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitParams(t *testing.T) {
+	for _, p := range []struct {
+		params string
+		n      int
+		values []string
+	}{
+		{"", 0, []string{}},
+		{"a b  c", 0, []string{"a", "b", "c"}},
+		{`"a b" c`, 0, []string{"a b", "c"}},
+		{`"a ""b""" c`, 0, []string{`a "b"`, "c"}},
+		{`a"b c`, 0, []string{`a"b`, "c"}},
+		{"755 my file.txt", 2, []string{"755", "my file.txt"}},
+		{`755 "my file.txt"`, 2, []string{"755", "my file.txt"}},
+		{`755 "my" "file.txt"`, 2, []string{"755", `"my" "file.txt"`}},
+		{`755 "unterminated`, 2, []string{"755", `"unterminated`}},
+		{"  a  ", 1, []string{"a  "}},
+	} {
+		values, err := splitParamsValues(p.params, p.n)
+		require.NoError(t, err, p.params)
+		require.Equal(t, p.values, values, p.params)
+	}
+
+	for _, params := range []string{`"unterminated`, `"a"b c`, `a "b"c`} {
+		_, err := splitParams(params, 0)
+		require.ErrorIs(t, err, errInvalidQuotedParam, params)
+	}
+
+	tokens, err := splitParams(`-al "-l"`, 0)
+	require.NoError(t, err)
+	require.Equal(t, []paramToken{{value: "-al"}, {value: "-l", quoted: true}}, tokens)
+}
+
+func TestUnquotePath(t *testing.T) {
+	require.Equal(t, "my file.txt", unquotePath("my file.txt"))
+	require.Equal(t, "my file.txt", unquotePath(`"my file.txt"`))
+	require.Equal(t, `my "file".txt`, unquotePath(`"my ""file"".txt"`))
+	require.Equal(t, `my "file".txt`, unquotePath(`my "file".txt`))
+	require.Equal(t, `"unterminated`, unquotePath(`"unterminated`))
+	require.Equal(t, "-dash", unquotePath("-dash"))
+	require.Equal(t, "", unquotePath(""))
+}
+
+func TestNastyFileNames(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.NoError(t, driver.fs.MkdirAll("/my dir", 0755))
+	require.NoError(t, afero.WriteFile(driver.fs, "/my dir/a b.txt", []byte("spaces"), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, "/-dash", []byte("dash"), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, `/quote"d`, []byte("quote"), 0600))
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	for _, p := range []struct {
+		param string
+		size  string
+	}{
+		{"my dir/a b.txt", "6"},
+		{`"my dir/a b.txt"`, "6"},
+		{"-dash", "4"},
+		{`"-dash"`, "4"},
+		{`quote"d`, "5"},
+		{`"quote""d"`, "5"},
+	} {
+		rc, response, err := raw.SendCommand("SIZE " + p.param)
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatus, rc, response)
+		require.Equal(t, p.size, response, p.param)
+	}
+
+	rc, response, err := raw.SendCommand(`CWD "my dir"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	rc, response, err = raw.SendCommand(`RNFR "a b.txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand(`RNTO "c ""d"".txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	_, err = driver.fs.Stat(`/my dir/c "d".txt`)
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand(`MFMT 20201209211059 "c ""d"".txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, response)
+
+	rc, response, err = raw.SendCommand("CWD /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand(`LIST -al "my dir"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	listing, err := ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+	require.True(t, strings.HasSuffix(string(listing), ` c "d".txt`+"\r\n"), string(listing))
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	rc, response, err = raw.SendCommand(`SITE CHMOD 600 "my dir/c ""d"".txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response, err = raw.SendCommand(`DELE "my dir/c ""d"".txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	rc, response, err = raw.SendCommand(`SIZE "a"b c`)
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+}
@@ -0,0 +1,259 @@
+package ftpserver
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Bandwidth sharing: the transfers of all the sessions share TransferBandwidth. It is divided between the
+// users transferring files in proportion of their weight, then between their transfers: a user opening
+// many sessions or data connections gets the same share as a user transferring a single file. Schedules
+// can change the bandwidth by time of day, for all the users and for some classes of users.
+
+// BandwidthSchedule gives the bandwidth by time of day
+type BandwidthSchedule struct {
+	Periods  []BandwidthPeriod // The first period including the current time gives the bandwidth
+	Location *time.Location    // Time zone of the periods, UTC if nil
+	Default  int64             // Bandwidth in bytes per second outside of the periods, 0 for unlimited
+}
+
+// BandwidthPeriod is the bandwidth of a daily time range
+type BandwidthPeriod struct {
+	Window    AccessWindow // Time range of the period
+	Bandwidth int64        // Bandwidth in bytes per second, 0 for unlimited
+}
+
+// valid tells if the bandwidths of the schedule aren't negative
+func (s *BandwidthSchedule) valid() bool {
+	for _, period := range s.Periods {
+		if period.Bandwidth < 0 {
+			return false
+		}
+	}
+
+	return s.Default >= 0
+}
+
+// bandwidthAt returns the bandwidth at a time, 0 for unlimited
+func (s *BandwidthSchedule) bandwidthAt(date time.Time) int64 {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	date = date.In(loc)
+
+	for i := range s.Periods {
+		if _, _, ok := s.Periods[i].Window.span(date); ok {
+			return s.Periods[i].Bandwidth
+		}
+	}
+
+	return s.Default
+}
+
+const (
+	bandwidthBurst     = 100 * time.Millisecond // bandwidth a share can save while it doesn't transfer
+	bandwidthChunkSize = 16 * 1024              // largest write waiting for its bandwidth at once
+)
+
+// bandwidthScheduler divides the bandwidth between the users transferring files
+type bandwidthScheduler struct {
+	mu          sync.Mutex
+	bandwidth   int64                      // bytes per second shared by the transfers, 0 for unlimited
+	schedule    *BandwidthSchedule         // overrides bandwidth if not nil
+	totalWeight int                        // sum of the weights of the shares
+	shares      map[string]*bandwidthShare // shares of the users transferring files
+}
+
+// bandwidthShare is the part of the bandwidth of a user
+type bandwidthShare struct {
+	key       string
+	weight    int
+	schedule  *BandwidthSchedule // bandwidth limit of the user, nil for none
+	transfers int                // transfers using the share
+	tokens    float64            // bytes the share can transfer now, negative if it transferred in advance
+	last      time.Time          // last time the tokens were updated
+}
+
+func newBandwidthScheduler(bandwidth int64, schedule *BandwidthSchedule) *bandwidthScheduler {
+	return &bandwidthScheduler{
+		bandwidth: bandwidth,
+		schedule:  schedule,
+		shares:    make(map[string]*bandwidthShare),
+	}
+}
+
+// setSchedule changes the schedule of the bandwidth shared by the transfers
+func (s *bandwidthScheduler) setSchedule(schedule *BandwidthSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedule = schedule
+}
+
+// bandwidthAt returns the bandwidth shared by the transfers, 0 for unlimited. s.mu must be held.
+func (s *bandwidthScheduler) bandwidthAt(now time.Time) int64 {
+	if s.schedule != nil {
+		return s.schedule.bandwidthAt(now)
+	}
+
+	return s.bandwidth
+}
+
+// limited tells if the transfer of a user with a schedule, nil for none, can be throttled now
+func (s *bandwidthScheduler) limited(schedule *BandwidthSchedule, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a schedule can limit it later
+	return s.bandwidthAt(now) > 0 || s.schedule != nil || schedule != nil
+}
+
+// join adds a transfer to the share of a user, the first one sets the weight and the schedule of the share
+func (s *bandwidthScheduler) join(key string, weight int, schedule *BandwidthSchedule) *bandwidthShare {
+	if weight < 1 {
+		weight = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share := s.shares[key]
+	if share == nil {
+		share = &bandwidthShare{key: key, weight: weight, schedule: schedule, last: time.Now()}
+		s.shares[key] = share
+		s.totalWeight += weight
+	}
+
+	share.transfers++
+
+	return share
+}
+
+// leave removes a transfer from its share, the share is removed with its last transfer
+func (s *bandwidthScheduler) leave(share *bandwidthShare) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if share.transfers--; share.transfers == 0 {
+		delete(s.shares, share.key)
+		s.totalWeight -= share.weight
+	}
+}
+
+// reserve takes size bytes from a share and returns the time to wait before sending them
+func (s *bandwidthScheduler) reserve(share *bandwidthShare, size int, now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rate float64
+
+	if bandwidth := s.bandwidthAt(now); bandwidth > 0 {
+		rate = float64(bandwidth) * float64(share.weight) / float64(s.totalWeight)
+	}
+
+	if share.schedule != nil {
+		if limit := float64(share.schedule.bandwidthAt(now)); limit > 0 && (rate == 0 || limit < rate) {
+			rate = limit
+		}
+	}
+
+	if rate == 0 {
+		share.tokens, share.last = 0, now
+
+		return 0
+	}
+
+	share.tokens += now.Sub(share.last).Seconds() * rate
+	if burst := rate * bandwidthBurst.Seconds(); share.tokens > burst {
+		share.tokens = burst
+	}
+
+	share.last = now
+	share.tokens -= float64(size)
+
+	if share.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-share.tokens / rate * float64(time.Second))
+}
+
+// throttledWriter writes at the pace of a bandwidth share
+type throttledWriter struct {
+	writer    io.Writer
+	scheduler *bandwidthScheduler
+	share     *bandwidthShare
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	// the empty writes are meaningful to some writers
+	if len(p) == 0 {
+		return w.writer.Write(p)
+	}
+
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthChunkSize {
+			chunk = chunk[:bandwidthChunkSize]
+		}
+
+		time.Sleep(w.scheduler.reserve(w.share, len(chunk), time.Now()))
+
+		n, err := w.writer.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[len(chunk):]
+	}
+
+	return written, nil
+}
+
+// throttleTransfer makes out write at the pace of the bandwidth share of the user, the returned function
+// must be called at the end of the transfer
+func (c *clientHandler) throttleTransfer(out io.Writer) (io.Writer, func()) {
+	share, endThrottling := c.joinBandwidthShare()
+	if share == nil {
+		return out, endThrottling
+	}
+
+	return &throttledWriter{writer: out, scheduler: c.server.bandwidth, share: share}, endThrottling
+}
+
+// joinBandwidthShare returns the bandwidth share of a transfer, nil if it isn't limited, and the function
+// to call at its end
+func (c *clientHandler) joinBandwidthShare() (*bandwidthShare, func()) {
+	scheduler := c.server.bandwidth
+
+	var schedule *BandwidthSchedule
+	if scheduled, ok := c.driver.(ClientDriverExtensionBandwidthSchedule); ok {
+		schedule = scheduled.GetBandwidthSchedule()
+	}
+
+	if !scheduler.limited(schedule, time.Now()) {
+		return nil, func() {}
+	}
+
+	weight := 1
+	if weighted, ok := c.driver.(ClientDriverExtensionTransferWeight); ok {
+		weight = weighted.GetTransferWeight()
+	}
+
+	share := scheduler.join(c.user, weight, schedule)
+
+	return share, func() { scheduler.leave(share) }
+}
+
+// SetTransferBandwidthSchedule changes the schedule of the bandwidth shared by the transfers, nil restores
+// TransferBandwidth. The running transfers follow it, except the ones started while it was unlimited.
+func (server *FtpServer) SetTransferBandwidthSchedule(schedule *BandwidthSchedule) {
+	server.bandwidth.setSchedule(schedule)
+}
@@ -0,0 +1,129 @@
+package ftpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBandwidthScheduler(t *testing.T) {
+	scheduler := newBandwidthScheduler(1000, nil)
+
+	// the parallel transfers of a user share the bandwidth of the user
+	shareA := scheduler.join("a", 1, nil)
+	require.Equal(t, shareA, scheduler.join("a", 1, nil))
+	require.Equal(t, shareA, scheduler.join("a", 1, nil))
+
+	shareB := scheduler.join("b", 0, nil)
+
+	now := time.Now()
+	shareA.last, shareB.last = now, now
+
+	require.Equal(t, time.Second, scheduler.reserve(shareA, 500, now))
+	require.Equal(t, time.Second, scheduler.reserve(shareB, 500, now))
+
+	// a weight of 2 gets twice the bandwidth
+	shareC := scheduler.join("c", 2, nil)
+	shareC.last = now
+
+	require.Equal(t, time.Second, scheduler.reserve(shareC, 500, now))
+	require.Equal(t, 3*time.Second, scheduler.reserve(shareA, 250, now))
+
+	// the bandwidth saved is limited
+	later := now.Add(time.Hour)
+	require.Zero(t, scheduler.reserve(shareB, 25, later))
+	require.Equal(t, 100*time.Millisecond, scheduler.reserve(shareB, 25, later))
+
+	scheduler.leave(shareA)
+	scheduler.leave(shareA)
+	require.Len(t, scheduler.shares, 3)
+
+	scheduler.leave(shareA)
+	scheduler.leave(shareB)
+	scheduler.leave(shareC)
+	require.Empty(t, scheduler.shares)
+	require.Zero(t, scheduler.totalWeight)
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	schedule := &BandwidthSchedule{
+		Periods: []BandwidthPeriod{
+			{
+				Window: AccessWindow{
+					Days:  []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday},
+					Start: 9 * time.Hour,
+					End:   18 * time.Hour,
+				},
+				Bandwidth: 10 * 1024 * 1024,
+			},
+			{Window: AccessWindow{Start: 22 * time.Hour, End: 6 * time.Hour}},
+		},
+		Location: paris,
+		Default:  50 * 1024 * 1024,
+	}
+
+	// a Monday
+	require.Equal(t, int64(10*1024*1024), schedule.bandwidthAt(time.Date(2021, 3, 1, 9, 0, 0, 0, paris)))
+	require.Equal(t, int64(50*1024*1024), schedule.bandwidthAt(time.Date(2021, 3, 1, 18, 0, 0, 0, paris)))
+	require.Zero(t, schedule.bandwidthAt(time.Date(2021, 3, 2, 1, 0, 0, 0, paris)))
+	require.Equal(t, int64(50*1024*1024), schedule.bandwidthAt(time.Date(2021, 3, 6, 12, 0, 0, 0, paris)))
+
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, paris)
+	scheduler := newBandwidthScheduler(0, nil)
+	require.False(t, scheduler.limited(nil, now))
+
+	// the limit of a user class
+	share := scheduler.join("a", 1, &BandwidthSchedule{Default: 1000})
+	require.True(t, scheduler.limited(share.schedule, now))
+
+	share.last = now
+	require.Equal(t, time.Second, scheduler.reserve(share, 1000, now))
+
+	// the lowest limit applies
+	scheduler.setSchedule(&BandwidthSchedule{Default: 500})
+	require.Equal(t, 3*time.Second, scheduler.reserve(share, 500, now))
+
+	// 10MB/s on Monday at noon, the limit of the user is lower
+	scheduler.setSchedule(schedule)
+	require.True(t, scheduler.limited(nil, now))
+	require.Equal(t, 2500*time.Millisecond, scheduler.reserve(share, 1000, now))
+
+	// unlimited
+	scheduler.setSchedule(nil)
+	scheduler.leave(share)
+
+	share = scheduler.join("a", 1, nil)
+	require.Zero(t, scheduler.reserve(share, 1000, now))
+}
+
+func TestTransferBandwidth(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{TransferBandwidth: 100 * 1024},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	// 30KB take 300ms
+	start := time.Now()
+
+	ftpUpload(t, c, createTemporaryFile(t, 30*1024), "file")
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(250*time.Millisecond))
+
+	s.bandwidth.mu.Lock()
+	defer s.bandwidth.mu.Unlock()
+
+	require.Empty(t, s.bandwidth.shares)
+}
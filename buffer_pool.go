@@ -0,0 +1,141 @@
+package ftpserver
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultTransferBufferSize is the size of the data copy buffers if TransferBufferSize isn't set
+const defaultTransferBufferSize = 32 * 1024
+
+// bufferPool shares the data copy buffers between all the transfers of a server.
+// If the memory is bounded, copies wait for a buffer to be released once the limit is reached.
+type bufferPool struct {
+	counters CopyPathCounters // first field to be 64-bit aligned for the atomic operations
+	size     int
+	pool     sync.Pool
+	tokens   chan struct{} // one token per buffer that can be used at the same time, nil if unbounded
+}
+
+func newBufferPool(size, maxMemory int) *bufferPool {
+	if size <= 0 {
+		size = defaultTransferBufferSize
+	}
+
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		buf := make([]byte, p.size)
+
+		return &buf
+	}
+
+	if maxMemory > 0 {
+		nbBuffers := maxMemory / size
+		if nbBuffers < 1 {
+			nbBuffers = 1
+		}
+
+		p.tokens = make(chan struct{}, nbBuffers)
+	}
+
+	return p
+}
+
+func (p *bufferPool) get() *[]byte {
+	p.acquire()
+
+	return p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+	p.release()
+}
+
+// acquire waits for a buffer to be available, without taking it from the pool
+func (p *bufferPool) acquire() {
+	if p.tokens != nil {
+		p.tokens <- struct{}{}
+	}
+}
+
+func (p *bufferPool) release() {
+	if p.tokens != nil {
+		<-p.tokens
+	}
+}
+
+// CopyPathCounters counts the data copies done through each copy path
+type CopyPathCounters struct {
+	Sendfile uint64 // Copies from a file to a TCP connection, done by the kernel (sendfile) when the OS allows it
+	Direct   uint64 // Copies done by an in-memory source itself, through its io.WriterTo implementation
+	Pooled   uint64 // Copies done with a buffer of the pool
+}
+
+// copy selects the fastest way to copy src to dst:
+// sendfile if possible, the io.WriterTo implementation of an in-memory source, a pooled buffer otherwise.
+// The io.WriterTo implementations of the other sources (files, connections) are ignored, they allocate
+// their own buffer. The in-memory copies count as a buffer for the memory limit, the sendfile copies
+// don't, the data doesn't go through the user space.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := src.(*os.File); ok {
+		if _, ok := dst.(*net.TCPConn); ok {
+			atomic.AddUint64(&p.counters.Sendfile, 1)
+
+			return io.Copy(dst, src)
+		}
+	}
+
+	if writerTo, ok := inMemoryWriterTo(src); ok {
+		atomic.AddUint64(&p.counters.Direct, 1)
+
+		p.acquire()
+		defer p.release()
+
+		return writerTo.WriteTo(dst)
+	}
+
+	atomic.AddUint64(&p.counters.Pooled, 1)
+
+	buf := p.get()
+	defer p.put(buf)
+
+	// io.CopyBuffer would ignore our buffer if dst implements io.ReaderFrom or src implements io.WriterTo,
+	// which isn't worth it for anything else than the cases above
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, *buf)
+}
+
+// inMemoryWriterTo returns the io.WriterTo implementation of a source whose data is already in memory
+func inMemoryWriterTo(src io.Reader) (io.WriterTo, bool) {
+	switch reader := src.(type) {
+	case *bytes.Reader:
+		return reader, true
+	case *strings.Reader:
+		return reader, true
+	default:
+		return nil, false
+	}
+}
+
+func (p *bufferPool) getCounters() CopyPathCounters {
+	return CopyPathCounters{
+		Sendfile: atomic.LoadUint64(&p.counters.Sendfile),
+		Direct:   atomic.LoadUint64(&p.counters.Direct),
+		Pooled:   atomic.LoadUint64(&p.counters.Pooled),
+	}
+}
+
+// writerOnly hides the optional interfaces of an io.Writer
+type writerOnly struct {
+	io.Writer
+}
+
+// readerOnly hides the optional interfaces of an io.Reader
+type readerOnly struct {
+	io.Reader
+}
@@ -0,0 +1,138 @@
+package ftpserver
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPool(t *testing.T) {
+	pool := newBufferPool(0, 0)
+	require.Len(t, *pool.get(), defaultTransferBufferSize)
+
+	data := bytes.Repeat([]byte("ftpserver"), 10000)
+	dst := bytes.NewBuffer(nil)
+
+	pool = newBufferPool(1024, 1024)
+	written, err := pool.copy(dst, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), written)
+	require.Equal(t, data, dst.Bytes())
+
+	// only one buffer can be used at the same time
+	buf := pool.get()
+	require.Len(t, *buf, 1024)
+
+	acquired := make(chan struct{})
+
+	go func() {
+		pool.put(pool.get())
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("The memory limit should have been enforced")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pool.put(buf)
+	<-acquired
+
+	// the copies done by the source count as well
+	buf = pool.get()
+	copied := make(chan struct{})
+
+	go func() {
+		_, errCopy := pool.copy(ioutil.Discard, bytes.NewReader(data))
+		require.NoError(t, errCopy)
+		close(copied)
+	}()
+
+	select {
+	case <-copied:
+		t.Fatal("The memory limit should have been enforced")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	pool.put(buf)
+	<-copied
+}
+
+func TestBufferPoolCopyPaths(t *testing.T) {
+	pool := newBufferPool(1024, 0)
+
+	// a reader implementing io.WriterTo copies the data itself
+	_, err := pool.copy(ioutil.Discard, bytes.NewReader([]byte("data")))
+	require.NoError(t, err)
+	require.Equal(t, CopyPathCounters{Direct: 1}, pool.getCounters())
+
+	_, err = pool.copy(ioutil.Discard, io.LimitReader(bytes.NewReader([]byte("data")), 2))
+	require.NoError(t, err)
+	require.Equal(t, CopyPathCounters{Direct: 1, Pooled: 1}, pool.getCounters())
+
+	// a file sent to a TCP connection can be handled by the kernel
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, listener.Close()) }()
+
+	received := make(chan int64)
+
+	go func() {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			close(received)
+
+			return
+		}
+
+		n, _ := io.Copy(ioutil.Discard, conn)
+		received <- n
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+
+	file := createTemporaryFile(t, 1000)
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	written, err := pool.copy(conn, file)
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), written)
+	require.NoError(t, conn.Close())
+	require.Equal(t, int64(1000), <-received)
+	require.Equal(t, CopyPathCounters{Sendfile: 1, Direct: 1, Pooled: 1}, pool.getCounters())
+}
+
+func TestBufferPoolTransfers(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	file := createTemporaryFile(t, 100*1024)
+	_, err = file.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+
+	// the data connections implement io.WriterTo, they must not bypass the buffers
+	pooled := s.CopyPathCounters().Pooled
+	require.NoError(t, c.Store("file.bin", file))
+	require.Greater(t, s.CopyPathCounters().Pooled, pooled)
+
+	pooled = s.CopyPathCounters().Pooled
+	require.NoError(t, c.Retrieve("file.bin", ioutil.Discard))
+	require.Greater(t, s.CopyPathCounters().Pooled, pooled)
+}
@@ -2,12 +2,17 @@ package ftpserver // nolint
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fclairamb/ftpserverlib/log"
@@ -34,13 +39,54 @@ const (
 	TransferTypeBinary
 )
 
+// TransferMode is the enumerable that represents the transfer modes of the MODE command (RFC 959, 3.4)
+type TransferMode int
+
+// Transfer modes, the block mode is supported if EnableBlockMode is set and the extended block mode if
+// MaxParallelStreams is set
+const (
+	TransferModeStream TransferMode = iota
+	TransferModeBlock
+	TransferModeCompressed
+	TransferModeExtendedBlock
+)
+
+// transferModes maps the MODE command codes to the transfer modes
+var transferModes = map[string]TransferMode{ //nolint:gochecknoglobals
+	"S": TransferModeStream,
+	"B": TransferModeBlock,
+	"C": TransferModeCompressed,
+	"E": TransferModeExtendedBlock,
+}
+
+// isTransferModeSupported tells if the transfers can use this mode
+func (c *clientHandler) isTransferModeSupported(mode TransferMode) bool {
+	switch mode {
+	case TransferModeStream:
+		return true
+	case TransferModeBlock:
+		return c.server.settings.EnableBlockMode
+	case TransferModeExtendedBlock:
+		return c.server.settings.MaxParallelStreams > 0
+	default:
+		return false
+	}
+}
+
 const (
-	maxCommandSize = 4096
+	defaultMaxCommandSize = 4096
+
+	// dataConnectionFailFastDelay absorbs the passive connections arriving just after the command
+	dataConnectionFailFastDelay = 250 * time.Millisecond
 )
 
 var (
 	errNoTransferConnection = errors.New("unable to open transfer: no transfer connection")
 	errTLSRequired          = errors.New("unable to open transfer: TLS is required")
+	errDataConnNotReady     = errors.New("unable to open transfer: the data connection must be established first")
+	errDataConnectionPeer   = errors.New("data connection peer doesn't match the control connection peer")
+	errInvalidParamChar     = errors.New("parameter contains an invalid character")
+	errParamTooLong         = errors.New("parameter too long")
 )
 
 func getHashMapping() map[string]HASHAlgo {
@@ -69,31 +115,90 @@ func getHashName(algo HASHAlgo) string {
 
 // nolint: maligned
 type clientHandler struct {
-	id                  uint32          // ID of the client
-	server              *FtpServer      // Server on which the connection was accepted
-	driver              ClientDriver    // Client handling driver
-	conn                net.Conn        // TCP connection
-	writer              *bufio.Writer   // Writer on the TCP connection
-	reader              *bufio.Reader   // Reader on the TCP connection
-	user                string          // Authenticated user
-	path                string          // Current path
-	clnt                string          // Identified client
-	command             string          // Command received on the connection
-	connectedAt         time.Time       // Date of connection
-	ctxRnfr             string          // Rename from
-	ctxRest             int64           // Restart point
-	debug               bool            // Show debugging info on the server side
-	transferTLS         bool            // Use TLS for transfer connection
-	controlTLS          bool            // Use TLS for control connection
-	selectedHashAlgo    HASHAlgo        // algorithm used when we receive the HASH command
-	logger              log.Logger      // Client handler logging
-	currentTransferType TransferType    // current transfer type
-	transferWg          sync.WaitGroup  // wait group for command that open a transfer connection
-	transferMu          sync.Mutex      // this mutex will protect the transfer parameters
-	transfer            transferHandler // Transfer connection (passive or active)s
-	isTransferOpen      bool            // indicate if the transfer connection is opened
-	isTransferAborted   bool            // indicate if the transfer was aborted
-	paramsMutex         sync.RWMutex    // mutex to protect the parameters exposed to the library users
+	id                  uint32                 // ID of the client
+	sessionID           string                 // ID of the session, unique across the server instances
+	server              *FtpServer             // Server on which the connection was accepted
+	driver              ClientDriver           // Client handling driver
+	driverFactory       ClientDriverFactory    // Creates the client driver at the next command needing it
+	accessSchedule      *AccessSchedule        // Times at which the user can be connected, nil if unrestricted
+	accessEnd           time.Time              // End of the current access window, zero if unrestricted
+	accessWarned        bool                   // The client was warned of the end of the access window
+	maxSessionDuration  time.Duration          // Time the user can stay logged in, unlimited if 0
+	sessionEnd          time.Time              // End of the login, zero if unlimited
+	replyNotice         string                 // Notice added to the next reply
+	replyLines          int                    // Depth of the multi-line replies being written, see ReplyFlush
+	securityMechanism   SecurityContext        // RFC 2228 security mechanism, see MainDriverExtensionSecurityMechanism
+	securityComplete    bool                   // The security data exchange (ADAT) is complete
+	commandProtection   ProtectionLevel        // Protection of the command being handled, protected by replyMu
+	protectedCommand    string                 // Protected command decoded by MIC, CONF or ENC, to handle next
+	protectedLevel      ProtectionLevel        // Protection of protectedCommand
+	replyProtection     ProtectionLevel        // Protection of the reply being written, protected by replyMu
+	protectedLines      []string               // Lines of the protected reply being written, protected by replyMu
+	idleSince           time.Time              // Date of the last activity, see IdleTimeoutIgnoresNOOP
+	idleWarned          bool                   // The client was warned of the idle timeout, see IdleWarning
+	conn                net.Conn               // TCP connection
+	netConn             net.Conn               // Connection of the client as accepted, under the TLS layer of conn
+	writer              *bufio.Writer          // Writer on the TCP connection
+	reader              *bufio.Reader          // Reader on the TCP connection
+	user                string                 // Authenticated user
+	path                string                 // Current path
+	clnt                string                 // Identified client
+	location            *GeoLocation           // Location of the client, see MainDriverExtensionGeoLocator
+	command             string                 // Command received on the connection
+	connectedAt         time.Time              // Date of connection
+	stats               SessionStats           // Statistics of the transfers, see QuitTemplate
+	ctxRnfr             string                 // Rename from
+	ctxRnfrAt           time.Time              // Date of the accepted RNFR
+	ctxRest             int64                  // Restart point
+	ctxIfMatch          string                 // Version required for the next RETR (SITE IFMATCH)
+	ctxUploadPath       string                 // Path of the upload, given in the 150 reply, if not the requested one
+	debug               bool                   // Show debugging info on the server side
+	resources           resourceCounters       // Resources in use by the session
+	trace               io.Writer              // Protocol trace of the session, nil if disabled
+	traceMu             sync.Mutex             // this mutex protects the trace
+	replyMu             sync.Mutex             // Serializes the replies of the commands and of the transfers
+	sessionPublished    bool                   // The session is published to the MainDriverExtensionSessionStore
+	sessionMu           sync.Mutex             // this mutex serializes the session publications
+	loginRelease        func()                 // Releases the login slot of the concurrency limiter
+	commandsLimiter     *tokenBucket           // Commands rate limiter, nil if disabled
+	unknownCommands     int                    // Number of unknown commands received
+	firstCommands       []string               // First commands received, to identify the client
+	clientProfile       string                 // Name of the identified client profile
+	quirks              ClientQuirks           // Quirks of the identified client
+	listingCache        *listingCache          // Last directory listing, nil if disabled or cleared
+	listingCacheMu      sync.Mutex             // Protects listingCache, set by the transfers
+	statBatchResults    map[string]os.FileInfo // Files info of the current SIZE/MDTM/MLST burst
+	statBatchUses       map[string]int         // Commands of the burst that haven't used the info of each file yet
+	transferTLS         bool                   // Use TLS for transfer connection
+	controlTLS          bool                   // Use TLS for control connection
+	plainConn           net.Conn               // Connection under the TLS layer of AUTH TLS, for CCC
+	selectedHashAlgo    HASHAlgo               // algorithm used when we receive the HASH command
+	logger              log.Logger             // Client handler logging
+	currentTransferType TransferType           // current transfer type
+	currentTransferMode TransferMode           // current transfer mode, negotiated with MODE
+	parallelism         int                    // connections of the MODE E transfers, negotiated with OPTS
+	uploadTrailer       string                 // digest algorithm of the upload trailers, negotiated with OPTS
+	uploadContentType   string                 // content type detected for the last upload
+	uploadResumed       bool                   // the upload appends to or resumes its file, see FileTransferContentType
+	fileOpenDeadline    time.Time              // deadline of the file being opened for a transfer
+	transferWg          sync.WaitGroup         // wait group for command that open a transfer connection
+	transferMu          sync.Mutex             // this mutex will protect the transfer parameters
+	transfer            transferHandler        // Transfer connection (passive or active)s
+	transferConn        net.Conn               // Opened transfer connection
+	tlsControlState     *tls.ConnectionState   // Negotiated TLS parameters of the control connection
+	tlsTransferState    *tls.ConnectionState   // Negotiated TLS parameters of the last transfer connection
+	isTransferOpen      bool                   // indicate if the transfer connection is opened
+	controlCommand      *commandContext        // Command executed by the control goroutine, protected by replyMu
+	transferCommand     *commandContext        // Transfer command running along the other ones, protected by replyMu
+	transferActive      int32                  // isTransferOpen, readable without transferMu (atomic)
+	takenOver           int32                  // A new login of the user replaced the session (atomic)
+	closeReason         int32                  // CloseReason of the session (atomic)
+	state               LifecycleState         // State of the session lifecycle, apart from the transfers
+	transferring        bool                   // A transfer connection is open, protected by stateMu
+	stateMu             sync.Mutex             // Protects state and transferring
+	stateHooksMu        sync.Mutex             // Serializes the state changes and their notifications
+	isTransferAborted   bool                   // indicate if the transfer was aborted
+	paramsMutex         sync.RWMutex           // mutex to protect the parameters exposed to the library users
 }
 
 // newClientHandler initializes a client handler when someone connects
@@ -101,20 +206,35 @@ func (server *FtpServer) newClientHandler(connection net.Conn, id uint32, transf
 	p := &clientHandler{
 		server:              server,
 		conn:                connection,
+		netConn:             connection,
 		id:                  id,
+		sessionID:           newSessionID(),
 		writer:              bufio.NewWriter(connection),
-		reader:              bufio.NewReaderSize(connection, maxCommandSize),
+		reader:              bufio.NewReaderSize(newTelnetReader(connection), server.settings.MaxCommandLength),
 		connectedAt:         time.Now().UTC(),
 		path:                "/",
 		selectedHashAlgo:    HASHAlgoSHA256,
 		currentTransferType: transferType,
 		logger:              server.Logger.With("clientId", id),
+		maxSessionDuration:  time.Duration(server.settings.MaxSessionDuration) * time.Second,
+	}
+
+	if server.settings.CommandRateLimit > 0 {
+		burst := server.settings.CommandRateBurst
+		if burst == 0 {
+			burst = server.settings.CommandRateLimit
+		}
+
+		p.commandsLimiter = newTokenBucket(float64(server.settings.CommandRateLimit), burst)
 	}
 
 	return p
 }
 
-func (c *clientHandler) disconnect() {
+// disconnect closes the control connection for the given reason
+func (c *clientHandler) disconnect(reason CloseReason) {
+	c.setCloseReason(reason)
+
 	if err := c.conn.Close(); err != nil {
 		c.logger.Warn(
 			"Problem disconnecting a client",
@@ -231,6 +351,87 @@ func (c *clientHandler) GetLastCommand() string {
 	return c.command
 }
 
+// GetFileOpenDeadline returns the time before which the file being opened for a transfer should be
+// opened, zero if there is none
+func (c *clientHandler) GetFileOpenDeadline() time.Time {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.fileOpenDeadline
+}
+
+// GetTLSControlState returns the negotiated TLS parameters of the control connection, nil if it isn't over TLS
+func (c *clientHandler) GetTLSControlState() *tls.ConnectionState {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.tlsControlState
+}
+
+// GetTLSTransferState returns the negotiated TLS parameters of the last transfer connection, nil if it
+// wasn't over TLS
+func (c *clientHandler) GetTLSTransferState() *tls.ConnectionState {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.tlsTransferState
+}
+
+// saveTLSState saves and logs the TLS parameters of a connection once its handshake is done
+func (c *clientHandler) saveTLSState(conn net.Conn, control bool) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	if !state.HandshakeComplete {
+		return
+	}
+
+	c.paramsMutex.Lock()
+	if control {
+		c.tlsControlState = &state
+	} else {
+		c.tlsTransferState = &state
+	}
+	c.paramsMutex.Unlock()
+
+	c.checkTLSVersion(&state, control)
+
+	keyvals := []interface{}{
+		"control", control,
+		"version", getTLSVersionName(state.Version),
+		"cipherSuite", tls.CipherSuiteName(state.CipherSuite),
+		"serverName", state.ServerName,
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		keyvals = append(keyvals, "clientCertificate", state.PeerCertificates[0].Subject.String())
+	}
+
+	if control {
+		c.logger.Info("TLS negotiated", keyvals...)
+	} else if c.debug {
+		c.logger.Debug("TLS negotiated", keyvals...)
+	}
+}
+
+func getTLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
+
 func (c *clientHandler) setLastCommand(cmd string) {
 	c.paramsMutex.Lock()
 	defer c.paramsMutex.Unlock()
@@ -238,12 +439,84 @@ func (c *clientHandler) setLastCommand(cmd string) {
 	c.command = cmd
 }
 
+// checkDataConnectionPeer verifies that the peer of a data connection is acceptable. This protects
+// from FTP bounce attacks and from passive connections stealing.
+func (c *clientHandler) checkDataConnectionPeer(peerIP net.IP, requirement DataConnectionRequirement) error {
+	if requirement == IPMatchDisabled {
+		return nil
+	}
+
+	controlIP := getIPFromAddr(c.conn.RemoteAddr())
+	if controlIP != nil && controlIP.Equal(peerIP) {
+		return nil
+	}
+
+	allowed := false
+
+	for _, allowedNet := range c.server.dataConnAllowList {
+		if allowedNet.Contains(peerIP) {
+			allowed = true
+
+			break
+		}
+	}
+
+	if !allowed {
+		if fxp, ok := c.driver.(ClientDriverExtensionFXP); ok {
+			allowed = fxp.IsFXPAllowed()
+		}
+	}
+
+	if !allowed {
+		return fmt.Errorf("%w: %v", errDataConnectionPeer, peerIP)
+	}
+
+	c.logger.Info(
+		"FXP data connection",
+		"user", c.user,
+		"controlPeer", controlIP,
+		"dataPeer", peerIP,
+	)
+
+	return nil
+}
+
+// remoteIP returns the IP of the client as a string
+func (c *clientHandler) remoteIP() string {
+	if ip := getIPFromAddr(c.RemoteAddr()); ip != nil {
+		return ip.String()
+	}
+
+	return c.RemoteAddr().String()
+}
+
+// isUnixSocket tells if the control connection is over a unix socket, its client has no IP then
+func (c *clientHandler) isUnixSocket() bool {
+	return c.conn.LocalAddr().Network() == "unix"
+}
+
+func getIPFromAddr(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
 func (c *clientHandler) closeTransfer() error {
 	var err error
 	if c.transfer != nil {
 		err = c.transfer.Close()
 		c.isTransferOpen = false
+		atomic.StoreInt32(&c.transferActive, 0)
+		c.setTransferring(false)
 		c.transfer = nil
+		c.transferConn = nil
 
 		if c.debug {
 			c.logger.Debug("Transfer connection closed")
@@ -258,6 +531,8 @@ func (c *clientHandler) Close() error {
 	c.transferMu.Lock()
 	defer c.transferMu.Unlock()
 
+	c.setCloseReason(CloseReasonServerShutdown)
+
 	// set isTransferAborted to true so any transfer in progress will not try to write
 	// to the closed connection on transfer close
 	c.isTransferAborted = true
@@ -280,8 +555,13 @@ func (c *clientHandler) Close() error {
 }
 
 func (c *clientHandler) end() {
-	c.server.driver.ClientDisconnected(c)
+	c.setState(StateClosed)
+	c.unregisterSession()
+	c.unpublishSession()
+	c.releaseLogin()
+	c.clientDisconnected()
 	c.server.clientDeparture(c)
+	c.SetTrace(nil)
 
 	if err := c.conn.Close(); err != nil {
 		c.logger.Debug(
@@ -312,46 +592,47 @@ func (c *clientHandler) isCommandAborted() (aborted bool) {
 
 // HandleCommands reads the stream of commands
 func (c *clientHandler) HandleCommands() {
-	defer c.end()
+	c.trackResource(resourceGoroutine, 1)
+	defer c.trackResource(resourceGoroutine, -1)
 
-	if msg, err := c.server.driver.ClientConnected(c); err == nil {
-		c.writeMessage(StatusServiceReady, msg)
-	} else {
-		c.writeMessage(StatusSyntaxErrorNotRecognised, msg)
+	defer c.end()
 
+	if !c.greet() {
 		return
 	}
 
+	c.idleSince = time.Now()
+
 	for {
 		if c.reader == nil {
-			if c.debug {
-				c.logger.Debug("Client disconnected", "clean", true)
-			}
-
 			return
 		}
 
 		// florent(2018-01-14): #58: IDLE timeout: Preparing the deadline before we read
-		if c.server.settings.IdleTimeout > 0 {
-			if err := c.conn.SetDeadline(
-				time.Now().Add(time.Duration(time.Second.Nanoseconds() * int64(c.server.settings.IdleTimeout)))); err != nil {
-				c.logger.Error("Network error", "err", err)
-			}
+		c.setIdleDeadline()
+
+		// checked once the deadline is set, a later takeover expires it
+		if c.isTakenOver() {
+			c.closeSession(CloseReasonTakeover, takeoverMessage)
+
+			return
 		}
 
 		lineSlice, isPrefix, err := c.reader.ReadLine()
 
 		if isPrefix {
-			if c.debug {
-				c.logger.Warn("Received line too long, disconnecting client",
-					"size", len(lineSlice))
-			}
+			c.logger.Warn("Received line too long, disconnecting client", "size", len(lineSlice))
+			c.setCloseReason(CloseReasonProtocolViolation)
+			c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Line too long (more than %d bytes)",
+				c.server.settings.MaxCommandLength))
 
 			return
 		}
 
 		if err != nil {
-			c.handleCommandsStreamError(err)
+			if c.handleReadError(err) {
+				continue
+			}
 
 			return
 		}
@@ -362,8 +643,75 @@ func (c *clientHandler) HandleCommands() {
 			c.logger.Debug("Received line", "line", line)
 		}
 
+		c.traceLine(">", line)
+
+		activity := c.isIdleActivity(line)
+
+		c.warnAccessEnd()
+
+		c.setCommandProtection(ProtectionNone)
 		c.handleCommand(line)
+		c.handleProtectedCommandLine()
+
+		if activity {
+			c.idleSince = time.Now()
+			c.idleWarned = false
+		}
+	}
+}
+
+// handleReadError deals with the error of a command read, it returns true if the next command can be read
+func (c *clientHandler) handleReadError(err error) bool {
+	if c.isTakenOver() {
+		c.closeSession(CloseReasonTakeover, takeoverMessage)
+
+		return false
+	}
+
+	if c.isLoginDeadline(err) {
+		return c.handleLoginDeadline()
+	}
+
+	if c.sendAccessWarning(err) {
+		return true
+	}
+
+	if c.warnIdle(err) {
+		return true
+	}
+
+	c.handleCommandsStreamError(err)
+
+	return false
+}
+
+// handleUnknownCommand replies to a command the server doesn't know
+func (c *clientHandler) handleUnknownCommand(command, param string) {
+	if handler, ok := c.server.driver.(MainDriverExtensionUnknownCommandHandler); ok {
+		if code, message, handled := handler.HandleUnknownCommand(c, command, param); handled {
+			c.writeMessage(code, message)
+
+			return
+		}
+	}
+
+	c.unknownCommands++
+
+	if maxUnknown := c.server.settings.MaxUnknownCommands; maxUnknown > 0 && c.unknownCommands >= maxUnknown {
+		c.logger.Warn("Too many unknown commands, disconnecting client", "command", command)
+		c.writeMessage(StatusServiceNotAvailable, "Too many unknown commands, closing control connection")
+		c.disconnect(CloseReasonProtocolViolation)
+
+		return
 	}
+
+	if !c.isLoggedIn() && c.server.settings.UnknownCommandsNotLoggedIn {
+		c.writeMessage(StatusNotLoggedIn, "Please login with USER and PASS")
+
+		return
+	}
+
+	c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Unknown command %#v", command))
 }
 
 func (c *clientHandler) handleCommandsStreamError(err error) {
@@ -371,6 +719,8 @@ func (c *clientHandler) handleCommandsStreamError(err error) {
 	switch err := err.(type) {
 	case net.Error:
 		if err.Timeout() {
+			c.setCloseReason(CloseReasonIdleTimeout)
+
 			// We have to extend the deadline now
 			if err := c.conn.SetDeadline(time.Now().Add(time.Minute)); err != nil {
 				c.logger.Error("Could not set read deadline", "err", err)
@@ -381,20 +731,22 @@ func (c *clientHandler) handleCommandsStreamError(err error) {
 				StatusServiceNotAvailable,
 				fmt.Sprintf("command timeout (%d seconds): closing control connection", c.server.settings.IdleTimeout))
 
+			c.replyMu.Lock()
 			if err := c.writer.Flush(); err != nil {
 				c.logger.Error("Flush error", "err", err)
 			}
+			c.replyMu.Unlock()
 
 			break
 		}
 
+		c.setCloseReason(CloseReasonNetworkError)
 		c.logger.Error("Network error", "err", err)
 	default:
 		if err == io.EOF {
-			if c.debug {
-				c.logger.Debug("Client disconnected", "clean", false)
-			}
+			c.setCloseReason(CloseReasonClientDisconnected)
 		} else {
+			c.setCloseReason(CloseReasonNetworkError)
 			c.logger.Error("Read error", "err", err)
 		}
 	}
@@ -402,35 +754,49 @@ func (c *clientHandler) handleCommandsStreamError(err error) {
 
 // handleCommand takes care of executing the received line
 func (c *clientHandler) handleCommand(line string) {
-	command, param := parseLine(line)
-	command = strings.ToUpper(command)
+	name, param := parseLine(line)
+	command, cmdDesc := lookupCommand(name)
+
+	if command == "SITE" && isSiteTransfer(param) {
+		cmdDesc = siteTransferCommand
+	}
+
+	if c.commandsLimiter != nil && !c.commandsLimiter.allow(time.Now()) {
+		c.logger.Warn("Commands rate limit exceeded, disconnecting client", "command", command)
+		c.writeMessage(StatusServiceNotAvailable, "Too many commands, closing control connection")
+		c.disconnect(CloseReasonProtocolViolation)
+
+		return
+	}
 
-	cmdDesc := commandsMap[command]
 	if cmdDesc == nil {
-		// Search among commands having a "special semantic". They
-		// should be sent by following the RFC-959 procedure of sending
-		// Telnet IP/Synch sequence (chr 242 and 255) as OOB data but
-		// since many ftp clients don't do it correctly we check the
-		// command suffix.
-		for _, cmd := range specialAttentionCommands {
-			if strings.HasSuffix(command, cmd) {
-				cmdDesc = commandsMap[cmd]
-				command = cmd
-
-				break
-			}
-		}
+		c.setLastCommand(command)
+		c.handleUnknownCommand(command, param)
 
-		if cmdDesc == nil {
-			c.setLastCommand(command)
-			c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Unknown command %#v", command))
+		return
+	}
 
-			return
-		}
+	if err := c.checkParam(param); err != nil {
+		c.setLastCommand(command)
+		c.writeMessage(StatusSyntaxErrorParameters, err.Error())
+
+		return
 	}
 
-	if c.driver == nil && !cmdDesc.Open {
-		c.writeMessage(StatusNotLoggedIn, "Please login with USER and PASS")
+	if !cmdDesc.Open && !c.isLoggedIn() && !c.isPasswordChange(command, param) {
+		c.writeMessage(StatusNotLoggedIn, c.notLoggedInMessage())
+
+		return
+	}
+
+	if !c.checkCommandState(command) {
+		c.setLastCommand(command)
+
+		return
+	}
+
+	if c.isTransferPipeliningRejected(command, cmdDesc) {
+		c.writeMessage(StatusFileActionNotTaken, "A transfer is in progress, retry once it is complete")
 
 		return
 	}
@@ -440,12 +806,40 @@ func (c *clientHandler) handleCommand(line string) {
 	// have at most one command that can open a transfer connection and one special
 	// action command running at the same time.
 	// Only server STAT is a special action command so we do an additional check here
-	if !cmdDesc.SpecialAction || (command == "STAT" && param != "") {
+	serialized := !cmdDesc.SpecialAction || (command == "STAT" && param != "")
+	if serialized {
 		c.transferWg.Wait()
 	}
 
+	// the driver can't be replaced during a transfer
+	if serialized && !cmdDesc.Open && !c.loadDriver(command) {
+		c.setLastCommand(command)
+
+		return
+	}
+
 	c.setLastCommand(command)
 
+	if !cmdDesc.SpecialAction {
+		c.fingerprintCommand(command)
+
+		if !listingCacheCommands[command] {
+			c.clearListingCache()
+		}
+
+		if statBatchCommands[command] && c.driver != nil {
+			c.prefetchStats(param)
+		} else {
+			c.statBatchResults = nil
+			c.statBatchUses = nil
+		}
+	}
+
+	// RNTO must immediately follow RNFR, any other command cancels the pending rename
+	if c.ctxRnfr != "" && command != "RNTO" {
+		c.endRename()
+	}
+
 	if cmdDesc.TransferRelated {
 		// these commands will be started in a separate goroutine so
 		// they can be aborted.
@@ -460,28 +854,103 @@ func (c *clientHandler) handleCommand(line string) {
 		c.isTransferAborted = false
 
 		c.transferWg.Add(1)
+		c.trackResource(resourceGoroutine, 1)
+
+		// the context is started here as the transfer replies are protected like the command
+		cmd := c.startCommand(true)
 
-		go func(cmd, param string) {
+		go func(command, param string) {
 			defer c.transferWg.Done()
+			defer c.trackResource(resourceGoroutine, -1)
 
-			c.executeCommandFn(cmdDesc, cmd, param)
+			c.executeCommandFn(cmd, cmdDesc, command, param)
 		}(command, param)
 	} else {
-		c.executeCommandFn(cmdDesc, command, param)
+		c.executeCommandFn(c.startCommand(false), cmdDesc, command, param)
+	}
+}
+
+// transferPipeliningCommands are the commands, on top of the transfer ones, that would change the data
+// connection parameters of a running transfer
+var transferPipeliningCommands = map[string]bool{"PASV": true, "EPSV": true, "PORT": true, "EPRT": true, "REST": true}
+
+// isTransferPipeliningRejected tells if a command received during a transfer must be refused
+func (c *clientHandler) isTransferPipeliningRejected(command string, cmdDesc *CommandDescription) bool {
+	if c.server.settings.TransferPipelining != TransferPipeliningReject {
+		return false
+	}
+
+	if !cmdDesc.TransferRelated && !transferPipeliningCommands[command] {
+		return false
+	}
+
+	return atomic.LoadInt32(&c.transferActive) != 0
+}
+
+// commandContext is the state of a command for its replies. A transfer command runs along the commands
+// the client sends in the meantime, its transfer replies (150, 226) belong to its own context.
+type commandContext struct {
+	replyCode  int             // Code of the last reply, for the access log
+	bytes      int64           // Bytes of the file transfers, for the access log
+	protection ProtectionLevel // Protection of the command, see MIC, CONF and ENC
+}
+
+// startCommand gives a command its context, until endCommand
+func (c *clientHandler) startCommand(transfer bool) *commandContext {
+	c.replyMu.Lock()
+	defer c.replyMu.Unlock()
+
+	cmd := &commandContext{protection: c.commandProtection}
+
+	if transfer {
+		c.transferCommand = cmd
+	} else {
+		c.controlCommand = cmd
+	}
+
+	return cmd
+}
+
+// endCommand ends the context of a command and writes the command to the access log
+func (c *clientHandler) endCommand(cmd *commandContext, command, param string, start time.Time) {
+	c.replyMu.Lock()
+
+	if c.transferCommand == cmd {
+		c.transferCommand = nil
+	} else if c.controlCommand == cmd {
+		c.controlCommand = nil
 	}
+
+	replyCode, bytes := cmd.replyCode, cmd.bytes
+	c.replyMu.Unlock()
+
+	c.logAccess(command, param, start, replyCode, bytes)
 }
 
-func (c *clientHandler) executeCommandFn(cmdDesc *CommandDescription, command, param string) {
-	// Let's prepare to recover in case there's a command error
+// replyCommand returns the command a reply belongs to, nil if none: the transfer replies belong to the
+// transfer command, the other ones to the command executed by the control goroutine if any.
+// replyMu must be held.
+func (c *clientHandler) replyCommand(transfer bool) *commandContext {
+	if transfer || c.controlCommand == nil {
+		return c.transferCommand
+	}
+
+	return c.controlCommand
+}
+
+func (c *clientHandler) executeCommandFn(cmd *commandContext, cmdDesc *CommandDescription, command, param string) {
+	defer c.endCommand(cmd, command, param, time.Now())
+
+	// Let's prepare to recover in case there's a command error, most likely a driver bug
 	defer func() {
 		if r := recover(); r != nil {
-			c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Unhandled internal error: %s", r))
-			c.logger.Warn(
-				"Internal command handling error",
-				"err", r,
-				"command", command,
-				"param", param,
-			)
+			c.handlePanic(command, param, r)
+
+			if cmdDesc.TransferRelated {
+				c.abortTransferOnPanic()
+			}
+
+			c.writeMessage(StatusLocalError, fmt.Sprintf("Unhandled internal error: %s", r))
 		}
 	}()
 
@@ -490,11 +959,39 @@ func (c *clientHandler) executeCommandFn(cmdDesc *CommandDescription, command, p
 	}
 }
 
+// writeLine sends a line of a reply, it is buffered until the end of the reply if it is a multi-line one.
+// replyMu must be held.
 func (c *clientHandler) writeLine(line string) {
+	c.bufferLine(line)
+
+	if c.replyLines == 0 || c.server.settings.ReplyFlush == ReplyFlushPerLine {
+		c.flushReply()
+	}
+}
+
+// startReply buffers the lines of a multi-line reply until endReply
+func (c *clientHandler) startReply() {
+	c.replyLines++
+}
+
+// endReply sends the lines of a multi-line reply
+func (c *clientHandler) endReply() {
+	if c.replyLines--; c.replyLines == 0 {
+		c.flushReply()
+	}
+}
+
+func (c *clientHandler) bufferLine(line string) {
 	if c.debug {
 		c.logger.Debug("Sending answer", "line", line)
 	}
 
+	c.traceLine("<", line)
+
+	if c.protectReply(line) {
+		return
+	}
+
 	if _, err := c.writer.WriteString(fmt.Sprintf("%s\r\n", line)); err != nil {
 		c.logger.Warn(
 			"Answer couldn't be sent",
@@ -502,6 +999,10 @@ func (c *clientHandler) writeLine(line string) {
 			"err", err,
 		)
 	}
+}
+
+func (c *clientHandler) flushReply() {
+	c.writeProtectedReply()
 
 	if err := c.writer.Flush(); err != nil {
 		c.logger.Warn(
@@ -512,14 +1013,18 @@ func (c *clientHandler) writeLine(line string) {
 }
 
 func (c *clientHandler) writeMessage(code int, message string) {
-	lines := getMessageLines(message)
+	c.writeReply(NewReply(code, message))
+}
 
-	for idx, line := range lines {
-		if idx < len(lines)-1 {
-			c.writeLine(fmt.Sprintf("%d-%s", code, line))
-		} else {
-			c.writeLine(fmt.Sprintf("%d %s", code, line))
-		}
+// writeTransferMessage sends a reply of the transfer of the running transfer command
+func (c *clientHandler) writeTransferMessage(code int, message string) {
+	c.writeCommandReply(NewReply(code, message), true)
+}
+
+// setReplyCode records the code of a reply for the access log. replyMu must be held.
+func (c *clientHandler) setReplyCode(code int, transfer bool) {
+	if cmd := c.replyCommand(transfer); cmd != nil {
+		cmd.replyCode = code
 	}
 }
 
@@ -543,32 +1048,42 @@ func (c *clientHandler) TransferOpen(info string) (net.Conn, error) {
 			return nil, errNoTransferConnection
 		}
 
-		c.writeMessage(StatusActionNotTaken, errNoTransferConnection.Error())
+		c.writeTransferMessage(StatusActionNotTaken, errNoTransferConnection.Error())
 
 		return nil, errNoTransferConnection
 	}
 
 	if c.server.settings.TLSRequired == MandatoryEncryption && !c.HasTLSForTransfers() {
-		c.writeMessage(StatusServiceNotAvailable, errTLSRequired.Error())
+		c.writeTransferMessage(StatusServiceNotAvailable, errTLSRequired.Error())
 
 		return nil, errTLSRequired
 	}
 
-	conn, err := c.transfer.Open()
+	conn, err := c.openTransfer()
 	if err != nil {
 		c.logger.Warn(
 			"Unable to open transfer",
 			"error", err)
 
-		c.writeMessage(StatusCannotOpenDataConnection, err.Error())
+		c.writeTransferMessage(StatusCannotOpenDataConnection, err.Error())
 
 		return nil, err
 	}
 
 	c.isTransferOpen = true
+	atomic.StoreInt32(&c.transferActive, 1)
+	c.setTransferring(true)
+	c.transferConn = conn
 	c.transfer.SetInfo(info)
 
-	c.writeMessage(StatusFileStatusOK, "Using transfer connection")
+	conn = c.watchTransferConn(conn)
+
+	if c.ctxUploadPath != "" {
+		c.writeTransferMessage(StatusFileStatusOK, "FILE: "+c.ctxUploadPath)
+		c.ctxUploadPath = ""
+	} else {
+		c.writeTransferMessage(StatusFileStatusOK, "Using transfer connection")
+	}
 
 	if c.debug {
 		c.logger.Debug(
@@ -580,10 +1095,74 @@ func (c *clientHandler) TransferOpen(info string) (net.Conn, error) {
 	return conn, err
 }
 
+// getTransferTLSConfig returns the TLS config of the transfer connections, nil if they aren't protected.
+// The protection level is the one of the transfer, PROT can be sent after PASV or PORT.
+func (c *clientHandler) getTransferTLSConfig() (*tls.Config, error) {
+	if !c.HasTLSForTransfers() && c.server.settings.TLSRequired != ImplicitEncryption {
+		return nil, nil
+	}
+
+	if configurer, ok := c.server.driver.(MainDriverExtensionTransferTLSConfig); ok {
+		return configurer.GetTransferTLSConfig(c)
+	}
+
+	return c.server.getTLSConfig()
+}
+
+// openTransfer gets the data connection, waiting for it as defined by the DataConnectionPolicies
+func (c *clientHandler) openTransfer() (net.Conn, error) {
+	tlsConfig, err := c.getTransferTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get a TLS config for the transfer connection: %w", err)
+	}
+
+	c.transfer.SetTLSConfig(tlsConfig)
+
+	policy := c.server.settings.DataConnectionPolicies[c.GetLastCommand()]
+
+	timeout := time.Duration(policy.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Duration(c.server.settings.ConnectionTimeout) * time.Second
+	}
+
+	if _, passive := c.transfer.(*passiveTransferHandler); !passive || !policy.FailFast {
+		return c.transfer.Open(timeout)
+	}
+
+	conn, err := c.transfer.Open(dataConnectionFailFastDelay)
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil, errDataConnNotReady
+	}
+
+	return conn, err
+}
+
 func (c *clientHandler) TransferClose(err error) {
+	c.closeTransferWithMessage(err, "Closing transfer connection")
+}
+
+// closeTransferWithStats closes the transfer connection and replies, with the statistics of the file
+// transfers (see TransferCompleteTemplate)
+func (c *clientHandler) closeTransferWithStats(err error, stats *TransferStats) {
+	c.closeTransferWithMessage(err,
+		c.executeStatsTemplate(c.server.transferTemplate, *stats, "Closing transfer connection"))
+}
+
+// closeTransferWithMessage closes the transfer connection and replies, message being the one of the reply
+// of a successful transfer
+func (c *clientHandler) closeTransferWithMessage(err error, message string) {
 	c.transferMu.Lock()
 	defer c.transferMu.Unlock()
 
+	c.saveTLSState(c.transferConn, false)
+
+	// the reply of a rejected upload is sent right away, the client stops sending once it gets it
+	if isUploadRejection(err) {
+		c.drainTransfer()
+	}
+
 	errClose := c.closeTransfer()
 	if errClose != nil {
 		c.logger.Warn(
@@ -601,42 +1180,218 @@ func (c *clientHandler) TransferClose(err error) {
 
 	switch {
 	case err == nil && errClose == nil:
-		c.writeMessage(StatusClosingDataConn, "Closing transfer connection")
+		c.writeTransferMessage(StatusClosingDataConn, message)
 	case errClose != nil:
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Issue during transfer close: %v", errClose))
+		c.writeTransferMessage(StatusActionNotTaken, fmt.Sprintf("Issue during transfer close: %v", errClose))
 	case err != nil:
-		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Issue during transfer: %v", err))
+		c.writeTransferMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Issue during transfer: %v", err))
+	}
+}
+
+// uploadDrainTimeout is the time given to a client whose upload was rejected to stop sending its data
+const uploadDrainTimeout = 5 * time.Second
+
+// drainTransfer closes the transfer connection in the background, once the client stopped sending or after
+// uploadDrainTimeout. Closing a connection with unread data resets it, the client could then report a
+// network error instead of the reply.
+func (c *clientHandler) drainTransfer() {
+	transfer, conn := c.transfer, c.transferConn
+	if transfer == nil || conn == nil {
+		return
+	}
+
+	c.transfer = nil
+	c.transferConn = nil
+	c.isTransferOpen = false
+	atomic.StoreInt32(&c.transferActive, 0)
+	c.setTransferring(false)
+
+	c.trackResource(resourceGoroutine, 1)
+
+	go func() {
+		defer c.trackResource(resourceGoroutine, -1)
+
+		if err := conn.SetReadDeadline(time.Now().Add(uploadDrainTimeout)); err != nil {
+			c.logger.Warn("Could not set the drain deadline", "err", err)
+		}
+
+		drained, err := io.Copy(ioutil.Discard, conn)
+		if err != nil {
+			c.logger.Debug("Rejected upload not drained", "drainedBytes", drained, "err", err)
+		}
+
+		if err = transfer.Close(); err != nil {
+			c.logger.Warn("Problem closing transfer connection", "err", err)
+		}
+	}()
+}
+
+// watchTransferConn adds the stall watchdog and the injected faults to a transfer connection
+func (c *clientHandler) watchTransferConn(conn net.Conn) net.Conn {
+	if c.server.settings.TransferStallTimeout > 0 {
+		conn = &stallWatchdogConn{
+			Conn:    conn,
+			timeout: time.Duration(c.server.settings.TransferStallTimeout) * time.Second,
+		}
+	}
+
+	if faults := c.server.settings.Faults; faults != nil {
+		conn = faults.injectDataFault(conn)
 	}
+
+	return conn
+}
+
+// stallWatchdogConn extends the deadline of a transfer connection each time data flows on it,
+// so that a stalled peer makes the transfer fail with errTransferStalled instead of hanging
+// until the OS detects the dead TCP session. As it hides the underlying connection, the
+// transfers can't use sendfile when it is enabled.
+type stallWatchdogConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *stallWatchdogConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(b)
+
+	return n, c.checkStall(err)
+}
+
+func (c *stallWatchdogConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Write(b)
+
+	return n, c.checkStall(err)
+}
+
+func (c *stallWatchdogConn) checkStall(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: no data for %v", errTransferStalled, c.timeout)
+	}
+
+	return err
 }
 
-func parseLine(line string) (string, string) {
-	params := strings.SplitN(line, " ", 2)
-	if len(params) == 1 {
-		return params[0], ""
+// checkParam rejects the parameters that can't be valid paths before they reach the driver
+func (c *clientHandler) checkParam(param string) error {
+	if strings.ContainsAny(param, "\x00\r\n") {
+		return errInvalidParamChar
+	}
+
+	if len(param) > c.server.settings.MaxPathLength {
+		return fmt.Errorf("%w (more than %d bytes)", errParamTooLong, c.server.settings.MaxPathLength)
 	}
 
-	return params[0], params[1]
+	return nil
 }
 
+// multilineAnswer starts a multi-line reply whose plain text lines are written with writeText, the returned
+// function ends it. No other reply can be sent in between. The first and last lines go through the reply
+// filter, they are sent empty if it suppresses them as the reply couldn't be parsed without them.
 func (c *clientHandler) multilineAnswer(code int, message string) func() {
-	c.writeLine(fmt.Sprintf("%d-%s", code, message))
+	var header []string
+
+	for _, line := range getMessageLines(message) {
+		header = append(header, c.filterLine(code, line)...)
+	}
+
+	end := c.filterLine(code, "End")
+
+	if len(header) == 0 {
+		header = []string{""}
+	}
+
+	if len(end) == 0 {
+		end = []string{""}
+	}
+
+	c.replyMu.Lock()
+	c.setReplyCode(code, false)
+	c.replyProtection = c.replyProtectionLevel(false)
+	c.startReply()
+
+	for _, line := range header {
+		c.writeLine(fmt.Sprintf("%d-%s", code, line))
+	}
 
 	return func() {
-		c.writeLine(fmt.Sprintf("%d End", code))
+		for _, line := range end[:len(end)-1] {
+			c.writeLine(fmt.Sprintf("%d-%s", code, line))
+		}
+
+		c.writeLine(fmt.Sprintf("%d %s", code, end[len(end)-1]))
+		c.endReply()
+		c.replyMu.Unlock()
 	}
 }
 
+// replyLineBreaks are the line breaks of the messages, a single CR can't be sent within a line
+var replyLineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n") // nolint: gochecknoglobals
+
 func getMessageLines(message string) []string {
-	lines := make([]string, 0, 1)
-	sc := bufio.NewScanner(strings.NewReader(message))
+	return strings.Split(strings.TrimSuffix(replyLineBreaks.Replace(message), "\n"), "\n")
+}
+
+// clientConnected calls the driver's ClientConnected, a panic refuses the client
+func (c *clientHandler) clientConnected() (msg string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.handlePanic("ClientConnected", "", r)
+			msg, err = "Internal error", errDriverPanic
+		}
+	}()
+
+	return c.server.driver.ClientConnected(c)
+}
 
-	for sc.Scan() {
-		lines = append(lines, sc.Text())
+// clientDisconnected calls the driver's ClientDisconnected, a panic doesn't prevent the session cleanup
+func (c *clientHandler) clientDisconnected() {
+	defer func() {
+		if r := recover(); r != nil {
+			c.handlePanic("ClientDisconnected", "", r)
+		}
+	}()
+
+	c.server.driver.ClientDisconnected(c)
+}
+
+// handlePanic logs a recovered panic with its stack trace and notifies the MainDriverExtensionPanicHandler
+func (c *clientHandler) handlePanic(call, param string, recovered interface{}) {
+	stack := debug.Stack()
+
+	if isCredentialCommand(call, param) {
+		param = "****"
+	}
+
+	c.logger.Error(
+		"Recovered from a panic",
+		"err", recovered,
+		"call", call,
+		"param", param,
+		"stack", string(stack),
+	)
+
+	if handler, ok := c.server.driver.(MainDriverExtensionPanicHandler); ok {
+		handler.PanicRecovered(c, call, recovered, stack)
 	}
+}
 
-	if len(lines) == 0 {
-		lines = append(lines, "")
+// abortTransferOnPanic closes the transfer connection a panicking command might have left open
+func (c *clientHandler) abortTransferOnPanic() {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	if err := c.closeTransfer(); err != nil {
+		c.logger.Warn("Problem closing transfer connection", "err", err)
 	}
 
-	return lines
+	c.isTransferAborted = false
 }
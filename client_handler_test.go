@@ -1,13 +1,21 @@
 package ftpserver
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -81,6 +89,91 @@ func TestDOS(t *testing.T) {
 	}
 }
 
+func TestCommandLineValidation(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			MaxCommandLength: 64,
+			MaxPathLength:    20,
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("CWD " + strings.Repeat("a", 21))
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	rc, response, err = raw.SendCommand("CWD a\x00b")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	rc, response, err = raw.SendCommand("CWD a\rb")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	rc, response, err = raw.SendCommand("CWD /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	// too long lines are rejected and the client is disconnected
+	rc, response, err = raw.SendCommand("NOOP " + strings.Repeat("a", 100))
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, rc, response)
+
+	_, _, err = raw.SendCommand("NOOP")
+	require.Error(t, err)
+}
+
+func TestCommandRateLimit(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			CommandRateLimit: 1,
+			CommandRateBurst: 10,
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc := StatusOK
+
+	// the login already consumed a few commands of the burst
+	for i := 0; i < 10 && rc == StatusOK; i++ {
+		rc, _, err = raw.SendCommand("NOOP")
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, StatusServiceNotAvailable, rc)
+
+	_, _, err = raw.SendCommand("NOOP")
+	require.Error(t, err, "The client should have been disconnected")
+}
+
 func TestLastCommand(t *testing.T) {
 	cc := clientHandler{}
 	assert.Empty(t, cc.GetLastCommand())
@@ -110,6 +203,75 @@ func TestTransferOpenError(t *testing.T) {
 	require.Equal(t, "unable to open transfer: no transfer connection", response)
 }
 
+// writesCounter counts the writes made to a buffer
+type writesCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writesCounter) Write(p []byte) (int, error) {
+	w.writes++
+
+	return w.Buffer.Write(p)
+}
+
+func TestReplyFlush(t *testing.T) {
+	for policy, expectedWrites := range map[ReplyFlushPolicy]int{ReplyFlushPerReply: 1, ReplyFlushPerLine: 3} {
+		var w writesCounter
+
+		cc := clientHandler{
+			server: &FtpServer{settings: &Settings{ReplyFlush: policy}},
+			writer: bufio.NewWriter(&w),
+		}
+
+		cc.writeMessage(StatusSystemStatus, "Extensions supported:\n UTF8\nEnd")
+		require.Equal(t, "211-Extensions supported:\r\n211- UTF8\r\n211 End\r\n", w.String())
+		require.Equal(t, expectedWrites, w.writes)
+
+		w.Reset()
+		w.writes = 0
+
+		end := cc.multilineAnswer(StatusFileStatus, "STAT file")
+		cc.writeLine(" -rw-r--r-- 1 ftp ftp 10 Jan  1 00:00 file")
+		end()
+		require.Equal(t, expectedWrites, w.writes)
+
+		// the single line replies are always sent at once
+		cc.writeMessage(StatusOK, "Done !")
+		require.Equal(t, expectedWrites+1, w.writes)
+	}
+}
+
+func BenchmarkReplyFlush(b *testing.B) {
+	for name, policy := range map[string]ReplyFlushPolicy{"per-reply": ReplyFlushPerReply, "per-line": ReplyFlushPerLine} {
+		b.Run(name, func(b *testing.B) {
+			s := newTestServerWithDriver(b, &TestServerDriver{Settings: &Settings{ReplyFlush: policy}})
+			conf := goftp.Config{
+				User:     authUser,
+				Password: authPass,
+			}
+
+			c, err := goftp.DialConfig(conf, s.Addr())
+			require.NoError(b, err, "Couldn't connect")
+
+			defer func() { panicOnError(c.Close()) }()
+
+			raw, err := c.OpenRawConn()
+			require.NoError(b, err, "Couldn't open raw connection")
+
+			defer func() { require.NoError(b, raw.Close()) }()
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				rc, _, err := raw.SendCommand("FEAT")
+				require.NoError(b, err)
+				require.Equal(b, StatusSystemStatus, rc)
+			}
+		})
+	}
+}
+
 func TestTLSMethods(t *testing.T) {
 	t.Run("without-tls", func(t *testing.T) {
 		cc := clientHandler{
@@ -135,6 +297,126 @@ func TestTLSMethods(t *testing.T) {
 	})
 }
 
+func TestTLSConnectionState(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		TLS:   true,
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			// nolint:gosec
+			InsecureSkipVerify: true,
+			ServerName:         "example.com",
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 1)
+	cc := driver.Clients[0]
+	driver.clientMU.Unlock()
+
+	controlState := cc.GetTLSControlState()
+	require.NotNil(t, controlState)
+	require.True(t, controlState.HandshakeComplete)
+	require.Equal(t, "example.com", controlState.ServerName)
+	require.Equal(t, "TLS 1.3", getTLSVersionName(controlState.Version))
+
+	transferState := cc.GetTLSTransferState()
+	require.NotNil(t, transferState)
+	require.NotZero(t, transferState.CipherSuite)
+
+	require.Equal(t, "0x0123", getTLSVersionName(0x0123))
+}
+
+var errUnknownServerName = errors.New("unknown server name")
+
+func TestTLSServerName(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		TLS:   true,
+	}
+	driver.TLSServerNames = func(serverName string) (*tls.Config, error) {
+		switch serverName {
+		case "legacy.example.com":
+			tlsConfig, err := driver.GetTLSConfig()
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.MaxVersion = tls.VersionTLS12
+			tlsConfig.NextProtos = []string{"ftp"}
+
+			return tlsConfig, nil
+		case "unknown.example.com":
+			return nil, errUnknownServerName
+		}
+
+		return nil, nil
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	connect := func(serverName string) (*goftp.Client, error) {
+		conf := goftp.Config{
+			User:     authUser,
+			Password: authPass,
+			TLSConfig: &tls.Config{
+				// nolint:gosec
+				InsecureSkipVerify: true,
+				ServerName:         serverName,
+				NextProtos:         []string{"ftp"},
+			},
+			TLSMode: goftp.TLSExplicit,
+		}
+		c, err := goftp.DialConfig(conf, s.Addr())
+		require.NoError(t, err, "Couldn't connect")
+
+		_, err = c.ReadDir("/")
+
+		return c, err
+	}
+
+	// TLS state of the control connection of the connected client
+	state := func(serverName string) tls.ConnectionState {
+		driver.clientMU.Lock()
+		defer driver.clientMU.Unlock()
+
+		for _, cc := range driver.Clients {
+			if state := cc.GetTLSControlState(); state != nil && state.ServerName == serverName {
+				return *state
+			}
+		}
+
+		return tls.ConnectionState{}
+	}
+
+	c, err := connect("legacy.example.com")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), state("legacy.example.com").Version)
+	require.Equal(t, "ftp", state("legacy.example.com").NegotiatedProtocol)
+	require.NoError(t, c.Close())
+
+	c, err = connect("example.com")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), state("example.com").Version)
+	require.Empty(t, state("example.com").NegotiatedProtocol)
+	require.NoError(t, c.Close())
+
+	c, err = connect("unknown.example.com")
+	require.Error(t, err)
+	require.NoError(t, c.Close())
+}
+
 func TestConnectionNotAllowed(t *testing.T) {
 	driver := &TestServerDriver{
 		Debug:          true,
@@ -280,7 +562,7 @@ func TestMultiLineMessages(t *testing.T) {
 		},
 		{
 			message:       "first line\rsecond line",
-			expectedLines: []string{"first line\rsecond line"},
+			expectedLines: []string{"first line", "second line"},
 		},
 		{
 			message: `first line
@@ -339,3 +621,224 @@ func TestUnknownCommand(t *testing.T) {
 	require.Equal(t, StatusSyntaxErrorNotRecognised, rc)
 	require.Equal(t, fmt.Sprintf("Unknown command %#v", cmd), response)
 }
+
+func TestUnknownCommandHandler(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("XCUSTOM param")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+	require.Equal(t, "custom command: param", response)
+}
+
+func TestUnknownCommandsLimit(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			MaxUnknownCommands:         2,
+			UnknownCommandsNotLoggedIn: true,
+		},
+	})
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "220 TEST Server\r\n", line)
+
+	_, err = conn.Write([]byte("UNSUPPORTED\r\n"))
+	require.NoError(t, err)
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "530 Please login with USER and PASS\r\n", line)
+
+	_, err = conn.Write([]byte("UNSUPPORTED\r\n"))
+	require.NoError(t, err)
+
+	line, err = reader.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "421 Too many unknown commands, closing control connection\r\n", line)
+
+	_, err = reader.ReadString('\n')
+	require.Error(t, err)
+}
+
+func TestTransferStallTimeout(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			TransferStallTimeout: 1,
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("STOR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	// we stop sending data after a few bytes, the server must abort the transfer
+	_, err = dc.Write([]byte("some data"))
+	require.NoError(t, err)
+
+	start := time.Now()
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusTransferAborted, rc, response)
+	require.Contains(t, response, errTransferStalled.Error())
+	require.Less(t, int64(time.Since(start)), int64(3*time.Second))
+	require.NoError(t, dc.Close())
+}
+
+func TestSessionTrace(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	traceFile, err := ioutil.TempFile("", "ftpserver-trace")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, os.Remove(traceFile.Name())) }()
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	reader := bufio.NewReader(conn)
+
+	sendCommand := func(command, expectedReply string) {
+		if command != "" {
+			_, err := conn.Write([]byte(command + "\r\n"))
+			require.NoError(t, err)
+		}
+
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, expectedReply+"\r\n", line)
+	}
+
+	sendCommand("", "220 TEST Server")
+
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 1)
+	cc := driver.Clients[0]
+	driver.clientMU.Unlock()
+
+	// the trace is enabled at runtime, for this session only
+	cc.SetTrace(traceFile)
+
+	sendCommand("USER "+authUser, "331 OK")
+	sendCommand("PASS "+authPass, "230 Password ok, continue")
+	sendCommand("NOOP", "200 OK")
+	sendCommand("QUIT", "221 Goodbye")
+	require.NoError(t, conn.Close())
+
+	var trace string
+
+	// the trace file is closed when the session ends
+	require.Eventually(t, func() bool {
+		content, err := ioutil.ReadFile(traceFile.Name())
+		require.NoError(t, err)
+		trace = string(content)
+
+		return strings.Contains(trace, "< 221 Goodbye")
+	}, 2*time.Second, 50*time.Millisecond)
+
+	require.Contains(t, trace, fmt.Sprintf("# client %d, session %s", cc.ID(), cc.SessionID()))
+	require.Contains(t, trace, "> USER "+authUser+"\n")
+	require.Contains(t, trace, "> PASS ****\n")
+	require.NotContains(t, trace, "PASS "+authPass)
+	require.Contains(t, trace, "> NOOP\n")
+	require.Contains(t, trace, "< 200 OK\n")
+	require.Error(t, traceFile.Close(), "the trace file should already be closed")
+}
+
+func TestDriverPanic(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/panic-on-read.bin", make([]byte, 10), 0600))
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("RETR panic-on-open.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusLocalError, rc, response)
+
+	// the transfer connection is closed when the panic happens during the transfer
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("RETR panic-on-read.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusLocalError, rc, response)
+
+	// the session is still usable
+	rc, response, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	driver.panicsMu.Lock()
+	defer driver.panicsMu.Unlock()
+
+	require.Equal(t, []string{"RETR", "RETR"}, driver.panics)
+}
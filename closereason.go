@@ -0,0 +1,68 @@
+package ftpserver
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// CloseReason tells why a session ended, it is given by ClientContext.GetCloseReason from
+// MainDriver.ClientDisconnected and logged with the client departure
+type CloseReason int32
+
+// Reasons of the sessions end
+const (
+	CloseReasonNone               CloseReason = iota // The session isn't closed
+	CloseReasonQuit                                  // The client sent QUIT
+	CloseReasonClientDisconnected                    // The client closed the connection without QUIT
+	CloseReasonIdleTimeout                           // The client didn't send a command within IdleTimeout
+	CloseReasonAuthFailure                           // Failed login, lockout or TLS verification failure
+	CloseReasonRefused                               // Refused connection or session (limits, reputation, location)
+	CloseReasonProtocolViolation                     // Line too long, too many commands, TLS failure
+	CloseReasonDriverError                           // The driver refused the client or returned no driver
+	CloseReasonSessionExpired                        // The access window or the session duration is over
+	CloseReasonTakeover                              // A new session of the same user took this one over
+	CloseReasonServerShutdown                        // The server closed the session with ClientContext.Close
+	CloseReasonNetworkError                          // The control connection failed
+)
+
+func (r CloseReason) String() string {
+	switch r {
+	case CloseReasonNone:
+		return "none"
+	case CloseReasonQuit:
+		return "quit"
+	case CloseReasonClientDisconnected:
+		return "client-disconnected"
+	case CloseReasonIdleTimeout:
+		return "idle-timeout"
+	case CloseReasonAuthFailure:
+		return "auth-failure"
+	case CloseReasonRefused:
+		return "refused"
+	case CloseReasonProtocolViolation:
+		return "protocol-violation"
+	case CloseReasonDriverError:
+		return "driver-error"
+	case CloseReasonSessionExpired:
+		return "session-expired"
+	case CloseReasonTakeover:
+		return "takeover"
+	case CloseReasonServerShutdown:
+		return "server-shutdown"
+	case CloseReasonNetworkError:
+		return "network-error"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(r))
+	}
+}
+
+// GetCloseReason returns why the session ended, CloseReasonNone while it is open
+func (c *clientHandler) GetCloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&c.closeReason))
+}
+
+// setCloseReason records why the session ends, the first reason is kept: closing the connection makes the
+// next read fail
+func (c *clientHandler) setCloseReason(reason CloseReason) {
+	atomic.CompareAndSwapInt32(&c.closeReason, int32(CloseReasonNone), int32(reason))
+}
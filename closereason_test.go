@@ -0,0 +1,106 @@
+package ftpserver
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseReasons(t *testing.T) {
+	tests := []struct {
+		name     string
+		driver   *TestServerDriver
+		commands []string
+		reason   CloseReason
+	}{
+		{"quit", &TestServerDriver{}, []string{"USER " + authUser, "PASS " + authPass, "QUIT"}, CloseReasonQuit},
+		{"client-disconnected", &TestServerDriver{}, []string{"USER " + authUser}, CloseReasonClientDisconnected},
+		{"auth-failure", &TestServerDriver{}, []string{"USER " + authUser, "PASS wrong"}, CloseReasonAuthFailure},
+		{
+			"idle-timeout",
+			&TestServerDriver{Settings: &Settings{IdleTimeout: 1}},
+			[]string{"USER " + authUser, ""},
+			CloseReasonIdleTimeout,
+		},
+		{
+			"protocol-violation",
+			&TestServerDriver{Settings: &Settings{MaxUnknownCommands: 1}},
+			[]string{"FOO"},
+			CloseReasonProtocolViolation,
+		},
+		{
+			"refused",
+			&TestServerDriver{Reputation: func(context.Context) (bool, error) { return true, nil }},
+			nil,
+			CloseReasonRefused,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			test.driver.Debug = true
+			s := NewTestServerWithDriver(t, test.driver)
+
+			conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+			require.NoError(t, err)
+
+			control := textproto.NewConn(conn)
+
+			defer func() { _ = control.Close() }()
+
+			_, err = control.ReadLine()
+			require.NoError(t, err)
+
+			for _, command := range test.commands {
+				// an empty command waits for the server to close the connection
+				if command != "" {
+					require.NoError(t, control.PrintfLine("%s", command))
+				}
+
+				_, err = control.ReadLine()
+				require.NoError(t, err)
+			}
+
+			if test.reason == CloseReasonClientDisconnected {
+				require.NoError(t, control.Close())
+			}
+
+			require.Eventually(t, func() bool { return len(test.driver.getCloseReasons()) == 1 },
+				5*time.Second, 10*time.Millisecond)
+			require.Equal(t, []CloseReason{test.reason}, test.driver.getCloseReasons())
+		})
+	}
+}
+
+func TestCloseReasonServerShutdown(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	control, err := textproto.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+
+	defer func() { _ = control.Close() }()
+
+	_, err = control.ReadLine()
+	require.NoError(t, err)
+
+	driver.clientMU.Lock()
+	require.Equal(t, CloseReasonNone, driver.Clients[0].GetCloseReason())
+	require.NoError(t, driver.Clients[0].Close())
+	driver.clientMU.Unlock()
+
+	require.Eventually(t, func() bool { return len(driver.getCloseReasons()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []CloseReason{CloseReasonServerShutdown}, driver.getCloseReasons())
+}
+
+func TestCloseReasonString(t *testing.T) {
+	require.Equal(t, "idle-timeout", CloseReasonIdleTimeout.String())
+	require.Equal(t, "network-error", CloseReasonNetworkError.String())
+	require.Equal(t, "unknown(42)", CloseReason(42).String())
+}
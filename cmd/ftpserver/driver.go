@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sync/atomic"
+
+	"github.com/spf13/afero"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/fclairamb/ftpserverlib/config"
+)
+
+var errBadCredentials = errors.New("bad username or password")
+
+// mainDriver serves a local directory to a single user, the settings come from the configuration
+type mainDriver struct {
+	*config.Driver
+	fs       afero.Fs
+	user     string
+	password string
+	sessions int32 // connected clients (atomic)
+}
+
+func newMainDriver(settingsDriver *config.Driver, rootDir, user, password string) *mainDriver {
+	return &mainDriver{
+		Driver:   settingsDriver,
+		fs:       afero.NewBasePathFs(afero.NewOsFs(), rootDir),
+		user:     user,
+		password: password,
+	}
+}
+
+// ClientConnected counts the sessions
+func (d *mainDriver) ClientConnected(ftpserver.ClientContext) (string, error) {
+	atomic.AddInt32(&d.sessions, 1)
+
+	return "ftpserver reference server", nil
+}
+
+// ClientDisconnected counts the sessions
+func (d *mainDriver) ClientDisconnected(ftpserver.ClientContext) {
+	atomic.AddInt32(&d.sessions, -1)
+}
+
+// AuthUser checks the credentials, all the users share the root directory
+func (d *mainDriver) AuthUser(_ ftpserver.ClientContext, user, password string) (ftpserver.ClientDriver, error) {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(d.user)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(d.password)) == 1
+
+	if !userOK || !passwordOK {
+		return nil, errBadCredentials
+	}
+
+	return d.fs, nil
+}
+
+func (d *mainDriver) getSessions() int {
+	return int(atomic.LoadInt32(&d.sessions))
+}
@@ -0,0 +1,230 @@
+// ftpserver is a reference FTP server built on the library. It serves a local directory to a single user,
+// its settings come from a YAML or JSON configuration file (see the config package) and it exposes
+// its metrics in JSON over HTTP.
+//
+//	ftpserver -conf ftpserver.yaml -root /srv/ftp -metrics 127.0.0.1:9090
+//
+// The metrics endpoint also serves /health, which fails once the server is paused, and accepts POST
+// requests on /pause and /resume to drain the node before a maintenance: the connected clients keep
+// their sessions, the new ones are refused. These requests must give the FTPSERVER_ADMIN_TOKEN environment
+// variable as a bearer token ("Authorization: Bearer <token>"), they are only accepted from the loopback
+// addresses if it isn't set.
+//
+// The credentials are given by the FTPSERVER_USER and FTPSERVER_PASSWORD environment variables.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/fclairamb/ftpserverlib/config"
+)
+
+var errMissingCredentials = errors.New("FTPSERVER_USER and FTPSERVER_PASSWORD must be set")
+
+type options struct {
+	configFile  string
+	rootDir     string
+	metricsAddr string
+	user        string
+	password    string
+	adminToken  string
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	opts := options{
+		user:       os.Getenv("FTPSERVER_USER"),
+		password:   os.Getenv("FTPSERVER_PASSWORD"),
+		adminToken: os.Getenv("FTPSERVER_ADMIN_TOKEN"),
+	}
+
+	flags := flag.NewFlagSet("ftpserver", flag.ContinueOnError)
+	flags.StringVar(&opts.configFile, "conf", "", "Configuration file (.yaml, .yml or .json)")
+	flags.StringVar(&opts.rootDir, "root", ".", "Served directory")
+	flags.StringVar(&opts.metricsAddr, "metrics", "", "Metrics HTTP endpoint address, disabled if empty")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	server, driver, err := newServer(opts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if errClose := driver.Close(); errClose != nil {
+			server.Logger.Error("Could not close the driver", "err", errClose)
+		}
+	}()
+
+	if err = server.Listen(); err != nil {
+		return err
+	}
+
+	if opts.metricsAddr != "" {
+		metricsServer := &http.Server{
+			Addr:              opts.metricsAddr,
+			Handler:           adminHandler(server, driver, opts.adminToken),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func() {
+			if errMetrics := metricsServer.ListenAndServe(); errMetrics != nil {
+				server.Logger.Error("Metrics endpoint failed", "err", errMetrics)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		server.Logger.Info("Stopping")
+
+		if errStop := server.Stop(); errStop != nil {
+			server.Logger.Error("Could not stop the server", "err", errStop)
+		}
+	}()
+
+	return server.Serve()
+}
+
+// newServer creates the server and its driver from the options
+func newServer(opts options) (*ftpserver.FtpServer, *mainDriver, error) {
+	if opts.user == "" || opts.password == "" {
+		return nil, nil, errMissingCredentials
+	}
+
+	cfg := &config.Config{}
+
+	if opts.configFile != "" {
+		var err error
+		if cfg, err = config.Load(opts.configFile); err != nil {
+			return nil, nil, err
+		}
+	} else if err := cfg.ApplyEnv(config.DefaultEnvPrefix, os.LookupEnv); err != nil {
+		return nil, nil, err
+	}
+
+	settingsDriver, err := cfg.NewDriver()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	driver := newMainDriver(settingsDriver, opts.rootDir, opts.user, opts.password)
+
+	server, err := cfg.NewServer(driver)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return server, driver, nil
+}
+
+// metrics are the values exposed by the metrics endpoint
+type metrics struct {
+	Sessions   int                                  `json:"sessions"`
+	Resources  ftpserver.ResourceCounters           `json:"resources"`
+	CopyPaths  ftpserver.CopyPathCounters           `json:"copy_paths"`
+	Countries  map[string]ftpserver.CountryCounters `json:"countries,omitempty"`
+	ListenAddr string                               `json:"listen_address"`
+	Accepting  bool                                 `json:"accepting"`
+}
+
+// adminHandler serves the metrics, the health check and the pause/resume commands, the latter require the
+// token if any, a loopback client otherwise
+func adminHandler(server *ftpserver.FtpServer, driver *mainDriver, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", metricsHandler(server, driver))
+	mux.Handle("/health", healthHandler(server))
+	mux.Handle("/pause", acceptHandler(server.PauseAccept, token))
+	mux.Handle("/resume", acceptHandler(server.ResumeAccept, token))
+
+	return mux
+}
+
+// healthHandler fails if the server doesn't accept new connections, a paused node is taken out of the load
+// balancing this way
+func healthHandler(server *ftpserver.FtpServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !server.Accepting() {
+			http.Error(w, "not accepting connections", http.StatusServiceUnavailable)
+
+			return
+		}
+
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// acceptHandler calls PauseAccept or ResumeAccept on an authorized POST request
+func acceptHandler(action func(), token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		if !isAdminRequest(r, token) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+
+			return
+		}
+
+		action()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// isAdminRequest tells if a request gives the admin token, or comes from a loopback address if there is none
+func isAdminRequest(r *http.Request, token string) bool {
+	if token != "" {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func metricsHandler(server *ftpserver.FtpServer, driver *mainDriver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(metrics{
+			Sessions:   driver.getSessions(),
+			Resources:  server.Resources(),
+			CopyPaths:  server.CopyPathCounters(),
+			Countries:  server.CountryCounters(),
+			ListenAddr: server.Addr(),
+			Accepting:  server.Accepting(),
+		}); err != nil {
+			server.Logger.Warn("Could not write the metrics", "err", err)
+		}
+	})
+}
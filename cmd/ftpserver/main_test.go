@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "ftpserver-root")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, os.RemoveAll(rootDir)) }()
+
+	configFile := filepath.Join(rootDir, "..", filepath.Base(rootDir)+".yaml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("listen_address: 127.0.0.1:0\nlogging:\n  output: none\n"), 0600))
+
+	defer func() { require.NoError(t, os.Remove(configFile)) }()
+
+	_, _, err = newServer(options{configFile: configFile, rootDir: rootDir})
+	require.ErrorIs(t, err, errMissingCredentials)
+
+	server, driver, err := newServer(options{configFile: configFile, rootDir: rootDir, user: "user", password: "pass"})
+	require.NoError(t, err)
+	require.NoError(t, server.Listen())
+
+	served := make(chan error, 1)
+
+	go func() {
+		served <- server.Serve()
+	}()
+
+	defer func() {
+		require.NoError(t, server.Stop())
+		require.NoError(t, <-served)
+	}()
+
+	wrong, err := goftp.DialConfig(goftp.Config{User: "user", Password: "wrong"}, server.Addr())
+	if err == nil {
+		_, err = wrong.ReadDir("/")
+		require.NoError(t, wrong.Close())
+	}
+
+	require.Error(t, err)
+
+	c, err := goftp.DialConfig(goftp.Config{User: "user", Password: "pass"}, server.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	require.NoError(t, c.Store("file.txt", bytes.NewReader([]byte("content"))))
+
+	content, err := ioutil.ReadFile(filepath.Join(rootDir, "file.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+
+	var values metrics
+
+	// the session of the failed login ends asynchronously
+	require.Eventually(t, func() bool {
+		recorder := httptest.NewRecorder()
+		metricsHandler(server, driver).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &values))
+
+		return values.Sessions == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, server.Addr(), values.ListenAddr)
+	require.True(t, values.Accepting)
+
+	admin := func(method, path string) int {
+		request := httptest.NewRequest(method, path, nil)
+		request.Header.Set("Authorization", "Bearer secret")
+
+		recorder := httptest.NewRecorder()
+		adminHandler(server, driver, "secret").ServeHTTP(recorder, request)
+
+		return recorder.Code
+	}
+
+	// without a token, only the loopback clients can pause the server
+	for remoteAddr, expected := range map[string]int{
+		"192.0.2.1:1234": http.StatusForbidden,
+		"127.0.0.1:1234": http.StatusNoContent,
+	} {
+		request := httptest.NewRequest("POST", "/resume", nil)
+		request.RemoteAddr = remoteAddr
+
+		recorder := httptest.NewRecorder()
+		adminHandler(server, driver, "").ServeHTTP(recorder, request)
+		require.Equal(t, expected, recorder.Code, remoteAddr)
+	}
+
+	wrongToken := httptest.NewRequest("POST", "/pause", nil)
+	wrongToken.Header.Set("Authorization", "Bearer wrong")
+
+	recorder := httptest.NewRecorder()
+	adminHandler(server, driver, "secret").ServeHTTP(recorder, wrongToken)
+	require.Equal(t, http.StatusForbidden, recorder.Code)
+
+	require.Equal(t, http.StatusOK, admin("GET", "/health"))
+	require.Equal(t, http.StatusMethodNotAllowed, admin("GET", "/pause"))
+	require.Equal(t, http.StatusNoContent, admin("POST", "/pause"))
+	require.Equal(t, http.StatusServiceUnavailable, admin("GET", "/health"))
+
+	// the connected clients keep their sessions
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusNoContent, admin("POST", "/resume"))
+	require.Equal(t, http.StatusOK, admin("GET", "/health"))
+}
@@ -0,0 +1,442 @@
+// Package config builds the settings, the TLS config and the logger of a server from a YAML or JSON
+// configuration file, with environment variables overrides.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	gklog "github.com/go-kit/kit/log"
+	gklevel "github.com/go-kit/kit/log/level"
+	"gopkg.in/yaml.v3"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/fclairamb/ftpserverlib/log"
+	"github.com/fclairamb/ftpserverlib/log/gokit"
+	"github.com/fclairamb/ftpserverlib/log/journald"
+	"github.com/fclairamb/ftpserverlib/log/syslog"
+)
+
+// DefaultEnvPrefix is the prefix of the environment variables overriding the configuration in Load
+const DefaultEnvPrefix = "FTPSERVER"
+
+var (
+	// ErrUnknownFormat is returned for a configuration file that isn't a .json, .yaml or .yml file
+	ErrUnknownFormat = errors.New("unknown configuration format")
+	// ErrInvalidValue is returned when a configuration value can't be used
+	ErrInvalidValue = errors.New("invalid configuration value")
+	// ErrNoTLS is returned by TLSConfig when no certificate is configured
+	ErrNoTLS = errors.New("no TLS certificate configured")
+)
+
+// Config is the configuration of a server. The keys of the files and the environment variables are
+// derived from the json tags: FTPSERVER_LIMITS_MAX_COMMAND_LENGTH overrides limits.max_command_length.
+type Config struct {
+	ListenAddress           string     `json:"listen_address" yaml:"listen_address"`
+	PublicHost              string     `json:"public_host" yaml:"public_host"`
+	PassivePortRange        *PortRange `json:"passive_port_range" yaml:"passive_port_range"`
+	ActiveTransferPortNon20 bool       `json:"active_transfer_port_non_20" yaml:"active_transfer_port_non_20"`
+	DisableActiveMode       bool       `json:"disable_active_mode" yaml:"disable_active_mode"`
+	IdleTimeout             int        `json:"idle_timeout" yaml:"idle_timeout"`
+	ConnectionTimeout       int        `json:"connection_timeout" yaml:"connection_timeout"`
+	Banner                  string     `json:"banner" yaml:"banner"`
+	TLS                     TLS        `json:"tls" yaml:"tls"`
+	Limits                  Limits     `json:"limits" yaml:"limits"`
+	Logging                 Logging    `json:"logging" yaml:"logging"`
+	AccessLog               AccessLog  `json:"access_log" yaml:"access_log"`
+}
+
+// PortRange is the range of the passive ports
+type PortRange struct {
+	Start int `json:"start" yaml:"start"`
+	End   int `json:"end" yaml:"end"`
+}
+
+// TLS defines the TLS mode and certificate
+type TLS struct {
+	Mode     string `json:"mode" yaml:"mode"`           // "clear" (TLS is optional, default), "mandatory" or "implicit"
+	CertFile string `json:"cert_file" yaml:"cert_file"` // PEM certificate chain
+	KeyFile  string `json:"key_file" yaml:"key_file"`   // PEM private key
+}
+
+// Limits defines the limits applied to the sessions, 0 keeps the server default
+type Limits struct {
+	MaxCommandLength        int `json:"max_command_length" yaml:"max_command_length"`
+	MaxPathLength           int `json:"max_path_length" yaml:"max_path_length"`
+	CommandRateLimit        int `json:"command_rate_limit" yaml:"command_rate_limit"`
+	CommandRateBurst        int `json:"command_rate_burst" yaml:"command_rate_burst"`
+	MaxUnknownCommands      int `json:"max_unknown_commands" yaml:"max_unknown_commands"`
+	MaxSessionsPerUser      int `json:"max_sessions_per_user" yaml:"max_sessions_per_user"`
+	TransferStallTimeout    int `json:"transfer_stall_timeout" yaml:"transfer_stall_timeout"`
+	MaxSessionGoroutines    int `json:"max_session_goroutines" yaml:"max_session_goroutines"`
+	MaxSessionOpenFiles     int `json:"max_session_open_files" yaml:"max_session_open_files"`
+	MaxSessionDataListeners int `json:"max_session_data_listeners" yaml:"max_session_data_listeners"`
+}
+
+// Logging defines where and how the server logs
+type Logging struct {
+	Output  string `json:"output" yaml:"output"`   // "stderr" (default), "stdout", "syslog", "journald" or "none"
+	Format  string `json:"format" yaml:"format"`   // "logfmt" (default) or "json", for stderr and stdout
+	Level   string `json:"level" yaml:"level"`     // Minimum level: "debug" (default), "info", "warn" or "error"
+	Address string `json:"address" yaml:"address"` // "udp:host:514" or "tcp:host:601" syslog, local daemon if empty
+}
+
+// AccessLog defines the W3C access log of the commands and its rotation, it is disabled without a path
+type AccessLog struct {
+	Path           string `json:"path" yaml:"path"`
+	MaxSize        int    `json:"max_size" yaml:"max_size"`               // Rotation size in megabytes, 0 for unlimited
+	RotateInterval int    `json:"rotate_interval" yaml:"rotate_interval"` // Rotation period in seconds, 0 disables it
+	Compress       bool   `json:"compress" yaml:"compress"`               // Gzip the rotated files
+	MaxBackups     int    `json:"max_backups" yaml:"max_backups"`         // Rotated files kept, 0 keeps them all
+}
+
+// Load reads a configuration file, its format is given by its extension, and applies the overrides of
+// the environment variables prefixed with DefaultEnvPrefix
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(config)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(config)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, path)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+
+	if err = config.ApplyEnv(DefaultEnvPrefix, os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ApplyEnv overrides the configuration with the variables found by lookup (os.LookupEnv usually)
+func (c *Config) ApplyEnv(prefix string, lookup func(string) (string, bool)) error {
+	return applyEnv(reflect.ValueOf(c).Elem(), prefix, lookup)
+}
+
+func applyEnv(value reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := prefix + "_" + strings.ToUpper(strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0])
+
+		switch field.Kind() { // nolint: exhaustive
+		case reflect.Struct:
+			if err := applyEnv(field, name, lookup); err != nil {
+				return err
+			}
+
+			continue
+		case reflect.Ptr:
+			if !field.IsNil() {
+				if err := applyEnv(field.Elem(), name, lookup); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			// the missing optional sections are only created if one of their variables is set
+			section := reflect.New(field.Type().Elem())
+			if err := applyEnv(section.Elem(), name, lookup); err != nil {
+				return err
+			}
+
+			if !section.Elem().IsZero() {
+				field.Set(section)
+			}
+
+			continue
+		}
+
+		env, ok := lookup(name)
+		if !ok {
+			continue
+		}
+
+		if err := setValue(field, env); err != nil {
+			return fmt.Errorf("%w: %s=%#v: %v", ErrInvalidValue, name, env, err)
+		}
+	}
+
+	return nil
+}
+
+func setValue(field reflect.Value, value string) error {
+	switch field.Kind() { // nolint: exhaustive
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(int64(number))
+	case reflect.Bool:
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+
+		field.SetBool(flag)
+	}
+
+	return nil
+}
+
+// Settings returns new server settings, they still have to be validated by the server
+func (c *Config) Settings() (*ftpserver.Settings, error) {
+	tlsRequired, err := c.TLS.requirement()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := &ftpserver.Settings{
+		ListenAddr:              c.ListenAddress,
+		PublicHost:              c.PublicHost,
+		ActiveTransferPortNon20: c.ActiveTransferPortNon20,
+		DisableActiveMode:       c.DisableActiveMode,
+		IdleTimeout:             c.IdleTimeout,
+		ConnectionTimeout:       c.ConnectionTimeout,
+		Banner:                  c.Banner,
+		TLSRequired:             tlsRequired,
+		MaxCommandLength:        c.Limits.MaxCommandLength,
+		MaxPathLength:           c.Limits.MaxPathLength,
+		CommandRateLimit:        c.Limits.CommandRateLimit,
+		CommandRateBurst:        c.Limits.CommandRateBurst,
+		MaxUnknownCommands:      c.Limits.MaxUnknownCommands,
+		MaxSessionsPerUser:      c.Limits.MaxSessionsPerUser,
+		TransferStallTimeout:    c.Limits.TransferStallTimeout,
+		MaxSessionGoroutines:    c.Limits.MaxSessionGoroutines,
+		MaxSessionOpenFiles:     c.Limits.MaxSessionOpenFiles,
+		MaxSessionDataListeners: c.Limits.MaxSessionDataListeners,
+	}
+
+	if c.AccessLog.Path != "" {
+		settings.AccessLog = &ftpserver.RotatingFile{
+			Path:           c.AccessLog.Path,
+			MaxSize:        int64(c.AccessLog.MaxSize) << 20,
+			RotateInterval: time.Duration(c.AccessLog.RotateInterval) * time.Second,
+			Compress:       c.AccessLog.Compress,
+			MaxBackups:     c.AccessLog.MaxBackups,
+		}
+	}
+
+	if c.PassivePortRange != nil {
+		settings.PassiveTransferPortRange = &ftpserver.PortRange{
+			Start: c.PassivePortRange.Start,
+			End:   c.PassivePortRange.End,
+		}
+	}
+
+	return settings, nil
+}
+
+func (t *TLS) requirement() (ftpserver.TLSRequirement, error) {
+	switch strings.ToLower(t.Mode) {
+	case "", "clear":
+		return ftpserver.ClearOrEncrypted, nil
+	case "mandatory":
+		return ftpserver.MandatoryEncryption, nil
+	case "implicit":
+		return ftpserver.ImplicitEncryption, nil
+	default:
+		return ftpserver.ClearOrEncrypted, fmt.Errorf("%w: unknown TLS mode %#v", ErrInvalidValue, t.Mode)
+	}
+}
+
+// TLSConfig loads the TLS certificate, it returns ErrNoTLS if none is configured
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TLS.CertFile == "" && c.TLS.KeyFile == "" {
+		return nil, ErrNoTLS
+	}
+
+	keypair, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the TLS certificate: %w", err)
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{keypair},
+	}, nil
+}
+
+// Logger creates the logger of the server
+func (c *Config) Logger() (log.Logger, error) {
+	level, err := c.Logging.level()
+	if err != nil {
+		return nil, err
+	}
+
+	var writer *os.File
+
+	switch strings.ToLower(c.Logging.Output) {
+	case "", "stderr":
+		writer = os.Stderr
+	case "stdout":
+		writer = os.Stdout
+	case "none":
+		return log.Nothing(), nil
+	case "syslog", "journald":
+		return c.Logging.daemonLogger(level)
+	default:
+		return nil, fmt.Errorf("%w: unknown logging output %#v", ErrInvalidValue, c.Logging.Output)
+	}
+
+	var logger gklog.Logger
+
+	switch strings.ToLower(c.Logging.Format) {
+	case "", "logfmt":
+		logger = gklog.NewLogfmtLogger(gklog.NewSyncWriter(writer))
+	case "json":
+		logger = gklog.NewJSONLogger(gklog.NewSyncWriter(writer))
+	default:
+		return nil, fmt.Errorf("%w: unknown logging format %#v", ErrInvalidValue, c.Logging.Format)
+	}
+
+	switch level {
+	case log.LevelDebug:
+	case log.LevelInfo:
+		logger = gklevel.NewFilter(logger, gklevel.AllowInfo())
+	case log.LevelWarn:
+		logger = gklevel.NewFilter(logger, gklevel.AllowWarn())
+	case log.LevelError:
+		logger = gklevel.NewFilter(logger, gklevel.AllowError())
+	}
+
+	return gokit.NewGKLogger(logger).With(
+		"ts", gokit.GKDefaultTimestampUTC,
+		"caller", gokit.GKDefaultCaller,
+	), nil
+}
+
+func (l *Logging) level() (log.Level, error) {
+	switch strings.ToLower(l.Level) {
+	case "", "debug":
+		return log.LevelDebug, nil
+	case "info":
+		return log.LevelInfo, nil
+	case "warn":
+		return log.LevelWarn, nil
+	case "error":
+		return log.LevelError, nil
+	default:
+		return log.LevelDebug, fmt.Errorf("%w: unknown logging level %#v", ErrInvalidValue, l.Level)
+	}
+}
+
+// daemonLogger connects to syslog or journald, the connection stays open for the life of the process
+func (l *Logging) daemonLogger(level log.Level) (log.Logger, error) {
+	var (
+		logger log.Logger
+		err    error
+	)
+
+	if strings.ToLower(l.Output) == "journald" {
+		logger, _, err = journald.Dial(l.Address, "ftpserver")
+	} else {
+		network, address := "", ""
+
+		if l.Address != "" {
+			parts := strings.SplitN(l.Address, ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%w: invalid syslog address %#v", ErrInvalidValue, l.Address)
+			}
+
+			network, address = parts[0], parts[1]
+		}
+
+		logger, _, err = syslog.Dial(network, address, syslog.Options{})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %w", l.Output, err)
+	}
+
+	return log.Filter(logger, level), nil
+}
+
+// Driver implements the settings part of ftpserver.MainDriver. It is meant to be embedded in the main
+// driver, which only has to implement the authentication and the client drivers selection.
+type Driver struct {
+	settings  *ftpserver.Settings
+	tlsConfig *tls.Config
+	tlsErr    error
+}
+
+// NewDriver loads the settings and the TLS certificate, if any
+func (c *Config) NewDriver() (*Driver, error) {
+	settings, err := c.Settings()
+	if err != nil {
+		return nil, err
+	}
+
+	driver := &Driver{settings: settings}
+
+	driver.tlsConfig, driver.tlsErr = c.TLSConfig()
+	if driver.tlsErr != nil && !errors.Is(driver.tlsErr, ErrNoTLS) {
+		return nil, driver.tlsErr
+	}
+
+	return driver, nil
+}
+
+// GetSettings returns the settings of the configuration
+func (d *Driver) GetSettings() (*ftpserver.Settings, error) {
+	return d.settings, nil
+}
+
+// Close closes the access log file, if any, once the server is stopped
+func (d *Driver) Close() error {
+	if closer, ok := d.settings.AccessLog.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// GetTLSConfig returns the TLS config of the configuration, ErrNoTLS if there is none
+func (d *Driver) GetTLSConfig() (*tls.Config, error) {
+	return d.tlsConfig, d.tlsErr
+}
+
+// NewServer creates a server for a main driver embedding the Driver of this configuration, with the
+// configured logger
+func (c *Config) NewServer(driver ftpserver.MainDriver) (*ftpserver.FtpServer, error) {
+	logger, err := c.Logger()
+	if err != nil {
+		return nil, err
+	}
+
+	server := ftpserver.NewFtpServer(driver)
+	server.Logger = logger
+
+	return server, nil
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+const yamlConfig = `
+listen_address: 127.0.0.1:0
+public_host: 192.0.2.1
+passive_port_range:
+  start: 2122
+  end: 2200
+idle_timeout: 60
+tls:
+  mode: clear
+limits:
+  max_command_length: 1024
+  command_rate_limit: 10
+logging:
+  output: none
+`
+
+const jsonConfig = `{
+	"listen_address": "127.0.0.1:0",
+	"public_host": "192.0.2.1",
+	"passive_port_range": {"start": 2122, "end": 2200},
+	"idle_timeout": 60,
+	"tls": {"mode": "clear"},
+	"limits": {"max_command_length": 1024, "command_rate_limit": 10},
+	"logging": {"output": "none"}
+}`
+
+func writeConfig(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "ftpserver-config")
+	require.NoError(t, err)
+
+	t.Cleanup(func() { require.NoError(t, os.RemoveAll(dir)) })
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	for name, content := range map[string]string{"ftpserver.yaml": yamlConfig, "ftpserver.json": jsonConfig} {
+		config, err := Load(writeConfig(t, name, content))
+		require.NoError(t, err, name)
+
+		settings, err := config.Settings()
+		require.NoError(t, err)
+		require.Equal(t, "127.0.0.1:0", settings.ListenAddr)
+		require.Equal(t, "192.0.2.1", settings.PublicHost)
+		require.Equal(t, &ftpserver.PortRange{Start: 2122, End: 2200}, settings.PassiveTransferPortRange)
+		require.Equal(t, 60, settings.IdleTimeout)
+		require.Equal(t, ftpserver.ClearOrEncrypted, settings.TLSRequired)
+		require.Equal(t, 1024, settings.MaxCommandLength)
+		require.Equal(t, 10, settings.CommandRateLimit)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load(writeConfig(t, "ftpserver.toml", ""))
+	require.True(t, errors.Is(err, ErrUnknownFormat), err)
+
+	// typos are reported
+	_, err = Load(writeConfig(t, "ftpserver.yaml", "listen_adress: 127.0.0.1:0\n"))
+	require.Error(t, err)
+
+	_, err = Load(writeConfig(t, "ftpserver.json", `{"listen_adress": "127.0.0.1:0"}`))
+	require.Error(t, err)
+
+	config, err := Load(writeConfig(t, "ftpserver.yaml", "tls:\n  mode: sometimes\n"))
+	require.NoError(t, err)
+
+	_, err = config.Settings()
+	require.True(t, errors.Is(err, ErrInvalidValue), err)
+}
+
+func TestApplyEnv(t *testing.T) {
+	env := map[string]string{
+		"FTPSERVER_LISTEN_ADDRESS":                "127.0.0.1:2121",
+		"FTPSERVER_DISABLE_ACTIVE_MODE":           "true",
+		"FTPSERVER_PASSIVE_PORT_RANGE_START":      "3000",
+		"FTPSERVER_PASSIVE_PORT_RANGE_END":        "3100",
+		"FTPSERVER_TLS_MODE":                      "implicit",
+		"FTPSERVER_LIMITS_MAX_SESSION_OPEN_FILES": "16",
+		"FTPSERVER_LIMITS_MAX_UNKNOWN_COMMANDS":   "5",
+		// the other variables are ignored
+		"OTHER_LIMITS_MAX_SESSION_DATA_LISTENERS":    "2",
+		"FTPSERVER_LIMITS_MAX_SESSION_DATA_LISTENER": "2",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+
+		return value, ok
+	}
+
+	config := &Config{IdleTimeout: 60}
+	require.NoError(t, config.ApplyEnv(DefaultEnvPrefix, lookup))
+
+	require.Equal(t, &Config{
+		ListenAddress:     "127.0.0.1:2121",
+		DisableActiveMode: true,
+		PassivePortRange:  &PortRange{Start: 3000, End: 3100},
+		IdleTimeout:       60,
+		TLS:               TLS{Mode: "implicit"},
+		Limits:            Limits{MaxSessionOpenFiles: 16, MaxUnknownCommands: 5},
+	}, config)
+
+	env["FTPSERVER_IDLE_TIMEOUT"] = "soon"
+	require.True(t, errors.Is(config.ApplyEnv(DefaultEnvPrefix, lookup), ErrInvalidValue))
+}
+
+func TestSyslogLogger(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, collector.Close()) }()
+
+	config := &Config{Logging: Logging{Output: "syslog", Level: "info", Address: "udp:" + collector.LocalAddr().String()}}
+	logger, err := config.Logger()
+	require.NoError(t, err)
+
+	// the debug events are filtered
+	logger.Debug("Sending answer")
+	logger.Info("Client connected", "clientId", 1)
+
+	message := make([]byte, 1024)
+	n, _, err := collector.ReadFrom(message)
+	require.NoError(t, err)
+	require.Regexp(t, `^<94>1 .* \[ftpserver@32473 clientId="1"\] Client connected$`, string(message[:n]))
+
+	config.Logging.Address = "192.0.2.1"
+	_, err = config.Logger()
+	require.True(t, errors.Is(err, ErrInvalidValue), err)
+}
+
+type testDriver struct {
+	*Driver
+}
+
+func (d *testDriver) ClientConnected(ftpserver.ClientContext) (string, error) {
+	return "test", nil
+}
+
+func (d *testDriver) ClientDisconnected(ftpserver.ClientContext) {}
+
+func (d *testDriver) AuthUser(ftpserver.ClientContext, string, string) (ftpserver.ClientDriver, error) {
+	return nil, errors.New("no user") // nolint: goerr113
+}
+
+func TestNewServer(t *testing.T) {
+	config, err := Load(writeConfig(t, "ftpserver.yaml", yamlConfig))
+	require.NoError(t, err)
+
+	driver, err := config.NewDriver()
+	require.NoError(t, err)
+
+	_, err = driver.GetTLSConfig()
+	require.True(t, errors.Is(err, ErrNoTLS), err)
+
+	server, err := config.NewServer(&testDriver{Driver: driver})
+	require.NoError(t, err)
+	require.NoError(t, server.Listen())
+	require.NotEmpty(t, server.Addr())
+	require.NoError(t, server.Stop())
+	require.NoError(t, driver.Close())
+
+	// a configured certificate must be loadable
+	config.TLS.CertFile = "missing.crt"
+	config.TLS.KeyFile = "missing.key"
+	_, err = config.NewDriver()
+	require.Error(t, err)
+}
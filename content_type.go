@@ -0,0 +1,160 @@
+package ftpserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// contentSniffLength is the number of bytes used to detect the content type of an upload
+const contentSniffLength = 512
+
+// ContentTypePolicy restricts the content of the uploads (STOR, APPE) by the MIME type detected from their
+// first bytes (see http.DetectContentType), like "text/plain" for a CSV file or "text/xml" for an XML one.
+// The appended and resumed uploads are checked from the first bytes they send. The refused uploads get a 553
+// reply, nothing is written and the files they created are deleted.
+type ContentTypePolicy struct {
+	Allowed []string // Patterns (path.Match syntax) of the allowed types, like "text/*", all of them if empty
+	Denied  []string // Patterns of the denied types, like "application/x-executable"
+}
+
+// check tells if a detected content type is allowed
+func (policy *ContentTypePolicy) check(contentType string) error {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+
+	if matchContentType(policy.Denied, mediaType) {
+		return fmt.Errorf("%w: %s content is denied", ErrContentNotAllowed, mediaType)
+	}
+
+	if len(policy.Allowed) > 0 && !matchContentType(policy.Allowed, mediaType) {
+		return fmt.Errorf("%w: %s content isn't allowed", ErrContentNotAllowed, mediaType)
+	}
+
+	return nil
+}
+
+// validate checks the patterns of the policy
+func (policy *ContentTypePolicy) validate() error {
+	for _, pattern := range append(append([]string{}, policy.Allowed...), policy.Denied...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid content type pattern %q: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func matchContentType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), mediaType); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getContentTypePolicy returns the policy of the user, nil if there is none
+func (c *clientHandler) getContentTypePolicy() *ContentTypePolicy {
+	if provider, ok := c.driver.(ClientDriverExtensionContentTypePolicy); ok {
+		return provider.GetContentTypePolicy()
+	}
+
+	return c.server.settings.ContentTypePolicy
+}
+
+// newContentTypeWriter returns a writer detecting the content type of an upload to file, nil if neither the
+// policy nor the file need it
+func (c *clientHandler) newContentTypeWriter(file io.Writer) *contentTypeWriter {
+	policy := c.getContentTypePolicy()
+	receiver, _ := file.(FileTransferContentType)
+
+	// the type of the sent bytes isn't the one of the whole file
+	if c.uploadResumed {
+		receiver = nil
+	}
+
+	if policy == nil && receiver == nil {
+		return nil
+	}
+
+	return &contentTypeWriter{
+		c:        c,
+		writer:   file,
+		policy:   policy,
+		receiver: receiver,
+		head:     make([]byte, 0, contentSniffLength),
+	}
+}
+
+// contentTypeWriter holds back the first bytes of an upload until its content type is detected and allowed
+type contentTypeWriter struct {
+	c        *clientHandler
+	writer   io.Writer
+	policy   *ContentTypePolicy
+	receiver FileTransferContentType
+	head     []byte // first bytes, until the detection
+	detected bool
+}
+
+func (w *contentTypeWriter) Write(p []byte) (int, error) {
+	if w.detected {
+		return w.writer.Write(p)
+	}
+
+	n := copy(w.head[len(w.head):cap(w.head)], p)
+	w.head = w.head[:len(w.head)+n]
+
+	if len(w.head) < contentSniffLength {
+		return len(p), nil
+	}
+
+	if err := w.detect(); err != nil {
+		return 0, err
+	}
+
+	if n == len(p) {
+		return n, nil
+	}
+
+	written, err := w.writer.Write(p[n:])
+
+	return n + written, err
+}
+
+// Close detects the content type of the uploads shorter than the sniffed length
+func (w *contentTypeWriter) Close() error {
+	if w.detected {
+		return nil
+	}
+
+	return w.detect()
+}
+
+// detect checks the content type of the held back bytes, and writes them if it is allowed
+func (w *contentTypeWriter) detect() error {
+	w.detected = true
+
+	contentType := http.DetectContentType(w.head)
+	w.c.uploadContentType = contentType
+
+	if w.policy != nil {
+		if err := w.policy.check(contentType); err != nil {
+			w.c.emitSecurityEvent(SecurityEventContentTypeDenied, err.Error())
+
+			return err
+		}
+	}
+
+	w.c.logger.Info("Upload content type detected", "contentType", contentType)
+
+	if w.receiver != nil {
+		w.receiver.SetContentType(contentType)
+	}
+
+	_, err := w.writer.Write(w.head)
+
+	return err
+}
@@ -0,0 +1,112 @@
+package ftpserver
+
+import (
+	"os"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContentTypePolicy(t *testing.T) {
+	policy := &ContentTypePolicy{Allowed: []string{"text/*", "application/pdf"}, Denied: []string{"text/html"}}
+	require.NoError(t, policy.validate())
+
+	for contentType, allowed := range map[string]bool{
+		"text/plain; charset=utf-8": true,
+		"Application/PDF":           true,
+		"text/html; charset=utf-8":  false,
+		"application/octet-stream":  false,
+	} {
+		err := policy.check(contentType)
+		if allowed {
+			require.NoError(t, err, contentType)
+		} else {
+			require.ErrorIs(t, err, ErrContentNotAllowed, contentType)
+		}
+	}
+
+	require.Error(t, (&ContentTypePolicy{Denied: []string{"text/["}}).validate())
+}
+
+func TestContentTypeUpload(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			ContentTypePolicy:        &ContentTypePolicy{Allowed: []string{"text/plain", "text/xml"}},
+			TransferCompleteTemplate: "Stored {{.ContentType}}",
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("TYPE I")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	// shorter than the sniffed length
+	rc, response = storeRawData(t, raw, "orders.csv", []byte("id,quantity\n1,12\n"))
+	require.Equal(t, StatusClosingDataConn, rc, response)
+	require.Equal(t, "Stored text/plain; charset=utf-8", response)
+
+	// longer than it
+	document := append([]byte(`<?xml version="1.0"?><orders>`), make([]byte, 1024)...)
+	for i := range document[29:] {
+		document[29+i] = ' '
+	}
+
+	rc, response = storeRawData(t, raw, "orders.xml", document)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+	require.Equal(t, "Stored text/xml; charset=utf-8", response)
+
+	content, err := afero.ReadFile(driver.fs, "/orders.xml")
+	require.NoError(t, err)
+	require.Equal(t, document, content)
+
+	// the refused upload is removed whatever the partial upload policy
+	rc, response = storeRawData(t, raw, "orders.html", []byte("<html><body>orders</body></html>"))
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+	require.Contains(t, response, "text/html content isn't allowed")
+
+	_, err = driver.fs.Stat("/orders.html")
+	require.True(t, os.IsNotExist(err), err)
+	require.Contains(t, driver.getSecurityEvents(), SecurityEventContentTypeDenied)
+
+	// a resumed upload is checked from the bytes it sends
+	rc, response, err = raw.SendCommand("REST 17")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response = storeRawData(t, raw, "orders.csv", []byte("2,5\n"))
+	require.Equal(t, StatusClosingDataConn, rc, response)
+	require.Equal(t, "Stored text/plain; charset=utf-8", response)
+
+	// so is an appended one, the data stored before doesn't matter
+	page := []byte("<html><body>orders</body></html>")
+	require.NoError(t, afero.WriteFile(driver.fs, "/page.txt", page, 0600))
+
+	rc, response = sendRawData(t, raw, "APPE page.txt", []byte("3,7\n"))
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	// a refused append doesn't write anything and keeps the file
+	rc, response = sendRawData(t, raw, "APPE page.txt", page)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+
+	content, err = afero.ReadFile(driver.fs, "/page.txt")
+	require.NoError(t, err)
+	require.Equal(t, "<html><body>orders</body></html>3,7\n", string(content))
+}
@@ -0,0 +1,63 @@
+package ftpserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// handlePREHASH creates a file from a content the driver already has, the client sends its digest instead
+// of uploading it: SITE PREHASH <algo> <digest> <file>. The 250 reply means the file was created, with
+// the 350 reply the client has to upload it.
+func (c *clientHandler) handlePREHASH(params string) {
+	args, err := splitParamsValues(params, 3)
+	if err != nil || len(args) != 3 {
+		c.writeMessage(StatusSyntaxErrorParameters, "usage: SITE PREHASH <algo> <digest> <file>")
+
+		return
+	}
+
+	algo, ok := getHashMapping()[strings.ToUpper(args[0])]
+	if !ok {
+		c.writeMessage(StatusNotImplementedParam, fmt.Sprintf("%v: %v", args[0], errUnknowHash))
+
+		return
+	}
+
+	dedup, ok := c.driver.(ClientDriverExtensionDeduplication)
+	if !ok {
+		c.writeMessage(StatusCommandNotImplemented, "This extension hasn't been implemented !")
+
+		return
+	}
+
+	digest := strings.ToLower(args[1])
+
+	found, err := dedup.HasContent(algo, digest)
+	if err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not look up the content: %v", err))
+
+		return
+	}
+
+	if !found {
+		c.writeMessage(StatusFileActionPending, "Unknown content, send the file")
+
+		return
+	}
+
+	// the file is created like an upload would
+	filePath, allowed := c.prepareUpload(c.absPath(args[2]), false)
+	if !allowed {
+		return
+	}
+
+	defer func() { c.ctxUploadPath = "" }()
+
+	if err = dedup.LinkContent(filePath, algo, digest); err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not create the file: %v", err))
+
+		return
+	}
+
+	c.writeMessage(StatusFileOK, fmt.Sprintf("Content already present, %s created", filePath))
+}
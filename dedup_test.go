@@ -0,0 +1,48 @@
+package ftpserver
+
+import (
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPREHASH(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 1024), "file")
+	digest := ftpDownloadAndHash(t, c, "file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, _, err := raw.SendCommand("SITE PREHASH SHA-256 " + digest)
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc)
+
+	rc, _, err = raw.SendCommand("SITE PREHASH BLAKE3 " + digest + " copy")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotImplementedParam, rc)
+
+	rc, response, err := raw.SendCommand("SITE PREHASH SHA-256 0123456789abcdef copy")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand("SITE PREHASH sha-256 " + digest + " copy")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+	require.Equal(t, "Content already present, /copy created", response)
+
+	require.Equal(t, digest, ftpDownloadAndHash(t, c, "copy"))
+}
@@ -0,0 +1,76 @@
+package ftpserver
+
+import (
+	"strings"
+)
+
+// Commands dispatch. It is on the path of every command, so the lookup of the known commands doesn't
+// allocate: the name is uppercased in a buffer on the stack and the compiler doesn't copy the []byte
+// converted to string to index a map.
+
+// commandNameBufferSize is the size of the buffer used to uppercase the commands names, the longer names
+// are uppercased with an allocation
+const commandNameBufferSize = 8
+
+// commandEntry is a command of commandsIndex
+type commandEntry struct {
+	name string
+	desc *CommandDescription
+}
+
+// commandsIndex gives the name of the commands along with their description
+var commandsIndex = newCommandsIndex()
+
+func newCommandsIndex() map[string]commandEntry {
+	index := make(map[string]commandEntry, len(commandsMap))
+
+	for name, desc := range commandsMap {
+		index[name] = commandEntry{name: name, desc: desc}
+	}
+
+	return index
+}
+
+// lookupCommand returns the uppercased name of a command and its description, nil if it is unknown
+func lookupCommand(name string) (string, *CommandDescription) {
+	if len(name) <= commandNameBufferSize {
+		var upper [commandNameBufferSize]byte
+
+		for i := 0; i < len(name); i++ {
+			b := name[i]
+			if 'a' <= b && b <= 'z' {
+				b -= 'a' - 'A'
+			}
+
+			upper[i] = b
+		}
+
+		if entry, ok := commandsIndex[string(upper[:len(name)])]; ok {
+			return entry.name, entry.desc
+		}
+	}
+
+	name = strings.ToUpper(name)
+
+	// Search among commands having a "special semantic". They
+	// should be sent by following the RFC-959 procedure of sending
+	// Telnet IP/Synch sequence (chr 242 and 255) as OOB data but
+	// since many ftp clients don't do it correctly we check the
+	// command suffix.
+	for _, cmd := range specialAttentionCommands {
+		if strings.HasSuffix(name, cmd) {
+			return cmd, commandsMap[cmd]
+		}
+	}
+
+	return name, nil
+}
+
+// parseLine splits a command line into the command name and its parameters
+func parseLine(line string) (string, string) {
+	if idx := strings.IndexByte(line, ' '); idx >= 0 {
+		return line[:idx], line[idx+1:]
+	}
+
+	return line, ""
+}
@@ -0,0 +1,60 @@
+package ftpserver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupCommand(t *testing.T) {
+	for _, name := range []string{"RETR", "retr", "Retr"} {
+		command, desc := lookupCommand(name)
+		require.Equal(t, "RETR", command)
+		require.NotNil(t, desc)
+		require.True(t, desc.TransferRelated)
+	}
+
+	// Telnet IP and Synch before the command
+	command, desc := lookupCommand("\xff\xf4\xffabor")
+	require.Equal(t, "ABOR", command)
+	require.NotNil(t, desc)
+
+	command, desc = lookupCommand("unknown")
+	require.Equal(t, "UNKNOWN", command)
+	require.Nil(t, desc)
+
+	command, desc = lookupCommand("averylongcommand")
+	require.Equal(t, "AVERYLONGCOMMAND", command)
+	require.Nil(t, desc)
+
+	name, param := parseLine("STOR a file")
+	require.Equal(t, "STOR", name)
+	require.Equal(t, "a file", param)
+
+	name, param = parseLine("PWD")
+	require.Equal(t, "PWD", name)
+	require.Empty(t, param)
+}
+
+func TestCommandDispatchAllocations(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		for _, line := range []string{"RETR file", "stor file", "Noop"} {
+			name, _ := parseLine(line)
+			if _, desc := lookupCommand(name); desc == nil {
+				t.Fatal("unknown command", name)
+			}
+		}
+	})
+	require.Zero(t, allocs)
+}
+
+func BenchmarkCommandDispatch(b *testing.B) {
+	lines := []string{"RETR file", "stor file", "Noop", "MLSD /a/directory", "\xff\xf4\xffABOR"}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		name, _ := parseLine(lines[i%len(lines)])
+		lookupCommand(name)
+	}
+}
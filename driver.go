@@ -1,10 +1,12 @@
 package ftpserver // nolint
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
 	"os"
+	"time"
 
 	"github.com/spf13/afero"
 )
@@ -41,6 +43,210 @@ type MainDriverExtensionTLSVerifier interface {
 	VerifyConnection(cc ClientContext, user string, tlsConn *tls.Conn) (ClientDriver, error)
 }
 
+// MainDriverExtensionPassivePortLeaser is an extension that allows an external controller to
+// lease the port advertised in the PASV/EPSV replies at runtime (allocate a NodePort, update a
+// load balancer listener...). If the lease fails or takes more than PassivePortLeaseTimeout
+// seconds, the server falls back to the port it would have advertised without this extension.
+type MainDriverExtensionPassivePortLeaser interface {
+
+	// LeasePassivePort is called once the server listens on listenedPort and before the reply is sent.
+	// exposedPort is the port that would be advertised without this extension. It returns the port
+	// to advertise to the client.
+	LeasePassivePort(cc ClientContext, listenedPort, exposedPort int) (int, error)
+
+	// ReleasePassivePort is called when a successfully leased port isn't needed anymore
+	ReleasePassivePort(cc ClientContext, listenedPort int)
+}
+
+// MainDriverExtensionSessionStore is an extension to publish the state of the sessions to an external
+// store (Redis, a database...). Instances behind a load balancer can then present a unified view of
+// the connected users and enforce the MaxSessionsPerUser setting globally.
+type MainDriverExtensionSessionStore interface {
+
+	// PublishSession is called when the state of a logged in session changes: login, transfer start and end
+	PublishSession(state *SessionState) error
+
+	// UnpublishSession is called when a published session ends
+	UnpublishSession(sessionID string) error
+
+	// CountUserSessions returns the number of published sessions of a user, on all the instances
+	CountUserSessions(user string) (int, error)
+}
+
+// MainDriverExtensionConcurrencyLimiter is an extension to limit the simultaneous logins and transfers,
+// for instance per user. It can be backed by a distributed store (Redis...) to enforce the limits across
+// a fleet of servers. Unlike MaxSessionsPerUser, the slots are acquired atomically by the implementation.
+type MainDriverExtensionConcurrencyLimiter interface {
+
+	// AcquireLogin is called once a user is authenticated. An error refuses the login and disconnects the
+	// client. The release function, if not nil, is called when the session ends.
+	AcquireLogin(cc ClientContext, user string) (release func(), err error)
+
+	// AcquireTransfer is called before a file transfer (STOR, APPE, RETR) starts. An error refuses the
+	// transfer. The release function, if not nil, is called when the transfer ends.
+	AcquireTransfer(cc ClientContext, user string) (release func(), err error)
+}
+
+// SessionState is the state of a logged in session
+type SessionState struct {
+	SessionID  string           // Unique ID of the session, see ClientContext.SessionID
+	User       string           // Authenticated user
+	RemoteAddr string           // Client's address
+	StartTime  time.Time        // Date of connection
+	Location   *GeoLocation     // Location of the client, nil if unknown
+	Transfer   *SessionTransfer // Current transfer, nil if there is none
+}
+
+// SessionTransfer describes the current transfer of a session
+type SessionTransfer struct {
+	Command   string    // Transfer command (STOR, APPE or RETR)
+	Path      string    // Path of the transferred file
+	StartTime time.Time // Date of the transfer start
+}
+
+// MainDriverExtensionUnknownCommandHandler is an extension to handle the commands the server doesn't know.
+// It can be used to log what exotic clients send or to implement custom commands.
+type MainDriverExtensionUnknownCommandHandler interface {
+
+	// HandleUnknownCommand returns the reply to send. If handled is false, the command is treated
+	// as unknown: the default reply is sent and it counts for MaxUnknownCommands.
+	HandleUnknownCommand(cc ClientContext, command, param string) (code int, message string, handled bool)
+}
+
+// MainDriverExtensionPanicHandler is an extension to be notified of the panics of the drivers. The panics
+// are recovered: a command failing this way gets a 451 reply and the server keeps running.
+type MainDriverExtensionPanicHandler interface {
+
+	// PanicRecovered is called with the command (or the driver method for the calls outside of the commands)
+	// during which the panic happened, the value given to panic and the stack trace
+	PanicRecovered(cc ClientContext, call string, value interface{}, stack []byte)
+}
+
+// MainDriverExtensionListenerMonitor is an extension to be notified when the listener fails and the server
+// re-creates it (see ListenerRecreateAttempts)
+type MainDriverExtensionListenerMonitor interface {
+
+	// ListenerRecreated is called after each attempt to re-create the listener that failed with cause,
+	// err is the error of the attempt, nil if the listener was re-created
+	ListenerRecreated(cause error, attempt int, err error)
+}
+
+// MainDriverExtensionTransferTLSConfig is an extension to use a different TLS config for the transfer
+// connections than for the control connection, with other curves or session tickets settings for example
+type MainDriverExtensionTransferTLSConfig interface {
+
+	// GetTransferTLSConfig returns the TLS config of the protected transfer connections (PROT P)
+	GetTransferTLSConfig(cc ClientContext) (*tls.Config, error)
+}
+
+// MainDriverExtensionTLSServerName is an extension to serve several domains with distinct certificates: the
+// TLS config of the implicit FTPS and AUTH TLS connections is selected from the server name (SNI) the client
+// sends. The default transfer connections use it too.
+type MainDriverExtensionTLSServerName interface {
+
+	// GetTLSConfigForServerName returns the TLS config of a server name, empty if the client didn't send any.
+	// A nil config keeps the one of GetTLSConfig, an error aborts the handshake. The NextProtos of the returned
+	// config ("ftp" for example) are the protocols negotiated with ALPN.
+	GetTLSConfigForServerName(serverName string) (*tls.Config, error)
+}
+
+// MainDriverExtensionLazyDriver is an extension to create the driver of a session at its first file system
+// command instead of at login, the sessions that only check the credentials or do nothing then cost less
+type MainDriverExtensionLazyDriver interface {
+
+	// AuthUserLazily replaces AuthUser, it authenticates the user and returns the factory of its driver
+	AuthUserLazily(cc ClientContext, user, pass string) (ClientDriverFactory, error)
+}
+
+// MainDriverExtensionPasswordChange is an extension to let the users change their password with SITE PSWD,
+// it is required by the logins whose password expired (see ErrPasswordExpired)
+type MainDriverExtensionPasswordChange interface {
+
+	// ChangePassword checks the old password of the user and replaces it
+	ChangePassword(cc ClientContext, user, oldPassword, newPassword string) error
+}
+
+// MainDriverExtensionVirtualEntries is an extension to add synthetic files and directories to the
+// listings, a README.txt or a shared folder for example. The files are served from memory by RETR, the
+// virtual entries can't be modified.
+type MainDriverExtensionVirtualEntries interface {
+
+	// GetVirtualEntries returns the virtual entries of a directory. It is called for each listing and
+	// each file lookup, it must be fast.
+	GetVirtualEntries(cc ClientContext, dirPath string) []VirtualEntry
+}
+
+// MainDriverExtensionLifecycle is an extension to follow the sessions through their lifecycle (see LifecycleState)
+type MainDriverExtensionLifecycle interface {
+
+	// SessionStateChanged is called synchronously after each transition, in the order of the transitions. It
+	// shouldn't block nor change the state of the session.
+	SessionStateChanged(cc ClientContext, from, to LifecycleState)
+}
+
+// MainDriverExtensionSecurityEvents is an extension to be notified of the security policy violations of the
+// sessions, like TLS downgrades, so that they can be alerted on without scraping the logs
+type MainDriverExtensionSecurityEvents interface {
+
+	// SecurityEvent is called synchronously for each event, it shouldn't block
+	SecurityEvent(cc ClientContext, event SecurityEvent)
+}
+
+// MainDriverExtensionPermissionChecker is an extension to express the access control policies in one place
+// instead of inside each driver method. It is consulted before the operations modifying the files.
+type MainDriverExtensionPermissionChecker interface {
+
+	// CheckPermission is called before user applies verb to path. The verbs are STOR, APPE, DELE, MKD, RMD,
+	// RNFR, RNTO (with the destination path), MFMT, COMB (and DELE for each combined part), SITE CHMOD, SITE
+	// CHOWN, SITE SYMLINK and SITE LINK (with the link path), SITE MKDIR and SITE RMDIR. SITE EXTRACT checks
+	// STOR for each extracted file and MKD for each created directory. An error denies the operation, the
+	// client gets a 550 reply.
+	CheckPermission(cc ClientContext, user, verb, path string) error
+}
+
+// MainDriverExtensionGeoLocator is an extension to locate the clients, with a GeoIP database the integrator
+// supplies. The location is added to the logs of the session and to its published state, it is counted by
+// FtpServer.CountryCounters and it is checked against the AllowedCountries and DeniedCountries settings.
+type MainDriverExtensionGeoLocator interface {
+
+	// LocateClient is called when a client connects, before ClientConnected. A nil location or an error
+	// leave the client unlocated: its country is unknown.
+	LocateClient(cc ClientContext, ip net.IP) (*GeoLocation, error)
+}
+
+// MainDriverExtensionReputation is an extension to check the IP of the clients against DNS blocklists (see
+// DNSBL) or an internal reputation service when they connect. The banner is delayed until the check answers,
+// for at most ReputationCheckTimeout milliseconds: the flagged clients get a 421 reply and are disconnected.
+type MainDriverExtensionReputation interface {
+
+	// CheckReputation tells if the IP is flagged. The context is canceled once the time budget is elapsed, the
+	// client is accepted then, as when an error is returned.
+	CheckReputation(ctx context.Context, ip net.IP) (flagged bool, err error)
+}
+
+// MainDriverExtensionSecurityMechanism is an extension to support RFC 2228 security mechanisms other than TLS
+// (GSSAPI for example): AUTH with another mechanism starts a security data exchange (ADAT), the MIC, CONF and
+// ENC commands and their replies are then protected by the SecurityContext.
+type MainDriverExtensionSecurityMechanism interface {
+
+	// NewSecurityContext starts the security data exchange of a mechanism, it returns nil if the mechanism
+	// isn't supported
+	NewSecurityContext(cc ClientContext, mechanism string) (SecurityContext, error)
+}
+
+// MainDriverExtensionReplyFilter is an extension to rewrite or suppress the replies before they are sent, to
+// translate the messages, scrub some data or add a compliance notice for example. The plain text lines of the
+// STAT and MLST listings aren't filtered, their first and last lines can't be suppressed.
+type MainDriverExtensionReplyFilter interface {
+
+	// FilterReply is called for each line of a reply, without its code. It returns the text to send, its line
+	// breaks split it into several lines of the same kind (with the code or plain text like the FEAT ones).
+	// The line is suppressed if send is false, the reply is suppressed with all its lines: the client might
+	// then wait for it, which is only safe for informational replies. FilterReply must not call
+	// ClientContext.SendReply.
+	FilterReply(cc ClientContext, code int, message string) (filtered string, send bool)
+}
+
 // ClientDriver is the base FS implementation that allows to manipulate files
 type ClientDriver interface {
 	afero.Fs
@@ -67,9 +273,28 @@ type ClientDriverExtensionSymlink interface {
 
 	// Symlink creates a symlink
 	Symlink(oldname, newname string) error
+}
+
+// ClientDriverExtensionLink is an extension to support the "SITE LINK" - hard link creation - command
+type ClientDriverExtensionLink interface {
+
+	// Link creates a hard link
+	Link(oldname, newname string) error
+}
+
+// ClientDriverExtensionLstat is an extension to STAT the symbolic links themselves instead of their targets
+type ClientDriverExtensionLstat interface {
 
-	// SymlinkIfPossible allows to get the source of a symlink (but we don't need for now)
-	// ReadlinkIfPossible(name string) (string, error)
+	// Lstat returns the information of a file, without following it if it's a symbolic link
+	Lstat(name string) (os.FileInfo, error)
+}
+
+// ClientDriverExtensionReadLink is an extension to show the target of the symbolic links in the listings:
+// "-> target" in LIST and STAT, "Type=OS.unix=slink:target" in MLSD and MLST
+type ClientDriverExtensionReadLink interface {
+
+	// ReadLink returns the target of a symbolic link
+	ReadLink(name string) (string, error)
 }
 
 // ClientDriverExtensionFileList is a convenience extension to allow to return file listing
@@ -93,6 +318,16 @@ type ClientDriverExtentionFileTransfer interface {
 	GetHandle(name string, flags int, offset int64) (FileTransfer, error)
 }
 
+// ClientDriverExtensionConditionalTransfer is an extension to check the version required with SITE IFMATCH
+// when opening the file of a RETR, an object store can do a conditional ranged GET for example. Without it,
+// the version given by FileInfoVersion is compared before opening the file.
+type ClientDriverExtensionConditionalTransfer interface {
+
+	// GetHandleIfMatch is GetHandle for a file that must have the version, it returns ErrVersionMismatch
+	// if it doesn't
+	GetHandleIfMatch(name string, flags int, offset int64, version string) (FileTransfer, error)
+}
+
 // ClientDriverExtensionRemoveDir is an extension to implement if you need to distinguish
 // between the FTP command DELE (remove a file) and RMD (remove a dir). If you don't
 // implement this extension they will be both mapped to the Remove method defined in your
@@ -107,12 +342,136 @@ type ClientDriverExtensionHasher interface {
 	ComputeHash(name string, algo HASHAlgo, startOffset, endOffset int64) (string, error)
 }
 
+// ClientDriverExtensionHashFacts is an extension to implement if you can provide precomputed file digests.
+// They are added as facts (x.crc32, x.md5, x.sha1, x.sha256, x.sha512) to the MLST/MLSD output so that
+// clients can skip unchanged files without issuing HASH commands. You have to set EnableHASH to true for
+// this extension to be called
+type ClientDriverExtensionHashFacts interface {
+	// GetHashFacts returns the already known digests of a file, it should not compute them
+	GetHashFacts(name string) (map[HASHAlgo]string, error)
+}
+
+// ClientDriverExtensionOverwriteRename is an extension to implement if you can atomically replace an
+// existing file when renaming. It is only used with the RenameOverwriteReplace policy
+type ClientDriverExtensionOverwriteRename interface {
+	// OverwriteRename renames oldname to newname, replacing newname if it exists
+	OverwriteRename(oldname, newname string) error
+}
+
+// ClientDriverExtensionStatBatch is an extension to implement if you can get the info of several files
+// in one call. It is used to coalesce the bursts of SIZE/MDTM/MLST commands some clients send.
+type ClientDriverExtensionStatBatch interface {
+	// StatBatch returns the info of the files it could get, the missing ones are looked up with Stat
+	StatBatch(names []string) (map[string]os.FileInfo, error)
+}
+
+// ClientDriverExtensionPartialUpload is an extension to decide what happens to the file of a failed
+// upload (STOR without restart offset), instead of applying the PartialUploadPolicy setting. The uploads
+// refused with ErrContentNotAllowed or failing with ErrUploadDigestMismatch are always deleted.
+type ClientDriverExtensionPartialUpload interface {
+
+	// GetPartialUploadPolicy returns the policy to apply. The cause is ErrTransferAborted if the
+	// client aborted the transfer, the transfer or file error otherwise.
+	GetPartialUploadPolicy(name string, cause error) PartialUploadPolicy
+}
+
+// ClientDriverExtensionFilenamePolicy is an extension to apply a filename policy per user
+type ClientDriverExtensionFilenamePolicy interface {
+
+	// GetFilenamePolicy returns the policy of the user, it replaces the one of the settings. nil disables it
+	GetFilenamePolicy() *FilenamePolicy
+}
+
+// ClientDriverExtensionContentTypePolicy is an extension to apply a content type policy per user, an EDI
+// account only allowed to upload CSV and XML files for example
+type ClientDriverExtensionContentTypePolicy interface {
+
+	// GetContentTypePolicy returns the policy of the user, it replaces the one of the settings. nil disables it
+	GetContentTypePolicy() *ContentTypePolicy
+}
+
+// ClientDriverExtensionDuplicateSessions is an extension to apply a duplicate session policy per user
+type ClientDriverExtensionDuplicateSessions interface {
+
+	// GetDuplicateSessionPolicy returns the policy of the user, it replaces the DuplicateSessionPolicy setting
+	GetDuplicateSessionPolicy() DuplicateSessionPolicy
+}
+
+// ClientDriverExtensionLoginMessage is an extension to send a message of the day to the user once logged in
+type ClientDriverExtensionLoginMessage interface {
+
+	// GetLoginMessage returns the message (quota status, password expiry warning...) added to the 230 reply of the
+	// login, its line breaks split it into several lines. Nothing is added if it is empty.
+	GetLoginMessage() string
+}
+
+// ClientDriverExtensionMissingDirectories is an extension to enable the creation of the missing directories
+// of the uploads per user
+type ClientDriverExtensionMissingDirectories interface {
+
+	// CreateMissingDirectories replaces the CreateMissingDirectories setting for the user
+	CreateMissingDirectories() bool
+}
+
+// ClientDriverExtensionVersioning is an extension to keep the previous versions of the files replaced by the
+// uploads in a driver specific way (see VersionRetention)
+type ClientDriverExtensionVersioning interface {
+
+	// SnapshotVersion is called before an upload replaces a file, it should keep at most retention versions.
+	// An error refuses the upload.
+	SnapshotVersion(name string, retention int) error
+}
+
+// ClientDriverExtensionTransferQuota is an extension to give the users their own monthly transfer quota
+// (see TransferQuota)
+type ClientDriverExtensionTransferQuota interface {
+
+	// GetTransferQuota returns the bytes the user can transfer per calendar month, 0 for unlimited
+	GetTransferQuota() int64
+}
+
+// ClientDriverExtensionTransferWeight is an extension to give the users of some classes a bigger part of
+// TransferBandwidth
+type ClientDriverExtensionTransferWeight interface {
+
+	// GetTransferWeight returns the weight of the user, the users transferring files share the bandwidth in
+	// proportion of their weights. The weights lower than 1 are taken as 1
+	GetTransferWeight() int
+}
+
+// ClientDriverExtensionBandwidthSchedule is an extension to limit the bandwidth of the users of some classes,
+// by time of day. The users get the lowest of this limit and of their part of TransferBandwidth
+type ClientDriverExtensionBandwidthSchedule interface {
+
+	// GetBandwidthSchedule returns the bandwidth schedule of the user, nil for none
+	GetBandwidthSchedule() *BandwidthSchedule
+}
+
+// ClientDriverExtensionDeduplication is an extension to support the "SITE PREHASH" command: the clients
+// send the digest of a file before uploading it and don't upload the contents the driver already has.
+// The file is created like an upload (STOR permission, filename policy, versioning...).
+type ClientDriverExtensionDeduplication interface {
+
+	// HasContent tells if the driver has a content with this digest
+	HasContent(algo HASHAlgo, digest string) (bool, error)
+
+	// LinkContent creates name with the content having this digest, by linking or copying it
+	LinkContent(name string, algo HASHAlgo, digest string) error
+}
+
 // ClientDriverExtensionAvailableSpace is an extension to implement to support
 // the AVBL ftp command
 type ClientDriverExtensionAvailableSpace interface {
 	GetAvailableSpace(dirName string) (int64, error)
 }
 
+// ClientDriverExtensionFXP is an extension to implement to allow site-to-site (FXP) transfers for the
+// authenticated user. When it returns true, the data connection checks defined in the settings are
+// bypassed: PORT/EPRT can target third-party hosts and passive connections can come from other hosts.
+type ClientDriverExtensionFXP interface {
+	IsFXPAllowed() bool
+}
+
 // ClientContext is implemented on the server side to provide some access to few data around the client
 type ClientContext interface {
 	// Path provides the path of the current connection
@@ -124,9 +483,17 @@ type ClientContext interface {
 	// Debug returns the current debugging status of this connection commands
 	Debug() bool
 
+	// SetTrace writes the protocol trace of this connection to w, with the credentials masked. The writer
+	// is closed when the trace is stopped if it is an io.Closer. A nil writer stops the trace. The traces can
+	// be replayed against another server with ParseTrace and Replay.
+	SetTrace(w io.Writer)
+
 	// Client's ID on the server
 	ID() uint32
 
+	// SessionID returns an ID unique across all the server instances, to identify the session in external stores
+	SessionID() string
+
 	// Client's address
 	RemoteAddr() net.Addr
 
@@ -147,6 +514,46 @@ type ClientContext interface {
 
 	// GetLastCommand returns the last received command
 	GetLastCommand() string
+
+	// GetTLSControlState returns the negotiated TLS parameters of the control connection,
+	// nil if the control connection isn't over TLS
+	GetTLSControlState() *tls.ConnectionState
+
+	// GetTLSTransferState returns the negotiated TLS parameters of the last transfer connection,
+	// nil if it wasn't over TLS
+	GetTLSTransferState() *tls.ConnectionState
+
+	// GetResources returns the goroutines, open files and data listeners in use by the session
+	GetResources() ResourceCounters
+
+	// GetFileOpenDeadline returns the time before which the driver should return the file it is opening
+	// for a transfer (see FileOpenTimeout), zero if there is none
+	GetFileOpenDeadline() time.Time
+
+	// SetAccessSchedule restricts the times at which the user can be connected, it is meant to be called
+	// by MainDriver.AuthUser. A nil schedule removes the restriction.
+	SetAccessSchedule(schedule *AccessSchedule)
+
+	// SetMaxSessionDuration changes the time the user can stay logged in (see MaxSessionDuration), it is
+	// meant to be called by MainDriver.AuthUser. 0 means unlimited.
+	SetMaxSessionDuration(duration time.Duration)
+
+	// SetDriverFactory replaces the driver of the session, for a tenant switch for example. The factory is
+	// called at the next command needing a driver.
+	SetDriverFactory(factory ClientDriverFactory)
+
+	// GetGeoLocation returns the location of the client given by MainDriverExtensionGeoLocator, nil if unknown
+	GetGeoLocation() *GeoLocation
+
+	// GetLifecycleState returns the current state of the session
+	GetLifecycleState() LifecycleState
+
+	// GetCloseReason returns why the session ended, it can be called from MainDriver.ClientDisconnected
+	GetCloseReason() CloseReason
+
+	// SendReply sends a reply on the control connection (see Reply). It must be called by the driver while
+	// a command is handled, for a preliminary (1xx) reply or the informational lines of a custom command.
+	SendReply(reply *Reply) error
 }
 
 // FileTransfer defines the inferface for file transfers.
@@ -162,16 +569,77 @@ type FileTransferError interface {
 	TransferError(err error)
 }
 
+// FileTransferContentType is a FileTransfer extension to get the content type of the uploads, detected from
+// their first bytes (an object store can keep it as the type of the object). It is called before these bytes
+// are written, but not for the appended and resumed uploads.
+type FileTransferContentType interface {
+	SetContentType(contentType string)
+}
+
+// FileTransferSync is a FileTransfer extension used to flush the written data to a durable storage.
+// It is called at the end of the uploads if the SyncUploads setting is enabled, afero files implement it.
+type FileTransferSync interface {
+	Sync() error
+}
+
+// FileInfoVersion is an optional interface the os.FileInfo returned by the driver can implement to provide
+// the version of the content of a file (an object store ETag for example). It is given as the x.etag fact
+// of the MLST/MLSD output, the clients can require it for a RETR with SITE IFMATCH.
+type FileInfoVersion interface {
+	Version() string // Version of the content of the file, empty if unknown
+}
+
+// FileInfoOwnership is an optional interface the os.FileInfo returned by the driver can implement to
+// provide the owner and group names of a file. They are used in the LIST output and as the unix.owner
+// and unix.group facts of the MLST/MLSD output.
+type FileInfoOwnership interface {
+	Owner() string // Owner name of the file, empty if unknown
+	Group() string // Group name of the file, empty if unknown
+}
+
+// FileInfoExtended is an optional interface the os.FileInfo returned by the driver can implement to provide
+// the metadata os.FileInfo can't carry, for the drivers on top of object stores or databases. The creation
+// time is the Create fact of the MLST/MLSD output, the link target is used instead of
+// ClientDriverExtensionReadLink and the custom facts are added to the MLST/MLSD output.
+type FileInfoExtended interface {
+	FileInfoOwnership
+
+	CreationTime() time.Time // Creation time of the file, zero if unknown
+	LinkTarget() string      // Target of a symbolic link, empty if it isn't one or if it is unknown
+
+	// Facts returns custom MLST/MLSD facts, prefixed by "x." by convention. They can't replace the facts of the
+	// server and they are sent in the order of their names.
+	Facts() map[string]string
+}
+
 // PortRange is a range of ports
 type PortRange struct {
 	Start int // Range start
 	End   int // Range end
 }
 
+// PortMapping maps the ports the server listens on for passive connections to the ports
+// advertised to the clients. This is required when the server runs behind a NAT or in a
+// container with port translation (Docker, Kubernetes...). The advertised IP address is
+// still defined by PublicHost or PublicIPResolver.
+type PortMapping struct {
+	ExposedStart  int // First port advertised to the clients
+	ListenedStart int // First port the server actually listens on
+	NbPorts       int // Number of mapped ports
+}
+
 // PublicIPResolver takes a ClientContext for a connection and returns the public IP
 // to use in the response to the PASV command, or an error if a public IP cannot be determined.
 type PublicIPResolver func(ClientContext) (string, error)
 
+// PassiveIPRule defines the passive IP advertised to the clients of a network. A multi-homed server can give
+// its private IP to the internal clients and its public IP to the others. The clients matching no rule get
+// PublicHost, or the IP given by PublicIPResolver which can implement any other routing.
+type PassiveIPRule struct {
+	Network string // Network of the clients, as a CIDR or an IP
+	IP      string // Passive IP advertised to them
+}
+
 // TLSRequirement is the enumerable that represents the supported TLS mode
 type TLSRequirement int
 
@@ -182,6 +650,100 @@ const (
 	ImplicitEncryption
 )
 
+// DataConnectionRequirement is the enumerable that represents the checks applied to data connections
+type DataConnectionRequirement int
+
+// Data connection checks
+const (
+	// IPMatchDisabled doesn't check the peer address of data connections
+	IPMatchDisabled DataConnectionRequirement = iota
+	// IPMatchRequired requires the data connection peer IP to match the control connection one
+	IPMatchRequired
+)
+
+// RenameOverwritePolicy is the enumerable that represents how RNTO handles existing targets
+type RenameOverwritePolicy int
+
+// Rename overwrite policies
+const (
+	// RenameOverwriteDriver lets the driver's Rename decide what to do with an existing target
+	RenameOverwriteDriver RenameOverwritePolicy = iota
+	// RenameOverwriteReplace replaces an existing target, atomically if the driver implements
+	// ClientDriverExtensionOverwriteRename, by removing it before the rename otherwise
+	RenameOverwriteReplace
+	// RenameOverwriteReject rejects the rename with a 553 reply if the target already exists
+	RenameOverwriteReject
+)
+
+// PASVOverIPv6Policy is the enumerable that represents how PASV is handled for the clients connected over IPv6
+type PASVOverIPv6Policy int
+
+// PASV over IPv6 policies
+const (
+	// PASVOverIPv6PublicIPv4 advertises the IPv4 address given by PublicHost or PublicIPResolver,
+	// it refuses the command if there is none
+	PASVOverIPv6PublicIPv4 PASVOverIPv6Policy = iota
+	// PASVOverIPv6EPSV replies like to EPSV (229), for clients that can parse both replies
+	PASVOverIPv6EPSV
+	// PASVOverIPv6Refuse always refuses the command, the client has to use EPSV
+	PASVOverIPv6Refuse
+)
+
+// PartialUploadPolicy is the enumerable that represents what happens to the file of a failed upload
+type PartialUploadPolicy int
+
+// Partial upload policies
+const (
+	// PartialUploadKeep keeps the partial file, clients can resume the upload with REST
+	PartialUploadKeep PartialUploadPolicy = iota
+	// PartialUploadDelete deletes the partial file
+	PartialUploadDelete
+	// PartialUploadRename renames the partial file by appending PartialUploadSuffix to its name
+	PartialUploadRename
+)
+
+// SessionExpiryPolicy is the enumerable that represents what happens to the sessions reaching their
+// MaxSessionDuration
+type SessionExpiryPolicy int
+
+// Session expiry policies
+const (
+	// SessionExpiryDisconnect sends a 421 reply and closes the connection
+	SessionExpiryDisconnect SessionExpiryPolicy = iota
+	// SessionExpiryRelogin logs the user out, the client has to log in again (USER, PASS) to continue
+	SessionExpiryRelogin
+)
+
+// TransferPipeliningPolicy is the enumerable that represents how the data connection commands received
+// during a transfer are handled
+type TransferPipeliningPolicy int
+
+// Transfer pipelining policies
+const (
+	// TransferPipeliningQueue executes the commands once the transfer is complete, like all the other commands
+	TransferPipeliningQueue TransferPipeliningPolicy = iota
+	// TransferPipeliningReject refuses the data connection commands (PASV, EPSV, PORT, EPRT, REST and the
+	// transfer commands) with a 450 reply, the client can retry them once the transfer is complete
+	TransferPipeliningReject
+)
+
+// ReplyFlushPolicy is the enumerable that represents when the replies lines are sent to the client
+type ReplyFlushPolicy int
+
+// Reply flush policies
+const (
+	// ReplyFlushPerReply sends all the lines of a reply at once
+	ReplyFlushPerReply ReplyFlushPolicy = iota
+	// ReplyFlushPerLine sends each line of a reply as soon as it is written
+	ReplyFlushPerLine
+)
+
+// DataConnectionPolicy defines how a command gets its data connection
+type DataConnectionPolicy struct {
+	Timeout  int  // Maximum time in seconds to wait for the data connection (ConnectionTimeout by default)
+	FailFast bool // In passive mode, fail if the client didn't connect to the passive port before the command
+}
+
 // Settings defines all the server settings
 // nolint: maligned
 type Settings struct {
@@ -189,15 +751,21 @@ type Settings struct {
 	ListenAddr               string           // Listening address
 	PublicHost               string           // Public IP to expose (only an IP address is accepted at this stage)
 	PublicIPResolver         PublicIPResolver // (Optional) To fetch a public IP lookup
+	PassiveIPRules           []PassiveIPRule  // (Optional) Passive IP per client network, the first matching rule wins
 	PassiveTransferPortRange *PortRange       // (Optional) Port Range for data connections. Random if not specified
+	PassivePortMapping       *PortMapping     // (Optional) NAT port mapping for data connections
+	PassivePortLeaseTimeout  int              // Maximum time in seconds to wait for a passive port lease (5 by default)
 	ActiveTransferPortNon20  bool             // Do not impose the port 20 for active data transfer (#88, RFC 1579)
-	IdleTimeout              int              // Maximum inactivity time before disconnecting (#58)
+	IdleTimeout              int              // Maximum inactivity time before disconnecting (#58), negative to disable
 	ConnectionTimeout        int              // Maximum time to establish passive or active transfer connections
 	DisableMLSD              bool             // Disable MLSD support
 	DisableMLST              bool             // Disable MLST support
+	EnableListingRestart     bool             // Skip the REST offset of the LIST, NLST and MLSD output instead of 501
+	MLSxFactsOrder           []string         // (Optional) Order of the MLSD/MLST facts, the others come after
 	DisableMFMT              bool             // Disable MFMT support (modify file mtime)
 	Banner                   string           // Banner to use in server status response
 	TLSRequired              TLSRequirement   // defines the TLS mode
+	TLSHandshakeTimeout      int              // Maximum time in seconds of the control TLS handshakes (10 by default)
 	DisableLISTArgs          bool             // Disable ls like options (-a,-la etc.) for directory listing
 	DisableSite              bool             // Disable SITE command
 	DisableActiveMode        bool             // Disable Active FTP
@@ -206,4 +774,249 @@ type Settings struct {
 	DisableSYST              bool             // Disable SYST
 	EnableCOMB               bool             // Enable COMB support
 	DefaultTransferType      TransferType     // Transfer type to use if the client don't send the TYPE command
+
+	// PASV only supports IPv4 addresses, this defines how to reply to it for the clients connected over IPv6
+	PASVOverIPv6 PASVOverIPv6Policy
+
+	// Uploads durability: sync the files with FileTransferSync before replying 226 to STOR/APPE. The
+	// uploads of the files not implementing it fail, as the reply couldn't guarantee their durability.
+	SyncUploads bool
+
+	// Block mode: MODE B support, for the mainframe clients refusing the stream mode for large files. The
+	// binary downloads get a restart marker every BlockRestartMarkerInterval bytes (none if 0), the
+	// markers are byte offsets that can be given to REST
+	EnableBlockMode            bool
+	BlockRestartMarkerInterval int64
+
+	// Parallel transfers: MODE E support, a transfer uses up to MaxParallelStreams passive connections as
+	// negotiated with "OPTS RETR Parallelism=<n>,<n>,<n>;". 0 disables it
+	MaxParallelStreams int
+
+	// Upload trailers: "OPTS STOR TRAILER <algo>" support, the data of the uploads then ends with its digest,
+	// checked before replying 226. A mismatch fails the upload with ErrUploadDigestMismatch, its file is deleted
+	// (renamed with PartialUploadSuffix for an append or a resume)
+	EnableUploadTrailer bool
+
+	// Directory archives: "SITE DOWNLOAD-ARCHIVE <tar|zip> <dir>" support, the directory and its subdirectories
+	// are sent as an archive built on the fly. The archives whose files exceed MaxArchiveSize bytes are
+	// refused before the transfer (no limit if 0)
+	EnableDownloadArchive bool
+	MaxArchiveSize        int64
+
+	// Archives extraction: "SITE EXTRACT <archive> [dir]" support, for the zip, tar and gzipped tar files. The
+	// extraction stops at the first entry larger than MaxExtractEntrySize bytes (1 GiB by default) or beyond
+	// MaxExtractEntries entries (10000 by default), no limit if negative. The entries already extracted are kept
+	EnableExtract       bool
+	MaxExtractEntrySize int64
+	MaxExtractEntries   int
+
+	// Append-only directories: their files, and the files of their subdirectories, can't be deleted, renamed
+	// or replaced, new files can be created and appended to. AppendOnlyOverwrite defines what happens to the
+	// uploads replacing a file
+	AppendOnlyPaths     []string
+	AppendOnlyOverwrite AppendOnlyOverwritePolicy
+
+	// Versioning: before an upload (STOR) replaces a file, once its data connection is opened, the file is kept
+	// as its version 1 ("file.txt;1"), the previous ones being shifted. ClientDriverExtensionVersioning can do
+	// it instead. 0 disables it
+	VersionRetention int // Maximum number of previous versions kept per file
+
+	// Uploads to a missing directory create it, and its missing parents, instead of failing. The permission
+	// checker gets a MKD verb for it. ClientDriverExtensionMissingDirectories can enable it per user
+	CreateMissingDirectories bool
+
+	// Names of the created files and directories, ClientDriverExtensionFilenamePolicy can override it per user
+	FilenamePolicy *FilenamePolicy
+
+	// Content types of the uploads, ClientDriverExtensionContentTypePolicy can override it per user
+	ContentTypePolicy *ContentTypePolicy
+
+	// Bulk delete: SITE MDEL deletes the files matching a pattern, this makes DELE accept patterns too.
+	// Only the last element of the path can have wildcards, the quoted names are never patterns
+	EnableDELEWildcards bool
+
+	// Failed uploads: what happens to the file of an aborted or failed STOR (APPE and resumed uploads
+	// are only cleaned up on a digest mismatch, the file has data the client didn't send in this upload)
+	PartialUploadPolicy PartialUploadPolicy // Keep, delete or rename the partial file
+	PartialUploadSuffix string              // Suffix of the renamed partial files (".part" by default)
+
+	// Temporary upload files: clients uploading to a temporary name before renaming it to the final one
+	// can have these files hidden from the listings (LIST, NLST, MLSD) and refused to RETR, so that the
+	// pollers of the directories never pick up incomplete files
+	HideTempUploads    bool     // Hide the temporary upload files
+	TempUploadSuffixes []string // Suffixes of the temporary upload files (PartialUploadSuffix by default)
+
+	// A session has at most one transfer at a time, this defines how the data connection commands
+	// received during a transfer are handled
+	TransferPipelining TransferPipeliningPolicy
+
+	// Data connections waiting policies per command (LIST, MLSD, NLST, RETR, STOR, APPE)
+	DataConnectionPolicies map[string]DataConnectionPolicy
+
+	// Control connection input validation
+	MaxCommandLength int // Maximum command line length in bytes, longer lines disconnect the client (4096 by default)
+	MaxPathLength    int // Maximum length in bytes of the commands parameters, which are mostly paths (4096 by default)
+
+	// Directory listings are kept for this time in seconds to answer the SIZE/MDTM/MLST commands on their
+	// entries without calling the driver. Any command that can modify a file clears it. 0 disables it
+	ListingCacheTTL int
+
+	// Directory listings limits (LIST, NLST, MLSD), so that a huge directory can't exhaust the server memory:
+	// at most MaxListingEntries entries are read from the driver (the ClientDriverExtensionFileList drivers
+	// still return all of them) and MaxListingBytes bytes are sent. Beyond them the listing fails with a 452
+	// reply, or is truncated with TruncateListings, the 226 reply telling it. 0 disables a limit
+	MaxListingEntries int
+	MaxListingBytes   int64
+	TruncateListings  bool
+
+	// Commands rate limiting, per session, clients exceeding it are disconnected with a 421 reply
+	CommandRateLimit int // Maximum number of commands per second, 0 disables the rate limiting
+	CommandRateBurst int // Maximum number of commands in a burst (CommandRateLimit by default)
+
+	// Clients compatibility: the quirks of the first profile matching a client are applied to its session
+	ClientProfiles []ClientProfile
+
+	// Transfer accounting: the bytes and files transferred by the users are recorded in TransferAccounting
+	// (NewMemoryAccounting or an external store). Once a user transferred TransferQuota bytes in the current
+	// calendar month (UTC), its transfers are refused with a 552 reply. ClientDriverExtensionTransferQuota
+	// can override it per user, 0 disables it. A transfer started below the quota isn't interrupted.
+	TransferAccounting TransferAccounting
+	TransferQuota      int64
+
+	// Bandwidth sharing: the transfers of all the sessions share TransferBandwidth bytes per second, 0 for
+	// unlimited. It is divided between the users transferring files in proportion of their weight (1 unless
+	// ClientDriverExtensionTransferWeight gives another one), then between their transfers: a user with
+	// many parallel connections can't starve the others. TransferBandwidthSchedule overrides it to change
+	// it by time of day, FtpServer.SetTransferBandwidthSchedule replaces it at runtime.
+	// ClientDriverExtensionBandwidthSchedule can limit the bandwidth of the users of some classes too
+	TransferBandwidth         int64
+	TransferBandwidthSchedule *BandwidthSchedule
+
+	// Sessions lifetime: the logins end MaxSessionDuration seconds after they are accepted, once the current
+	// transfer is over, 0 disables it. ClientContext.SetMaxSessionDuration can change it per user.
+	// SessionExpiry defines what happens then
+	MaxSessionDuration int
+	SessionExpiry      SessionExpiryPolicy
+
+	// Idle sessions: the clients are warned with a 421 reply IdleWarning seconds before being disconnected
+	// for inactivity (IdleTimeout), 0 disables the warning. With IdleTimeoutIgnoresNOOP, NOOP isn't an
+	// activity outside of the transfers: the clients sending it forever to stay connected are disconnected too
+	IdleWarning            int
+	IdleTimeoutIgnoresNOOP bool
+
+	// Transfer statistics: TransferCompleteTemplate formats the 226 reply of the file transfers with a
+	// TransferStats, QuitTemplate formats the QUIT reply with a SessionStats. They are text/template
+	// templates, like "Transfer complete. {{.Size}} in {{.Seconds}}, {{.Rate}}". The default replies are
+	// sent if they are empty
+	TransferCompleteTemplate string
+	QuitTemplate             string
+
+	// Access log: each command is written to AccessLog in the W3C extended log format, with its reply code,
+	// the transferred bytes and its duration. A RotatingFile rotates and compresses it
+	AccessLog io.Writer
+
+	// Replies flushing: the lines of the multi-line replies (FEAT, HELP, STAT, MLST...) are sent together,
+	// the fewer packets speed them up on high latency links. ReplyFlushPerLine sends each line on its own
+	ReplyFlush ReplyFlushPolicy
+
+	// Unknown commands
+	MaxUnknownCommands         int  // Disconnect the client after this number of unknown commands, 0 for unlimited
+	UnknownCommandsNotLoggedIn bool // Reply 530 instead of 500 to the unknown commands sent before the login
+
+	// Slow file opening: with EarlyTransferReply, the transfer connection of an upload is opened and the 150
+	// reply sent before the driver opens the file, the clients don't give up while it prepares it. The
+	// drivers can adapt to FileOpenTimeout, the time in seconds they're expected to open a file in, with
+	// ClientContext.GetFileOpenDeadline. It isn't enforced, 0 disables it
+	EarlyTransferReply bool
+	FileOpenTimeout    int
+
+	// Transfer connections watchdog
+	TransferStallTimeout int // Maximum time in seconds without data flowing before aborting a transfer, 0 to disable
+
+	// TLS downgrade protection: once a client IP logged in over TLS, refuse its plaintext logins for this
+	// time in seconds. This mitigates TLS stripping attacks against misconfigured clients. 0 disables it
+	TLSDowngradeProtectionWindow int
+
+	// Connections flood protection (slowloris attacks): at most MaxPendingConnections connections can be
+	// waiting for their banner (reputation check, location, implicit TLS handshake) and MaxPendingHandshakes
+	// negotiating TLS. The next ones wait for PendingQueueTimeout seconds (10 by default) in a queue of
+	// PendingQueueSize connections, they are refused once it is full. 0 disables a limit
+	MaxPendingConnections int
+	MaxPendingHandshakes  int
+	PendingQueueSize      int
+	PendingQueueTimeout   int
+
+	// Brute force protection: after MaxLoginFailures failed logins in a row of a user or from a client IP, their
+	// logins are refused for LoginLockoutDuration seconds (900 by default). The lockouts are reported as security
+	// events, FtpServer.Lockouts lists them and FtpServer.Unlock clears them. 0 disables it
+	MaxLoginFailures     int
+	LoginLockoutDuration int
+
+	// Security events (see MainDriverExtensionSecurityEvents): the TLS versions below this one (tls.VersionTLS12
+	// for example) are reported, on the control and transfer connections. 0 disables it
+	TLSVersionAlertThreshold uint16
+
+	// Countries restrictions, with MainDriverExtensionGeoLocator: the connections from the DeniedCountries are
+	// refused, as the ones from the countries that aren't in AllowedCountries if it isn't empty, including the
+	// clients that couldn't be located. The countries are ISO 3166-1 alpha-2 codes ("FR")
+	AllowedCountries []string
+	DeniedCountries  []string
+
+	// Reputation check: maximum time in milliseconds the banner waits for MainDriverExtensionReputation (1000
+	// by default), the client is accepted if it doesn't answer in time
+	ReputationCheckTimeout int
+
+	// Data connections security (FTP bounce protection)
+	PasvConnectionsCheck    DataConnectionRequirement // Checks applied to the passive data connections peers
+	ActiveConnectionsCheck  DataConnectionRequirement // Checks applied to the PORT/EPRT targets
+	DataConnectionAllowList []string                  // IPs or CIDR networks always allowed as data peers (FXP)
+
+	// Passive connections pairing: the PASV and EPSV replies end with a one-time token, "Token: 5f0c9e21d4a7b683",
+	// that the client must send first on the data connection (after the TLS handshake with PROT P). The other
+	// connections are closed while the server keeps waiting for the right one, another client can't steal the
+	// passive port, even from the same IP. Only the clients implementing it can be served then
+	PassiveConnectionToken bool
+
+	// CCC (RFC 2228): a logged in user can clear the control connection after AUTH TLS, the transfer connections
+	// stay protected. The NAT helpers that must read the PORT and PASV commands need it, it is refused otherwise
+	EnableCCC bool
+
+	// Renaming (RNFR/RNTO)
+	RenameTimeout         int                   // Maximum time in seconds between RNFR and RNTO (60 by default)
+	RenameOverwrite       RenameOverwritePolicy // What to do when the RNTO target already exists
+	DisableCrossDirRename bool                  // Reject renames moving a file to another directory
+
+	// Retries of the driver calls (Open, ReadDir, Stat) failing with temporary errors
+	DriverRetries    int // Number of retries, none by default
+	DriverRetryDelay int // Delay in milliseconds before the first retry, doubled at each retry (100 by default)
+
+	// Resources limits per session (see ClientContext.GetResources), a session exceeding one of them is
+	// considered as leaking and is closed. 0 disables a limit
+	MaxSessionGoroutines    int // Maximum number of goroutines, including the control connection one
+	MaxSessionOpenFiles     int // Maximum number of files and directories opened with the driver
+	MaxSessionDataListeners int // Maximum number of passive data connections listeners
+
+	// Listener self-healing: after an accept error that isn't temporary, the listener the server created is
+	// re-created on the same address, with an exponential backoff. Listeners set in the settings are never re-created
+	ListenerRecreateAttempts int // Maximum number of attempts to re-create the listener, 0 disables it
+
+	// Unix sockets: a ListenAddr starting with "unix:" is the path of a unix socket, or the name of an abstract
+	// one (Linux) if it starts with "@". The control connections over unix sockets have no client IP: their
+	// passive transfers advertise PublicHost and their data connections peers must be in DataConnectionAllowList
+	DisableUnixSocketPassive bool // Refuse PASV and EPSV to the clients connected over a unix socket
+
+	// Sessions published through MainDriverExtensionSessionStore
+	MaxSessionsPerUser int // Maximum number of sessions per user across all the instances, 0 for unlimited
+
+	// What happens when a user logs in while already having a session on this server: allow it (default), reject
+	// the new login or close the oldest session. ClientDriverExtensionDuplicateSessions can override it per user
+	DuplicateSessionPolicy DuplicateSessionPolicy
+
+	// Fault injection, for the resilience tests only (see FaultInjection)
+	Faults *FaultInjection
+
+	// Data copy buffers, shared by all the transfers. The copies done by the in-memory sources themselves count
+	// as a buffer, the ones done by the kernel (sendfile) don't
+	TransferBufferSize       int // Size in bytes of each buffer (32KB by default)
+	TransferBuffersMaxMemory int // Maximum memory in bytes used by the buffers at the same time, unlimited if 0
 }
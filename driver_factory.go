@@ -0,0 +1,91 @@
+package ftpserver
+
+import (
+	"fmt"
+)
+
+// ClientDriverFactory creates the driver of a session when it is first needed,
+// see MainDriverExtensionLazyDriver and ClientContext.SetDriverFactory
+type ClientDriverFactory func() (ClientDriver, error)
+
+// driverlessCommands don't use the client driver, they don't trigger the call of its factory
+var driverlessCommands = map[string]bool{
+	"NOOP": true, "PWD": true, "XPWD": true, "TYPE": true, "MODE": true, "PASV": true, "EPSV": true,
+	"PORT": true, "EPRT": true, "REST": true, "FEAT": true, "SYST": true, "OPTS": true, "CLNT": true,
+	"PBSZ": true, "PROT": true,
+}
+
+// isLoggedIn returns true once the client is authenticated, its driver might not be created yet
+func (c *clientHandler) isLoggedIn() bool {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.driver != nil || c.driverFactory != nil
+}
+
+// SetDriverFactory replaces the driver of the session. The factory is called before the next command
+// using the driver, once the current transfer is over.
+func (c *clientHandler) SetDriverFactory(factory ClientDriverFactory) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.driverFactory = factory
+}
+
+// logout forgets the driver of the session
+func (c *clientHandler) logout() {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.driver = nil
+	c.driverFactory = nil
+}
+
+// authUser authenticates the user with the main driver, lazily if it supports it
+func (c *clientHandler) authUser(pass string) error {
+	if lazy, ok := c.server.driver.(MainDriverExtensionLazyDriver); ok {
+		factory, err := lazy.AuthUserLazily(c, c.user, pass)
+		if err == nil {
+			c.SetDriverFactory(factory)
+		}
+
+		return err
+	}
+
+	driver, err := c.server.driver.AuthUser(c, c.user, pass)
+
+	c.paramsMutex.Lock()
+	c.driver = driver
+	c.paramsMutex.Unlock()
+
+	return err
+}
+
+// loadDriver calls the pending driver factory if the command needs the driver, it returns false
+// if the driver couldn't be created
+func (c *clientHandler) loadDriver(command string) bool {
+	c.paramsMutex.RLock()
+	factory := c.driverFactory
+	c.paramsMutex.RUnlock()
+
+	if factory == nil || driverlessCommands[command] {
+		return true
+	}
+
+	driver, err := factory()
+	if err != nil || driver == nil {
+		c.logger.Warn("Could not create the client driver", "err", err)
+		c.writeMessage(StatusLocalError, fmt.Sprintf("Could not access the file system: %v", err))
+
+		return false
+	}
+
+	c.paramsMutex.Lock()
+	c.driver = driver
+	c.driverFactory = nil
+	c.paramsMutex.Unlock()
+
+	c.clearListingCache()
+
+	return true
+}
@@ -0,0 +1,92 @@
+package ftpserver
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+var errTenantUnavailable = errors.New("tenant unavailable")
+
+func TestLazyDriver(t *testing.T) {
+	driver := &TestServerDriver{Debug: true, LazyDriver: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", []byte("content"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the commands not touching the files don't need the driver
+	for _, command := range []string{"NOOP", "PWD", "TYPE I", "FEAT", "SYST"} {
+		rc, response, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Less(t, rc, 300, response)
+	}
+
+	require.Equal(t, int32(0), atomic.LoadInt32(&driver.driversCreated))
+
+	rc, response, err := raw.SendCommand("SIZE /file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, response)
+	require.Equal(t, int32(1), atomic.LoadInt32(&driver.driversCreated))
+
+	// the session switches to another file system
+	tenantFs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(tenantFs, "/file", []byte("tenant content"), 0600))
+
+	driver.clientMU.Lock()
+	cc := driver.Clients[0]
+	driver.clientMU.Unlock()
+
+	cc.SetDriverFactory(func() (ClientDriver, error) {
+		return nil, errTenantUnavailable
+	})
+
+	rc, response, err = raw.SendCommand("SIZE /file")
+	require.NoError(t, err)
+	require.Equal(t, StatusLocalError, rc, response)
+	require.Contains(t, response, errTenantUnavailable.Error())
+
+	cc.SetDriverFactory(func() (ClientDriver, error) {
+		return tenantFs, nil
+	})
+
+	rc, response, err = raw.SendCommand("SIZE /file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, response)
+	require.Equal(t, "14", response)
+}
+
+func TestLazyDriverBadPassword(t *testing.T) {
+	driver := &TestServerDriver{Debug: true, LazyDriver: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: "wrong",
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.OpenRawConn()
+	require.Error(t, err)
+	require.Equal(t, int32(0), atomic.LoadInt32(&driver.driversCreated))
+}
@@ -1,13 +1,19 @@
 package ftpserver
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -31,6 +37,7 @@ const (
 const (
 	authUser    = "test"
 	authPass    = "test"
+	expiredPass = "expired" // password to change before logging in
 	authUserID  = 1000
 	authGroupID = 500
 )
@@ -46,6 +53,11 @@ func NewTestServer(t *testing.T, debug bool) *FtpServer {
 func NewTestServerWithDriver(t *testing.T, driver *TestServerDriver) *FtpServer {
 	t.Parallel()
 
+	return newTestServerWithDriver(t, driver)
+}
+
+// newTestServerWithDriver provides a server without marking the test as parallel (benchmarks can't be)
+func newTestServerWithDriver(t testing.TB, driver *TestServerDriver) *FtpServer {
 	if driver.Settings == nil {
 		driver.Settings = &Settings{
 			DefaultTransferType: TransferTypeBinary,
@@ -64,7 +76,12 @@ func NewTestServerWithDriver(t *testing.T, driver *TestServerDriver) *FtpServer
 		driver.fs = afero.NewBasePathFs(afero.NewOsFs(), dir)
 	}
 
-	s := NewFtpServer(driver)
+	var mainDriver MainDriver = driver
+	if driver.LazyDriver {
+		mainDriver = &lazyTestServerDriver{TestServerDriver: driver}
+	}
+
+	s := NewFtpServer(mainDriver)
 
 	// If we are in debug mode, we should log things
 	if driver.Debug {
@@ -102,13 +119,91 @@ type TestServerDriver struct {
 	clientMU             sync.Mutex
 	Clients              []ClientContext
 	TLSVerificationReply tlsVerificationReply
+	PassivePortLeaser    func(exposedPort int) (int, error)  // (Optional) defines the advertised passive port
+	EnableFXP            bool                                // Allow FXP transfers for the authenticated users
+	PermissionChecker    func(user, verb, path string) error // (Optional) vetoes the operations modifying the files
+	UserFilenamePolicy   *FilenamePolicy                     // (Optional) filename policy of the authenticated users
+	LazyDriver           bool                                // Create the client drivers at their first use
+	AccessSchedule       *AccessSchedule                     // (Optional) access schedule of the authenticated users
+	VirtualEntries       map[string][]VirtualEntry           // (Optional) virtual entries per directory
+	TLSServerNames       func(string) (*tls.Config, error)   // (Optional) TLS config per server name
+	GeoLocations         map[string]*GeoLocation             // (Optional) location of the clients per IP
+	Reputation           func(context.Context) (bool, error) // (Optional) reputation check of the clients
+	SecurityMechanisms   map[string]func() SecurityContext   // (Optional) RFC 2228 security mechanisms
+	ReplyFilter          func(int, string) (string, bool)    // (Optional) rewrites or suppresses the replies
+	LoginMessage         string                              // (Optional) message of the day of the users
+
+	statBatchesMu sync.Mutex
+	statBatches   [][]string // names of each StatBatch call
+
+	sessionsMu sync.Mutex
+	sessions   map[string]SessionState // published sessions
+	transfers  []string                // published transfers, as "COMMAND path"
+
+	maxLogins       int // simultaneous logins allowed by the concurrency limiter, unlimited if 0
+	maxTransfers    int // simultaneous transfers allowed by the concurrency limiter, unlimited if 0
+	limiterMu       sync.Mutex
+	activeLogins    int
+	activeTransfers int
+
+	partialUploadsMu    sync.Mutex
+	partialUploadCauses []error // causes given to GetPartialUploadPolicy
+
+	panicsMu sync.Mutex
+	panics   []string // calls during which a panic was recovered
+
+	listenerMu          sync.Mutex
+	listenerRecreations []error // errors of the attempts to re-create the listener
+
+	fileOpenDeadline time.Time // deadline of the last "record-deadline" file opening
+
+	transferTLSVersion uint16 // TLS version of the transfer connections, the control connection one if 0
+
+	securityEventsMu sync.Mutex
+	securityEvents   []SecurityEvent
+
+	statesMu sync.Mutex
+	states   []LifecycleState // states the sessions went through
+
+	closeReasons []CloseReason // reasons of the sessions end, protected by clientMU
+
+	driversCreated int32 // client drivers created by the lazy driver factories (atomic)
+}
+
+// lazyTestServerDriver is the main driver of the tests with LazyDriver set
+type lazyTestServerDriver struct {
+	*TestServerDriver
+}
+
+// AuthUserLazily returns a factory creating the client driver of AuthUser
+func (driver *lazyTestServerDriver) AuthUserLazily(cc ClientContext, user, pass string) (ClientDriverFactory, error) {
+	if _, err := driver.AuthUser(cc, user, pass); err != nil {
+		return nil, err
+	}
+
+	return func() (ClientDriver, error) {
+		atomic.AddInt32(&driver.driversCreated, 1)
+
+		return NewTestClientDriver(driver.TestServerDriver), nil
+	}, nil
 }
 
 // TestClientDriver defines a minimal serverftp client driver
 type TestClientDriver struct {
 	afero.Fs
+	fxp            bool
+	statFailures   map[string]int // number of temporary Stat failures per path
+	statFailuresMu sync.Mutex
+	server         *TestServerDriver
 }
 
+var errTemporaryFailure = &testTemporaryError{}
+
+type testTemporaryError struct{}
+
+func (e *testTemporaryError) Error() string   { return "temporary failure" }
+func (e *testTemporaryError) Temporary() bool { return true }
+
 type testFile struct {
 	afero.File
 }
@@ -119,6 +214,7 @@ var (
 	errFailSeek    = errors.New("couldn't seek")
 	errFailReaddir = errors.New("couldn't readdir")
 	errFailOpen    = errors.New("couldn't open")
+	errFailSync    = errors.New("couldn't sync")
 )
 
 func (f *testFile) Read(b []byte) (int, error) {
@@ -127,6 +223,10 @@ func (f *testFile) Read(b []byte) (int, error) {
 		time.Sleep(500 * time.Millisecond)
 	}
 
+	if strings.Contains(f.File.Name(), "panic-on-read") {
+		panic("read panic")
+	}
+
 	return f.File.Read(b)
 }
 
@@ -135,6 +235,11 @@ func (f *testFile) Write(b []byte) (int, error) {
 		return 0, errFailWrite
 	}
 
+	// the executables are rejected once sniffed
+	if strings.Contains(f.File.Name(), "sniffed") && bytes.HasPrefix(b, []byte("\x7fELF")) {
+		return 0, fmt.Errorf("%w: executable", ErrContentNotAllowed)
+	}
+
 	// simulating a slow writing allows us to test ABOR
 	if strings.Contains(f.File.Name(), "delay-io") {
 		time.Sleep(500 * time.Millisecond)
@@ -151,6 +256,14 @@ func (f *testFile) Close() error {
 	return f.File.Close()
 }
 
+func (f *testFile) Sync() error {
+	if strings.Contains(f.File.Name(), "fail-to-sync") {
+		return errFailSync
+	}
+
+	return f.File.Sync()
+}
+
 func (f *testFile) Seek(offset int64, whence int) (int64, error) {
 	// by delaying the seek and sending a REST before the actual transfer
 	// we can delay the opening of the transfer and then test an ABOR before
@@ -176,16 +289,105 @@ func (f *testFile) Readdir(count int) ([]os.FileInfo, error) {
 		return nil, errFailReaddir
 	}
 
-	return f.File.Readdir(count)
+	files, err := f.File.Readdir(count)
+
+	for i, file := range files {
+		files[i] = newTestFileInfo(file)
+	}
+
+	return files, err
+}
+
+// testFileInfo provides the owner and group names of the files whose name contains "owned"
+type testFileInfo struct {
+	os.FileInfo
+}
+
+func newTestFileInfo(info os.FileInfo) os.FileInfo {
+	if info != nil && strings.Contains(info.Name(), "owned") {
+		return &testFileInfo{FileInfo: info}
+	}
+
+	if info != nil && strings.Contains(info.Name(), "versioned") {
+		return &testVersionedFileInfo{FileInfo: info}
+	}
+
+	if info != nil && strings.Contains(info.Name(), "extended") {
+		return &testExtendedFileInfo{testFileInfo: testFileInfo{FileInfo: info}}
+	}
+
+	return info
+}
+
+// testVersionedFileInfo provides a version of the files whose name contains "versioned", based on their size
+type testVersionedFileInfo struct {
+	os.FileInfo
+}
+
+func (f *testVersionedFileInfo) Version() string {
+	return fmt.Sprintf("v%d", f.Size())
+}
+
+func (f *testFileInfo) Owner() string {
+	return "test-owner"
+}
+
+func (f *testFileInfo) Group() string {
+	return "test-group"
+}
+
+// testExtendedFileInfo provides the extended metadata of the files whose name contains "extended"
+type testExtendedFileInfo struct {
+	testFileInfo
+	target string
+}
+
+func (f *testExtendedFileInfo) CreationTime() time.Time {
+	return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+}
+
+func (f *testExtendedFileInfo) LinkTarget() string {
+	return f.target
+}
+
+func (f *testExtendedFileInfo) Facts() map[string]string {
+	return map[string]string{
+		"x.tier":    "cold",
+		"x.bucket":  "archives",
+		"size":      "1",         // can't replace a fact of the server
+		"x.comment": "two words", // can't be sent
+		"x;bad":     "name",
+	}
 }
 
 // NewTestClientDriver creates a client driver
 func NewTestClientDriver(server *TestServerDriver) *TestClientDriver {
 	return &TestClientDriver{
-		Fs: server.fs,
+		Fs:           server.fs,
+		fxp:          server.EnableFXP,
+		statFailures: make(map[string]int),
+		server:       server,
 	}
 }
 
+// GetFilenamePolicy returns the UserFilenamePolicy of the test, the one of the settings if not set
+func (driver *TestClientDriver) GetFilenamePolicy() *FilenamePolicy {
+	if driver.server.UserFilenamePolicy != nil {
+		return driver.server.UserFilenamePolicy
+	}
+
+	if driver.server.Settings != nil {
+		return driver.server.Settings.FilenamePolicy
+	}
+
+	return nil
+}
+
+// GetLoginMessage returns the LoginMessage of the test
+func (driver *TestClientDriver) GetLoginMessage() string {
+	return driver.server.LoginMessage
+}
+
 func mustStopServer(server *FtpServer) {
 	err := server.Stop()
 	if err != nil {
@@ -215,8 +417,14 @@ func (driver *TestServerDriver) ClientConnected(cc ClientContext) (string, error
 var errBadUserNameOrPassword = errors.New("bad username or password")
 
 // AuthUser with authenticate users
-func (driver *TestServerDriver) AuthUser(_ ClientContext, user, pass string) (ClientDriver, error) {
+func (driver *TestServerDriver) AuthUser(cc ClientContext, user, pass string) (ClientDriver, error) {
+	if user == authUser && pass == expiredPass {
+		return nil, ErrPasswordExpired
+	}
+
 	if user == authUser && pass == authPass {
+		cc.SetAccessSchedule(driver.AccessSchedule)
+
 		clientdriver := NewTestClientDriver(driver)
 
 		return clientdriver, nil
@@ -225,11 +433,113 @@ func (driver *TestServerDriver) AuthUser(_ ClientContext, user, pass string) (Cl
 	return nil, errBadUserNameOrPassword
 }
 
+// ChangePassword only allows changing the expired password to the regular one
+func (driver *TestServerDriver) ChangePassword(_ ClientContext, user, oldPassword, newPassword string) error {
+	if user != authUser || oldPassword != expiredPass || newPassword != authPass {
+		return errBadUserNameOrPassword
+	}
+
+	return nil
+}
+
+// GetVirtualEntries returns the VirtualEntries of a directory
+func (driver *TestServerDriver) GetVirtualEntries(_ ClientContext, dirPath string) []VirtualEntry {
+	return driver.VirtualEntries[dirPath]
+}
+
+// PanicRecovered records the calls during which a panic was recovered
+func (driver *TestServerDriver) PanicRecovered(_ ClientContext, call string, _ interface{}, _ []byte) {
+	driver.panicsMu.Lock()
+	defer driver.panicsMu.Unlock()
+
+	driver.panics = append(driver.panics, call)
+}
+
+// recordFileOpenDeadline records the deadline given to the only client
+func (driver *TestServerDriver) recordFileOpenDeadline() {
+	driver.clientMU.Lock()
+	defer driver.clientMU.Unlock()
+
+	driver.fileOpenDeadline = driver.Clients[0].GetFileOpenDeadline()
+}
+
+// GetTransferTLSConfig restricts the TLS version of the transfer connections to transferTLSVersion
+func (driver *TestServerDriver) GetTransferTLSConfig(_ ClientContext) (*tls.Config, error) {
+	config, err := driver.GetTLSConfig()
+	if err == nil && driver.transferTLSVersion != 0 {
+		config.MinVersion = driver.transferTLSVersion
+		config.MaxVersion = driver.transferTLSVersion
+	}
+
+	return config, err
+}
+
+// SecurityEvent records the security events
+func (driver *TestServerDriver) SecurityEvent(_ ClientContext, event SecurityEvent) {
+	driver.securityEventsMu.Lock()
+	defer driver.securityEventsMu.Unlock()
+
+	driver.securityEvents = append(driver.securityEvents, event)
+}
+
+func (driver *TestServerDriver) getSecurityEvents() []SecurityEventType {
+	driver.securityEventsMu.Lock()
+	defer driver.securityEventsMu.Unlock()
+
+	types := make([]SecurityEventType, 0, len(driver.securityEvents))
+	for _, event := range driver.securityEvents {
+		types = append(types, event.Type)
+	}
+
+	return types
+}
+
+// SessionStateChanged records the states of the sessions
+func (driver *TestServerDriver) SessionStateChanged(_ ClientContext, _, to LifecycleState) {
+	driver.statesMu.Lock()
+	defer driver.statesMu.Unlock()
+
+	driver.states = append(driver.states, to)
+}
+
+func (driver *TestServerDriver) getStates() []LifecycleState {
+	driver.statesMu.Lock()
+	defer driver.statesMu.Unlock()
+
+	return append([]LifecycleState{}, driver.states...)
+}
+
+func (driver *TestServerDriver) getCloseReasons() []CloseReason {
+	driver.clientMU.Lock()
+	defer driver.clientMU.Unlock()
+
+	return append([]CloseReason{}, driver.closeReasons...)
+}
+
+// CheckPermission uses the PermissionChecker of the test, if any
+func (driver *TestServerDriver) CheckPermission(_ ClientContext, user, verb, path string) error {
+	if driver.PermissionChecker == nil {
+		return nil
+	}
+
+	return driver.PermissionChecker(user, verb, path)
+}
+
+// ListenerRecreated records the attempts to re-create the listener
+func (driver *TestServerDriver) ListenerRecreated(_ error, _ int, err error) {
+	driver.listenerMu.Lock()
+	defer driver.listenerMu.Unlock()
+
+	driver.listenerRecreations = append(driver.listenerRecreations, err)
+}
+
 // ClientDisconnected is called when the user disconnects
 func (driver *TestServerDriver) ClientDisconnected(cc ClientContext) {
 	driver.clientMU.Lock()
 	defer driver.clientMU.Unlock()
 
+	driver.closeReasons = append(driver.closeReasons, cc.GetCloseReason())
+
 	for idx, client := range driver.Clients {
 		if client.ID() == cc.ID() {
 			lastIdx := len(driver.Clients) - 1
@@ -267,6 +577,117 @@ func (driver *TestServerDriver) GetClientsInfo() map[uint32]interface{} {
 	return info
 }
 
+// PublishSession stores the sessions in memory
+func (driver *TestServerDriver) PublishSession(state *SessionState) error {
+	driver.sessionsMu.Lock()
+	defer driver.sessionsMu.Unlock()
+
+	if driver.sessions == nil {
+		driver.sessions = make(map[string]SessionState)
+	}
+
+	driver.sessions[state.SessionID] = *state
+
+	if state.Transfer != nil {
+		driver.transfers = append(driver.transfers, state.Transfer.Command+" "+state.Transfer.Path)
+	}
+
+	return nil
+}
+
+// UnpublishSession removes a session from the memory
+func (driver *TestServerDriver) UnpublishSession(sessionID string) error {
+	driver.sessionsMu.Lock()
+	defer driver.sessionsMu.Unlock()
+
+	delete(driver.sessions, sessionID)
+
+	return nil
+}
+
+// CountUserSessions counts the sessions of a user in memory
+func (driver *TestServerDriver) CountUserSessions(user string) (int, error) {
+	driver.sessionsMu.Lock()
+	defer driver.sessionsMu.Unlock()
+
+	count := 0
+
+	for _, session := range driver.sessions {
+		if session.User == user {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+var (
+	errTooManyLogins    = errors.New("too many logins")
+	errTooManyTransfers = errors.New("too many transfers")
+)
+
+// AcquireLogin counts the logins, up to maxLogins
+func (driver *TestServerDriver) AcquireLogin(cc ClientContext, user string) (func(), error) {
+	return driver.acquireSlot(&driver.activeLogins, driver.maxLogins, errTooManyLogins)
+}
+
+// AcquireTransfer counts the transfers, up to maxTransfers
+func (driver *TestServerDriver) AcquireTransfer(cc ClientContext, user string) (func(), error) {
+	return driver.acquireSlot(&driver.activeTransfers, driver.maxTransfers, errTooManyTransfers)
+}
+
+func (driver *TestServerDriver) acquireSlot(active *int, max int, errLimit error) (func(), error) {
+	driver.limiterMu.Lock()
+	defer driver.limiterMu.Unlock()
+
+	if max > 0 && *active >= max {
+		return nil, errLimit
+	}
+
+	*active++
+
+	return func() {
+		driver.limiterMu.Lock()
+		defer driver.limiterMu.Unlock()
+
+		*active--
+	}, nil
+}
+
+func (driver *TestServerDriver) getSessions() (map[string]SessionState, []string) {
+	driver.sessionsMu.Lock()
+	defer driver.sessionsMu.Unlock()
+
+	sessions := make(map[string]SessionState, len(driver.sessions))
+	for id, session := range driver.sessions {
+		sessions[id] = session
+	}
+
+	return sessions, append([]string(nil), driver.transfers...)
+}
+
+// HandleUnknownCommand implements the XCUSTOM and XREPLY commands
+func (driver *TestServerDriver) HandleUnknownCommand(cc ClientContext, command, param string) (int, string, bool) {
+	switch command {
+	case "XCUSTOM":
+		return StatusOK, "custom command: " + param, true
+	case "XREPLY":
+		// a preliminary reply listing the parameters
+		reply := NewReply(StatusFileStatusOK, "Parameters:")
+		for _, value := range strings.Fields(param) {
+			reply.Text(value)
+		}
+
+		if err := cc.SendReply(reply.Line("End")); err != nil {
+			return StatusActionNotTaken, err.Error(), true
+		}
+
+		return StatusOK, "Done", true
+	default:
+		return 0, "", false
+	}
+}
+
 var errNoClientConnected = errors.New("no client connected")
 
 // DisconnectClient disconnect one of the connected clients
@@ -288,6 +709,47 @@ func (driver *TestServerDriver) GetSettings() (*Settings, error) {
 
 var errNoTLS = errors.New("TLS is not configured")
 
+// LocateClient gives the location of the client from GeoLocations
+func (driver *TestServerDriver) LocateClient(_ ClientContext, ip net.IP) (*GeoLocation, error) {
+	return driver.GeoLocations[ip.String()], nil
+}
+
+// CheckReputation checks the clients with Reputation
+func (driver *TestServerDriver) CheckReputation(ctx context.Context, _ net.IP) (bool, error) {
+	if driver.Reputation == nil {
+		return false, nil
+	}
+
+	return driver.Reputation(ctx)
+}
+
+// FilterReply applies ReplyFilter
+func (driver *TestServerDriver) FilterReply(_ ClientContext, code int, message string) (string, bool) {
+	if driver.ReplyFilter == nil {
+		return message, true
+	}
+
+	return driver.ReplyFilter(code, message)
+}
+
+// NewSecurityContext starts a mechanism of SecurityMechanisms
+func (driver *TestServerDriver) NewSecurityContext(_ ClientContext, mechanism string) (SecurityContext, error) {
+	if newContext, ok := driver.SecurityMechanisms[mechanism]; ok {
+		return newContext(), nil
+	}
+
+	return nil, nil
+}
+
+// GetTLSConfigForServerName selects the TLS config with TLSServerNames
+func (driver *TestServerDriver) GetTLSConfigForServerName(serverName string) (*tls.Config, error) {
+	if driver.TLSServerNames == nil {
+		return nil, nil
+	}
+
+	return driver.TLSServerNames(serverName)
+}
+
 // GetTLSConfig fetches the TLS config
 func (driver *TestServerDriver) GetTLSConfig() (*tls.Config, error) {
 	if driver.TLS {
@@ -321,12 +783,29 @@ func (driver *TestServerDriver) VerifyConnection(cc ClientContext, user string,
 	return nil, nil
 }
 
+// LeasePassivePort defines the port advertised to the client in the PASV/EPSV replies
+func (driver *TestServerDriver) LeasePassivePort(_ ClientContext, _, exposedPort int) (int, error) {
+	if driver.PassivePortLeaser != nil {
+		return driver.PassivePortLeaser(exposedPort)
+	}
+
+	return exposedPort, nil
+}
+
+// ReleasePassivePort is called when the leased port isn't used anymore
+func (driver *TestServerDriver) ReleasePassivePort(_ ClientContext, _ int) {
+}
+
 // OpenFile opens a file in 3 possible modes: read, write, appending write (use appropriate flags)
 func (driver *TestClientDriver) OpenFile(path string, flag int, perm os.FileMode) (afero.File, error) {
 	if strings.Contains(path, "fail-to-open") {
 		return nil, errFailOpen
 	}
 
+	if strings.Contains(path, "panic-on-open") {
+		panic("open panic")
+	}
+
 	if strings.Contains(path, "quota-exceeded") {
 		return nil, ErrStorageExceeded
 	}
@@ -335,6 +814,10 @@ func (driver *TestClientDriver) OpenFile(path string, flag int, perm os.FileMode
 		return nil, ErrFileNameNotAllowed
 	}
 
+	if strings.Contains(path, "record-deadline") {
+		driver.server.recordFileOpenDeadline()
+	}
+
 	file, err := driver.Fs.OpenFile(path, flag, perm)
 
 	if err == nil {
@@ -358,6 +841,41 @@ func (driver *TestClientDriver) Open(name string) (afero.File, error) {
 	return file, err
 }
 
+// Stat fails temporarily twice for each path containing "temp-fail" and always for "temp-fail-always"
+func (driver *TestClientDriver) Stat(name string) (os.FileInfo, error) {
+	if strings.Contains(name, "temp-fail") {
+		driver.statFailuresMu.Lock()
+		driver.statFailures[name]++
+		failures := driver.statFailures[name]
+		driver.statFailuresMu.Unlock()
+
+		if failures <= 2 || strings.Contains(name, "temp-fail-always") {
+			return nil, errTemporaryFailure
+		}
+	}
+
+	info, err := driver.Fs.Stat(name)
+
+	return newTestFileInfo(info), err
+}
+
+// StatBatch records the names it is called with and stats them one by one
+func (driver *TestClientDriver) StatBatch(names []string) (map[string]os.FileInfo, error) {
+	driver.server.statBatchesMu.Lock()
+	driver.server.statBatches = append(driver.server.statBatches, names)
+	driver.server.statBatchesMu.Unlock()
+
+	infos := make(map[string]os.FileInfo, len(names))
+
+	for _, name := range names {
+		if info, err := driver.Fs.Stat(name); err == nil {
+			infos[name] = newTestFileInfo(info)
+		}
+	}
+
+	return infos, nil
+}
+
 func (driver *TestClientDriver) Rename(oldname, newname string) error {
 	if strings.Contains(newname, "not-allowed") {
 		return ErrFileNameNotAllowed
@@ -403,6 +921,90 @@ func (driver *TestClientDriver) Chown(name string, uid int, gid int) error {
 	return err
 }
 
+// IsFXPAllowed defines if site-to-site transfers are allowed
+func (driver *TestClientDriver) IsFXPAllowed() bool {
+	return driver.fxp
+}
+
+// GetHashFacts returns precomputed digests for the files whose name contains "hashfacts"
+func (driver *TestClientDriver) GetHashFacts(name string) (map[HASHAlgo]string, error) {
+	if !strings.Contains(name, "hashfacts") {
+		return nil, nil
+	}
+
+	return map[HASHAlgo]string{
+		HASHAlgoSHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		HASHAlgoCRC32:  "00000000",
+	}, nil
+}
+
+var errContentNotFound = errors.New("content not found")
+
+// findContent returns the path of a file having a SHA-256 digest, empty if there is none
+func (driver *TestClientDriver) findContent(algo HASHAlgo, digest string) (string, error) {
+	if algo != HASHAlgoSHA256 {
+		return "", nil
+	}
+
+	var found string
+
+	err := afero.Walk(driver.Fs, "/", func(name string, info os.FileInfo, err error) error {
+		if err != nil || found != "" || !info.Mode().IsRegular() {
+			return err
+		}
+
+		content, err := afero.ReadFile(driver.Fs, name)
+		if err != nil {
+			return err
+		}
+
+		if fmt.Sprintf("%x", sha256.Sum256(content)) == digest {
+			found = name
+		}
+
+		return nil
+	})
+
+	return found, err
+}
+
+func (driver *TestClientDriver) HasContent(algo HASHAlgo, digest string) (bool, error) {
+	name, err := driver.findContent(algo, digest)
+
+	return name != "", err
+}
+
+func (driver *TestClientDriver) LinkContent(name string, algo HASHAlgo, digest string) error {
+	source, err := driver.findContent(algo, digest)
+	if err != nil {
+		return err
+	}
+
+	if source == "" {
+		return errContentNotFound
+	}
+
+	content, err := afero.ReadFile(driver.Fs, source)
+	if err != nil {
+		return err
+	}
+
+	return afero.WriteFile(driver.Fs, name, content, 0644)
+}
+
+// GetPartialUploadPolicy keeps the files whose name contains "keep-partial" and applies the settings otherwise
+func (driver *TestClientDriver) GetPartialUploadPolicy(name string, cause error) PartialUploadPolicy {
+	driver.server.partialUploadsMu.Lock()
+	driver.server.partialUploadCauses = append(driver.server.partialUploadCauses, cause)
+	driver.server.partialUploadsMu.Unlock()
+
+	if strings.Contains(name, "keep-partial") {
+		return PartialUploadKeep
+	}
+
+	return driver.server.Settings.PartialUploadPolicy
+}
+
 var errSymlinkNotImplemented = errors.New("symlink not implemented")
 
 func (driver *TestClientDriver) Symlink(oldname, newname string) error {
@@ -413,6 +1015,58 @@ func (driver *TestClientDriver) Symlink(oldname, newname string) error {
 	return errSymlinkNotImplemented
 }
 
+var errLinkNotImplemented = errors.New("link not implemented")
+
+func (driver *TestClientDriver) Link(oldname, newname string) error {
+	basePath, ok := driver.Fs.(*afero.BasePathFs)
+	if !ok {
+		return errLinkNotImplemented
+	}
+
+	oldPath, err := basePath.RealPath(oldname)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := basePath.RealPath(newname)
+	if err != nil {
+		return err
+	}
+
+	return os.Link(oldPath, newPath)
+}
+
+func (driver *TestClientDriver) Lstat(name string) (os.FileInfo, error) {
+	if lstater, ok := driver.Fs.(afero.Lstater); ok {
+		info, _, err := lstater.LstatIfPossible(name)
+
+		return info, err
+	}
+
+	return driver.Fs.Stat(name)
+}
+
+func (driver *TestClientDriver) ReadLink(name string) (string, error) {
+	reader, ok := driver.Fs.(afero.LinkReader)
+	if !ok {
+		return "", errSymlinkNotImplemented
+	}
+
+	target, err := reader.ReadlinkIfPossible(name)
+	if err != nil {
+		return "", err
+	}
+
+	// the targets are real paths, they are shown relative to the base path
+	if basePath, ok := driver.Fs.(*afero.BasePathFs); ok {
+		if root, errRoot := basePath.RealPath("/"); errRoot == nil {
+			target = "/" + strings.TrimPrefix(strings.TrimPrefix(target, root), "/")
+		}
+	}
+
+	return target, nil
+}
+
 // (copied from net/http/httptest)
 // localhostCert is a PEM-encoded TLS cert with SAN IPs
 // "127.0.0.1" and "[::1]", expiring at the last second of 2049 (the end
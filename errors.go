@@ -9,13 +9,57 @@ var (
 	// ErrFileNameNotAllowed defines the error mapped to the FTP 553 reply code.
 	// As for RFC 959 this error is checked for STOR, APPE, RNTO
 	ErrFileNameNotAllowed = errors.New("filename not allowed")
+	// ErrContentNotAllowed defines the error mapped to the FTP 553 reply code, the upload handle can return
+	// it from Write to reject the content of an upload partway (a file type found by sniffing the first
+	// bytes for example)
+	ErrContentNotAllowed = errors.New("content not allowed")
+	// ErrTransferAborted is the cause given to ClientDriverExtensionPartialUpload for the uploads
+	// aborted by the client with ABOR
+	ErrTransferAborted = errors.New("transfer aborted by the client")
+	// ErrVersionMismatch is returned when the file of a RETR doesn't have the version the client
+	// required with SITE IFMATCH, ClientDriverExtensionConditionalTransfer can return it too
+	ErrVersionMismatch = errors.New("file version mismatch")
+	// ErrUploadDigestMismatch is the cause of the failed uploads whose content doesn't match the digest
+	// the client sent after it, see EnableUploadTrailer
+	ErrUploadDigestMismatch = errors.New("upload digest mismatch")
 )
 
+// isTemporaryError tells if a driver marked an error as temporary by implementing Temporary() bool,
+// like net.Error does. These errors are retried (see DriverRetries) and mapped to the FTP 450 reply
+// code so that clients know they can try again later.
+func isTemporaryError(err error) bool {
+	var temporary interface{ Temporary() bool }
+
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// isUploadRejection tells if an error is a rejection of the upload by the driver: the client might still be
+// sending the data, it is drained before the transfer connection is closed (see drainTransfer)
+func isUploadRejection(err error) bool {
+	return errors.Is(err, ErrStorageExceeded) || errors.Is(err, ErrFileNameNotAllowed) ||
+		errors.Is(err, ErrContentNotAllowed)
+}
+
+// errTempUpload is returned when a client tries to download a temporary upload file (see HideTempUploads)
+var errTempUpload = errors.New("file is being uploaded")
+
+// errDriverPanic is returned when a driver call panicked
+var errDriverPanic = errors.New("driver panic")
+
+// errTransferStalled is returned when no data flowed on a transfer connection for TransferStallTimeout
+var errTransferStalled = errors.New("transfer stalled")
+
 func getErrorCode(err error, defaultCode int) int {
 	switch {
+	case errors.Is(err, errTransferStalled):
+		return StatusTransferAborted
+	case isTemporaryError(err):
+		return StatusFileActionNotTaken
 	case errors.Is(err, ErrStorageExceeded):
 		return StatusActionAborted
-	case errors.Is(err, ErrFileNameNotAllowed):
+	case errors.Is(err, ErrListingTooLarge):
+		return StatusInsufficientStorage
+	case errors.Is(err, ErrFileNameNotAllowed), errors.Is(err, ErrContentNotAllowed):
 		return StatusActionNotTakenNoFile
 	default:
 		return defaultCode
@@ -3,6 +3,7 @@ package ftpserver
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"os"
 	"testing"
 
@@ -15,6 +16,8 @@ func TestCustomErrorsCode(t *testing.T) {
 	assert.Equal(t, StatusActionAborted, code)
 	code = getErrorCode(ErrFileNameNotAllowed, StatusActionNotTaken)
 	assert.Equal(t, StatusActionNotTakenNoFile, code)
+	code = getErrorCode(fmt.Errorf("%w: executable", ErrContentNotAllowed), StatusActionNotTaken)
+	assert.Equal(t, StatusActionNotTakenNoFile, code)
 	code = getErrorCode(os.ErrPermission, StatusActionNotTaken)
 	assert.Equal(t, StatusActionNotTaken, code)
 	code = getErrorCode(os.ErrClosed, StatusNotLoggedIn)
@@ -23,7 +26,7 @@ func TestCustomErrorsCode(t *testing.T) {
 
 func TestTransferCloseStorageExceeded(t *testing.T) {
 	buf := bytes.Buffer{}
-	h := clientHandler{writer: bufio.NewWriter(&buf)}
+	h := clientHandler{server: &FtpServer{settings: &Settings{}}, writer: bufio.NewWriter(&buf)}
 	h.TransferClose(ErrStorageExceeded)
 	require.Equal(t, "552 Issue during transfer: storage limit exceeded\r\n", buf.String())
 }
@@ -0,0 +1,58 @@
+package ftpserver
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// getFileVersion returns the content version the driver gives for a file, empty if there is none
+func getFileVersion(file os.FileInfo) string {
+	if version, ok := file.(FileInfoVersion); ok {
+		return version.Version()
+	}
+
+	return ""
+}
+
+// handleIFMATCH sets the version the file of the next RETR must have, as given by the x.etag fact
+func (c *clientHandler) handleIFMATCH(params string) {
+	version := strings.TrimSpace(params)
+	if version == "" {
+		c.writeMessage(StatusSyntaxErrorNotRecognised, "Missing version")
+
+		return
+	}
+
+	c.ctxIfMatch = version
+	c.writeMessage(StatusFileActionPending, fmt.Sprintf("The next RETR requires version %s", version))
+}
+
+// getVersionedFileHandle opens the file of a transfer, if version isn't empty the file must have it.
+// The drivers implementing ClientDriverExtensionConditionalTransfer check it when opening the file.
+func (c *clientHandler) getVersionedFileHandle(name string, flags int, offset int64,
+	version string) (FileTransfer, error) {
+	if version == "" {
+		return c.getFileHandle(name, flags, offset)
+	}
+
+	if conditional, ok := c.driver.(ClientDriverExtensionConditionalTransfer); ok {
+		file, err := conditional.GetHandleIfMatch(name, flags, offset, version)
+		if err == nil {
+			c.trackResource(resourceOpenFile, 1)
+		}
+
+		return file, err
+	}
+
+	info, err := c.stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if getFileVersion(info) != version {
+		return nil, ErrVersionMismatch
+	}
+
+	return c.getFileHandle(name, flags, offset)
+}
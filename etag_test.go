@@ -0,0 +1,112 @@
+package ftpserver
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionFact(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/versioned", []byte("content"), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", []byte("content"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("MLST /versioned")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+	require.Contains(t, response, "x.etag=v7;")
+
+	rc, response, err = raw.SendCommand("MLST /file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+	require.NotContains(t, response, "x.etag")
+}
+
+func TestConditionalRETR(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/versioned", []byte("content"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("SITE IFMATCH")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorNotRecognised, rc, response)
+
+	// the file changed since the client got its version
+	rc, response, err = raw.SendCommand("SITE IFMATCH v3")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	_, err = raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("RETR /versioned")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+	require.Contains(t, response, ErrVersionMismatch.Error())
+
+	// the version applies to a single transfer
+	buf := &bytes.Buffer{}
+	require.NoError(t, c.Retrieve("/versioned", buf))
+
+	rc, response, err = raw.SendCommand("REST 3")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand("SITE IFMATCH v7")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("RETR /versioned")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	buf.Reset()
+	_, err = buf.ReadFrom(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+	require.Equal(t, "tent", buf.String())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+}
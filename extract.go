@@ -0,0 +1,321 @@
+package ftpserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Archives extraction: "SITE EXTRACT <archive> [dir]" extracts a zip, tar or gzipped tar file of the driver
+// to a directory, the one of the archive by default. The entries can't be written outside of it, the links
+// and the special files are skipped.
+
+const (
+	defaultMaxExtractEntrySize = 1 << 30
+	defaultMaxExtractEntries   = 10000
+)
+
+var (
+	// errUnsafeArchiveEntry is returned for the entries that would be written outside of the directory
+	errUnsafeArchiveEntry = errors.New("unsafe archive entry name")
+	// errExtractEntryTooLarge is returned for the entries larger than MaxExtractEntrySize
+	errExtractEntryTooLarge = errors.New("archive entry too large")
+	// errExtractTooManyEntries is returned for the archives with more than MaxExtractEntries entries
+	errExtractTooManyEntries = errors.New("too many archive entries")
+)
+
+// archiveExtractor writes the entries of an archive to a directory
+type archiveExtractor struct {
+	c       *clientHandler
+	dir     string // destination directory
+	entries int    // number of extracted entries
+}
+
+func (c *clientHandler) handleEXTRACT(params string) {
+	if !c.server.settings.EnableExtract {
+		c.writeMessage(StatusCommandNotImplemented, "SITE EXTRACT is disabled")
+
+		return
+	}
+
+	args, err := splitParamsValues(params, 2)
+	if err != nil || len(args) == 0 {
+		c.writeMessage(StatusSyntaxErrorParameters, "usage: SITE EXTRACT <archive> [dir]")
+
+		return
+	}
+
+	archivePath := c.absPath(args[0])
+	dir := path.Dir(archivePath)
+
+	if len(args) > 1 {
+		dir = c.absPath(args[1])
+	}
+
+	extract := getArchiveExtraction(archivePath)
+	if extract == nil {
+		c.writeMessage(StatusNotImplementedParam, fmt.Sprintf("%v: %v", archivePath, errArchiveFormat))
+
+		return
+	}
+
+	extractor := &archiveExtractor{c: c, dir: dir}
+
+	if err = extractor.extractArchive(archivePath, extract); err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken),
+			fmt.Sprintf("Could not extract %v: %v (%d entries extracted)", archivePath, err, extractor.entries))
+
+		return
+	}
+
+	c.writeMessage(StatusFileOK, fmt.Sprintf("Extracted %d entries to %v", extractor.entries, dir))
+}
+
+// archiveExtraction reads an archive of size bytes and writes its entries
+type archiveExtraction func(file FileTransfer, size int64, extractor *archiveExtractor) error
+
+// getArchiveExtraction returns the extraction of an archive by its extension, nil if it isn't supported
+func getArchiveExtraction(name string) archiveExtraction {
+	name = strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip
+	case strings.HasSuffix(name, ".tar"):
+		return extractTar
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return extractTarGzip
+	default:
+		return nil
+	}
+}
+
+// extractArchive opens the archive and extracts it
+func (e *archiveExtractor) extractArchive(archivePath string, extract archiveExtraction) error {
+	c := e.c
+
+	info, err := c.stat(archivePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := c.getFileHandle(archivePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer c.closeUnchecked(file)
+
+	return extract(file, info.Size(), e)
+}
+
+func extractZip(file FileTransfer, size int64, extractor *archiveExtractor) error {
+	archive, err := zip.NewReader(io.NewSectionReader(fileReaderAt(file), 0, size), size)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range archive.File {
+		mode := entry.Mode()
+		if !mode.IsDir() && !mode.IsRegular() {
+			continue
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			return err
+		}
+
+		err = extractor.extract(entry.Name, mode.IsDir(), content)
+		content.Close() //nolint:errcheck,gosec // the error of the content is returned by the reads
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func extractTar(file FileTransfer, _ int64, extractor *archiveExtractor) error {
+	archive := tar.NewReader(file)
+
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if err = extractor.extract(header.Name, header.Typeflag == tar.TypeDir, archive); err != nil {
+			return err
+		}
+	}
+}
+
+func extractTarGzip(file FileTransfer, size int64, extractor *archiveExtractor) error {
+	uncompressed, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	return extractTar(&gzipFile{FileTransfer: file, reader: uncompressed}, size, extractor)
+}
+
+// gzipFile reads the uncompressed content of a file
+type gzipFile struct {
+	FileTransfer
+	reader io.Reader
+}
+
+func (f *gzipFile) Read(p []byte) (int, error) {
+	return f.reader.Read(p)
+}
+
+// getEntryPath returns the path of an entry in the directory, the entries can't be outside of it
+func (e *archiveExtractor) getEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: %v", errUnsafeArchiveEntry, name)
+		}
+	}
+
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" || name == "." {
+		return e.dir, nil
+	}
+
+	return path.Join(e.dir, name), nil
+}
+
+// extract writes an entry of the archive
+func (e *archiveExtractor) extract(name string, isDir bool, content io.Reader) error {
+	c := e.c
+
+	if max := c.server.settings.MaxExtractEntries; max > 0 && e.entries >= max {
+		return fmt.Errorf("%w: more than %d", errExtractTooManyEntries, max)
+	}
+
+	entryPath, err := e.getEntryPath(name)
+	if err != nil {
+		return err
+	}
+
+	if policy := c.getFilenamePolicy(); policy != nil {
+		if entryPath, err = policy.apply(entryPath); err != nil {
+			return err
+		}
+	}
+
+	if isDir {
+		err = e.createDirectories(entryPath)
+	} else {
+		err = e.extractFile(entryPath, content)
+	}
+
+	if err == nil {
+		e.entries++
+	}
+
+	return err
+}
+
+// extractFile writes a file, at most MaxExtractEntrySize bytes
+func (e *archiveExtractor) extractFile(filePath string, content io.Reader) error {
+	c := e.c
+
+	if err := e.createDirectories(path.Dir(filePath)); err != nil {
+		return err
+	}
+
+	if err := c.permissionError("STOR", filePath); err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if c.isAppendOnly(filePath) {
+		// the existing files can't be replaced
+		flags |= os.O_EXCL
+	}
+
+	file, err := c.getFileHandle(filePath, flags, 0)
+	if err != nil {
+		return err
+	}
+
+	max := c.server.settings.MaxExtractEntrySize
+	if max > 0 {
+		content = io.LimitReader(content, max+1)
+	}
+
+	var out io.Writer = file
+
+	sniffer := c.newContentTypeWriter(file)
+	if sniffer != nil {
+		out = sniffer
+	}
+
+	written, err := c.server.bufferPool.copy(out, content)
+	if err == nil && max > 0 && written > max {
+		err = fmt.Errorf("%w: %v is larger than %d bytes", errExtractEntryTooLarge, filePath, max)
+	}
+
+	if err == nil && sniffer != nil {
+		err = sniffer.Close()
+	}
+
+	if errClose := c.closeFile(file); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		if errRemove := c.driver.Remove(filePath); errRemove != nil {
+			c.logger.Warn("Could not remove a partially extracted file", "path", filePath, "err", errRemove)
+		}
+	}
+
+	return err
+}
+
+// createDirectories creates the missing directories of a path, each of them must be allowed by the filename
+// policy and the permissions
+func (e *archiveExtractor) createDirectories(dirPath string) error {
+	c := e.c
+
+	for _, dir := range c.missingDirectories(dirPath) {
+		if _, err := c.stat(dir); err == nil {
+			continue
+		}
+
+		if policy := c.getFilenamePolicy(); policy != nil {
+			if _, err := policy.apply(dir); err != nil {
+				return err
+			}
+		}
+
+		if err := c.permissionError("MKD", dir); err != nil {
+			return err
+		}
+
+		if err := c.driver.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
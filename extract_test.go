@@ -0,0 +1,228 @@
+package ftpserver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newZipArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+
+	archive := zip.NewWriter(&buf)
+
+	for name, content := range files {
+		w, err := archive.Create(name)
+		require.NoError(t, err)
+
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, archive.Close())
+
+	return buf.Bytes()
+}
+
+func newTarGzipArchive(t *testing.T) []byte {
+	var buf bytes.Buffer
+
+	compressed := gzip.NewWriter(&buf)
+	archive := tar.NewWriter(compressed)
+
+	for _, header := range []*tar.Header{
+		{Name: "site/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "site/index.html", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "site/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"},
+	} {
+		require.NoError(t, archive.WriteHeader(header))
+
+		if header.Size > 0 {
+			_, err := archive.Write([]byte("hello"))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, archive.Close())
+	require.NoError(t, compressed.Close())
+
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EnableExtract: true, MaxExtractEntrySize: 10},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, driver.fs.MkdirAll("/upload", 0755))
+	require.NoError(t, afero.WriteFile(driver.fs, "/upload/site.tgz", newTarGzipArchive(t), 0644))
+	require.NoError(t, afero.WriteFile(driver.fs, "/upload/docs.zip",
+		newZipArchive(t, map[string]string{"a.txt": "first", "sub/b.txt": "second"}), 0644))
+	require.NoError(t, afero.WriteFile(driver.fs, "/upload/evil.zip",
+		newZipArchive(t, map[string]string{"../../evil.txt": "evil"}), 0644))
+	require.NoError(t, afero.WriteFile(driver.fs, "/upload/large.zip",
+		newZipArchive(t, map[string]string{"large.txt": "more than ten bytes"}), 0644))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// next to the archive by default
+	rc, response, err := raw.SendCommand("SITE EXTRACT /upload/site.tgz")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+	require.Equal(t, "Extracted 2 entries to /upload", response)
+
+	content, err := afero.ReadFile(driver.fs, "/upload/site/index.html")
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+
+	// the links aren't extracted
+	_, err = driver.fs.Stat("/upload/site/link")
+	require.True(t, os.IsNotExist(err), err)
+
+	rc, response, err = raw.SendCommand("SITE EXTRACT /upload/docs.zip /docs")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	content, err = afero.ReadFile(driver.fs, "/docs/sub/b.txt")
+	require.NoError(t, err)
+	require.Equal(t, "second", string(content))
+
+	// the entries can't leave the directory
+	rc, response, err = raw.SendCommand("SITE EXTRACT /upload/evil.zip /docs")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+	require.Contains(t, response, errUnsafeArchiveEntry.Error())
+
+	_, err = driver.fs.Stat("/evil.txt")
+	require.True(t, os.IsNotExist(err), err)
+
+	// the too large entries are removed
+	rc, response, err = raw.SendCommand("SITE EXTRACT /upload/large.zip")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+	require.Contains(t, response, errExtractEntryTooLarge.Error())
+
+	_, err = driver.fs.Stat("/upload/large.txt")
+	require.True(t, os.IsNotExist(err), err)
+
+	for params, code := range map[string]int{
+		"/upload/site.rar":    StatusNotImplementedParam,
+		"/upload/missing.zip": StatusActionNotTaken,
+		"":                    StatusSyntaxErrorParameters,
+	} {
+		rc, response, err = raw.SendCommand("SITE EXTRACT " + params)
+		require.NoError(t, err)
+		require.Equal(t, code, rc, params+": "+response)
+	}
+}
+
+func TestExtractEntryPath(t *testing.T) {
+	extractor := &archiveExtractor{dir: "/dest"}
+
+	for name, expected := range map[string]string{
+		"file.txt":        "/dest/file.txt",
+		"/etc/passwd":     "/dest/etc/passwd",
+		"dir\\file.txt":   "/dest/dir/file.txt",
+		"./dir/":          "/dest/dir",
+		"dir/../file.txt": "",
+		"..\\file.txt":    "",
+	} {
+		entryPath, err := extractor.getEntryPath(name)
+		if expected == "" {
+			require.ErrorIs(t, err, errUnsafeArchiveEntry, name)
+		} else {
+			require.NoError(t, err, name)
+			require.Equal(t, expected, entryPath, name)
+		}
+	}
+}
+
+func TestExtractPolicies(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			EnableExtract:     true,
+			FilenamePolicy:    &FilenamePolicy{DeniedPatterns: []string{"*.exe"}},
+			ContentTypePolicy: &ContentTypePolicy{Denied: []string{"text/html"}},
+		},
+		PermissionChecker: func(_, verb, dirPath string) error {
+			if verb == "MKD" && dirPath == "/denied" {
+				return errReadOnly
+			}
+
+			return nil
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.Equal(t, int64(defaultMaxExtractEntrySize), s.settings.MaxExtractEntrySize)
+	require.Equal(t, defaultMaxExtractEntries, s.settings.MaxExtractEntries)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/docs.zip",
+		newZipArchive(t, map[string]string{"a.txt": "first"}), 0644))
+	require.NoError(t, afero.WriteFile(driver.fs, "/bin.zip",
+		newZipArchive(t, map[string]string{"bin.exe/a.txt": "first"}), 0644))
+	require.NoError(t, afero.WriteFile(driver.fs, "/page.zip",
+		newZipArchive(t, map[string]string{"page.txt": "<html><body>page</body></html>"}), 0644))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the created directories are checked like MKD
+	rc, response, err := raw.SendCommand("SITE EXTRACT /docs.zip /denied")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+
+	_, err = driver.fs.Stat("/denied")
+	require.True(t, os.IsNotExist(err), err)
+
+	// the parent directories of the entries are subject to the filename policy
+	rc, response, err = raw.SendCommand("SITE EXTRACT /bin.zip /bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+
+	_, err = driver.fs.Stat("/bin/bin.exe")
+	require.True(t, os.IsNotExist(err), err)
+
+	// and the extracted files to the content type policy
+	rc, response, err = raw.SendCommand("SITE EXTRACT /page.zip /page")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+
+	_, err = driver.fs.Stat("/page/page.txt")
+	require.True(t, os.IsNotExist(err), err)
+}
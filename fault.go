@@ -0,0 +1,130 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// FaultInjection makes the server fail on purpose, to check in integration tests how the clients retry and how
+// the server and the drivers clean up after the failures. It must not be used in production.
+type FaultInjection struct {
+	DriverDelay     time.Duration  // Delay added to the driver calls (Open, Stat, ReadDir)
+	DriverErrorRate float64        // Probability (0 to 1) that a driver call fails with ErrInjectedFault
+	DataDropRate    float64        // Probability that a transfer connection is dropped during the transfer
+	DataDropAfter   int64          // Bytes transferred before a transfer connection is dropped
+	Random          func() float64 // Source of the probabilities, math/rand by default. It must be concurrency safe
+}
+
+// ErrInjectedFault is the temporary error of the driver calls failed by the FaultInjection
+var ErrInjectedFault error = injectedFaultError{}
+
+type injectedFaultError struct{}
+
+func (injectedFaultError) Error() string   { return "injected fault" }
+func (injectedFaultError) Temporary() bool { return true }
+
+var (
+	// errInjectedDrop is returned by the transfer connections dropped by the FaultInjection
+	errInjectedDrop = errors.New("transfer connection dropped by the fault injection")
+	// errInvalidFaultInjection is returned for a FaultInjection with invalid values
+	errInvalidFaultInjection = errors.New("invalid fault injection")
+)
+
+// validate checks the values of the faults
+func (faults *FaultInjection) validate() error {
+	if faults.DriverErrorRate < 0 || faults.DriverErrorRate > 1 || faults.DataDropRate < 0 || faults.DataDropRate > 1 {
+		return fmt.Errorf("%w: the rates must be between 0 and 1", errInvalidFaultInjection)
+	}
+
+	if faults.DriverDelay < 0 || faults.DataDropAfter < 0 {
+		return fmt.Errorf("%w: DriverDelay and DataDropAfter can't be negative", errInvalidFaultInjection)
+	}
+
+	return nil
+}
+
+// happens tells if a fault of the given rate happens this time
+func (faults *FaultInjection) happens(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+
+	random := rand.Float64 // nolint: gosec
+	if faults.Random != nil {
+		random = faults.Random
+	}
+
+	return random() < rate
+}
+
+// injectDriverFault delays a driver call and makes it fail at the DriverErrorRate
+func (faults *FaultInjection) injectDriverFault(call func() error) func() error {
+	return func() error {
+		if faults.DriverDelay > 0 {
+			time.Sleep(faults.DriverDelay)
+		}
+
+		if faults.happens(faults.DriverErrorRate) {
+			return ErrInjectedFault
+		}
+
+		return call()
+	}
+}
+
+// injectDataFault makes a transfer connection drop after DataDropAfter bytes at the DataDropRate
+func (faults *FaultInjection) injectDataFault(conn net.Conn) net.Conn {
+	if !faults.happens(faults.DataDropRate) {
+		return conn
+	}
+
+	return &droppingConn{Conn: conn, remaining: faults.DataDropAfter}
+}
+
+// droppingConn is a transfer connection closed once a number of bytes were transferred
+type droppingConn struct {
+	net.Conn
+	remaining int64
+}
+
+func (c *droppingConn) Read(b []byte) (int, error) {
+	if c.remaining <= 0 {
+		return 0, c.drop()
+	}
+
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+
+	n, err := c.Conn.Read(b)
+	c.remaining -= int64(n)
+
+	return n, err
+}
+
+func (c *droppingConn) Write(b []byte) (int, error) {
+	if int64(len(b)) <= c.remaining {
+		n, err := c.Conn.Write(b)
+		c.remaining -= int64(n)
+
+		return n, err
+	}
+
+	n, err := c.Conn.Write(b[:c.remaining])
+	c.remaining -= int64(n)
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, c.drop()
+}
+
+func (c *droppingConn) drop() error {
+	_ = c.Conn.Close()
+
+	return errInjectedDrop
+}
@@ -0,0 +1,127 @@
+package ftpserver
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sync/atomic"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjectionDriverErrors(t *testing.T) {
+	var calls int32
+
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			DefaultTransferType: TransferTypeBinary,
+			Faults: &FaultInjection{
+				DriverErrorRate: 0.5,
+				// only the first call fails
+				Random: func() float64 {
+					if atomic.AddInt32(&calls, 1) == 1 {
+						return 0
+					}
+
+					return 1
+				},
+			},
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", []byte("content"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("SIZE file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionNotTaken, rc, response)
+	require.Contains(t, response, ErrInjectedFault.Error())
+
+	rc, response, err = raw.SendCommand("SIZE file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, response)
+
+	// the injected faults are retried as the other temporary errors
+	atomic.StoreInt32(&calls, 0)
+	s.settings.DriverRetries = 1
+	s.settings.DriverRetryDelay = 1
+
+	rc, response, err = raw.SendCommand("SIZE file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, response)
+}
+
+func TestFaultInjectionDataDrop(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			DefaultTransferType: TransferTypeBinary,
+			Faults:              &FaultInjection{DataDropRate: 1, DataDropAfter: 10},
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", bytes.Repeat([]byte("0123456789"), 100), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("RETR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	// the download is cut after 10 bytes
+	content, err := ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(content))
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+	require.Contains(t, response, errInjectedDrop.Error())
+}
+
+func TestFaultInjectionValidation(t *testing.T) {
+	err := (&Settings{Faults: &FaultInjection{DataDropRate: 2}}).Validate()
+	require.True(t, errors.Is(err, ErrInvalidSettings), err)
+	require.Contains(t, err.Error(), "the rates must be between 0 and 1")
+
+	err = (&Settings{Faults: &FaultInjection{DataDropAfter: -1}}).Validate()
+	require.True(t, errors.Is(err, ErrInvalidSettings), err)
+}
@@ -0,0 +1,145 @@
+package ftpserver
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// chmodRecursiveMaxFiles is the maximum number of files a recursive SITE CHMOD can change
+const chmodRecursiveMaxFiles = 10000
+
+var (
+	errInvalidFileMode   = errors.New("invalid file mode")
+	errChmodTooManyFiles = errors.New("too many files to change")
+)
+
+const (
+	fileModeSpecial = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	fileModeAll     = os.ModePerm | fileModeSpecial
+)
+
+// fileModeChanger returns the new mode of a file from its current mode
+type fileModeChanger func(current os.FileMode) os.FileMode
+
+// parseFileMode parses an octal (755) or a symbolic (u+x,go-w) mode
+func parseFileMode(mode string) (fileModeChanger, error) {
+	if modeNb, err := strconv.ParseUint(mode, 8, 32); err == nil {
+		return func(os.FileMode) os.FileMode {
+			return os.FileMode(modeNb)
+		}, nil
+	}
+
+	clauses, err := parseSymbolicMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(current os.FileMode) os.FileMode {
+		result := current & fileModeAll
+
+		for _, clause := range clauses {
+			result = clause.apply(result, current.IsDir())
+		}
+
+		return result
+	}, nil
+}
+
+// symbolicModeClause is one action of a symbolic mode like "go-w"
+type symbolicModeClause struct {
+	who   os.FileMode // bits the clause can change
+	op    byte        // '+', '-' or '='
+	perms string      // permissions letters
+}
+
+// parseSymbolicMode parses comma separated clauses like "u+x,go-w" or "a=rw"
+func parseSymbolicMode(mode string) ([]symbolicModeClause, error) {
+	clauses := make([]symbolicModeClause, 0, 1)
+
+	for _, clause := range strings.Split(mode, ",") {
+		var who os.FileMode
+
+		i := 0
+		for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+			who |= getSymbolicModeWho(clause[i])
+		}
+
+		if who == 0 {
+			who = getSymbolicModeWho('a')
+		}
+
+		// a clause needs at least one operation, and can have several of them (u+x-w)
+		if i == len(clause) {
+			return nil, errInvalidFileMode
+		}
+
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return nil, errInvalidFileMode
+			}
+
+			end := strings.IndexFunc(clause[i+1:], func(r rune) bool { return !strings.ContainsRune("rwxXst", r) })
+			if end < 0 {
+				end = len(clause)
+			} else {
+				end += i + 1
+			}
+
+			clauses = append(clauses, symbolicModeClause{who: who, op: op, perms: clause[i+1 : end]})
+			i = end
+		}
+	}
+
+	return clauses, nil
+}
+
+func getSymbolicModeWho(who byte) os.FileMode {
+	switch who {
+	case 'u':
+		return 0700 | os.ModeSetuid
+	case 'g':
+		return 0070 | os.ModeSetgid
+	case 'o':
+		return 0007 | os.ModeSticky
+	default:
+		return fileModeAll
+	}
+}
+
+func (clause *symbolicModeClause) apply(mode os.FileMode, isDir bool) os.FileMode {
+	var bits os.FileMode
+
+	for _, perm := range clause.perms {
+		switch perm {
+		case 'r':
+			bits |= 0444
+		case 'w':
+			bits |= 0222
+		case 'x':
+			bits |= 0111
+		case 'X':
+			// execute only for directories or files already executable by someone
+			if isDir || mode&0111 != 0 {
+				bits |= 0111
+			}
+		case 's':
+			bits |= os.ModeSetuid | os.ModeSetgid
+		case 't':
+			bits |= os.ModeSticky
+		}
+	}
+
+	bits &= clause.who
+
+	switch clause.op {
+	case '+':
+		return mode | bits
+	case '-':
+		return mode &^ bits
+	default:
+		return mode&^clause.who | bits
+	}
+}
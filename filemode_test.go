@@ -0,0 +1,39 @@
+package ftpserver
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFileMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		current  os.FileMode
+		expected os.FileMode
+	}{
+		{"600", 0644, 0600},
+		{"u+x", 0644, 0744},
+		{"go-w", 0666, 0644},
+		{"+x", 0644, 0755},
+		{"a=r", 0755, 0444},
+		{"u=rwx,g=rx,o=", 0600, 0750},
+		{"u+x-w", 0644, 0544},
+		{"o+X", 0644, 0644},
+		{"o+X", 0744, 0745},
+		{"o+X", os.ModeDir | 0700, 0701},
+		{"u+s,+t", 0755, 0755 | os.ModeSetuid | os.ModeSticky},
+	}
+
+	for _, test := range tests {
+		changeMode, err := parseFileMode(test.mode)
+		require.NoError(t, err, test.mode)
+		require.Equal(t, test.expected, changeMode(test.current), test.mode)
+	}
+
+	for _, mode := range []string{"a", "", "u+x,", "z+x", "u+y", "999"} {
+		_, err := parseFileMode(mode)
+		require.ErrorIs(t, err, errInvalidFileMode, mode)
+	}
+}
@@ -0,0 +1,95 @@
+package ftpserver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// FilenamePolicy restricts the names of the files and directories created by the clients (STOR, APPE,
+// MKD, SITE MKDIR and RNTO). The names it refuses get a 553 reply.
+type FilenamePolicy struct {
+	NormalizeNFC      bool     // Convert the paths to the Unicode NFC form, the driver gets the normalized path
+	DeniedPatterns    []string // Patterns (path.Match syntax) of the denied names, like "*.exe" or ".*", case insensitive
+	AllowedCharacters string   // Characters allowed in the names, all of them if empty
+	MaxDepth          int      // Maximum number of elements of the paths, unlimited if 0
+	MaxLength         int      // Maximum length in bytes of the paths, unlimited if 0
+}
+
+// apply checks a path against the policy and returns it normalized
+func (policy *FilenamePolicy) apply(filePath string) (string, error) {
+	if policy.NormalizeNFC {
+		filePath = norm.NFC.String(filePath)
+	}
+
+	if policy.MaxLength > 0 && len(filePath) > policy.MaxLength {
+		return "", fmt.Errorf("%w: %s is longer than %d bytes", ErrFileNameNotAllowed, filePath, policy.MaxLength)
+	}
+
+	if depth := len(strings.Split(strings.Trim(filePath, "/"), "/")); policy.MaxDepth > 0 && depth > policy.MaxDepth {
+		return "", fmt.Errorf("%w: %s is deeper than %d levels", ErrFileNameNotAllowed, filePath, policy.MaxDepth)
+	}
+
+	name := path.Base(filePath)
+
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: %q isn't valid UTF-8", ErrFileNameNotAllowed, name)
+	}
+
+	for _, pattern := range policy.DeniedPatterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(name)); matched {
+			return "", fmt.Errorf("%w: %s matches the denied pattern %s", ErrFileNameNotAllowed, name, pattern)
+		}
+	}
+
+	if policy.AllowedCharacters != "" {
+		for _, r := range name {
+			if !strings.ContainsRune(policy.AllowedCharacters, r) {
+				return "", fmt.Errorf("%w: %s contains the character %q", ErrFileNameNotAllowed, name, r)
+			}
+		}
+	}
+
+	return filePath, nil
+}
+
+// validate checks the patterns of the policy
+func (policy *FilenamePolicy) validate() error {
+	for _, pattern := range policy.DeniedPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid FilenamePolicy pattern %#v: %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// getFilenamePolicy returns the policy of the user, nil if there is none
+func (c *clientHandler) getFilenamePolicy() *FilenamePolicy {
+	if provider, ok := c.driver.(ClientDriverExtensionFilenamePolicy); ok {
+		return provider.GetFilenamePolicy()
+	}
+
+	return c.server.settings.FilenamePolicy
+}
+
+// checkFilename applies the filename policy to the path of a file or directory to create. It returns the
+// path to use, or replies 553 and returns false if the name isn't allowed.
+func (c *clientHandler) checkFilename(filePath string) (string, bool) {
+	policy := c.getFilenamePolicy()
+	if policy == nil {
+		return filePath, true
+	}
+
+	normalized, err := policy.apply(filePath)
+	if err != nil {
+		c.writeMessage(StatusActionNotTakenNoFile, err.Error())
+
+		return "", false
+	}
+
+	return normalized, true
+}
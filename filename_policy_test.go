@@ -0,0 +1,103 @@
+package ftpserver
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilenamePolicyApply(t *testing.T) {
+	policy := &FilenamePolicy{
+		NormalizeNFC:      true,
+		DeniedPatterns:    []string{"*.exe", ".*"},
+		AllowedCharacters: "abcdefghijklmnopqrstuvwxyz\u00e9._-",
+		MaxDepth:          3,
+		MaxLength:         32,
+	}
+
+	// "e" followed by a combining acute accent
+	normalized, err := policy.apply("/dir/cafe\u0301.txt")
+	require.NoError(t, err)
+	require.Equal(t, "/dir/caf\u00e9.txt", normalized)
+
+	for _, name := range []string{
+		"/dir/setup.EXE",
+		"/dir/.hidden",
+		"/dir/UPPER.txt",
+		"/a/b/c/d",
+		"/dir/" + string(bytes.Repeat([]byte("a"), 32)),
+		"/dir/invalid\xff",
+	} {
+		_, err = policy.apply(name)
+		require.True(t, errors.Is(err, ErrFileNameNotAllowed), name)
+	}
+
+	require.Error(t, (&FilenamePolicy{DeniedPatterns: []string{"[a"}}).validate())
+}
+
+func TestFilenamePolicy(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{FilenamePolicy: &FilenamePolicy{DeniedPatterns: []string{"*.exe"}}},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	err = c.Store("setup.exe", bytes.NewReader([]byte("data")))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "553")
+
+	require.NoError(t, c.Store("file.txt", bytes.NewReader([]byte("data"))))
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("MKD dir.exe")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+	require.Contains(t, response, "denied pattern *.exe")
+
+	// the parent directories created by SITE MKDIR are checked too
+	rc, response, err = raw.SendCommand("SITE MKDIR dir.exe/sub")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+
+	_, err = driver.fs.Stat("/dir.exe")
+	require.True(t, os.IsNotExist(err))
+
+	rc, response, err = raw.SendCommand("RNFR file.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand("RNTO file.exe")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+
+	_, err = driver.fs.Stat("/file.txt")
+	require.NoError(t, err)
+
+	// the policy of the user replaces the one of the settings
+	driver.UserFilenamePolicy = &FilenamePolicy{MaxDepth: 1}
+
+	rc, response, err = raw.SendCommand("MKD other.exe")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+
+	rc, response, err = raw.SendCommand("SITE MKDIR /a/b")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+}
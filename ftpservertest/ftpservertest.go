@@ -0,0 +1,183 @@
+// Package ftpservertest starts FTP servers for the integration tests of the drivers: the server listens on an
+// ephemeral port of the loopback interface, with a temporary TLS certificate, and a client is connected to it.
+//
+//	type testDriver struct {
+//		*ftpservertest.Driver
+//	}
+//
+//	server, client := ftpservertest.Start(t, &testDriver{Driver: ftpservertest.NewDriver(t, nil)},
+//		ftpservertest.Options{User: "user", Password: "pass", TLS: true})
+package ftpservertest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+	"github.com/fclairamb/ftpserverlib/log"
+)
+
+// serverName is the name of the temporary certificate, used by the client to verify it
+const serverName = "localhost"
+
+// Driver implements the settings part of ftpserver.MainDriver for the tests. It is meant to be embedded in
+// the main driver under test, which only has to implement the authentication and the client drivers selection.
+type Driver struct {
+	settings  *ftpserver.Settings
+	tlsConfig *tls.Config
+}
+
+// NewDriver creates a Driver with a copy of the settings (the default ones if nil) listening on an ephemeral
+// port of the loopback interface, and a temporary self-signed certificate
+func NewDriver(t testing.TB, settings *ftpserver.Settings) *Driver {
+	driver := &Driver{settings: &ftpserver.Settings{}}
+
+	if settings != nil {
+		*driver.settings = *settings
+	}
+
+	driver.settings.Listener = nil
+	driver.settings.ListenAddr = "127.0.0.1:0"
+
+	certificate, err := newCertificate()
+	require.NoError(t, err, "Couldn't create the TLS certificate")
+
+	driver.tlsConfig = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+	}
+
+	return driver
+}
+
+// GetSettings returns the settings of the driver
+func (d *Driver) GetSettings() (*ftpserver.Settings, error) {
+	return d.settings, nil
+}
+
+// GetTLSConfig returns the TLS config of the temporary certificate
+func (d *Driver) GetTLSConfig() (*tls.Config, error) {
+	return d.tlsConfig, nil
+}
+
+// newCertificate creates a self-signed certificate for the loopback interface, valid for a day
+func newCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{Organization: []string{"ftpservertest"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{serverName},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// Options are the options of Start
+type Options struct {
+	User            string      // User of the client
+	Password        string      // Password of the client
+	TLS             bool        // Use TLS: explicit, or implicit if the server requires it (ImplicitEncryption)
+	ClientTLSConfig *tls.Config // (Optional) TLS config of the client, it trusts the driver certificate by default
+	Logger          log.Logger  // (Optional) Logger of the server, nothing is logged by default
+}
+
+// Start starts a server for the driver and returns it with a client logging in as opts.User on its first
+// command. The client is closed and the server stopped at the end of the test.
+func Start(t testing.TB, driver ftpserver.MainDriver, opts Options) (*ftpserver.FtpServer, *goftp.Client) {
+	server := ftpserver.NewFtpServer(driver)
+	if opts.Logger != nil {
+		server.Logger = opts.Logger
+	}
+
+	require.NoError(t, server.Listen(), "Couldn't listen")
+
+	served := make(chan error, 1)
+
+	go func() { served <- server.Serve() }()
+
+	config := goftp.Config{
+		User:     opts.User,
+		Password: opts.Password,
+		Timeout:  10 * time.Second,
+	}
+
+	if opts.TLS {
+		config.TLSConfig = opts.ClientTLSConfig
+		if config.TLSConfig == nil {
+			config.TLSConfig = newClientTLSConfig(t, driver)
+		}
+
+		settings, err := driver.GetSettings()
+		require.NoError(t, err)
+
+		if settings.TLSRequired == ftpserver.ImplicitEncryption {
+			config.TLSMode = goftp.TLSImplicit
+		}
+	}
+
+	client, err := goftp.DialConfig(config, server.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	t.Cleanup(func() {
+		require.NoError(t, client.Close())
+		require.NoError(t, server.Stop())
+		require.NoError(t, <-served)
+	})
+
+	return server, client
+}
+
+// newClientTLSConfig creates a client TLS config trusting the certificate of the driver
+func newClientTLSConfig(t testing.TB, driver ftpserver.MainDriver) *tls.Config {
+	serverConfig, err := driver.GetTLSConfig()
+	require.NoError(t, err, "Couldn't get the TLS config")
+
+	roots := x509.NewCertPool()
+
+	for _, certificate := range serverConfig.Certificates {
+		for _, der := range certificate.Certificate {
+			parsed, errParse := x509.ParseCertificate(der)
+			require.NoError(t, errParse)
+			roots.AddCert(parsed)
+		}
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		RootCAs:    roots,
+	}
+}
@@ -0,0 +1,78 @@
+package ftpservertest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	ftpserver "github.com/fclairamb/ftpserverlib"
+)
+
+var errBadCredentials = errors.New("bad credentials")
+
+type testDriver struct {
+	*Driver
+	fs afero.Fs
+}
+
+func (d *testDriver) ClientConnected(ftpserver.ClientContext) (string, error) {
+	return "ftpservertest", nil
+}
+
+func (d *testDriver) ClientDisconnected(ftpserver.ClientContext) {}
+
+func (d *testDriver) AuthUser(_ ftpserver.ClientContext, user, pass string) (ftpserver.ClientDriver, error) {
+	if user != "user" || pass != "pass" {
+		return nil, errBadCredentials
+	}
+
+	return d.fs, nil
+}
+
+func TestStart(t *testing.T) {
+	for name, settings := range map[string]*ftpserver.Settings{
+		"clear":    nil,
+		"explicit": {TLSRequired: ftpserver.MandatoryEncryption},
+		"implicit": {TLSRequired: ftpserver.ImplicitEncryption},
+	} {
+		settings := settings
+
+		t.Run(name, func(t *testing.T) {
+			driver := &testDriver{Driver: NewDriver(t, settings), fs: afero.NewMemMapFs()}
+			server, client := Start(t, driver, Options{User: "user", Password: "pass", TLS: settings != nil})
+
+			require.NotEqual(t, "127.0.0.1:0", server.Addr())
+			require.NoError(t, client.Store("file.txt", bytes.NewReader([]byte("content"))))
+
+			content, err := afero.ReadFile(driver.fs, "/file.txt")
+			require.NoError(t, err)
+			require.Equal(t, "content", string(content))
+
+			var downloaded bytes.Buffer
+
+			require.NoError(t, client.Retrieve("file.txt", &downloaded))
+			require.Equal(t, "content", downloaded.String())
+		})
+	}
+}
+
+func TestNewDriver(t *testing.T) {
+	settings := &ftpserver.Settings{ListenAddr: "0.0.0.0:21", IdleTimeout: 60}
+	driver := NewDriver(t, settings)
+
+	driverSettings, err := driver.GetSettings()
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:0", driverSettings.ListenAddr)
+	require.Equal(t, 60, driverSettings.IdleTimeout)
+
+	// the settings of the caller are left untouched
+	require.Equal(t, "0.0.0.0:21", settings.ListenAddr)
+
+	tlsConfig, err := driver.GetTLSConfig()
+	require.NoError(t, err)
+	require.NoError(t, tlsConfig.Certificates[0].Leaf.VerifyHostname(serverName))
+	require.NoError(t, tlsConfig.Certificates[0].Leaf.VerifyHostname("127.0.0.1"))
+}
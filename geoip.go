@@ -0,0 +1,157 @@
+package ftpserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// GeoLocation is the location of a client, given by MainDriverExtensionGeoLocator
+type GeoLocation struct {
+	Country      string // ISO 3166-1 alpha-2 code ("FR"), empty if unknown
+	ASN          uint32 // Autonomous system number, 0 if unknown
+	Organization string // Organization of the autonomous system
+}
+
+// CountryCounters counts the connections from a country, see FtpServer.CountryCounters
+type CountryCounters struct {
+	Connections uint64 // Accepted connections
+	Rejected    uint64 // Connections refused by AllowedCountries or DeniedCountries
+}
+
+// unknownCountry is the key of the countries counters for the clients that couldn't be located
+const unknownCountry = "unknown"
+
+// countriesCounters counts the connections per country
+type countriesCounters struct {
+	counters map[string]*CountryCounters
+	mu       sync.Mutex
+}
+
+func (cc *countriesCounters) count(country string, rejected bool) {
+	if country == "" {
+		country = unknownCountry
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.counters == nil {
+		cc.counters = make(map[string]*CountryCounters)
+	}
+
+	counters := cc.counters[country]
+	if counters == nil {
+		counters = &CountryCounters{}
+		cc.counters[country] = counters
+	}
+
+	if rejected {
+		counters.Rejected++
+	} else {
+		counters.Connections++
+	}
+}
+
+func (cc *countriesCounters) get() map[string]CountryCounters {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	counters := make(map[string]CountryCounters, len(cc.counters))
+	for country, c := range cc.counters {
+		counters[country] = *c
+	}
+
+	return counters
+}
+
+// CountryCounters returns the connections counters per country, "unknown" for the clients that couldn't be
+// located. It is empty if the driver doesn't implement MainDriverExtensionGeoLocator.
+func (server *FtpServer) CountryCounters() map[string]CountryCounters {
+	return server.countries.get()
+}
+
+// validateCountries checks the AllowedCountries and DeniedCountries settings
+func validateCountries(name string, countries []string) []string {
+	var problems []string
+
+	for _, country := range countries {
+		if len(country) != 2 {
+			problems = append(problems, fmt.Sprintf("invalid country code %#v in %s", country, name))
+		}
+	}
+
+	return problems
+}
+
+// isCountryAllowed applies the AllowedCountries and DeniedCountries settings
+func (s *Settings) isCountryAllowed(country string) bool {
+	for _, denied := range s.DeniedCountries {
+		if strings.EqualFold(denied, country) {
+			return false
+		}
+	}
+
+	if len(s.AllowedCountries) == 0 {
+		return true
+	}
+
+	for _, allowed := range s.AllowedCountries {
+		if strings.EqualFold(allowed, country) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// locateClient locates the client with the MainDriverExtensionGeoLocator and applies the countries
+// restrictions, it returns false if the connection is refused
+func (c *clientHandler) locateClient() bool {
+	locator, ok := c.server.driver.(MainDriverExtensionGeoLocator)
+	if !ok {
+		return true
+	}
+
+	var location *GeoLocation
+
+	if ip := getIPFromAddr(c.RemoteAddr()); ip != nil {
+		var err error
+
+		if location, err = locator.LocateClient(c, ip); err != nil {
+			c.logger.Warn("Could not locate the client", "err", err)
+		}
+	}
+
+	var country string
+
+	if location != nil {
+		country = strings.ToUpper(location.Country)
+
+		c.paramsMutex.Lock()
+		c.location = location
+		c.paramsMutex.Unlock()
+
+		c.logger = c.logger.With("country", country, "asn", location.ASN)
+	}
+
+	settings := c.server.settings
+	if (len(settings.AllowedCountries) > 0 || len(settings.DeniedCountries) > 0) && !settings.isCountryAllowed(country) {
+		c.server.countries.count(country, true)
+		c.emitSecurityEvent(SecurityEventCountryRejected, fmt.Sprintf("connection from country %#v refused", country))
+
+		return false
+	}
+
+	c.server.countries.count(country, false)
+
+	return true
+}
+
+// GetGeoLocation returns the location of the client, nil if it isn't known
+func (c *clientHandler) GetGeoLocation() *GeoLocation {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.location
+}
@@ -0,0 +1,91 @@
+package ftpserver
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGeoLocation(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:        true,
+		GeoLocations: map[string]*GeoLocation{"127.0.0.1": {Country: "fr", ASN: 64496, Organization: "Example"}},
+		Settings:     &Settings{AllowedCountries: []string{"FR", "BE"}},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+
+	driver.clientMU.Lock()
+	location := driver.Clients[0].GetGeoLocation()
+	driver.clientMU.Unlock()
+
+	require.Equal(t, &GeoLocation{Country: "fr", ASN: 64496, Organization: "Example"}, location)
+	require.Equal(t, map[string]CountryCounters{"FR": {Connections: 1}}, s.CountryCounters())
+}
+
+func TestGeoLocationRejected(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:        true,
+		GeoLocations: map[string]*GeoLocation{"127.0.0.1": {Country: "FR"}},
+		Settings:     &Settings{DeniedCountries: []string{"fr"}},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	buf := make([]byte, 128)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "421 Service not available from your location\r\n", string(buf[:n]))
+
+	// ClientConnected isn't called
+	driver.clientMU.Lock()
+	require.Empty(t, driver.Clients)
+	driver.clientMU.Unlock()
+
+	require.Equal(t, map[string]CountryCounters{"FR": {Rejected: 1}}, s.CountryCounters())
+	require.Equal(t, []SecurityEventType{SecurityEventCountryRejected}, driver.getSecurityEvents())
+}
+
+func TestGeoLocationUnknownCountry(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{AllowedCountries: []string{"FR"}},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	buf := make([]byte, 128)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "421 Service not available from your location\r\n", string(buf[:n]))
+	require.Equal(t, map[string]CountryCounters{"unknown": {Rejected: 1}}, s.CountryCounters())
+}
+
+func TestCountriesValidation(t *testing.T) {
+	err := (&Settings{DeniedCountries: []string{"FRA"}}).Validate()
+	require.True(t, errors.Is(err, ErrInvalidSettings), err)
+	require.Contains(t, err.Error(), `invalid country code "FRA" in DeniedCountries`)
+}
@@ -7,7 +7,8 @@ require (
 	github.com/secsy/goftp v0.0.0-20200609142545-aa2de14babf4
 	github.com/spf13/afero v1.6.0
 	github.com/stretchr/testify v1.7.0
-	golang.org/x/text v0.3.4 // indirect
+	golang.org/x/text v0.3.4
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 replace github.com/secsy/goftp => github.com/drakkan/goftp v0.0.0-20201220151643-27b7174e8caf
@@ -2,7 +2,9 @@ package ftpserver // nolint
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"strings"
 )
 
 // Handle the "USER" command
@@ -13,6 +15,14 @@ func (c *clientHandler) handleUSER(param string) error {
 		return nil
 	}
 
+	if !c.HasTLSForControl() && c.server.hasRecentTLSLogin(c.remoteIP()) {
+		c.emitSecurityEvent(SecurityEventPlaintextLogin,
+			fmt.Sprintf("plaintext login of %s refused after a TLS login from the same IP", param))
+		c.writeMessage(StatusNotLoggedIn, "TLS is required, this client previously used it")
+
+		return nil
+	}
+
 	if c.HasTLSForControl() {
 		if verifier, ok := c.server.driver.(MainDriverExtensionTLSVerifier); ok {
 			if tlsConn, ok := c.conn.(*tls.Conn); ok {
@@ -20,7 +30,7 @@ func (c *clientHandler) handleUSER(param string) error {
 
 				if err != nil {
 					c.writeMessage(StatusNotLoggedIn, fmt.Sprintf("TLS verification failed: %v", err))
-					c.disconnect()
+					c.disconnect(CloseReasonAuthFailure)
 
 					return nil
 				}
@@ -28,7 +38,14 @@ func (c *clientHandler) handleUSER(param string) error {
 				if driver != nil {
 					c.user = param
 					c.driver = driver
-					c.writeMessage(StatusUserLoggedIn, "TLS certificate ok, continue")
+					c.server.recordTLSLogin(c.remoteIP())
+
+					if !c.acceptSession() {
+						return nil
+					}
+
+					c.setState(StateLoggedIn)
+					c.writeLoginReply("TLS certificate ok, continue")
 
 					return nil
 				}
@@ -37,6 +54,12 @@ func (c *clientHandler) handleUSER(param string) error {
 	}
 
 	c.user = param
+
+	// a logged in user stays logged in until the next PASS
+	if c.sessionState() != StateLoggedIn {
+		c.setState(StateAuthenticating)
+	}
+
 	c.writeMessage(StatusUserOK, "OK")
 
 	return nil
@@ -44,19 +67,62 @@ func (c *clientHandler) handleUSER(param string) error {
 
 // Handle the "PASS" command
 func (c *clientHandler) handlePASS(param string) error {
-	var err error
-	c.driver, err = c.server.driver.AuthUser(c, c.user, param)
+	c.login(param, "Password ok, continue")
+
+	return nil
+}
+
+// login authenticates the user with a password and replies to the client
+func (c *clientHandler) login(pass, message string) {
+	if !c.checkLockout() {
+		return
+	}
+
+	err := c.authUser(pass)
 
 	switch {
 	case err == nil:
-		c.writeMessage(StatusUserLoggedIn, "Password ok, continue")
+		c.server.clearLoginFailures(c.user, c.remoteIP())
+
+		if c.HasTLSForControl() {
+			c.server.recordTLSLogin(c.remoteIP())
+		}
+
+		if !c.acceptSession() {
+			return
+		}
+
+		c.setState(StateLoggedIn)
+		c.writeLoginReply(message)
+	case errors.Is(err, ErrPasswordExpired) && c.canChangePassword():
+		c.expirePassword()
 	case err != nil:
+		c.recordLoginFailure()
 		c.writeMessage(StatusNotLoggedIn, fmt.Sprintf("Authentication problem: %v", err))
-		c.disconnect()
+		c.disconnect(CloseReasonAuthFailure)
 	default:
 		c.writeMessage(StatusNotLoggedIn, "I can't deal with you (nil driver)")
-		c.disconnect()
+		c.disconnect(CloseReasonDriverError)
 	}
+}
+
+// Handle the "REIN" command, it logs the user out once the current transfer is over
+func (c *clientHandler) handleREIN(_ string) error {
+	c.endLogin()
+	c.writeMessage(StatusServiceReady, "Service ready for new user")
 
 	return nil
 }
+
+// writeLoginReply sends the 230 reply of a login, preceded by the message of the day of the user if any
+func (c *clientHandler) writeLoginReply(message string) {
+	if provider, ok := c.driver.(ClientDriverExtensionLoginMessage); ok {
+		if motd := strings.TrimRight(provider.GetLoginMessage(), "\r\n"); motd != "" {
+			c.writeReply(NewReply(StatusUserLoggedIn, motd).Line(message))
+
+			return
+		}
+	}
+
+	c.writeMessage(StatusUserLoggedIn, message)
+}
@@ -1,6 +1,7 @@
 package ftpserver
 
 import (
+	"bufio"
 	"crypto/tls"
 	"net"
 	"testing"
@@ -73,6 +74,36 @@ func TestLoginSuccess(t *testing.T) {
 	require.Equal(t, StatusCommandNotImplemented, rc, response)
 }
 
+func TestLoginMessage(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:        true,
+		LoginMessage: "Welcome\n230 MB used out of 1 GB\n",
+	})
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	readLine := func() string {
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return line
+	}
+
+	require.Equal(t, "220 TEST Server\r\n", readLine())
+
+	_, err = conn.Write([]byte("USER " + authUser + "\r\nPASS " + authPass + "\r\n"))
+	require.NoError(t, err)
+
+	require.Equal(t, "331 OK\r\n", readLine())
+	require.Equal(t, "230-Welcome\r\n", readLine())
+	require.Equal(t, "230-230 MB used out of 1 GB\r\n", readLine())
+	require.Equal(t, "230 Password ok, continue\r\n", readLine())
+}
+
 func TestLoginFailure(t *testing.T) {
 	s := NewTestServer(t, true)
 
@@ -180,6 +211,56 @@ func TestAuthTLSRequired(t *testing.T) {
 	require.Equal(t, StatusSystemStatus, rc)
 }
 
+func TestAuthTLSDowngradeProtection(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		TLS:   true,
+		Settings: &Settings{
+			TLSDowngradeProtectionWindow: 60,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	// plaintext logins are accepted until a TLS login is done
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Plain text login must work")
+	require.NoError(t, raw.Close())
+	panicOnError(c.Close())
+
+	tlsConf := conf
+	tlsConf.TLSConfig = &tls.Config{
+		// nolint:gosec
+		InsecureSkipVerify: true,
+	}
+	tlsConf.TLSMode = goftp.TLSExplicit
+
+	c, err = goftp.DialConfig(tlsConf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	raw, err = c.OpenRawConn()
+	require.NoError(t, err, "TLS login must work")
+	require.NoError(t, raw.Close())
+	panicOnError(c.Close())
+
+	c, err = goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.OpenRawConn()
+	require.Error(t, err, "Plain text login must fail after a TLS login")
+	require.Contains(t, err.Error(), "530-TLS is required")
+	require.Equal(t, []SecurityEventType{SecurityEventPlaintextLogin}, driver.getSecurityEvents())
+}
+
 func TestAuthTLSVerificationFailed(t *testing.T) {
 	s := NewTestServerWithDriver(t, &TestServerDriver{
 		Debug:                true,
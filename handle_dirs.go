@@ -27,9 +27,9 @@ func (c *clientHandler) absPath(p string) string {
 }
 
 func (c *clientHandler) handleCWD(param string) error {
-	p := c.absPath(param)
+	p := c.paramPath(param)
 
-	if stat, err := c.driver.Stat(p); err == nil {
+	if stat, err := c.stat(p); err == nil {
 		if stat.IsDir() {
 			c.SetPath(p)
 			c.writeMessage(StatusFileOK, fmt.Sprintf("CD worked on %s", p))
@@ -37,14 +37,18 @@ func (c *clientHandler) handleCWD(param string) error {
 			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Can't change directory to %s: Not a Directory", p))
 		}
 	} else {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("CD issue: %v", err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("CD issue: %v", err))
 	}
 
 	return nil
 }
 
 func (c *clientHandler) handleMKD(param string) error {
-	p := c.absPath(param)
+	p, allowed := c.checkFilename(c.paramPath(param))
+	if !allowed || !c.checkPermission("MKD", p) {
+		return nil
+	}
+
 	if err := c.driver.Mkdir(p, 0755); err == nil {
 		// handleMKD confirms to "qoute-doubling"
 		// https://tools.ietf.org/html/rfc959 , page 63
@@ -63,7 +67,17 @@ func (c *clientHandler) handleMKDIR(params string) {
 		return
 	}
 
-	p := c.absPath(params)
+	p, allowed := c.checkFilename(c.paramPath(params))
+	if !allowed {
+		return
+	}
+
+	// every directory created on the way must be allowed, not only the last one
+	for _, dir := range c.missingDirectories(p) {
+		if _, allowed = c.checkFilename(dir); !allowed || !c.checkPermission("SITE MKDIR", dir) {
+			return
+		}
+	}
 
 	if err := c.driver.MkdirAll(p, 0755); err == nil {
 		c.writeMessage(StatusFileOK, fmt.Sprintf("Created dir %s", p))
@@ -72,10 +86,29 @@ func (c *clientHandler) handleMKDIR(params string) {
 	}
 }
 
+// missingDirectories returns the directories of a path that don't exist yet, from the top one.
+// The path itself is always returned so that an existing path is still checked.
+func (c *clientHandler) missingDirectories(dirPath string) []string {
+	dirs := []string{dirPath}
+
+	for dir := path.Dir(dirPath); dir != "/" && dir != "."; dir = path.Dir(dir) {
+		if _, err := c.stat(dir); !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+
+		dirs = append([]string{dir}, dirs...)
+	}
+
+	return dirs
+}
+
 func (c *clientHandler) handleRMD(param string) error {
 	var err error
 
-	p := c.absPath(param)
+	p := c.paramPath(param)
+	if !c.checkAppendOnlyRemoval(p) || !c.checkPermission("RMD", p) {
+		return nil
+	}
 
 	if rmd, ok := c.driver.(ClientDriverExtensionRemoveDir); ok {
 		err = rmd.RemoveDir(p)
@@ -99,7 +132,10 @@ func (c *clientHandler) handleRMDIR(params string) {
 		return
 	}
 
-	p := c.absPath(params)
+	p := c.paramPath(params)
+	if !c.checkAppendOnlyRemoval(p) || !c.checkPermission("SITE RMDIR", p) {
+		return
+	}
 
 	if err := c.driver.RemoveAll(p); err == nil {
 		c.writeMessage(StatusFileOK, fmt.Sprintf("Removed dir %s", p))
@@ -114,11 +150,11 @@ func (c *clientHandler) handleCDUP(param string) error {
 		parent = parent[0 : len(parent)-1]
 	}
 
-	if _, err := c.driver.Stat(parent); err == nil {
+	if _, err := c.stat(parent); err == nil {
 		c.SetPath(parent)
 		c.writeMessage(StatusFileOK, fmt.Sprintf("CDUP worked on %s", parent))
 	} else {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("CDUP issue: %v", err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("CDUP issue: %v", err))
 	}
 
 	return nil
@@ -139,7 +175,7 @@ func (c *clientHandler) checkLISTArgs(args string) string {
 			// a check for a non-existent directory error is more appropriate here
 			// but we cannot assume that the driver implementation will return an
 			// os.IsNotExist error.
-			if _, err := c.driver.Stat(args); err != nil {
+			if _, err := c.stat(args); err != nil {
 				params := strings.SplitN(args, " ", 2)
 				if len(params) == 1 {
 					result = ""
@@ -153,19 +189,69 @@ func (c *clientHandler) checkLISTArgs(args string) string {
 	return result
 }
 
+// takeListingRestart returns the restart offset (REST) of a listing and clears it. It replies and returns
+// false if the listings can't be restarted.
+func (c *clientHandler) takeListingRestart() (int64, bool) {
+	offset := c.ctxRest
+	c.ctxRest = 0
+
+	if offset != 0 && !c.server.settings.EnableListingRestart {
+		c.writeMessage(StatusSyntaxErrorParameters, "REST isn't supported for the listings")
+
+		return 0, false
+	}
+
+	return offset, true
+}
+
+// skipWriter drops the first bytes written to it, to restart a listing
+type skipWriter struct {
+	writer io.Writer
+	skip   int64
+}
+
+func newSkipWriter(w io.Writer, skip int64) io.Writer {
+	if skip == 0 {
+		return w
+	}
+
+	return &skipWriter{writer: w, skip: skip}
+}
+
+func (w *skipWriter) Write(p []byte) (int, error) {
+	if w.skip >= int64(len(p)) {
+		w.skip -= int64(len(p))
+
+		return len(p), nil
+	}
+
+	skipped := int(w.skip)
+	w.skip = 0
+
+	n, err := w.writer.Write(p[skipped:])
+
+	return skipped + n, err
+}
+
 func (c *clientHandler) handleLIST(param string) error {
 	info := fmt.Sprintf("LIST %v", param)
 
-	if files, err := c.getFileList(param, true); err == nil || err == io.EOF {
+	offset, ok := c.takeListingRestart()
+	if !ok {
+		return nil
+	}
+
+	if files, directoryPath, err := c.getFileList(param, true); isListable(err) {
 		if tr, errTr := c.TransferOpen(info); errTr == nil {
-			err = c.dirTransferLIST(tr, files)
-			c.TransferClose(err)
+			w := c.newListingWriter(newSkipWriter(tr, offset), err)
+			err = c.dirTransferLIST(w, directoryPath, files)
+			c.closeListing(w, err)
 
 			return nil
 		}
 	} else {
 		if !c.isCommandAborted() {
-			c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+			c.writeMessage(getErrorCode(err, StatusFileActionNotTaken), fmt.Sprintf("Could not list: %v", err))
 		}
 	}
 
@@ -175,16 +261,22 @@ func (c *clientHandler) handleLIST(param string) error {
 func (c *clientHandler) handleNLST(param string) error {
 	info := fmt.Sprintf("NLST %v", param)
 
-	if files, err := c.getFileList(param, false); err == nil || err == io.EOF {
+	offset, ok := c.takeListingRestart()
+	if !ok {
+		return nil
+	}
+
+	if files, _, err := c.getFileList(param, false); isListable(err) {
 		if tr, errTrOpen := c.TransferOpen(info); errTrOpen == nil {
-			err = c.dirTransferNLST(tr, files)
-			c.TransferClose(err)
+			w := c.newListingWriter(newSkipWriter(tr, offset), err)
+			err = c.dirTransferNLST(w, files)
+			c.closeListing(w, err)
 
 			return nil
 		}
 	} else {
 		if !c.isCommandAborted() {
-			c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+			c.writeMessage(getErrorCode(err, StatusFileActionNotTaken), fmt.Sprintf("Could not list: %v", err))
 		}
 	}
 
@@ -216,16 +308,22 @@ func (c *clientHandler) handleMLSD(param string) error {
 
 	info := fmt.Sprintf("MLSD %v", param)
 
-	if files, err := c.getFileList(param, false); err == nil || err == io.EOF {
+	offset, ok := c.takeListingRestart()
+	if !ok {
+		return nil
+	}
+
+	if files, directoryPath, err := c.getFileList(param, false); isListable(err) {
 		if tr, errTr := c.TransferOpen(info); errTr == nil {
-			err = c.dirTransferMLSD(tr, files)
-			c.TransferClose(err)
+			w := c.newListingWriter(newSkipWriter(tr, offset), err)
+			err = c.dirTransferMLSD(w, directoryPath, files)
+			c.closeListing(w, err)
 
 			return nil
 		}
 	} else {
 		if !c.isCommandAborted() {
-			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+			c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not list: %v", err))
 		}
 	}
 
@@ -239,7 +337,49 @@ const (
 	dateFormatMLSD          = "20060102150405"        // MLSD date formatting
 )
 
-func (c *clientHandler) fileStat(file os.FileInfo) string {
+// readLink returns the target of a symbolic link, or an empty string if it isn't one or its target is unknown
+func (c *clientHandler) readLink(filePath string, file os.FileInfo) string {
+	if file.Mode()&os.ModeSymlink == 0 {
+		return ""
+	}
+
+	if extended, ok := file.(FileInfoExtended); ok {
+		if target := extended.LinkTarget(); target != "" {
+			return target
+		}
+	}
+
+	linkReader, ok := c.driver.(ClientDriverExtensionReadLink)
+	if !ok {
+		return ""
+	}
+
+	target, err := linkReader.ReadLink(filePath)
+	if err != nil {
+		c.logger.Debug("Could not read link", "path", filePath, "err", err)
+
+		return ""
+	}
+
+	return target
+}
+
+// lstatLink returns the information of a symbolic link itself, nil if it isn't one or the driver can't tell
+func (c *clientHandler) lstatLink(filePath string) os.FileInfo {
+	lstater, ok := c.driver.(ClientDriverExtensionLstat)
+	if !ok {
+		return nil
+	}
+
+	info, err := lstater.Lstat(filePath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+
+	return info
+}
+
+func (c *clientHandler) fileStat(filePath string, file os.FileInfo) string {
 	modTime := file.ModTime()
 
 	var dateFormat string
@@ -250,17 +390,36 @@ func (c *clientHandler) fileStat(file os.FileInfo) string {
 		dateFormat = dateFormatStatTime
 	}
 
+	owner, group := "ftp", "ftp"
+
+	if ownership, ok := file.(FileInfoOwnership); ok {
+		if name := ownership.Owner(); name != "" {
+			owner = name
+		}
+
+		if name := ownership.Group(); name != "" {
+			group = name
+		}
+	}
+
+	name := file.Name()
+	if target := c.readLink(filePath, file); target != "" {
+		name += " -> " + target
+	}
+
 	return fmt.Sprintf(
-		"%s 1 ftp ftp %12d %s %s",
+		"%s 1 %s %s %12d %s %s",
 		file.Mode(),
+		owner,
+		group,
 		file.Size(),
 		file.ModTime().Format(dateFormat),
-		file.Name(),
+		name,
 	)
 }
 
 // fclairamb (2018-02-13): #64: Removed extra empty line
-func (c *clientHandler) dirTransferLIST(w io.Writer, files []os.FileInfo) error {
+func (c *clientHandler) dirTransferLIST(w io.Writer, directoryPath string, files []os.FileInfo) error {
 	if len(files) == 0 {
 		_, err := w.Write([]byte(""))
 
@@ -268,7 +427,7 @@ func (c *clientHandler) dirTransferLIST(w io.Writer, files []os.FileInfo) error
 	}
 
 	for _, file := range files {
-		if _, err := fmt.Fprintf(w, "%s\r\n", c.fileStat(file)); err != nil {
+		if _, err := fmt.Fprintf(w, "%s\r\n", c.fileStat(path.Join(directoryPath, file.Name()), file)); err != nil {
 			return err
 		}
 	}
@@ -277,7 +436,7 @@ func (c *clientHandler) dirTransferLIST(w io.Writer, files []os.FileInfo) error
 }
 
 // fclairamb (2018-02-13): #64: Removed extra empty line
-func (c *clientHandler) dirTransferMLSD(w io.Writer, files []os.FileInfo) error {
+func (c *clientHandler) dirTransferMLSD(w io.Writer, directoryPath string, files []os.FileInfo) error {
 	if len(files) == 0 {
 		_, err := w.Write([]byte(""))
 
@@ -285,70 +444,131 @@ func (c *clientHandler) dirTransferMLSD(w io.Writer, files []os.FileInfo) error
 	}
 
 	for _, file := range files {
-		if err := c.writeMLSxOutput(w, file); err != nil {
+		if err := c.writeMLSxOutput(w, path.Join(directoryPath, file.Name()), file); err != nil {
 			return err
 		}
 	}
 
 	return nil
 }
-func (c *clientHandler) writeMLSxOutput(w io.Writer, file os.FileInfo) error {
-	var listType string
-	if file.IsDir() {
-		listType = "dir"
-	} else {
-		listType = "file"
-	}
 
-	_, err := fmt.Fprintf(
-		w,
-		"Type=%s;Size=%d;Modify=%s; %s\r\n",
-		listType,
-		file.Size(),
-		file.ModTime().UTC().Format(dateFormatMLSD),
-		file.Name(),
-	)
-
-	return err
-}
-
-func (c *clientHandler) getFileList(param string, filePathAllowed bool) ([]os.FileInfo, error) {
+func (c *clientHandler) getFileList(param string, filePathAllowed bool) ([]os.FileInfo, string, error) {
 	if !c.server.settings.DisableLISTArgs {
 		param = c.checkLISTArgs(param)
 	}
 	// directory or filePath
-	listPath := c.absPath(param)
+	listPath := c.paramPath(param)
 
 	// return list of single file if directoryPath points to file and filePathAllowed
-	info, err := c.driver.Stat(listPath)
+	info, err := c.stat(listPath)
 	if err != nil {
-		return nil, err
+		return nil, listPath, err
 	}
 
 	if !info.IsDir() {
 		if filePathAllowed {
-			return []os.FileInfo{info}, nil
+			return c.hideTempUploads([]os.FileInfo{info}), path.Dir(listPath), nil
+		}
+
+		return nil, listPath, errFileList
+	}
+
+	files, err := c.readDirectoryEntries(listPath, c.listingReadCount())
+	if err != nil {
+		return c.hideTempUploads(files), listPath, err
+	}
+
+	c.cacheListing(listPath, files)
+
+	files, err = c.limitListingEntries(c.hideTempUploads(files), len(files))
+
+	return files, listPath, err
+}
+
+// isTempUpload tells if a file is a temporary upload file that must be hidden
+func (c *clientHandler) isTempUpload(name string) bool {
+	if !c.server.settings.HideTempUploads {
+		return false
+	}
+
+	for _, suffix := range c.server.settings.TempUploadSuffixes {
+		if suffix != "" && strings.HasSuffix(name, suffix) {
+			return true
 		}
+	}
 
-		return nil, errFileList
+	return false
+}
+
+// hideTempUploads removes the temporary upload files from a listing
+func (c *clientHandler) hideTempUploads(files []os.FileInfo) []os.FileInfo {
+	if !c.server.settings.HideTempUploads {
+		return files
 	}
 
-	if fileList, ok := c.driver.(ClientDriverExtensionFileList); ok {
-		return fileList.ReadDir(listPath)
+	visibleFiles := make([]os.FileInfo, 0, len(files))
+
+	for _, file := range files {
+		if !c.isTempUpload(file.Name()) {
+			visibleFiles = append(visibleFiles, file)
+		}
 	}
 
-	directory, errOpenFile := c.driver.Open(listPath)
-	if errOpenFile != nil {
-		return nil, errOpenFile
+	return visibleFiles
+}
+
+// readDirectory returns the entries of a directory
+func (c *clientHandler) readDirectory(directoryPath string) ([]os.FileInfo, error) {
+	return c.readDirectoryEntries(directoryPath, -1)
+}
+
+// readDirectoryEntries returns at most count entries of a directory (all of them if count is -1), the
+// ClientDriverExtensionFileList drivers always return all of them
+func (c *clientHandler) readDirectoryEntries(directoryPath string, count int) ([]os.FileInfo, error) {
+	// a virtual directory only has virtual entries
+	if entry := c.getVirtualEntry(directoryPath); entry != nil && entry.IsDir {
+		return c.addVirtualEntries(directoryPath, nil), nil
 	}
 
-	defer c.closeDirectory(listPath, directory)
+	var files []os.FileInfo
+
+	err := c.retryDriverCall("ReadDir", directoryPath, func() error {
+		var err error
+
+		if fileList, ok := c.driver.(ClientDriverExtensionFileList); ok {
+			files, err = fileList.ReadDir(directoryPath)
+
+			return err
+		}
+
+		directory, err := c.driver.Open(directoryPath)
+		if err != nil {
+			return err
+		}
+
+		c.trackResource(resourceOpenFile, 1)
+
+		defer c.closeDirectory(directoryPath, directory)
+
+		files, err = directory.Readdir(count)
+
+		// a limited read of an empty directory ends with io.EOF
+		if count > 0 && err == io.EOF {
+			err = nil
+		}
+
+		return err
+	})
+
+	if err == nil {
+		files = c.addVirtualEntries(directoryPath, files)
+	}
 
-	return directory.Readdir(-1)
+	return files, err
 }
 
 func (c *clientHandler) closeDirectory(directoryPath string, directory afero.File) {
-	if errClose := directory.Close(); errClose != nil {
+	if errClose := c.closeFile(directory); errClose != nil {
 		c.logger.Error("Couldn't close directory", "err", errClose, "directory", directoryPath)
 	}
 }
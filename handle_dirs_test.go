@@ -3,12 +3,15 @@ package ftpserver
 import (
 	"crypto/tls"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"path"
 	"testing"
 	"time"
 
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
 )
 
@@ -246,6 +249,53 @@ func TestMkdirRmDir(t *testing.T) {
 	})
 }
 
+func TestMkdirAllIntermediatePermissions(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		PermissionChecker: func(_, verb, dirPath string) error {
+			if verb == "SITE MKDIR" && path.Base(dirPath) == "private" {
+				return errReadOnly
+			}
+
+			return nil
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the denied directory is in the middle of the path, nothing is created
+	rc, response, err := raw.SendCommand("SITE MKDIR /pub/private/sub")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+
+	_, err = driver.fs.Stat("/pub")
+	require.Error(t, err)
+
+	// an existing directory isn't checked again
+	require.NoError(t, driver.fs.MkdirAll("/pub/private", 0750))
+
+	rc, response, err = raw.SendCommand("SITE MKDIR /pub/private/sub/deep")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	stat, err := driver.fs.Stat("/pub/private/sub/deep")
+	require.NoError(t, err)
+	require.True(t, stat.IsDir())
+}
+
 // TestDirListingWithSpace uses the MLSD for files listing
 func TestDirListingWithSpace(t *testing.T) {
 	s := NewTestServer(t, true)
@@ -527,3 +577,363 @@ func TestMLSDAndNLSTFilePathError(t *testing.T) {
 	_, _, err = raw.ReadResponse()
 	require.Error(t, err, "NLST for filePath must fail")
 }
+
+func TestOwnershipFacts(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "owned-file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	listing := func(command string) string {
+		dcGetter, err := raw.PrepareDataConn()
+		require.NoError(t, err)
+
+		rc, response, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatusOK, rc, response)
+
+		dc, err := dcGetter()
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(dc)
+		require.NoError(t, err)
+		require.NoError(t, dc.Close())
+
+		rc, response, err = raw.ReadResponse()
+		require.NoError(t, err)
+		require.Equal(t, StatusClosingDataConn, rc, response)
+
+		return string(data)
+	}
+
+	require.Contains(t, listing("MLSD /"), ";unix.owner=test-owner;unix.group=test-group; owned-file\r\n")
+	require.Contains(t, listing("LIST /"), " 1 test-owner test-group ")
+
+	rc, response, err := raw.SendCommand("MLST owned-file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.Contains(t, response, ";unix.owner=test-owner;unix.group=test-group; ")
+
+	rc, response, err = raw.SendCommand("STAT owned-file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc)
+	require.Contains(t, response, " 1 test-owner test-group ")
+}
+
+func TestExtendedFileInfo(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "extended-file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("MLST extended-file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.Regexp(t, `\n ?Type=file;Size=10;Modify=\d{14};Create=20200102030405;`+
+		`unix.owner=test-owner;unix.group=test-group;x.bucket=archives;x.tier=cold; extended-file\n`, response)
+
+	rc, response, err = raw.SendCommand("STAT extended-file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc)
+	require.Contains(t, response, " 1 test-owner test-group ")
+
+	// the link target is given by the file information
+	link := &testExtendedFileInfo{testFileInfo: testFileInfo{FileInfo: testSymlinkInfo{}}, target: "/target"}
+	cc := clientHandler{server: &FtpServer{settings: &Settings{}}}
+	require.Equal(t, "/target", cc.readLink("/link", link))
+	require.Equal(t, "OS.unix=slink:/target", cc.getMLSxFacts("/link", link)[0].value)
+}
+
+// testSymlinkInfo is a symbolic link
+type testSymlinkInfo struct{}
+
+func (testSymlinkInfo) Name() string       { return "link" }
+func (testSymlinkInfo) Size() int64        { return 0 }
+func (testSymlinkInfo) Mode() os.FileMode  { return os.ModeSymlink | 0777 }
+func (testSymlinkInfo) ModTime() time.Time { return time.Time{} }
+func (testSymlinkInfo) IsDir() bool        { return false }
+func (testSymlinkInfo) Sys() interface{}   { return nil }
+
+func TestMLSxFactsOrder(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{MLSxFactsOrder: []string{"modify", "TYPE"}},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("MLST file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.Regexp(t, `\n ?Modify=\d{14};Type=file;Size=10; file\n`, response)
+
+	rc, response, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc)
+	require.Contains(t, response, " MLST Modify*;Type*;Size*;Create*;unix.owner*;unix.group*;x.etag*;\n")
+
+	require.Equal(t, "a\r\x00b", escapeMLSxName("a\rb"))
+
+	// a name containing a LF can't be listed
+	require.NoError(t, afero.WriteFile(driver.fs, "/bad\nname", []byte("content"), 0600))
+
+	files, err := c.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "file", files[0].Name())
+}
+
+func TestListingRestart(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		s := newTestServerWithDriver(t, &TestServerDriver{
+			Debug:    true,
+			Settings: &Settings{EnableListingRestart: enabled},
+		})
+		conf := goftp.Config{
+			User:     authUser,
+			Password: authPass,
+		}
+
+		c, err := goftp.DialConfig(conf, s.Addr())
+		require.NoError(t, err, "Couldn't connect")
+
+		ftpUpload(t, c, createTemporaryFile(t, 10), "file1")
+		ftpUpload(t, c, createTemporaryFile(t, 10), "file2")
+
+		raw, err := c.OpenRawConn()
+		require.NoError(t, err, "Couldn't open raw connection")
+
+		transfer := func(restart int, command string) (int, string) {
+			if restart != 0 {
+				rc, response, err := raw.SendCommand(fmt.Sprintf("REST %d", restart))
+				require.NoError(t, err)
+				require.Equal(t, StatusFileActionPending, rc, response)
+			}
+
+			dcGetter, err := raw.PrepareDataConn()
+			require.NoError(t, err)
+
+			rc, response, err := raw.SendCommand(command)
+			require.NoError(t, err)
+
+			if rc != StatusFileStatusOK {
+				return rc, response
+			}
+
+			dc, err := dcGetter()
+			require.NoError(t, err)
+
+			data, err := ioutil.ReadAll(dc)
+			require.NoError(t, err)
+			require.NoError(t, dc.Close())
+
+			rc, response, err = raw.ReadResponse()
+			require.NoError(t, err)
+			require.Equal(t, StatusClosingDataConn, rc, response)
+
+			return rc, string(data)
+		}
+
+		rc, full := transfer(0, "NLST /")
+		require.Equal(t, StatusClosingDataConn, rc)
+		require.Len(t, full, 14)
+
+		rc, restarted := transfer(9, "NLST /")
+		if enabled {
+			require.Equal(t, StatusClosingDataConn, rc)
+			require.Equal(t, full[9:], restarted)
+		} else {
+			require.Equal(t, StatusSyntaxErrorParameters, rc)
+		}
+
+		// the restart offset doesn't apply to the next transfer
+		rc, content := transfer(0, "RETR file1")
+		require.Equal(t, StatusClosingDataConn, rc)
+		require.Len(t, content, 10)
+
+		require.NoError(t, raw.Close())
+		require.NoError(t, c.Close())
+	}
+}
+
+func TestListingCache(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			ListingCacheTTL: 60,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// SIZE is refused in ASCII mode
+	rc, response, err := raw.SendCommand("TYPE I")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	checkSize := func(expected string) {
+		rc, response, err := raw.SendCommand("SIZE file")
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatus, rc, response)
+		require.Equal(t, expected, response)
+	}
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("MLSD /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	// the file is changed behind the server's back, the listing is still used
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", make([]byte, 20), 0600))
+	checkSize("10")
+
+	rc, response, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+	checkSize("10")
+
+	// a command that could modify files clears the cache
+	rc, response, err = raw.SendCommand("MKD dir2")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+	checkSize("20")
+}
+
+func TestHideTempUploads(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			HideTempUploads:    true,
+			TempUploadSuffixes: []string{".part", ".uploading"},
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	for _, name := range []string{"/file", "/file.part", "/file.uploading"} {
+		require.NoError(t, afero.WriteFile(driver.fs, name, make([]byte, 10), 0600))
+	}
+
+	contents, err := c.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, contents, 1)
+	require.Equal(t, "file", contents[0].Name())
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("NLST /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	names, err := ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+	require.Equal(t, "file\r\n", string(names))
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	rc, response, err = raw.SendCommand("RETR file.part")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+
+	// the files can still be renamed once the upload is complete
+	rc, response, err = raw.SendCommand("RNFR file.uploading")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand("RNTO file2")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	contents, err = c.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, contents, 2)
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/sha1" //nolint:gosec
 	"crypto/sha256"
 	"crypto/sha512"
-	"encoding/csv"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -14,6 +13,7 @@ import (
 	"io"
 	"net"
 	"os"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
@@ -46,33 +46,62 @@ func (c *clientHandler) handleRETR(param string) error {
 func (c *clientHandler) transferFile(write bool, append bool, param, info string) {
 	var file FileTransfer
 	var err error
-	var fileFlag int
 
-	path := c.absPath(param)
+	path := c.paramPath(param)
+	resumed := c.ctxRest != 0
+
+	// the offsets of the ASCII transfers don't match the file ones, REST only applies to the listings then
+	if resumed && c.currentTransferType == TransferTypeASCII {
+		c.writeMessage(StatusSyntaxErrorParameters, "Resuming transfers not allowed in ASCII mode")
+		c.ctxRest = 0
+
+		return
+	}
+
+	// the blocks of the parallel transfers are written at their offset, an appended file can't do it
+	if append && c.currentTransferMode == TransferModeExtendedBlock {
+		c.writeMessage(StatusNotImplementedParam, "APPE isn't supported in extended block mode")
+		c.ctxRest = 0
+
+		return
+	}
+
+	// the version required with SITE IFMATCH only applies to this transfer
+	version := c.ctxIfMatch
+	c.ctxIfMatch = ""
 
-	// We try to open the file
 	if write {
-		fileFlag = os.O_WRONLY
-		if append {
-			fileFlag |= os.O_APPEND
-		} else {
-			fileFlag |= os.O_CREATE
-			// if this isn't a resume we add the truncate flag
-			// to be sure to overwrite an existing file
-			if c.ctxRest == 0 {
-				fileFlag |= os.O_TRUNC
-			}
-		}
-	} else {
-		fileFlag = os.O_RDONLY
+		version = ""
+	}
+
+	if !write && c.isTempUpload(path) {
+		c.writeMessage(StatusActionNotTaken, "Could not access file: "+errTempUpload.Error())
+		c.ctxRest = 0
+
+		return
+	}
+
+	if !c.checkTransferQuota() {
+		c.ctxRest = 0
+
+		return
 	}
 
-	file, err = c.getFileHandle(path, fileFlag, c.ctxRest)
+	if write {
+		var allowed bool
+		if path, allowed = c.prepareUpload(path, append); !allowed {
+			c.ctxRest = 0
 
-	// If this fail, can stop right here and reset the seek position
+			return
+		}
+
+		defer func() { c.ctxUploadPath = "" }()
+	}
+
+	release, err := c.acquireTransfer()
 	if err != nil {
 		if !c.isCommandAborted() {
-			c.writeMessage(getErrorCode(err, StatusActionNotTaken), "Could not access file: "+err.Error())
+			c.writeMessage(getErrorCode(err, StatusFileActionNotTaken), "Could not start transfer: "+err.Error())
 		}
 
 		c.ctxRest = 0
@@ -80,47 +109,335 @@ func (c *clientHandler) transferFile(write bool, append bool, param, info string
 		return
 	}
 
-	// Try to seek on it
-	if c.ctxRest != 0 {
-		_, err = file.Seek(c.ctxRest, 0)
-		// Whatever happens we should reset the seek position
-		c.ctxRest = 0
+	defer release()
 
-		if err != nil {
-			// if we are unable to seek we can stop right here and close the file
-			if !c.isCommandAborted() {
-				c.writeMessage(getErrorCode(err, StatusActionNotTaken), "Could not seek file: "+err.Error())
-			}
-			// we can ignore the close error here
-			c.closeUnchecked(file)
+	var tr net.Conn
+
+	// the replaced file is only kept as a previous version once the data connection is opened, before the
+	// opening of the file truncates it
+	versioned := write && !append && !resumed && c.isVersioned(path)
+
+	// the drivers slowly preparing the uploads don't keep the clients waiting for the 150 reply
+	if write && (c.server.settings.EarlyTransferReply || versioned) {
+		if tr, err = c.TransferOpen(info); err != nil {
+			c.ctxRest = 0
 
 			return
 		}
 	}
 
-	tr, err := c.TransferOpen(info)
+	if versioned {
+		if err = c.keepPreviousVersion(path); err != nil {
+			c.ctxRest = 0
+			release()
+			c.TransferClose(err)
+
+			return
+		}
+	}
+
+	offset := c.ctxRest
+
+	flags := getTransferFileFlag(write, append, resumed)
+	if write && !append && c.isAppendOnly(path) {
+		// a file created meanwhile by another session must not be replaced
+		flags |= os.O_EXCL
+	}
+
+	file, err = c.openTransferFile(path, flags, version, tr != nil)
 	if err != nil {
-		// an error is already returned to the FTP client
-		// we can stop right here and close the file ignoring close error if any
-		c.closeUnchecked(file)
+		if tr != nil {
+			release()
+			c.TransferClose(err)
+		}
 
 		return
 	}
 
-	err = c.doFileTransfer(tr, file, write)
+	if tr == nil {
+		if tr, err = c.TransferOpen(info); err != nil {
+			// an error is already returned to the FTP client
+			// we can stop right here and close the file ignoring close error if any
+			c.closeUnchecked(file)
+
+			return
+		}
+	}
+
+	c.publishTransfer(getTransferCommand(write, append), path)
+
+	start := time.Now()
+	c.uploadContentType = ""
+	c.uploadResumed = write && (append || resumed)
+	written, err := c.doFileTransfer(tr, file, write, offset)
+	c.uploadResumed = false
+	c.recordTransfer(write, written)
+
+	stats := &TransferStats{Upload: write, Bytes: written, Duration: time.Since(start), ContentType: c.uploadContentType}
+
+	if err == nil && write && c.server.settings.SyncUploads {
+		err = syncFile(file)
+	}
+
 	// we ignore close error for reads
-	if errClose := file.Close(); errClose != nil && err == nil && write {
+	if errClose := c.closeFile(file); errClose != nil && err == nil && write {
 		err = errClose
 	}
 
+	if err != nil && write {
+		c.cleanupPartialUpload(path, err, !append && !resumed)
+	}
+
+	// the slot is released before the reply, the client can start another transfer as soon as it gets it
+	release()
+
+	c.countTransfer(write, written, err == nil)
+
 	// closing the transfer we also send the response message to the FTP client
-	c.TransferClose(err)
+	c.closeTransferWithStats(err, stats)
+	c.publishSession(nil)
+}
+
+// openTransferFile opens the file of a transfer at the REST position, if version isn't empty the file must
+// have it. The errors are replied unless the transfer connection is already open (see EarlyTransferReply),
+// TransferClose does it then.
+func (c *clientHandler) openTransferFile(path string, flags int, version string,
+	transferOpen bool) (FileTransfer, error) {
+	offset := c.ctxRest
+	// Whatever happens we should reset the seek position
+	c.ctxRest = 0
+
+	file, err := c.getTransferFileHandle(path, flags, offset, version)
+	if err != nil {
+		if !transferOpen && !c.isCommandAborted() {
+			c.writeMessage(getErrorCode(err, StatusActionNotTaken), "Could not access file: "+err.Error())
+		}
+
+		return nil, err
+	}
+
+	if offset != 0 {
+		if _, err = file.Seek(offset, 0); err != nil {
+			// if we are unable to seek we can stop right here and close the file
+			if !transferOpen && !c.isCommandAborted() {
+				c.writeMessage(getErrorCode(err, StatusActionNotTaken), "Could not seek file: "+err.Error())
+			}
+			// we can ignore the close error here
+			c.closeUnchecked(file)
+
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// getTransferFileHandle opens a file, the driver can get the deadline of the opening with
+// GetFileOpenDeadline (see FileOpenTimeout)
+func (c *clientHandler) getTransferFileHandle(path string, flags int, offset int64,
+	version string) (FileTransfer, error) {
+	if c.server.settings.FileOpenTimeout <= 0 {
+		return c.getVersionedFileHandle(path, flags, offset, version)
+	}
+
+	deadline := time.Now().Add(time.Duration(c.server.settings.FileOpenTimeout) * time.Second)
+
+	c.paramsMutex.Lock()
+	c.fileOpenDeadline = deadline
+	c.paramsMutex.Unlock()
+
+	defer func() {
+		c.paramsMutex.Lock()
+		c.fileOpenDeadline = time.Time{}
+		c.paramsMutex.Unlock()
+	}()
+
+	file, err := c.getVersionedFileHandle(path, flags, offset, version)
+
+	if late := time.Since(deadline); late > 0 {
+		c.logger.Warn("The driver opened a file after its deadline", "path", path, "late", late, "err", err)
+	}
+
+	return file, err
+}
+
+// prepareUpload applies the filename policy, the append-only directories, the permission checker and
+// CreateMissingDirectories to the path of an upload. It returns the path to use, or replies and returns
+// false if the upload is refused.
+func (c *clientHandler) prepareUpload(filePath string, append bool) (string, bool) {
+	filePath, allowed := c.checkFilename(filePath)
+
+	if allowed && !append {
+		filePath, allowed = c.getAppendOnlyUploadPath(filePath)
+	}
+
+	if !allowed || !c.checkPermission(getTransferVerb(append), filePath) || !c.createParentDirectories(filePath) {
+		c.ctxUploadPath = ""
+
+		return "", false
+	}
+
+	return filePath, true
+}
+
+// createParentDirectories creates the missing directories of an upload path if CreateMissingDirectories
+// is enabled for the user. It replies and returns false if they can't be created.
+func (c *clientHandler) createParentDirectories(filePath string) bool {
+	enabled := c.server.settings.CreateMissingDirectories
+	if creator, ok := c.driver.(ClientDriverExtensionMissingDirectories); ok {
+		enabled = creator.CreateMissingDirectories()
+	}
+
+	dir := path.Dir(filePath)
+
+	if !enabled || dir == "/" {
+		return true
+	}
+
+	if _, err := c.stat(dir); !errors.Is(err, os.ErrNotExist) {
+		// the other errors will be reported by the opening of the file
+		return true
+	}
+
+	// every directory created on the way must be allowed, not only the last one
+	for _, missingDir := range c.missingDirectories(dir) {
+		if _, allowed := c.checkFilename(missingDir); !allowed || !c.checkPermission("MKD", missingDir) {
+			return false
+		}
+	}
+
+	if err := c.driver.MkdirAll(dir, 0755); err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not create directory %s: %v", dir, err))
+
+		return false
+	}
+
+	c.logger.Debug("Created the missing directories of an upload", "path", dir)
+
+	return true
+}
+
+// getTransferVerb returns the verb given to MainDriverExtensionPermissionChecker for an upload
+func getTransferVerb(append bool) string {
+	if append {
+		return "APPE"
+	}
+
+	return "STOR"
+}
+
+func getTransferFileFlag(write, append, resumed bool) int {
+	if !write {
+		return os.O_RDONLY
+	}
+
+	if append {
+		return os.O_WRONLY | os.O_APPEND
+	}
+
+	// if this isn't a resume we add the truncate flag
+	// to be sure to overwrite an existing file
+	if !resumed {
+		return os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	return os.O_WRONLY | os.O_CREATE
+}
+
+// cleanupPartialUpload applies the PartialUploadPolicy to the file of a failed upload, created tells if the
+// upload created the file. A file with a digest mismatch never stays under its name.
+func (c *clientHandler) cleanupPartialUpload(path string, err error, created bool) {
+	cause := err
+	if c.isCommandAborted() {
+		cause = ErrTransferAborted
+	}
+
+	policy := c.server.settings.PartialUploadPolicy
+
+	switch {
+	case errors.Is(cause, ErrUploadDigestMismatch) && !created:
+		// the data stored before the upload is kept aside with the corrupted one
+		policy = PartialUploadRename
+	case !created:
+		// there is nothing to resume from for an append, and a refused content wasn't written
+		return
+	case errors.Is(cause, ErrContentNotAllowed) || errors.Is(cause, ErrUploadDigestMismatch):
+		// a refused or corrupted content isn't an upload that could be resumed
+		policy = PartialUploadDelete
+	default:
+		if policer, ok := c.driver.(ClientDriverExtensionPartialUpload); ok {
+			policy = policer.GetPartialUploadPolicy(path, cause)
+		}
+	}
+
+	switch policy {
+	case PartialUploadDelete:
+		err = c.driver.Remove(path)
+	case PartialUploadRename:
+		err = c.driver.Rename(path, path+c.server.settings.PartialUploadSuffix)
+	default:
+		return
+	}
+
+	if err != nil {
+		c.logger.Warn("Could not clean up partial upload", "path", path, "cause", cause, "err", err)
+	}
+}
+
+// errSyncNotSupported is returned when SyncUploads is enabled and the uploaded file can't be synced
+var errSyncNotSupported = errors.New("the file can't be synced to durable storage")
+
+// syncFile flushes an uploaded file to a durable storage
+func syncFile(file FileTransfer) error {
+	syncer, ok := file.(FileTransferSync)
+	if !ok {
+		return errSyncNotSupported
+	}
+
+	if err := syncer.Sync(); err != nil {
+		return fmt.Errorf("could not sync file: %w", err)
+	}
+
+	return nil
+}
+
+func getTransferCommand(write, append bool) string {
+	switch {
+	case append:
+		return "APPE"
+	case write:
+		return "STOR"
+	default:
+		return "RETR"
+	}
+}
+
+func (c *clientHandler) doFileTransfer(tr net.Conn, file io.ReadWriter, write bool, offset int64) (int64, error) {
+	var err error
+	var written int64
+
+	if c.currentTransferMode == TransferModeExtendedBlock {
+		written, err = c.doParallelTransfer(tr, file, write, offset)
+	} else {
+		written, err = c.doStreamTransfer(tr, file, write, offset)
+	}
+
+	if err != nil {
+		if fileTransferError, ok := file.(FileTransferError); ok {
+			fileTransferError.TransferError(err)
+		}
+	}
+
+	return written, err
 }
 
-func (c *clientHandler) doFileTransfer(tr net.Conn, file io.ReadWriter, write bool) error {
+// doStreamTransfer transfers a file over a connection in stream or block mode
+func (c *clientHandler) doStreamTransfer(tr net.Conn, file io.ReadWriter, write bool, offset int64) (int64, error) {
 	var err error
 	var in io.Reader
 	var out io.Writer
+	var blocks *blockWriter
+	var sniffer *contentTypeWriter
 
 	conversionMode := convertModeToCRLF
 
@@ -129,20 +446,39 @@ func (c *clientHandler) doFileTransfer(tr net.Conn, file io.ReadWriter, write bo
 		in = tr
 		out = file
 
+		if c.currentTransferMode == TransferModeBlock {
+			in = newBlockReader(tr, offset, c.replyRestartMarker)
+		}
+
+		in = c.newUploadReader(in)
+
+		if sniffer = c.newContentTypeWriter(file); sniffer != nil {
+			out = sniffer
+		}
+
 		if runtime.GOOS != "windows" {
 			conversionMode = convertModeToLF
 		}
 	} else { // ... from the file to the connection
 		in = file
 		out = tr
+
+		if c.currentTransferMode == TransferModeBlock {
+			blocks = c.newBlockWriter(tr, offset)
+			out = blocks
+		}
 	}
 
 	if c.currentTransferType == TransferTypeASCII {
 		in = newASCIIConverter(in, conversionMode)
 	}
 
+	out, endThrottling := c.throttleTransfer(out)
+	defer endThrottling()
+
 	// for reads io.EOF isn't an error, for writes it must be considered an error
-	if written, errCopy := io.Copy(out, in); errCopy != nil && (errCopy != io.EOF || write) {
+	written, errCopy := c.server.bufferPool.copy(out, in)
+	if errCopy != nil && (errCopy != io.EOF || write) {
 		err = errCopy
 	} else {
 		c.logger.Debug(
@@ -152,15 +488,17 @@ func (c *clientHandler) doFileTransfer(tr net.Conn, file io.ReadWriter, write bo
 		if written == 0 {
 			_, err = out.Write([]byte{})
 		}
-	}
 
-	if err != nil {
-		if fileTransferError, ok := file.(FileTransferError); ok {
-			fileTransferError.TransferError(err)
+		if err == nil && blocks != nil {
+			err = blocks.Close()
+		}
+
+		if err == nil && sniffer != nil {
+			err = sniffer.Close()
 		}
 	}
 
-	return err
+	return written, err
 }
 
 func (c *clientHandler) handleCOMB(param string) error {
@@ -178,17 +516,32 @@ func (c *clientHandler) handleCOMB(param string) error {
 		return nil
 	}
 
-	targetPath := c.absPath(relativePaths[0])
+	targetPath, allowed := c.checkFilename(c.absPath(relativePaths[0]))
+	if !allowed {
+		return nil
+	}
 
 	sourcePaths := make([]string, 0, len(relativePaths)-1)
 	for _, src := range relativePaths[1:] {
 		sourcePaths = append(sourcePaths, c.absPath(src))
 	}
+
+	if !c.checkPermission("COMB", targetPath) {
+		return nil
+	}
+
+	// the parts are deleted once combined
+	for _, sourcePath := range sourcePaths {
+		if !c.checkAppendOnlyRemoval(sourcePath) || !c.checkPermission("DELE", sourcePath) {
+			return nil
+		}
+	}
+
 	// if targetPath exists we have append to it
 	// partial files will be deleted if COMB succeeded
-	_, err = c.driver.Stat(targetPath)
+	_, err = c.stat(targetPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not access file %#v: %v", targetPath, err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not access file %#v: %v", targetPath, err))
 
 		return nil
 	}
@@ -224,7 +577,7 @@ func (c *clientHandler) combineFiles(targetPath string, fileFlag int, sourcePath
 			return
 		}
 
-		_, err = io.Copy(file, src)
+		_, err = c.server.bufferPool.copy(file, src)
 		if err != nil {
 			c.closeUnchecked(src)
 			c.closeUnchecked(file)
@@ -244,7 +597,7 @@ func (c *clientHandler) combineFiles(targetPath string, fileFlag int, sourcePath
 		}
 	}
 
-	err = file.Close()
+	err = c.closeFile(file)
 	if err != nil {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not close combined file %#v: %v", targetPath, err))
 
@@ -254,15 +607,34 @@ func (c *clientHandler) combineFiles(targetPath string, fileFlag int, sourcePath
 	c.writeMessage(StatusFileOK, "COMB succeeded!")
 }
 
+// SITE CHMOD [-R] <mode> <path>
+// mode can be an octal number (755) or a symbolic mode (u+x,go-w)
 func (c *clientHandler) handleCHMOD(params string) {
-	spl := strings.SplitN(params, " ", 2)
-	modeNb, err := strconv.ParseUint(spl[0], 8, 32)
+	spl, err := splitParams(params, 3)
+	recursive := false
+
+	if err == nil && len(spl) > 0 && !spl[0].quoted && (spl[0].value == "-R" || spl[0].value == "-r") {
+		recursive = true
+		spl = spl[1:]
+	} else if len(spl) == 3 {
+		// without options, the path is the rest of the line
+		spl, err = splitParams(params, 2)
+	}
 
-	mode := os.FileMode(modeNb)
-	path := c.absPath(spl[1])
+	if err != nil || len(spl) != 2 {
+		c.writeMessage(StatusSyntaxErrorParameters, "bad command")
+
+		return
+	}
 
+	path := c.absPath(spl[1].value)
+	if !c.checkPermission("SITE CHMOD", path) {
+		return
+	}
+
+	changeMode, err := parseFileMode(spl[0].value)
 	if err == nil {
-		err = c.driver.Chmod(path, mode)
+		err = c.chmodPath(path, changeMode, recursive)
 	}
 
 	if err != nil {
@@ -274,11 +646,68 @@ func (c *clientHandler) handleCHMOD(params string) {
 	c.writeMessage(StatusOK, "SITE CHMOD command successful")
 }
 
+// chmodPath applies a mode change to a file and, if recursive, to everything below it
+func (c *clientHandler) chmodPath(name string, changeMode fileModeChanger, recursive bool) error {
+	info, err := c.stat(name)
+	if err != nil {
+		return err
+	}
+
+	if err = c.driver.Chmod(name, changeMode(info.Mode())); err != nil {
+		return err
+	}
+
+	if !recursive || !info.IsDir() {
+		return nil
+	}
+
+	return c.chmodTree(name, changeMode)
+}
+
+// chmodTree walks a directory tree to apply a mode change. Symbolic links are never
+// followed and the number of changed files is bounded by chmodRecursiveMaxFiles.
+func (c *clientHandler) chmodTree(root string, changeMode fileModeChanger) error {
+	directories := []string{root}
+	changed := 0
+
+	for len(directories) > 0 {
+		directory := directories[0]
+		directories = directories[1:]
+
+		files, err := c.readDirectory(directory)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if file.Mode()&os.ModeSymlink != 0 {
+				continue
+			}
+
+			if changed++; changed > chmodRecursiveMaxFiles {
+				return errChmodTooManyFiles
+			}
+
+			name := path.Join(directory, file.Name())
+
+			if err = c.driver.Chmod(name, changeMode(file.Mode())); err != nil {
+				return err
+			}
+
+			if file.IsDir() {
+				directories = append(directories, name)
+			}
+		}
+	}
+
+	return nil
+}
+
 // https://www.raidenftpd.com/en/raiden-ftpd-doc/help-sitecmd.html (wildcard isn't supported)
 func (c *clientHandler) handleCHOWN(params string) {
-	spl := strings.SplitN(params, " ", 3)
+	spl, err := splitParamsValues(params, 2)
 
-	if len(spl) != 2 {
+	if err != nil || len(spl) != 2 {
 		c.writeMessage(StatusSyntaxErrorParameters, "bad command")
 
 		return
@@ -307,6 +736,9 @@ func (c *clientHandler) handleCHOWN(params string) {
 	}
 
 	path := c.absPath(spl[1])
+	if !c.checkPermission("SITE CHOWN", path) {
+		return
+	}
 
 	if err := c.driver.Chown(path, userID, groupID); err != nil {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't chown: %v", err))
@@ -318,31 +750,70 @@ func (c *clientHandler) handleCHOWN(params string) {
 // https://learn.akamai.com/en-us/webhelp/netstorage/netstorage-user-guide/
 // GUID-AB301948-C6FF-4957-9291-FE3F02457FD0.html
 func (c *clientHandler) handleSYMLINK(params string) {
-	spl := strings.SplitN(params, " ", 3)
+	var symlink func(oldname, newname string) error
+
+	if symlinkInt, ok := c.driver.(ClientDriverExtensionSymlink); ok {
+		symlink = symlinkInt.Symlink
+	}
+
+	c.createLink("SITE SYMLINK", "symlink", params, symlink)
+}
+
+func (c *clientHandler) handleLINK(params string) {
+	var link func(oldname, newname string) error
 
-	if len(spl) != 2 {
+	if linkInt, ok := c.driver.(ClientDriverExtensionLink); ok {
+		link = linkInt.Link
+	}
+
+	c.createLink("SITE LINK", "link", params, link)
+}
+
+// createLink handles the SITE SYMLINK and SITE LINK commands, link is nil if the driver doesn't implement
+// the command
+func (c *clientHandler) createLink(command, action, params string, link func(oldname, newname string) error) {
+	spl, err := splitParamsValues(params, 0)
+
+	if err != nil || len(spl) != 2 {
 		c.writeMessage(StatusSyntaxErrorParameters, "bad command")
 
 		return
 	}
 
-	oldname := c.absPath(spl[0])
-	newname := c.absPath(spl[1])
-
-	if symlinkInt, ok := c.driver.(ClientDriverExtensionSymlink); !ok {
+	if link == nil {
 		// It's not implemented and that's not OK, it must be explicitly refused
 		c.writeMessage(StatusCommandNotImplemented, "This extension hasn't been implemented !")
+
+		return
+	}
+
+	oldname := c.absPath(spl[0])
+
+	newname, allowed := c.checkFilename(c.absPath(spl[1]))
+	if !allowed || !c.checkPermission(command, newname) {
+		return
+	}
+
+	if err := link(oldname, newname); err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't %s: %v", action, err))
 	} else {
-		if err := symlinkInt.Symlink(oldname, newname); err != nil {
-			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't symlink: %v", err))
-		} else {
-			c.writeMessage(StatusOK, "Done !")
-		}
+		c.writeMessage(StatusOK, "Done !")
 	}
 }
 
 func (c *clientHandler) handleDELE(param string) error {
-	path := c.absPath(param)
+	// a quoted name is never a pattern, it allows to delete the files having wildcards in their name
+	if token := lastParam(param); c.server.settings.EnableDELEWildcards && !token.quoted && hasWildcards(token.value) {
+		c.deleteMatchingFiles(param)
+
+		return nil
+	}
+
+	path := c.paramPath(param)
+	if !c.checkAppendOnlyRemoval(path) || !c.checkPermission("DELE", path) {
+		return nil
+	}
+
 	if err := c.driver.Remove(path); err == nil {
 		c.writeMessage(StatusFileOK, fmt.Sprintf("Removed file %s", path))
 	} else {
@@ -352,36 +823,167 @@ func (c *clientHandler) handleDELE(param string) error {
 	return nil
 }
 
+// handleMDEL handles the SITE MDEL command, which deletes the files matching a pattern
+func (c *clientHandler) handleMDEL(params string) {
+	c.deleteMatchingFiles(params)
+}
+
+func hasWildcards(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// deleteMatchingFiles deletes the files of a directory matching a pattern (like "logs/*.log", only the
+// last element of the path can have wildcards), the result of each deletion is given in the reply
+func (c *clientHandler) deleteMatchingFiles(param string) {
+	pattern := c.paramPath(param)
+	directoryPath, namePattern := path.Split(pattern)
+	directoryPath = path.Clean(directoryPath)
+
+	if _, err := path.Match(namePattern, ""); err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Invalid pattern %s: %v", pattern, err))
+
+		return
+	}
+
+	files, err := c.readDirectory(directoryPath)
+	if err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't list %s: %v", directoryPath, err))
+
+		return
+	}
+
+	var results []string
+
+	nbFailures := 0
+
+	for _, file := range files {
+		if matched, _ := path.Match(namePattern, file.Name()); !matched || file.IsDir() {
+			continue
+		}
+
+		filePath := path.Join(directoryPath, file.Name())
+
+		errRemove := c.permissionError("DELE", filePath)
+		if errRemove == nil && c.isAppendOnly(filePath) {
+			errRemove = errAppendOnly
+		}
+
+		if errRemove == nil {
+			errRemove = c.driver.Remove(filePath)
+		}
+
+		if errRemove != nil {
+			nbFailures++
+
+			results = append(results, fmt.Sprintf("Couldn't delete %s: %v", filePath, errRemove))
+		} else {
+			results = append(results, fmt.Sprintf("Removed file %s", filePath))
+		}
+	}
+
+	switch {
+	case len(results) == 0:
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("No file matching %s", pattern))
+	case nbFailures > 0:
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Removed %d files matching %s, %d failures\n%s",
+			len(results)-nbFailures, pattern, nbFailures, strings.Join(results, "\n")))
+	default:
+		c.writeMessage(StatusFileOK, fmt.Sprintf("Removed %d files matching %s\n%s",
+			len(results), pattern, strings.Join(results, "\n")))
+	}
+}
+
+var (
+	errRenameExpired      = errors.New("RNFR expired, please send it again")
+	errRenameTargetExists = fmt.Errorf("%w: the target already exists", ErrFileNameNotAllowed)
+	errRenameCrossDir     = fmt.Errorf("%w: renaming across directories is disabled", ErrFileNameNotAllowed)
+)
+
 func (c *clientHandler) handleRNFR(param string) error {
-	path := c.absPath(param)
-	if _, err := c.driver.Stat(path); err == nil {
+	path := c.paramPath(param)
+	if !c.checkAppendOnlyRemoval(path) || !c.checkPermission("RNFR", path) {
+		return nil
+	}
+
+	if _, err := c.stat(path); err == nil {
 		c.writeMessage(StatusFileActionPending, "Sure, give me a target")
 		c.ctxRnfr = path
+		c.ctxRnfrAt = time.Now()
+		c.setState(StateRenamePending)
 	} else {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't access %s: %v", path, err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't access %s: %v", path, err))
 	}
 
 	return nil
 }
 
 func (c *clientHandler) handleRNTO(param string) error {
-	dst := c.absPath(param)
+	dst := c.paramPath(param)
 
-	if c.ctxRnfr != "" {
-		if err := c.driver.Rename(c.ctxRnfr, dst); err == nil {
-			c.writeMessage(StatusFileOK, "Done !")
-			c.ctxRnfr = ""
-		} else {
-			c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't rename %s to %s: %s",
-				c.ctxRnfr, dst, err.Error()))
-		}
+	if time.Since(c.ctxRnfrAt) > time.Duration(c.server.settings.RenameTimeout)*time.Second {
+		c.endRename()
+		c.writeMessage(StatusBadCommandSequence, errRenameExpired.Error())
+
+		return nil
+	}
+
+	dst, allowed := c.checkFilename(dst)
+	if !allowed {
+		return nil
+	}
+
+	if !c.checkPermission("RNTO", dst) {
+		return nil
+	}
+
+	if err := c.rename(c.ctxRnfr, dst); err == nil {
+		c.writeMessage(StatusFileOK, "Done !")
+		c.endRename()
 	} else {
-		c.writeMessage(StatusBadCommandSequence, "RNFR is expected before RNTO")
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't rename %s to %s: %s",
+			c.ctxRnfr, dst, err.Error()))
 	}
 
 	return nil
 }
 
+// rename applies the cross directories and overwrite policies before renaming
+func (c *clientHandler) rename(from, to string) error {
+	if c.server.settings.DisableCrossDirRename && path.Dir(from) != path.Dir(to) {
+		return errRenameCrossDir
+	}
+
+	// the files of the append-only directories can't be replaced
+	if c.isAppendOnly(to) {
+		if _, err := c.stat(to); err == nil {
+			return errAppendOnly
+		}
+	}
+
+	if c.server.settings.RenameOverwrite == RenameOverwriteDriver || from == to {
+		return c.driver.Rename(from, to)
+	}
+
+	if _, err := c.stat(to); err != nil {
+		// the target doesn't exist (or can't be checked), this is a plain rename
+		return c.driver.Rename(from, to)
+	}
+
+	if c.server.settings.RenameOverwrite == RenameOverwriteReject {
+		return errRenameTargetExists
+	}
+
+	if overwriteRename, ok := c.driver.(ClientDriverExtensionOverwriteRename); ok {
+		return overwriteRename.OverwriteRename(from, to)
+	}
+
+	if err := c.driver.Remove(to); err != nil {
+		return err
+	}
+
+	return c.driver.Rename(from, to)
+}
+
 // properly handling the SIZE command when TYPE ASCII is used would
 // require to scan the entire file to perform the ASCII translation
 // logic. Considering that calculating such result could be very
@@ -397,36 +999,43 @@ func (c *clientHandler) handleSIZE(param string) error {
 		return nil
 	}
 
-	path := c.absPath(param)
-	if info, err := c.driver.Stat(path); err == nil {
+	path := c.paramPath(param)
+	if info, err := c.batchedStat(path); err == nil {
 		c.writeMessage(StatusFileStatus, fmt.Sprintf("%d", info.Size()))
 	} else {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't access %s: %v", path, err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't access %s: %v", path, err))
 	}
 
 	return nil
 }
 
 func (c *clientHandler) handleSTATFile(param string) error {
-	path := c.absPath(param)
+	filePath := c.paramPath(param)
+
+	if info, err := c.stat(filePath); err == nil {
+		// a symbolic link is shown with its target instead of being followed
+		if link := c.lstatLink(filePath); link != nil {
+			info = link
+		}
 
-	if info, err := c.driver.Stat(path); err == nil {
 		if info.IsDir() {
 			var files []os.FileInfo
 			var errList error
 
-			directoryPath := c.absPath(param)
+			directoryPath := filePath
 
 			if fileList, ok := c.driver.(ClientDriverExtensionFileList); ok {
 				files, errList = fileList.ReadDir(directoryPath)
 			} else {
-				directory, errOpenFile := c.driver.Open(c.absPath(param))
+				directory, errOpenFile := c.driver.Open(directoryPath)
 
 				if errOpenFile != nil {
 					c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", errOpenFile))
 
 					return nil
 				}
+
+				c.trackResource(resourceOpenFile, 1)
 				files, errList = directory.Readdir(-1)
 				c.closeDirectory(directoryPath, directory)
 			}
@@ -435,7 +1044,7 @@ func (c *clientHandler) handleSTATFile(param string) error {
 				defer c.multilineAnswer(StatusDirectoryStatus, fmt.Sprintf("STAT %v", param))()
 
 				for _, f := range files {
-					c.writeLine(fmt.Sprintf(" %s", c.fileStat(f)))
+					c.writeText(fmt.Sprintf(" %s", c.fileStat(path.Join(directoryPath, f.Name()), f)))
 				}
 			} else {
 				c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not list: %v", errList))
@@ -443,7 +1052,7 @@ func (c *clientHandler) handleSTATFile(param string) error {
 		} else {
 			defer c.multilineAnswer(StatusFileStatus, fmt.Sprintf("STAT %v", param))()
 
-			c.writeLine(fmt.Sprintf(" %s", c.fileStat(info)))
+			c.writeText(fmt.Sprintf(" %s", c.fileStat(filePath, info)))
 		}
 	} else {
 		c.writeMessage(StatusFileActionNotTaken, fmt.Sprintf("Could not STAT: %v", err))
@@ -459,16 +1068,16 @@ func (c *clientHandler) handleMLST(param string) error {
 		return nil
 	}
 
-	path := c.absPath(param)
+	path := c.paramPath(param)
 
-	if info, err := c.driver.Stat(path); err == nil {
+	if info, err := c.batchedStat(path); err == nil {
 		defer c.multilineAnswer(StatusFileOK, "File details")()
 
-		if errWrite := c.writeMLSxOutput(c.writer, info); errWrite != nil {
+		if errWrite := c.writeMLSxOutput(c.writer, path, info); errWrite != nil {
 			return errWrite
 		}
 	} else {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not list: %v", err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Could not list: %v", err))
 	}
 
 	return nil
@@ -495,12 +1104,6 @@ func (c *clientHandler) handleALLO(param string) error {
 
 func (c *clientHandler) handleREST(param string) error {
 	if size, err := strconv.ParseInt(param, 10, 0); err == nil {
-		if c.currentTransferType == TransferTypeASCII {
-			c.writeMessage(StatusSyntaxErrorParameters, "Resuming transfers not allowed in ASCII mode")
-
-			return nil
-		}
-
 		c.ctxRest = size
 		c.writeMessage(StatusFileActionPending, "OK")
 	} else {
@@ -511,11 +1114,11 @@ func (c *clientHandler) handleREST(param string) error {
 }
 
 func (c *clientHandler) handleMDTM(param string) error {
-	path := c.absPath(param)
-	if info, err := c.driver.Stat(path); err == nil {
+	path := c.paramPath(param)
+	if info, err := c.batchedStat(path); err == nil {
 		c.writeMessage(StatusFileStatus, info.ModTime().UTC().Format(dateFormatMLSD))
 	} else {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't access %s: %s", path, err.Error()))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't access %s: %s", path, err.Error()))
 	}
 
 	return nil
@@ -523,8 +1126,8 @@ func (c *clientHandler) handleMDTM(param string) error {
 
 // RFC draft: https://tools.ietf.org/html/draft-somers-ftp-mfxx-04#section-3.1
 func (c *clientHandler) handleMFMT(param string) error {
-	params := strings.SplitN(param, " ", 2)
-	if len(params) != 2 {
+	params, err := splitParamsValues(param, 2)
+	if err != nil || len(params) != 2 {
 		c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf(
 			"Couldn't set mtime, not enough params, given: %s", param))
 
@@ -540,6 +1143,9 @@ func (c *clientHandler) handleMFMT(param string) error {
 	}
 
 	path := c.absPath(params[1])
+	if !c.checkPermission("MFMT", path) {
+		return nil
+	}
 
 	if err := c.driver.Chtimes(path, mtime, mtime); err != nil {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf(
@@ -585,11 +1191,18 @@ func (c *clientHandler) handleGenericHash(param string, algo HASHAlgo, isCustomM
 		return nil
 	}
 
-	args := strings.SplitN(param, " ", 3)
-	info, err := c.driver.Stat(args[0])
+	args, err := parseHashParams(param, isCustomMode)
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("%v: %v", param, err))
+
+		return nil
+	}
+
+	filePath := c.absPath(args[0])
+	info, err := c.stat(filePath)
 
 	if err != nil {
-		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("%v: %v", param, err))
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("%v: %v", param, err))
 
 		return nil
 	}
@@ -628,13 +1241,7 @@ func (c *clientHandler) handleGenericHash(param string, algo HASHAlgo, isCustomM
 		}
 	}
 
-	var result string
-	if hasher, ok := c.driver.(ClientDriverExtensionHasher); ok {
-		result, err = hasher.ComputeHash(c.absPath(args[0]), algo, start, end)
-	} else {
-		result, err = c.computeHashForFile(c.absPath(args[0]), algo, start, end)
-	}
-
+	result, err := c.computeHash(filePath, algo, start, end)
 	if err != nil {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("%v: %v", args[0], err))
 
@@ -656,28 +1263,114 @@ func (c *clientHandler) handleGenericHash(param string, algo HASHAlgo, isCustomM
 	return nil
 }
 
-func (c *clientHandler) computeHashForFile(filePath string, algo HASHAlgo, start, end int64) (string, error) {
-	var h hash.Hash
-	var file FileTransfer
-	var err error
+// parseHashParams splits the parameters of a hash command: the file name, then for the custom
+// commands the start and end offsets. The file name must be quoted if it contains spaces and
+// is followed by offsets, as CuteFTP and SmartFTP do: XCRC "my file.txt" 0 100.
+// The HASH command only takes a file name.
+func parseHashParams(param string, withRange bool) ([]string, error) {
+	if !withRange {
+		return []string{unquotePath(param)}, nil
+	}
+
+	args, err := splitParamsValues(param, 3)
+	if err == nil && len(args) == 0 {
+		args = []string{""}
+	}
+
+	return args, err
+}
+
+// handleCHECKSUM handles the SITE CHECKSUM <algo> <expected digest> <file> command: the server computes the
+// digest of the file and tells if it matches, the clients don't have to compare it themselves
+func (c *clientHandler) handleCHECKSUM(params string) {
+	if !c.server.settings.EnableHASH {
+		c.writeMessage(StatusCommandNotImplemented, "File hash support is disabled")
+
+		return
+	}
+
+	args, err := splitParamsValues(params, 3)
+	if err != nil || len(args) != 3 {
+		c.writeMessage(StatusSyntaxErrorParameters, "usage: SITE CHECKSUM <algo> <expected digest> <file>")
+
+		return
+	}
+
+	algo, ok := getHashMapping()[strings.ToUpper(args[0])]
+	if !ok {
+		c.writeMessage(StatusNotImplementedParam, fmt.Sprintf("%v: %v", args[0], errUnknowHash))
+
+		return
+	}
+
+	filePath := c.absPath(args[2])
+
+	info, err := c.stat(filePath)
+	if err != nil {
+		c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("%v: %v", args[2], err))
+
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		c.writeMessage(StatusActionNotTakenNoFile, fmt.Sprintf("%v is not a regular file", args[2]))
+
+		return
+	}
+
+	result, err := c.computeHash(filePath, algo, 0, info.Size())
+	if err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("%v: %v", args[2], err))
+
+		return
+	}
+
+	hashName := getHashName(algo)
+
+	if !strings.EqualFold(result, args[1]) {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("%v digest mismatch, expected %v, got %v: %v",
+			hashName, args[1], result, args[2]))
+
+		return
+	}
+
+	c.writeMessage(StatusFileOK, fmt.Sprintf("%v digest match %v: %v", hashName, result, args[2]))
+}
+
+// computeHash computes the digest of a part of a file, with the ClientDriverExtensionHasher if available
+func (c *clientHandler) computeHash(filePath string, algo HASHAlgo, start, end int64) (string, error) {
+	if hasher, ok := c.driver.(ClientDriverExtensionHasher); ok {
+		return hasher.ComputeHash(filePath, algo, start, end)
+	}
+
+	return c.computeHashForFile(filePath, algo, start, end)
+}
 
+// newHash returns a hash of the algorithm
+func newHash(algo HASHAlgo) (hash.Hash, error) {
 	switch algo {
 	case HASHAlgoCRC32:
-		h = crc32.NewIEEE()
+		return crc32.NewIEEE(), nil
 	case HASHAlgoMD5:
-		h = md5.New() //nolint:gosec
+		return md5.New(), nil //nolint:gosec
 	case HASHAlgoSHA1:
-		h = sha1.New() //nolint:gosec
+		return sha1.New(), nil //nolint:gosec
 	case HASHAlgoSHA256:
-		h = sha256.New()
+		return sha256.New(), nil
 	case HASHAlgoSHA512:
-		h = sha512.New()
+		return sha512.New(), nil
 	default:
-		return "", errUnknowHash
+		return nil, errUnknowHash
 	}
+}
 
-	file, err = c.getFileHandle(filePath, os.O_RDONLY, start)
+func (c *clientHandler) computeHashForFile(filePath string, algo HASHAlgo, start, end int64) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
 
+	file, err := c.getFileHandle(filePath, os.O_RDONLY, start)
 	if err != nil {
 		return "", err
 	}
@@ -691,7 +1384,7 @@ func (c *clientHandler) computeHashForFile(filePath string, algo HASHAlgo, start
 		}
 	}
 
-	_, err = io.CopyN(h, file, end-start)
+	_, err = c.server.bufferPool.copy(h, io.LimitReader(file, end-start))
 
 	if err != nil && err != io.EOF {
 		return "", err
@@ -701,15 +1394,76 @@ func (c *clientHandler) computeHashForFile(filePath string, algo HASHAlgo, start
 }
 
 func (c *clientHandler) getFileHandle(name string, flags int, offset int64) (FileTransfer, error) {
-	if fileTransfer, ok := c.driver.(ClientDriverExtentionFileTransfer); ok {
-		return fileTransfer.GetHandle(name, flags, offset)
+	var file FileTransfer
+
+	if entry := c.getVirtualEntry(name); entry != nil && !entry.IsDir && flags == os.O_RDONLY {
+		c.trackResource(resourceOpenFile, 1)
+
+		return newVirtualFile(entry), nil
 	}
 
-	return c.driver.OpenFile(name, flags, os.ModePerm)
+	err := c.retryDriverCall("Open", name, func() error {
+		var err error
+
+		if fileTransfer, ok := c.driver.(ClientDriverExtentionFileTransfer); ok {
+			file, err = fileTransfer.GetHandle(name, flags, offset)
+		} else {
+			file, err = c.driver.OpenFile(name, flags, os.ModePerm)
+		}
+
+		return err
+	})
+
+	if err == nil {
+		c.trackResource(resourceOpenFile, 1)
+	}
+
+	return file, err
+}
+
+func (c *clientHandler) stat(name string) (os.FileInfo, error) {
+	if info := c.getCachedFileInfo(name); info != nil {
+		return info, nil
+	}
+
+	if entry := c.getVirtualEntry(name); entry != nil {
+		return &virtualFileInfo{entry: entry}, nil
+	}
+
+	var info os.FileInfo
+
+	err := c.retryDriverCall("Stat", name, func() error {
+		var err error
+		info, err = c.driver.Stat(name)
+
+		return err
+	})
+
+	return info, err
+}
+
+// retryDriverCall calls the driver again when it fails with a temporary error
+func (c *clientHandler) retryDriverCall(operation, name string, call func() error) error {
+	if faults := c.server.settings.Faults; faults != nil {
+		call = faults.injectDriverFault(call)
+	}
+
+	err := call()
+	delay := time.Duration(c.server.settings.DriverRetryDelay) * time.Millisecond
+
+	for retry := 1; err != nil && retry <= c.server.settings.DriverRetries && isTemporaryError(err); retry++ {
+		c.logger.Debug("Retrying driver call", "operation", operation, "path", name, "retry", retry, "err", err)
+		time.Sleep(delay)
+
+		delay *= 2
+		err = call()
+	}
+
+	return err
 }
 
 func (c *clientHandler) closeUnchecked(file io.Closer) {
-	if err := file.Close(); err != nil {
+	if err := c.closeFile(file); err != nil {
 		c.logger.Warn(
 			"Problem closing a file",
 			"err", err,
@@ -717,6 +1471,13 @@ func (c *clientHandler) closeUnchecked(file io.Closer) {
 	}
 }
 
+// closeFile closes a file opened with the driver
+func (c *clientHandler) closeFile(file io.Closer) error {
+	c.trackResource(resourceOpenFile, -1)
+
+	return file.Close()
+}
+
 // This method split params by spaces, except when the space is inside quotes.
 // It was introduced to support COMB command. Supported COMB examples:
 //
@@ -726,8 +1487,10 @@ func (c *clientHandler) closeUnchecked(file io.Closer) {
 //   - COMB "final5.log" "64.log" "65.log"
 //   - COMB final7.log "6 6.log" 67.log
 func unquoteSpaceSeparatedParams(params string) ([]string, error) {
-	reader := csv.NewReader(strings.NewReader(params))
-	reader.Comma = ' ' // space
+	values, err := splitParamsValues(params, 0)
+	if err == nil && len(values) == 0 {
+		return nil, errNoParams
+	}
 
-	return reader.Read()
+	return values, err
 }
@@ -1,18 +1,23 @@
 package ftpserver
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/textproto"
 	"os"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -148,6 +153,44 @@ func TestCHMOD(t *testing.T) {
 	rc, _, err = raw.SendCommand("SITE CHMOD 600 file")
 	require.NoError(t, err)
 	require.Equal(t, StatusOK, rc, "Should have been accepted")
+
+	rc, _, err = raw.SendCommand("SITE CHMOD 600")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, "Should have been refused")
+
+	rc, _, err = raw.SendCommand("SITE CHMOD u+x,go+r file")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, "Should have been accepted")
+
+	rc, response, err := raw.SendCommand("STAT file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc)
+	require.Contains(t, response, "-rwxr--r-- ")
+
+	_, err = c.Mkdir("dir")
+	require.NoError(t, err)
+
+	_, err = c.Mkdir("dir/sub")
+	require.NoError(t, err)
+
+	err = c.Store("dir/sub/file", createTemporaryFile(t, 10))
+	require.NoError(t, err)
+
+	rc, _, err = raw.SendCommand("SITE CHMOD -R go-rwx dir")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, "Should have been accepted")
+
+	// each directory listing shows the mode of its content
+	for _, name := range []string{"/", "dir", "dir/sub"} {
+		rc, response, err = raw.SendCommand("STAT " + name)
+		require.NoError(t, err)
+		require.Equal(t, StatusDirectoryStatus, rc)
+		require.Regexp(t, "[d-]rw[x-]------ 1 ftp ftp .* (dir|sub|file)\r?\n", response, name)
+	}
+
+	rc, _, err = raw.SendCommand("SITE CHMOD -R 755 missing")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, "Should have been refused")
 }
 
 func TestCHOWN(t *testing.T) {
@@ -314,6 +357,178 @@ func TestSYMLINK(t *testing.T) {
 	require.Equal(t, StatusOK, rc, "Should have been accepted")
 }
 
+func TestSymlinkListing(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, _, err := raw.SendCommand("SITE SYMLINK file link")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+
+	listing := func(command string) string {
+		dcGetter, err := raw.PrepareDataConn()
+		require.NoError(t, err)
+
+		rc, response, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatusOK, rc, response)
+
+		dc, err := dcGetter()
+		require.NoError(t, err)
+
+		data, err := ioutil.ReadAll(dc)
+		require.NoError(t, err)
+		require.NoError(t, dc.Close())
+
+		rc, response, err = raw.ReadResponse()
+		require.NoError(t, err)
+		require.Equal(t, StatusClosingDataConn, rc, response)
+
+		return string(data)
+	}
+
+	require.Regexp(t, `(?m)^Type=OS\.unix=slink:/file;Size=\d+;Modify=\d{14}; link\r$`, listing("MLSD /"))
+	require.Regexp(t, `(?m)^Type=file;Size=10;Modify=\d{14}; file\r$`, listing("MLSD /"))
+	require.Regexp(t, `(?m)^L.* link -> /file\r$`, listing("LIST /"))
+
+	rc, response, err := raw.SendCommand("STAT link")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc)
+	require.Contains(t, response, " link -> /file\n")
+}
+
+func TestSiteLink(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			DefaultTransferType: TransferTypeBinary,
+			FilenamePolicy:      &FilenamePolicy{DeniedPatterns: []string{"*.exe"}},
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the names of the links follow the filename policy
+	for _, command := range []string{"SITE LINK", "SITE SYMLINK"} {
+		rc, _, err := raw.SendCommand(command + " file link.exe")
+		require.NoError(t, err)
+		require.Equal(t, StatusActionNotTakenNoFile, rc, command)
+	}
+
+	rc, _, err := raw.SendCommand("SITE LINK file")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc)
+
+	rc, _, err = raw.SendCommand("SITE LINK missing link")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc)
+
+	rc, _, err = raw.SendCommand("SITE LINK file link")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+
+	rc, response, err := raw.SendCommand("SIZE link")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc)
+	require.Equal(t, "10", response)
+
+	// a hard link isn't shown as a link
+	rc, response, err = raw.SendCommand("STAT link")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc)
+	require.NotContains(t, response, "->")
+}
+
+func TestBulkDelete(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EnableDELEWildcards: true},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, driver.fs.Mkdir("/dir.log", 0750))
+
+	for _, name := range []string{"/a.log", "/b.log", "/c.txt", "/dir.log/file", "/*.txt"} {
+		require.NoError(t, afero.WriteFile(driver.fs, name, []byte("content"), 0600))
+	}
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// directories are never deleted
+	rc, response, err := raw.SendCommand("SITE MDEL /*.log")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+	require.Contains(t, response, "Removed 2 files matching /*.log")
+	require.Contains(t, response, "Removed file /a.log")
+	require.Contains(t, response, "Removed file /b.log")
+
+	_, err = driver.fs.Stat("/dir.log/file")
+	require.NoError(t, err)
+
+	rc, _, err = raw.SendCommand("SITE MDEL /*.log")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc)
+
+	rc, _, err = raw.SendCommand("SITE MDEL /[.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc)
+
+	// a quoted name is deleted as is
+	rc, _, err = raw.SendCommand(`DELE "*.txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+
+	_, err = driver.fs.Stat("/c.txt")
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("DELE *.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.Contains(t, response, "Removed file /c.txt")
+
+	_, err = driver.fs.Stat("/c.txt")
+	require.True(t, os.IsNotExist(err), err)
+}
+
 func TestSTATFile(t *testing.T) {
 	s := NewTestServer(t, true)
 	conf := goftp.Config{
@@ -428,6 +643,183 @@ func TestRename(t *testing.T) {
 	require.Equal(t, StatusBadCommandSequence, rc)
 }
 
+func TestRenamePolicies(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file1")
+	ftpUpload(t, c, createTemporaryFile(t, 20), "file2")
+
+	_, err = c.Mkdir("dir")
+	require.NoError(t, err)
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rename := func(from, to string) int {
+		rc, response, err := raw.SendCommand("RNFR " + from)
+		require.NoError(t, err)
+		require.Equal(t, StatusFileActionPending, rc, response)
+
+		rc, _, err = raw.SendCommand("RNTO " + to)
+		require.NoError(t, err)
+
+		return rc
+	}
+
+	// any other command cancels the pending rename
+	rc, _, err := raw.SendCommand("RNFR file1")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc)
+
+	rc, _, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+
+	rc, _, err = raw.SendCommand("RNTO file3")
+	require.NoError(t, err)
+	require.Equal(t, StatusBadCommandSequence, rc)
+
+	// so does the timeout
+	s.settings.RenameTimeout = -1
+	require.Equal(t, StatusBadCommandSequence, rename("file1", "file3"))
+
+	s.settings.RenameTimeout = 60
+	s.settings.RenameOverwrite = RenameOverwriteReject
+	require.Equal(t, StatusActionNotTakenNoFile, rename("file1", "file2"))
+	require.Equal(t, StatusFileOK, rename("file1", "file3"))
+
+	s.settings.RenameOverwrite = RenameOverwriteReplace
+	require.Equal(t, StatusFileOK, rename("file3", "file2"))
+
+	info, err := c.Stat("file2")
+	require.NoError(t, err)
+	require.Equal(t, int64(10), info.Size())
+
+	s.settings.DisableCrossDirRename = true
+	require.Equal(t, StatusActionNotTakenNoFile, rename("file2", "dir/file2"))
+	require.Equal(t, StatusFileOK, rename("dir", "dir2"))
+
+	s.settings.DisableCrossDirRename = false
+	require.Equal(t, StatusFileOK, rename("file2", "dir2/file2"))
+}
+
+func TestDriverRetries(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			DriverRetries:    2,
+			DriverRetryDelay: 1,
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "temp-fail.txt")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// SIZE is refused in ASCII mode
+	rc, response, err := raw.SendCommand("TYPE I")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	// persistent temporary failures are reported with a 450 reply
+	rc, response, err = raw.SendCommand("SIZE temp-fail-always.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionNotTaken, rc, response)
+
+	s.settings.DriverRetries = 0
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file.txt")
+
+	rc, response, err = raw.SendCommand("RNFR file.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand("RNTO temp-fail-2.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	rc, response, err = raw.SendCommand("SIZE temp-fail-2.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionNotTaken, rc, response)
+}
+
+func TestCreateMissingDirectories(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			CreateMissingDirectories: true,
+			FilenamePolicy:           &FilenamePolicy{DeniedPatterns: []string{"*.exe"}},
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.NoError(t, c.Store("a/b/c.txt", bytes.NewReader([]byte("data"))))
+
+	info, err := driver.fs.Stat("/a/b")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	content, err := afero.ReadFile(driver.fs, "/a/b/c.txt")
+	require.NoError(t, err)
+	require.Equal(t, "data", string(content))
+
+	// a file can't be used as a directory
+	err = c.Store("a/b/c.txt/d.txt", bytes.NewReader([]byte("data")))
+	require.Error(t, err)
+	// the filename policy applies to the created directories
+	err = c.Store("a/bin.exe/c/d.txt", bytes.NewReader([]byte("data")))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "553")
+
+	_, err = driver.fs.Stat("/a/bin.exe")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestMissingDirectoriesNotCreated(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.Error(t, c.Store("a/b/c.txt", bytes.NewReader([]byte("data"))))
+}
+
 func TestUploadErrorCodes(t *testing.T) {
 	s := NewTestServer(t, true)
 	conf := goftp.Config{
@@ -457,6 +849,54 @@ func TestUploadErrorCodes(t *testing.T) {
 	}
 }
 
+func TestSITECHECKSUM(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EnableHASH: true},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/file name.txt", []byte("sample data with know checksum/hash\n"), 0600))
+	require.NoError(t, driver.fs.Mkdir("/dir", 0750))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	sha256Hash := "ceee704dd96e2b8c2ceca59c4c697bc01123fb9e66a1a3ac34dbdd2d6da9659b"
+
+	for command, code := range map[string]int{
+		"SITE CHECKSUM SHA-256 " + sha256Hash + " file name.txt":              StatusFileOK,
+		"SITE CHECKSUM crc32 21B0F382 file name.txt":                          StatusFileOK,
+		"SITE CHECKSUM SHA-256 " + strings.Repeat("0", 64) + " file name.txt": StatusActionNotTaken,
+		"SITE CHECKSUM SHA-384 " + sha256Hash + " file name.txt":              StatusNotImplementedParam,
+		"SITE CHECKSUM SHA-256 " + sha256Hash:                                 StatusSyntaxErrorParameters,
+		"SITE CHECKSUM SHA-256 " + sha256Hash + " missing.txt":                StatusActionNotTaken,
+		"SITE CHECKSUM SHA-256 " + sha256Hash + " dir":                        StatusActionNotTakenNoFile,
+	} {
+		rc, response, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, code, rc, command+": "+response)
+	}
+
+	rc, response, err := raw.SendCommand("SITE CHECKSUM SHA-256 " + strings.Repeat("0", 64) + " file name.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc)
+	require.Contains(t, response, "mismatch")
+	require.Contains(t, response, sha256Hash)
+}
+
 func TestHASHDisabled(t *testing.T) {
 	s := NewTestServer(t, true)
 	conf := goftp.Config{
@@ -540,6 +980,58 @@ func TestHASHCommand(t *testing.T) {
 	require.True(t, strings.HasSuffix(message, fmt.Sprintf("CRC32 0-36 %v file.txt", crc32Sum)))
 }
 
+func TestHashFacts(t *testing.T) {
+	s := NewTestServerWithDriver(
+		t,
+		&TestServerDriver{
+			Debug: true,
+			Settings: &Settings{
+				EnableHASH: true,
+			},
+		},
+	)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file-hashfacts.txt")
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file.txt")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("MLST file-hashfacts.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.Contains(t, response, ";x.crc32=00000000;x.sha256="+
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855; ")
+
+	rc, response, err = raw.SendCommand("MLST file.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.NotContains(t, response, "x.")
+
+	// the facts are also sent with MLSD and the client must still be able to parse them
+	files, err := c.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	s.settings.EnableHASH = false
+
+	rc, response, err = raw.SendCommand("MLST file-hashfacts.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc)
+	require.NotContains(t, response, "x.crc32")
+}
+
 func TestCustomHASHCommands(t *testing.T) {
 	s := NewTestServer(t, true)
 	s.settings.EnableHASH = true
@@ -597,6 +1089,67 @@ func TestCustomHASHCommands(t *testing.T) {
 	require.Equal(t, StatusSyntaxErrorParameters, rc)
 }
 
+func TestHASHCommandsQuotedFileName(t *testing.T) {
+	s := NewTestServer(t, true)
+	s.settings.EnableHASH = true
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	err = c.Store("my file.txt", strings.NewReader("sample data with know checksum/hash\n"))
+	require.NoError(t, err)
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, message, err := raw.SendCommand(`XCRC "my file.txt"`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, message)
+	require.True(t, strings.HasSuffix(message, getKnownHASHMappings()["XCRC"]))
+
+	rc, message, err = raw.SendCommand(`XSHA256 "my file.txt" 7 11`)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, message)
+	require.True(t, strings.HasSuffix(message, "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"))
+
+	rc, message, err = raw.SendCommand("HASH my file.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, message)
+	require.True(t, strings.HasSuffix(message, " my file.txt"))
+}
+
+func TestParseHashParams(t *testing.T) {
+	for _, p := range []struct {
+		param     string
+		withRange bool
+		args      []string
+	}{
+		{"file.txt", true, []string{"file.txt"}},
+		{"file.txt 7 11", true, []string{"file.txt", "7", "11"}},
+		{`"my file.txt" 7 11`, true, []string{"my file.txt", "7", "11"}},
+		{`"my file.txt"  7`, true, []string{"my file.txt", "7"}},
+		{`"my file.txt"`, true, []string{"my file.txt"}},
+		{"", true, []string{""}},
+		{"my file.txt", false, []string{"my file.txt"}},
+		{`"my file.txt"`, false, []string{"my file.txt"}},
+	} {
+		args, err := parseHashParams(p.param, p.withRange)
+		require.NoError(t, err)
+		require.Equal(t, p.args, args, p.param)
+	}
+
+	_, err := parseHashParams(`"unterminated`, true)
+	require.ErrorIs(t, err, errInvalidQuotedParam)
+}
+
 func TestCOMB(t *testing.T) {
 	s := NewTestServer(t, true)
 	conf := goftp.Config{
@@ -768,9 +1321,15 @@ func TestREST(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, StatusOK, rc, response)
 
+	// the offset is refused by the ASCII file transfers, the listings accept it
 	rc, response, err = raw.SendCommand("REST 10")
 	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	rc, response, err = raw.SendCommand("RETR file")
+	require.NoError(t, err)
 	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+	require.Equal(t, "Resuming transfers not allowed in ASCII mode", response)
 
 	rc, response, err = raw.SendCommand("TYPE I")
 	require.NoError(t, err)
@@ -820,6 +1379,53 @@ func TestSIZE(t *testing.T) {
 	require.Equal(t, "SIZE not allowed in ASCII mode", response)
 }
 
+func TestStatBatch(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/file1", make([]byte, 10), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, "/file2", make([]byte, 20), 0600))
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	tc := textproto.NewConn(conn)
+
+	defer func() { require.NoError(t, tc.Close()) }()
+
+	sendCommand := func(command string, expectedCode int) string {
+		if command != "" {
+			require.NoError(t, tc.PrintfLine("%s", command))
+		}
+
+		_, message, err := tc.ReadResponse(expectedCode)
+		require.NoError(t, err, message)
+
+		return message
+	}
+
+	sendCommand("", StatusServiceReady)
+	sendCommand("USER "+authUser, StatusUserOK)
+	sendCommand("PASS "+authPass, StatusUserLoggedIn)
+
+	// the client pipelines its commands, they are all sent before the first reply is received
+	_, err = conn.Write([]byte("SIZE file1\r\nMDTM file1\r\nSIZE file2\r\n"))
+	require.NoError(t, err)
+
+	require.Equal(t, "10", sendCommand("", StatusFileStatus))
+	sendCommand("", StatusFileStatus)
+	require.Equal(t, "20", sendCommand("", StatusFileStatus))
+
+	// a lone command doesn't need a batch, and doesn't get the info of the previous one
+	require.NoError(t, afero.WriteFile(driver.fs, "/file1", make([]byte, 30), 0600))
+	require.Equal(t, "30", sendCommand("SIZE file1", StatusFileStatus))
+
+	driver.statBatchesMu.Lock()
+	defer driver.statBatchesMu.Unlock()
+
+	require.Equal(t, [][]string{{"/file1", "/file2"}}, driver.statBatches)
+}
+
 func TestCOMBErrors(t *testing.T) {
 	s := NewTestServer(t, true)
 	conf := goftp.Config{
@@ -860,6 +1466,59 @@ func TestCOMBErrors(t *testing.T) {
 	require.Equal(t, StatusActionNotTaken, rc, message)
 }
 
+func TestCOMBPolicies(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			EnableCOMB:     true,
+			FilenamePolicy: &FilenamePolicy{DeniedPatterns: []string{"*.exe"}},
+		},
+		PermissionChecker: func(_, verb, filePath string) error {
+			if verb == "DELE" && filePath == "/kept" {
+				return errReadOnly
+			}
+
+			return nil
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/part", []byte("part"), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, "/kept", []byte("kept"), 0600))
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the target is subject to the filename policy
+	rc, message, err := raw.SendCommand("COMB file.exe part")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, message)
+
+	// the parts must be allowed to be deleted
+	rc, message, err = raw.SendCommand("COMB file.bin part kept")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, message)
+
+	for _, name := range []string{"/part", "/kept"} {
+		_, err = driver.fs.Stat(name)
+		require.NoError(t, err, name)
+	}
+
+	_, err = driver.fs.Stat("/file.bin")
+	require.True(t, os.IsNotExist(err), err)
+}
+
 type quotedParams struct {
 	params    string
 	parsed    []string
@@ -5,19 +5,46 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"strings"
 	"time"
 )
 
 var errUnknowHash = errors.New("unknown hash algorithm")
 
+// errCCCUnexpectedData is returned when a client sends commands before closing the TLS layer of the control
+// connection after CCC
+var errCCCUnexpectedData = errors.New("data received before the TLS closure")
+
 func (c *clientHandler) handleAUTH(param string) error {
-	if tlsConfig, err := c.server.driver.GetTLSConfig(); err == nil {
+	if c.handleAUTHMechanism(param) {
+		return nil
+	}
+
+	if tlsConfig, err := c.server.getTLSConfig(); err == nil {
+		if !c.server.pendingHandshakes.acquire(c.server.pendingQueueTimeout()) {
+			c.writeMessage(StatusNeedSecurityResource, "Too many TLS negotiations in progress, try again later")
+
+			return nil
+		}
+
+		defer c.server.pendingHandshakes.release()
+
 		c.writeMessage(StatusAuthAccepted, "AUTH command ok. Expecting TLS Negotiation.")
-		c.conn = tls.Server(c.conn, tlsConfig)
-		c.reader = bufio.NewReaderSize(c.conn, maxCommandSize)
+		tlsConn := tls.Server(c.conn, tlsConfig)
+		c.plainConn = c.conn
+		c.conn = tlsConn
+		c.reader = bufio.NewReaderSize(newTelnetReader(c.conn), c.server.settings.MaxCommandLength)
 		c.writer = bufio.NewWriter(c.conn)
 		c.setTLSForControl(true)
+
+		// a failed handshake will also make the next read fail and disconnect the client
+		if c.handshakeTLS(tlsConn) {
+			c.saveTLSState(tlsConn, true)
+		} else {
+			c.setCloseReason(CloseReasonProtocolViolation)
+		}
 	} else {
 		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Cannot get a TLS config: %v", err))
 	}
@@ -25,9 +52,45 @@ func (c *clientHandler) handleAUTH(param string) error {
 	return nil
 }
 
+// handshakeTLS does the TLS handshake of the control connection within TLSHandshakeTimeout, a silent client
+// would otherwise keep its goroutine forever. A takeover of the session expiring the deadline cancels it.
+func (c *clientHandler) handshakeTLS(tlsConn *tls.Conn) bool {
+	timeout := time.Duration(c.server.settings.TLSHandshakeTimeout) * time.Second
+	if err := tlsConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		c.logger.Error("Network error", "err", err)
+
+		return false
+	}
+
+	err := tlsConn.Handshake()
+
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		c.logger.Warn("TLS handshake timed out", "timeout", timeout)
+	case err != nil:
+		c.logger.Warn("TLS handshake failed", "err", err)
+	}
+
+	// the next command gets the idle deadline
+	if errDeadline := tlsConn.SetDeadline(time.Time{}); errDeadline != nil && err == nil {
+		c.logger.Error("Network error", "err", errDeadline)
+
+		return false
+	}
+
+	return err == nil
+}
+
 func (c *clientHandler) handlePROT(param string) error {
 	// P for Private, C for Clear
+	param = strings.ToUpper(param)
 	c.setTLSForTransfer(param == "P")
+
+	if param == "C" && c.HasTLSForControl() {
+		c.emitSecurityEvent(SecurityEventClearTransfers, "clear transfer connections requested after AUTH TLS")
+	}
 	c.writeMessage(StatusOK, "OK")
 
 	return nil
@@ -39,6 +102,87 @@ func (c *clientHandler) handlePBSZ(param string) error {
 	return nil
 }
 
+// handleCCC clears the control connection once the user is logged in, the transfer connections keep their
+// protection. The NAT helpers can then read the PORT and PASV commands.
+func (c *clientHandler) handleCCC(param string) error {
+	tlsConn, ok := c.conn.(*tls.Conn)
+
+	switch {
+	case !c.server.settings.EnableCCC:
+		c.writeMessage(StatusRequestDenied, "CCC is disabled")
+
+		return nil
+	case !ok:
+		c.writeMessage(StatusProtectionDenied, "The control connection isn't protected")
+
+		return nil
+	case c.plainConn == nil:
+		c.writeMessage(StatusRequestDenied, "CCC isn't available with implicit TLS")
+
+		return nil
+	}
+
+	c.writeMessage(StatusOK, "Clearing the control connection")
+
+	// the client sends its close_notify first: nothing can follow it in the same read, it waits for ours
+	if err := c.waitTLSClosure(tlsConn); err != nil {
+		c.logger.Warn("Could not clear the control connection, disconnecting client", "err", err)
+		c.disconnect(CloseReasonProtocolViolation)
+
+		return nil
+	}
+
+	// the TLS layer blocks the writes on the connection once its close_notify is sent
+	err := tlsConn.CloseWrite()
+	if err == nil {
+		err = c.plainConn.SetWriteDeadline(time.Time{})
+	}
+
+	if err != nil {
+		c.logger.Warn("Could not clear the control connection, disconnecting client", "err", err)
+		c.disconnect(CloseReasonProtocolViolation)
+
+		return nil
+	}
+
+	c.conn = c.plainConn
+	c.plainConn = nil
+	c.reader = bufio.NewReaderSize(newTelnetReader(c.conn), c.server.settings.MaxCommandLength)
+	c.writer = bufio.NewWriter(c.conn)
+	c.setTLSForControl(false)
+
+	c.paramsMutex.Lock()
+	c.tlsControlState = nil
+	c.paramsMutex.Unlock()
+
+	c.logger.Info("Control connection cleared")
+
+	return nil
+}
+
+// waitTLSClosure reads the close_notify alert of the client, it must come within ConnectionTimeout
+func (c *clientHandler) waitTLSClosure(tlsConn *tls.Conn) error {
+	timeout := time.Duration(c.server.settings.ConnectionTimeout) * time.Second
+	if err := tlsConn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	if c.reader.Buffered() > 0 {
+		return errCCCUnexpectedData
+	}
+
+	n, err := tlsConn.Read(make([]byte, 1))
+	if n > 0 {
+		return errCCCUnexpectedData
+	}
+
+	if !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	return tlsConn.SetReadDeadline(time.Time{})
+}
+
 func (c *clientHandler) handleSYST(param string) error {
 	if c.server.settings.DisableSYST {
 		c.writeMessage(StatusCommandNotImplemented, "SYST is disabled")
@@ -84,10 +228,26 @@ func (c *clientHandler) handleSITE(param string) error {
 		c.handleCHOWN(params)
 	case "SYMLINK":
 		c.handleSYMLINK(params)
+	case "LINK":
+		c.handleLINK(params)
 	case "MKDIR":
 		c.handleMKDIR(params)
 	case "RMDIR":
 		c.handleRMDIR(params)
+	case "MDEL":
+		c.handleMDEL(params)
+	case "CHECKSUM":
+		c.handleCHECKSUM(params)
+	case "IFMATCH":
+		c.handleIFMATCH(params)
+	case "PREHASH":
+		c.handlePREHASH(params)
+	case "DOWNLOAD-ARCHIVE":
+		c.handleDownloadArchive(params)
+	case "EXTRACT":
+		c.handleEXTRACT(params)
+	case "PSWD":
+		c.handlePSWD(params)
 	default:
 		c.writeMessage(StatusSyntaxErrorNotRecognised, fmt.Sprintf("Unknown SITE subcommand: %s", cmd))
 	}
@@ -113,7 +273,7 @@ func (c *clientHandler) handleSTATServer() error {
 
 	duration := time.Now().UTC().Sub(c.connectedAt)
 	duration -= duration % time.Second
-	c.writeLine(fmt.Sprintf(
+	c.writeText(fmt.Sprintf(
 		"Connected to %s from %s for %s",
 		c.server.settings.ListenAddr,
 		c.conn.RemoteAddr(),
@@ -121,17 +281,17 @@ func (c *clientHandler) handleSTATServer() error {
 	))
 
 	if c.user != "" {
-		c.writeLine(fmt.Sprintf("Logged in as %s", c.user))
+		c.writeText(fmt.Sprintf("Logged in as %s", c.user))
 	} else {
-		c.writeLine("Not logged in yet")
+		c.writeText("Not logged in yet")
 	}
 
 	if info := c.GetTranferInfo(); info != "" {
-		c.writeLine("Transfer connection open")
-		c.writeLine(info)
+		c.writeText("Transfer connection open")
+		c.writeText(info)
 	}
 
-	c.writeLine(c.server.settings.Banner)
+	c.writeText(c.server.settings.Banner)
 
 	return nil
 }
@@ -144,6 +304,20 @@ func (c *clientHandler) handleOPTS(param string) error {
 		return nil
 	}
 
+	if len(args) > 1 && strings.EqualFold(args[0], "RETR") && c.server.settings.MaxParallelStreams > 0 &&
+		strings.HasPrefix(strings.ToLower(args[1]), "parallelism=") {
+		c.handleOPTSParallelism(args[1])
+
+		return nil
+	}
+
+	if len(args) > 1 && strings.EqualFold(args[0], "STOR") && c.server.settings.EnableUploadTrailer &&
+		strings.HasPrefix(strings.ToUpper(args[1]), "TRAILER ") {
+		c.handleOPTSTrailer(args[1][len("TRAILER "):])
+
+		return nil
+	}
+
 	if strings.EqualFold(args[0], "HASH") && c.server.settings.EnableHASH {
 		hashMapping := getHashMapping()
 
@@ -185,15 +359,13 @@ func (c *clientHandler) handleNOOP(param string) error {
 
 func (c *clientHandler) handleCLNT(param string) error {
 	c.setClientVersion(param)
+	c.identifyClient()
 	c.writeMessage(StatusOK, "Good to know")
 
 	return nil
 }
 
 func (c *clientHandler) handleFEAT(param string) error {
-	c.writeLine(fmt.Sprintf("%d- These are my features", StatusSystemStatus))
-	defer c.writeMessage(StatusSystemStatus, "end")
-
 	features := []string{
 		"CLNT",
 		"UTF8",
@@ -201,7 +373,10 @@ func (c *clientHandler) handleFEAT(param string) error {
 		"MDTM",
 		"REST STREAM",
 		"EPRT",
-		"EPSV",
+	}
+
+	if !c.quirks.DisableEPSV {
+		features = append(features, "EPSV")
 	}
 
 	if !c.server.settings.DisableMLSD {
@@ -209,7 +384,7 @@ func (c *clientHandler) handleFEAT(param string) error {
 	}
 
 	if !c.server.settings.DisableMLST {
-		features = append(features, "MLST")
+		features = append(features, c.getMLSTFeature())
 	}
 
 	if !c.server.settings.DisableMFMT {
@@ -245,14 +420,26 @@ func (c *clientHandler) handleFEAT(param string) error {
 		features = append(features, "COMB")
 	}
 
+	if c.server.settings.MaxParallelStreams > 0 {
+		features = append(features, "PARALLEL")
+	}
+
+	if c.server.settings.EnableUploadTrailer {
+		features = append(features, c.getTrailerFeature())
+	}
+
 	if _, ok := c.driver.(ClientDriverExtensionAvailableSpace); ok {
 		features = append(features, "AVBL")
 	}
 
+	reply := NewReply(StatusSystemStatus, " These are my features")
+
 	for _, f := range features {
-		c.writeLine(" " + f)
+		reply.Text(" " + f)
 	}
 
+	c.writeReply(reply.Line("end"))
+
 	return nil
 }
 
@@ -262,7 +449,12 @@ func (c *clientHandler) handleTYPE(param string) error {
 		c.currentTransferType = TransferTypeBinary
 		c.writeMessage(StatusOK, "Type set to binary")
 	case "A", "L7":
-		c.currentTransferType = TransferTypeASCII
+		if c.quirks.ASCIIAsBinary {
+			c.currentTransferType = TransferTypeBinary
+		} else {
+			c.currentTransferType = TransferTypeASCII
+		}
+
 		c.writeMessage(StatusOK, "Type set to ASCII")
 	default:
 		c.writeMessage(StatusNotImplementedParam, "Unsupported transfer type")
@@ -271,10 +463,27 @@ func (c *clientHandler) handleTYPE(param string) error {
 	return nil
 }
 
+func (c *clientHandler) handleMODE(param string) error {
+	mode, ok := transferModes[strings.ToUpper(param)]
+
+	switch {
+	case !ok:
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Unknown transfer mode %s", param))
+	case !c.isTransferModeSupported(mode):
+		c.writeMessage(StatusNotImplementedParam, fmt.Sprintf("Transfer mode %s isn't supported", param))
+	default:
+		c.currentTransferMode = mode
+		c.writeMessage(StatusOK, fmt.Sprintf("Mode set to %s", strings.ToUpper(param)))
+	}
+
+	return nil
+}
+
 func (c *clientHandler) handleQUIT(param string) error {
 	c.transferWg.Wait()
-	c.writeMessage(StatusClosingControlConn, "Goodbye")
-	c.disconnect()
+	c.writeMessage(StatusClosingControlConn,
+		c.executeStatsTemplate(c.server.quitTemplate, c.getSessionStats(), "Goodbye"))
+	c.disconnect(CloseReasonQuit)
 	c.reader = nil
 
 	return nil
@@ -303,7 +512,7 @@ func (c *clientHandler) handleABOR(param string) error {
 		}
 
 		if isOpened {
-			c.writeMessage(StatusTransferAborted, "Connection closed; transfer aborted")
+			c.writeTransferMessage(StatusTransferAborted, "Connection closed; transfer aborted")
 		}
 	}
 
@@ -314,11 +523,11 @@ func (c *clientHandler) handleABOR(param string) error {
 
 func (c *clientHandler) handleAVBL(param string) error {
 	if avbl, ok := c.driver.(ClientDriverExtensionAvailableSpace); ok {
-		path := c.absPath(param)
+		path := c.paramPath(param)
 
-		info, err := c.driver.Stat(path)
+		info, err := c.stat(path)
 		if err != nil {
-			c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Couldn't access %s: %v", path, err))
+			c.writeMessage(getErrorCode(err, StatusActionNotTaken), fmt.Sprintf("Couldn't access %s: %v", path, err))
 
 			return nil
 		}
@@ -1,8 +1,11 @@
 package ftpserver
 
 import (
+	"bufio"
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net"
 	"strings"
 	"testing"
 
@@ -70,6 +73,43 @@ func TestIdleTimeout(t *testing.T) {
 	require.Equal(t, StatusServiceNotAvailable, rc)
 }
 
+func TestIdleWarning(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{IdleTimeout: 2, IdleWarning: 1, IdleTimeoutIgnoresNOOP: true},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the warning comes 1s before the timeout
+	rc, response, err := raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc)
+	require.Contains(t, response, "Idle session")
+
+	// NOOP doesn't reset the idle timer
+	rc, _, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc)
+	require.Contains(t, response, "command timeout")
+}
+
 func TestStat(t *testing.T) {
 	s := NewTestServer(t, true)
 	conf := goftp.Config{
@@ -301,3 +341,166 @@ func TestTYPE(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, StatusNotImplementedParam, rc)
 }
+
+func TestMODE(t *testing.T) {
+	s := NewTestServer(t, true)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	for command, code := range map[string]int{
+		"MODE S":     StatusOK,
+		"MODE s":     StatusOK,
+		"MODE B":     StatusNotImplementedParam,
+		"MODE C":     StatusNotImplementedParam,
+		"MODE wrong": StatusSyntaxErrorParameters,
+	} {
+		rc, _, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, code, rc, command)
+	}
+}
+
+func TestCCC(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		TLS:      true,
+		Settings: &Settings{EnableCCC: true},
+	})
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	command := func(conn net.Conn, reader *bufio.Reader, line string) string {
+		if line != "" {
+			_, errWrite := conn.Write([]byte(line + "\r\n"))
+			require.NoError(t, errWrite)
+		}
+
+		reply, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return strings.TrimRight(reply, "\r\n")
+	}
+
+	reader := bufio.NewReader(conn)
+	require.Equal(t, "220 TEST Server", command(conn, reader, ""))
+
+	// the user must be logged in
+	require.Equal(t, "530 Please login with USER and PASS", command(conn, reader, "CCC"))
+	require.Equal(t, "234 AUTH command ok. Expecting TLS Negotiation.", command(conn, reader, "AUTH TLS"))
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true}) // nolint:gosec
+	tlsReader := bufio.NewReader(tlsConn)
+
+	require.Equal(t, "331 OK", command(tlsConn, tlsReader, "USER "+authUser))
+	require.Equal(t, "230 Password ok, continue", command(tlsConn, tlsReader, "PASS "+authPass))
+	require.Equal(t, "200 OK", command(tlsConn, tlsReader, "PROT P"))
+	require.Equal(t, "200 Clearing the control connection", command(tlsConn, tlsReader, "CCC"))
+
+	// the client closes the TLS layer first, then waits for the server closure
+	require.NoError(t, tlsConn.CloseWrite())
+
+	_, err = tlsReader.ReadByte()
+	require.Equal(t, io.EOF, err)
+
+	// the TLS layer blocked the writes once its close_notify was sent
+	require.NoError(t, conn.SetWriteDeadline(time.Time{}))
+
+	reader = bufio.NewReader(conn)
+	require.Equal(t, "257 \"/\" is the current directory", command(conn, reader, "PWD"))
+	require.Equal(t, "533 The control connection isn't protected", command(conn, reader, "CCC"))
+}
+
+func TestCCCDisabled(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		TLS:   true,
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			// nolint:gosec
+			InsecureSkipVerify: true,
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, _, err := raw.SendCommand("CCC")
+	require.NoError(t, err)
+	require.Equal(t, StatusRequestDenied, rc)
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	t.Run("auth-tls", func(t *testing.T) {
+		s := NewTestServerWithDriver(t, &TestServerDriver{
+			Debug:    true,
+			TLS:      true,
+			Settings: &Settings{TLSHandshakeTimeout: 1},
+		})
+
+		conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+		require.NoError(t, err)
+
+		defer func() { require.NoError(t, conn.Close()) }()
+
+		reader := bufio.NewReader(conn)
+		_, err = reader.ReadString('\n')
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte("AUTH TLS\r\n"))
+		require.NoError(t, err)
+
+		reply, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "234 AUTH command ok. Expecting TLS Negotiation.\r\n", reply)
+
+		// the client never starts the handshake
+		start := time.Now()
+		_, err = reader.ReadByte()
+		require.Error(t, err)
+		require.Less(t, int64(time.Since(start)), int64(3*time.Second))
+	})
+
+	t.Run("implicit-tls", func(t *testing.T) {
+		s := NewTestServerWithDriver(t, &TestServerDriver{
+			Debug:    true,
+			TLS:      true,
+			Settings: &Settings{TLSRequired: ImplicitEncryption, TLSHandshakeTimeout: 1},
+		})
+
+		conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+		require.NoError(t, err)
+
+		defer func() { require.NoError(t, conn.Close()) }()
+
+		start := time.Now()
+		_, err = conn.Read(make([]byte, 1))
+		require.Error(t, err)
+		require.Less(t, int64(time.Since(start)), int64(3*time.Second))
+	})
+}
@@ -0,0 +1,70 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// setIdleDeadline sets the deadline of the next command, the deadline of the idle warning if it is
+// enabled and hasn't been sent yet, or the end of the login or the warning of the end of the access if they
+// come first. Without idle timeout, only the login ones are set.
+func (c *clientHandler) setIdleDeadline() {
+	settings := c.server.settings
+	deadline := c.loginDeadline()
+
+	if settings.IdleTimeout > 0 {
+		idleDeadline := c.idleSince.Add(time.Duration(settings.IdleTimeout) * time.Second)
+
+		if settings.IdleWarning > 0 && !c.idleWarned {
+			idleDeadline = idleDeadline.Add(-time.Duration(settings.IdleWarning) * time.Second)
+		}
+
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+
+	if warning := c.accessWarningDeadline(); !warning.IsZero() && (deadline.IsZero() || warning.Before(deadline)) {
+		deadline = warning
+	}
+
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		c.logger.Error("Network error", "err", err)
+	}
+}
+
+// warnIdle sends the idle warning if the read error is its deadline, it returns false if the error
+// has to end the session
+func (c *clientHandler) warnIdle(err error) bool {
+	var netErr net.Error
+
+	settings := c.server.settings
+	if settings.IdleTimeout <= 0 || settings.IdleWarning <= 0 || c.idleWarned || !errors.As(err, &netErr) ||
+		!netErr.Timeout() {
+		return false
+	}
+
+	// the deadline applies to the writes too
+	c.idleWarned = true
+	c.setIdleDeadline()
+	c.writeMessage(StatusServiceNotAvailable,
+		fmt.Sprintf("Idle session, send a command within %d seconds to stay connected", c.server.settings.IdleWarning))
+
+	return true
+}
+
+// isIdleActivity returns true if a received line resets the idle timer. NOOP doesn't with
+// IdleTimeoutIgnoresNOOP, unless a transfer is in progress.
+func (c *clientHandler) isIdleActivity(line string) bool {
+	if !c.server.settings.IdleTimeoutIgnoresNOOP || atomic.LoadInt32(&c.transferActive) != 0 {
+		return true
+	}
+
+	command, _ := parseLine(line)
+
+	return !strings.EqualFold(command, "NOOP")
+}
@@ -0,0 +1,209 @@
+package ftpserver
+
+import (
+	"fmt"
+)
+
+// LifecycleState is a state of the lifecycle of a session. The sessions go through these states:
+//
+//	connected -> authenticating (USER) -> logged-in (PASS) -> closed
+//	                                   -> password-expired -> logged-in (SITE PSWD)
+//	logged-in -> rename-pending (RNFR) -> logged-in (RNTO or any other command)
+//	logged-in or rename-pending -> transferring (transfer connection open) -> previous state
+//
+// The transfers are tracked apart from the other states: a session keeps its state while a transfer is open
+// and gets it back once the transfer is closed, the commands are accepted according to that state.
+// REIN brings a session back to connected. MainDriverExtensionLifecycle is notified of the transitions.
+type LifecycleState int32
+
+// Lifecycle states
+const (
+	StateConnected       LifecycleState = iota // Connected, the user isn't known yet
+	StateAuthenticating                        // USER received, PASS is expected
+	StatePasswordExpired                       // Authenticated with an expired password, SITE PSWD is expected
+	StateLoggedIn                              // Authenticated
+	StateRenamePending                         // RNFR accepted, RNTO is expected
+	StateTransferring                          // Transfer connection open
+	StateClosed                                // The session ended
+)
+
+func (s LifecycleState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateAuthenticating:
+		return "authenticating"
+	case StatePasswordExpired:
+		return "password-expired"
+	case StateLoggedIn:
+		return "logged-in"
+	case StateRenamePending:
+		return "rename-pending"
+	case StateTransferring:
+		return "transferring"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// lifecycleTransitions are the valid transitions, any state can also go to StateClosed
+var lifecycleTransitions = map[LifecycleState][]LifecycleState{
+	StateConnected:       {StateAuthenticating, StateLoggedIn},
+	StateAuthenticating:  {StateLoggedIn, StatePasswordExpired, StateConnected},
+	StatePasswordExpired: {StateAuthenticating, StateLoggedIn, StateConnected},
+	StateLoggedIn:        {StateRenamePending, StateTransferring, StateConnected},
+	StateRenamePending:   {StateLoggedIn, StateTransferring, StateConnected},
+	StateTransferring:    {StateLoggedIn, StateRenamePending},
+}
+
+// IsValidTransition tells if a session can go from a state to another one
+func IsValidTransition(from, to LifecycleState) bool {
+	if from == StateClosed {
+		return false
+	}
+
+	if to == StateClosed {
+		return true
+	}
+
+	for _, state := range lifecycleTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// commandStates are the commands that are only accepted in some states, the others get a 503 reply
+var commandStates = map[string]struct {
+	states  []LifecycleState
+	message string
+}{
+	"PASS": {states: []LifecycleState{StateAuthenticating, StateLoggedIn}, message: "USER is expected before PASS"},
+	"RNTO": {states: []LifecycleState{StateRenamePending}, message: "RNFR is expected before RNTO"},
+}
+
+// GetLifecycleState returns the current state of the session
+func (c *clientHandler) GetLifecycleState() LifecycleState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.lifecycleState()
+}
+
+// lifecycleState returns the state of the session with its open transfer, stateMu must be held
+func (c *clientHandler) lifecycleState() LifecycleState {
+	if c.transferring && c.state != StateClosed {
+		return StateTransferring
+	}
+
+	return c.state
+}
+
+// sessionState returns the state of the session, regardless of its open transfer
+func (c *clientHandler) sessionState() LifecycleState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.state
+}
+
+// setState moves the session to a state
+func (c *clientHandler) setState(to LifecycleState) {
+	c.changeState(func() bool {
+		if c.state == StateClosed {
+			return false
+		}
+
+		c.state = to
+
+		return true
+	})
+}
+
+// transition moves the session to a state if it is in the from state
+func (c *clientHandler) transition(from, to LifecycleState) {
+	c.changeState(func() bool {
+		if c.state != from {
+			return false
+		}
+
+		c.state = to
+
+		return true
+	})
+}
+
+// setTransferring tells if a transfer connection is open, the state of the session is kept along it
+func (c *clientHandler) setTransferring(transferring bool) {
+	c.changeState(func() bool {
+		c.transferring = transferring
+
+		return true
+	})
+}
+
+// changeState applies a change under stateMu and notifies the driver if the state of the session changed.
+// The changes are serialized with their notifications so that the driver sees them in order, and a closed
+// session doesn't change anymore.
+func (c *clientHandler) changeState(change func() bool) {
+	c.stateHooksMu.Lock()
+	defer c.stateHooksMu.Unlock()
+
+	c.stateMu.Lock()
+	from := c.lifecycleState()
+
+	if from == StateClosed || !change() {
+		c.stateMu.Unlock()
+
+		return
+	}
+
+	to := c.lifecycleState()
+	c.stateMu.Unlock()
+
+	if from == to {
+		return
+	}
+
+	if !IsValidTransition(from, to) {
+		c.logger.Warn("Unexpected session state transition", "from", from.String(), "to", to.String())
+	}
+
+	if c.debug {
+		c.logger.Debug("Session state changed", "from", from.String(), "to", to.String())
+	}
+
+	if hooks, ok := c.server.driver.(MainDriverExtensionLifecycle); ok {
+		hooks.SessionStateChanged(c, from, to)
+	}
+}
+
+// checkCommandState rejects a command received out of sequence
+func (c *clientHandler) checkCommandState(command string) bool {
+	rule, ok := commandStates[command]
+	if !ok {
+		return true
+	}
+
+	state := c.sessionState()
+
+	for _, accepted := range rule.states {
+		if state == accepted {
+			return true
+		}
+	}
+
+	c.writeMessage(StatusBadCommandSequence, rule.message)
+
+	return false
+}
+
+// endRename forgets the pending RNFR, once RNTO is done or cancelled
+func (c *clientHandler) endRename() {
+	c.ctxRnfr = ""
+	c.transition(StateRenamePending, StateLoggedIn)
+}
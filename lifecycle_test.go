@@ -0,0 +1,91 @@
+package ftpserver
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLifecycle(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	sendCommand := func(command string) string {
+		if command != "" {
+			_, errWrite := conn.Write([]byte(command + "\r\n"))
+			require.NoError(t, errWrite)
+		}
+
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return line[:len(line)-2]
+	}
+
+	require.Equal(t, "220 TEST Server", sendCommand(""))
+
+	driver.clientMU.Lock()
+	cc := driver.Clients[0]
+	driver.clientMU.Unlock()
+
+	require.Equal(t, StateConnected, cc.GetLifecycleState())
+
+	// the out of sequence commands are refused
+	require.Equal(t, "503 USER is expected before PASS", sendCommand("PASS "+authPass))
+	require.Equal(t, "331 OK", sendCommand("USER "+authUser))
+	require.Equal(t, StateAuthenticating, cc.GetLifecycleState())
+	require.Equal(t, "230 Password ok, continue", sendCommand("PASS "+authPass))
+	require.Equal(t, StateLoggedIn, cc.GetLifecycleState())
+	require.Equal(t, "503 RNFR is expected before RNTO", sendCommand("RNTO b"))
+
+	require.Equal(t, `257 Created dir "/a"`, sendCommand("MKD a"))
+	require.Equal(t, "350 Sure, give me a target", sendCommand("RNFR a"))
+	require.Equal(t, StateRenamePending, cc.GetLifecycleState())
+
+	// any other command cancels the rename
+	require.Equal(t, "200 OK", sendCommand("NOOP"))
+	require.Equal(t, StateLoggedIn, cc.GetLifecycleState())
+	require.Equal(t, "503 RNFR is expected before RNTO", sendCommand("RNTO b"))
+
+	// the pending rename is kept along a transfer
+	require.Equal(t, "350 Sure, give me a target", sendCommand("RNFR a"))
+
+	handler, ok := cc.(*clientHandler)
+	require.True(t, ok)
+	handler.setTransferring(true)
+	require.Equal(t, StateTransferring, cc.GetLifecycleState())
+	handler.setTransferring(false)
+	require.Equal(t, StateRenamePending, cc.GetLifecycleState())
+	require.Equal(t, "250 Done !", sendCommand("RNTO b"))
+	require.Equal(t, StateLoggedIn, cc.GetLifecycleState())
+
+	require.Equal(t, "220 Service ready for new user", sendCommand("REIN"))
+	require.Equal(t, StateConnected, cc.GetLifecycleState())
+	require.Equal(t, "221 Goodbye", sendCommand("QUIT"))
+
+	require.Eventually(t, func() bool {
+		return cc.GetLifecycleState() == StateClosed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, []LifecycleState{StateAuthenticating, StateLoggedIn, StateRenamePending, StateLoggedIn,
+		StateRenamePending, StateTransferring, StateRenamePending, StateLoggedIn, StateConnected, StateClosed},
+		driver.getStates())
+}
+
+func TestLifecycleTransitions(t *testing.T) {
+	require.True(t, IsValidTransition(StateConnected, StateAuthenticating))
+	require.True(t, IsValidTransition(StateTransferring, StateClosed))
+	require.True(t, IsValidTransition(StateTransferring, StateRenamePending))
+	require.False(t, IsValidTransition(StateConnected, StateTransferring))
+	require.False(t, IsValidTransition(StateClosed, StateConnected))
+	require.Equal(t, "rename-pending", StateRenamePending.String())
+}
@@ -0,0 +1,142 @@
+package ftpserver
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// listingCache keeps the last directory listing of a session for a short time, so that the
+// SIZE/MDTM/MLST commands clients send for the listed entries don't all reach the driver
+type listingCache struct {
+	directory string
+	entries   map[string]os.FileInfo
+	expiresAt time.Time
+}
+
+// listingCacheCommands are the commands that can't modify files, the cache is cleared by any other one
+var listingCacheCommands = map[string]bool{
+	"SIZE": true, "MDTM": true, "MLST": true, "STAT": true, "LIST": true, "NLST": true, "MLSD": true,
+	"NOOP": true, "PWD": true, "XPWD": true, "CWD": true, "XCWD": true, "CDUP": true, "TYPE": true,
+	"PASV": true, "EPSV": true, "PORT": true, "EPRT": true, "REST": true, "RETR": true, "FEAT": true,
+	"SYST": true, "OPTS": true, "CLNT": true, "AVBL": true, "HASH": true, "XCRC": true, "MD5": true,
+	"XMD5": true, "XSHA": true, "XSHA1": true, "XSHA256": true, "XSHA512": true,
+}
+
+// cacheListing saves the entries of a listed directory if the listing cache is enabled
+func (c *clientHandler) cacheListing(directory string, files []os.FileInfo) {
+	if c.server.settings.ListingCacheTTL <= 0 {
+		return
+	}
+
+	entries := make(map[string]os.FileInfo, len(files))
+	for _, file := range files {
+		entries[file.Name()] = file
+	}
+
+	c.listingCacheMu.Lock()
+	defer c.listingCacheMu.Unlock()
+
+	c.listingCache = &listingCache{
+		directory: directory,
+		entries:   entries,
+		expiresAt: time.Now().Add(time.Duration(c.server.settings.ListingCacheTTL) * time.Second),
+	}
+}
+
+// clearListingCache forgets the last listing
+func (c *clientHandler) clearListingCache() {
+	c.listingCacheMu.Lock()
+	c.listingCache = nil
+	c.listingCacheMu.Unlock()
+}
+
+// getCachedFileInfo returns the cached info of a file, nil if it isn't available
+func (c *clientHandler) getCachedFileInfo(name string) os.FileInfo {
+	c.listingCacheMu.Lock()
+	defer c.listingCacheMu.Unlock()
+
+	cache := c.listingCache
+	if cache == nil || path.Dir(name) != cache.directory {
+		return nil
+	}
+
+	if time.Now().After(cache.expiresAt) {
+		c.listingCache = nil
+
+		return nil
+	}
+
+	return cache.entries[path.Base(name)]
+}
+
+// statBatchCommands are the commands whose bursts are coalesced with ClientDriverExtensionStatBatch
+var statBatchCommands = map[string]bool{"SIZE": true, "MDTM": true, "MLST": true}
+
+// prefetchStats gets in one driver call the info of all the files of a burst of SIZE/MDTM/MLST commands.
+// The burst is made of the current command and of the ones the client already sent (pipelining).
+func (c *clientHandler) prefetchStats(param string) {
+	statBatch, ok := c.driver.(ClientDriverExtensionStatBatch)
+	if !ok {
+		return
+	}
+
+	name := c.paramPath(param)
+	if _, ok := c.statBatchResults[name]; ok {
+		return
+	}
+
+	uses := map[string]int{name: 1}
+	names := []string{name}
+	nbCommands := 1
+
+	buffered, _ := c.reader.Peek(c.reader.Buffered())
+	lines := strings.Split(string(buffered), "\n")
+
+	// the last element is an incomplete line, or an empty string
+	for _, line := range lines[:len(lines)-1] {
+		command, lineParam := parseLine(strings.TrimSuffix(line, "\r"))
+		if !statBatchCommands[strings.ToUpper(command)] || lineParam == "" {
+			continue
+		}
+
+		nbCommands++
+
+		lineName := c.paramPath(lineParam)
+		if uses[lineName] == 0 {
+			names = append(names, lineName)
+		}
+
+		uses[lineName]++
+	}
+
+	if nbCommands < 2 {
+		return
+	}
+
+	results, err := statBatch.StatBatch(names)
+	if err != nil {
+		c.logger.Warn("Could not get the files info in batch", "names", names, "err", err)
+
+		return
+	}
+
+	c.statBatchResults = results
+	c.statBatchUses = uses
+}
+
+// batchedStat gets the info of a file for a SIZE/MDTM/MLST command, from its burst if it was part of one.
+// Each result is only used by the command it was fetched for, later commands look the file up again.
+func (c *clientHandler) batchedStat(name string) (os.FileInfo, error) {
+	if info, ok := c.statBatchResults[name]; ok {
+		c.statBatchUses[name]--
+		if c.statBatchUses[name] <= 0 {
+			delete(c.statBatchResults, name)
+		}
+
+		return info, nil
+	}
+
+	return c.stat(name)
+}
@@ -0,0 +1,99 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrListingTooLarge is returned when a directory listing exceeds MaxListingEntries or MaxListingBytes
+var ErrListingTooLarge = errors.New("listing too large")
+
+// errListingTruncated is returned when the listing limits truncated a listing, it ends normally
+var errListingTruncated = errors.New("listing truncated")
+
+// isListable tells if the result of getFileList can be sent
+func isListable(err error) bool {
+	return err == nil || err == io.EOF || errors.Is(err, errListingTruncated)
+}
+
+// listingReadCount is the number of directory entries to read to apply MaxListingEntries, -1 for all of them
+func (c *clientHandler) listingReadCount() int {
+	if max := c.server.settings.MaxListingEntries; max > 0 {
+		return max + 1
+	}
+
+	return -1
+}
+
+// limitListingEntries applies MaxListingEntries to the entries of a directory (read with listingReadCount),
+// count being their number before the temporary uploads were hidden
+func (c *clientHandler) limitListingEntries(files []os.FileInfo, count int) ([]os.FileInfo, error) {
+	max := c.server.settings.MaxListingEntries
+	if max <= 0 || count <= max {
+		return files, nil
+	}
+
+	if !c.server.settings.TruncateListings {
+		return nil, fmt.Errorf("%w: more than %d entries", ErrListingTooLarge, max)
+	}
+
+	if len(files) > max {
+		files = files[:max]
+	}
+
+	return files, errListingTruncated
+}
+
+// listingWriter applies MaxListingBytes to a listing, each write being an entry
+type listingWriter struct {
+	writer    io.Writer
+	maxBytes  int64
+	written   int64
+	truncate  bool // TruncateListings
+	truncated bool // the entries or the bytes of the listing were truncated
+}
+
+func (c *clientHandler) newListingWriter(w io.Writer, errList error) *listingWriter {
+	return &listingWriter{
+		writer:    w,
+		maxBytes:  c.server.settings.MaxListingBytes,
+		truncate:  c.server.settings.TruncateListings,
+		truncated: errors.Is(errList, errListingTruncated),
+	}
+}
+
+func (w *listingWriter) Write(p []byte) (int, error) {
+	if w.maxBytes > 0 && w.written+int64(len(p)) > w.maxBytes {
+		if !w.truncate {
+			return 0, fmt.Errorf("%w: more than %d bytes", ErrListingTooLarge, w.maxBytes)
+		}
+
+		w.truncated = true
+
+		return 0, errListingTruncated
+	}
+
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+
+	return n, err
+}
+
+// closeListing closes the transfer of a listing, the reply tells if the listing was truncated
+func (c *clientHandler) closeListing(w *listingWriter, err error) {
+	if errors.Is(err, errListingTruncated) {
+		err = nil
+	}
+
+	message := "Closing transfer connection"
+
+	if err == nil && w.truncated {
+		c.logger.Warn("Listing truncated", "entries", c.server.settings.MaxListingEntries, "bytes", w.written)
+
+		message = "Closing transfer connection, the listing was truncated"
+	}
+
+	c.closeTransferWithMessage(err, message)
+}
@@ -0,0 +1,83 @@
+package ftpserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListingLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		entries  int    // entries sent, -1 if the listing fails before the transfer
+		reply    int    // final reply
+		marker   bool   // the reply tells that the listing was truncated
+		message  string // part of the final reply
+	}{
+		{"unlimited", Settings{}, 5, StatusClosingDataConn, false, ""},
+		{"entries", Settings{MaxListingEntries: 3}, -1, StatusInsufficientStorage, false, "more than 3 entries"},
+		{"entries-truncated", Settings{MaxListingEntries: 3, TruncateListings: true}, 3, StatusClosingDataConn, true, ""},
+		{"entries-exact", Settings{MaxListingEntries: 5}, 5, StatusClosingDataConn, false, ""},
+		// the names are 7 bytes long with their CRLF
+		{"bytes", Settings{MaxListingBytes: 20}, 2, StatusInsufficientStorage, false, "more than 20 bytes"},
+		{"bytes-truncated", Settings{MaxListingBytes: 20, TruncateListings: true}, 2, StatusClosingDataConn, true, ""},
+	}
+
+	for _, test := range tests {
+		test := test
+
+		t.Run(test.name, func(t *testing.T) {
+			settings := test.settings
+			settings.DefaultTransferType = TransferTypeBinary
+			driver := &TestServerDriver{Debug: true, Settings: &settings}
+			s := NewTestServerWithDriver(t, driver)
+
+			for i := 1; i <= 5; i++ {
+				require.NoError(t, afero.WriteFile(driver.fs, fmt.Sprintf("/file%d", i), nil, 0600))
+			}
+
+			c, err := goftp.DialConfig(goftp.Config{User: authUser, Password: authPass}, s.Addr())
+			require.NoError(t, err, "Couldn't connect")
+
+			defer func() { panicOnError(c.Close()) }()
+
+			raw, err := c.OpenRawConn()
+			require.NoError(t, err, "Couldn't open raw connection")
+
+			defer func() { require.NoError(t, raw.Close()) }()
+
+			dcGetter, err := raw.PrepareDataConn()
+			require.NoError(t, err)
+
+			rc, response, err := raw.SendCommand("NLST /")
+			require.NoError(t, err)
+
+			if test.entries >= 0 {
+				require.Equal(t, StatusFileStatusOK, rc, response)
+
+				dc, errDc := dcGetter()
+				require.NoError(t, errDc)
+
+				content, errRead := ioutil.ReadAll(dc)
+				require.NoError(t, errRead)
+				require.NoError(t, dc.Close())
+
+				lines := strings.Split(strings.TrimSuffix(string(content), "\r\n"), "\r\n")
+				require.Len(t, lines, test.entries)
+
+				rc, response, err = raw.ReadResponse()
+				require.NoError(t, err)
+				require.Equal(t, test.marker, strings.Contains(response, "the listing was truncated"), response)
+			}
+
+			require.Equal(t, test.reply, rc, response)
+			require.Contains(t, response, test.message)
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package ftpserver
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// LockoutScope tells what a Lockout applies to
+type LockoutScope int
+
+// Lockout scopes
+const (
+	LockoutScopeUser LockoutScope = iota // The logins of a user are refused, whatever the client IP
+	LockoutScopeIP                       // The logins from a client IP are refused, whatever the user
+)
+
+func (s LockoutScope) String() string {
+	switch s {
+	case LockoutScopeUser:
+		return "user"
+	case LockoutScopeIP:
+		return "ip"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// Lockout is a user or a client IP whose logins are refused after too many failures (see MaxLoginFailures)
+type Lockout struct {
+	Scope    LockoutScope
+	Key      string    // User name or client IP
+	Failures int       // Failed logins that caused the lockout
+	Until    time.Time // End of the lockout
+}
+
+type lockoutKey struct {
+	scope LockoutScope
+	key   string
+}
+
+// loginFailures are the recent failed logins of a user or a client IP
+type loginFailures struct {
+	count int
+	last  time.Time // last failure
+	until time.Time // end of the lockout, zero if there is none
+}
+
+func (f *loginFailures) isLocked(now time.Time) bool {
+	return now.Before(f.until)
+}
+
+func (f *loginFailures) isExpired(now time.Time, duration time.Duration) bool {
+	if f.until.IsZero() {
+		return now.Sub(f.last) > duration
+	}
+
+	return !f.isLocked(now)
+}
+
+func (server *FtpServer) lockoutDuration() time.Duration {
+	return time.Duration(server.settings.LoginLockoutDuration) * time.Second
+}
+
+// getLockoutKeys returns the keys of the failures of a login, the unknown user or IP are skipped
+func getLockoutKeys(user, ip string) []lockoutKey {
+	keys := make([]lockoutKey, 0, 2)
+
+	if user != "" {
+		keys = append(keys, lockoutKey{scope: LockoutScopeUser, key: user})
+	}
+
+	if ip != "" {
+		keys = append(keys, lockoutKey{scope: LockoutScopeIP, key: ip})
+	}
+
+	return keys
+}
+
+// getLockout returns the lockout preventing a user to log in from a client IP, nil if there is none
+func (server *FtpServer) getLockout(user, ip string, now time.Time) *Lockout {
+	if server.settings.MaxLoginFailures <= 0 {
+		return nil
+	}
+
+	server.loginFailuresMu.Lock()
+	defer server.loginFailuresMu.Unlock()
+
+	for _, key := range getLockoutKeys(user, ip) {
+		if failures, ok := server.loginFailures[key]; ok && failures.isLocked(now) {
+			return &Lockout{Scope: key.scope, Key: key.key, Failures: failures.count, Until: failures.until}
+		}
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failed login of a user from a client IP, it returns the lockouts it started
+func (server *FtpServer) recordLoginFailure(user, ip string, now time.Time) []Lockout {
+	if server.settings.MaxLoginFailures <= 0 {
+		return nil
+	}
+
+	server.loginFailuresMu.Lock()
+	defer server.loginFailuresMu.Unlock()
+
+	server.pruneLoginFailures(now)
+
+	if server.loginFailures == nil {
+		server.loginFailures = make(map[lockoutKey]*loginFailures)
+	}
+
+	var lockouts []Lockout
+
+	for _, key := range getLockoutKeys(user, ip) {
+		failures, ok := server.loginFailures[key]
+		if !ok {
+			failures = &loginFailures{}
+			server.loginFailures[key] = failures
+		}
+
+		failures.count++
+		failures.last = now
+
+		if failures.count >= server.settings.MaxLoginFailures && !failures.isLocked(now) {
+			failures.until = now.Add(server.lockoutDuration())
+			lockouts = append(lockouts, Lockout{Scope: key.scope, Key: key.key, Failures: failures.count,
+				Until: failures.until})
+		}
+	}
+
+	return lockouts
+}
+
+// clearLoginFailures forgets the failed logins of a user and a client IP once the user logged in
+func (server *FtpServer) clearLoginFailures(user, ip string) {
+	server.loginFailuresMu.Lock()
+	defer server.loginFailuresMu.Unlock()
+
+	for _, key := range getLockoutKeys(user, ip) {
+		delete(server.loginFailures, key)
+	}
+}
+
+// pruneLoginFailures removes the ended lockouts and the old failures, it must be called with loginFailuresMu held
+func (server *FtpServer) pruneLoginFailures(now time.Time) {
+	for key, failures := range server.loginFailures {
+		if failures.isExpired(now, server.lockoutDuration()) {
+			delete(server.loginFailures, key)
+		}
+	}
+}
+
+// Lockouts returns the users and client IPs whose logins are currently refused
+func (server *FtpServer) Lockouts() []Lockout {
+	server.loginFailuresMu.Lock()
+	defer server.loginFailuresMu.Unlock()
+
+	now := time.Now()
+	server.pruneLoginFailures(now)
+
+	lockouts := []Lockout{}
+
+	for key, failures := range server.loginFailures {
+		if failures.isLocked(now) {
+			lockouts = append(lockouts, Lockout{Scope: key.scope, Key: key.key, Failures: failures.count,
+				Until: failures.until})
+		}
+	}
+
+	sort.Slice(lockouts, func(i, j int) bool {
+		if lockouts[i].Scope != lockouts[j].Scope {
+			return lockouts[i].Scope < lockouts[j].Scope
+		}
+
+		return lockouts[i].Key < lockouts[j].Key
+	})
+
+	return lockouts
+}
+
+// Unlock clears the lockout and the failed logins of a user or a client IP, it returns false if it wasn't
+// locked out
+func (server *FtpServer) Unlock(scope LockoutScope, key string) bool {
+	server.loginFailuresMu.Lock()
+	defer server.loginFailuresMu.Unlock()
+
+	failures, ok := server.loginFailures[lockoutKey{scope: scope, key: key}]
+	if !ok {
+		return false
+	}
+
+	delete(server.loginFailures, lockoutKey{scope: scope, key: key})
+
+	if !failures.isLocked(time.Now()) {
+		return false
+	}
+
+	server.Logger.Info("Lockout cleared", "scope", scope.String(), "key", key)
+
+	return true
+}
+
+// checkLockout refuses the login if the user or the client IP is locked out
+func (c *clientHandler) checkLockout() bool {
+	lockout := c.server.getLockout(c.user, c.remoteIP(), time.Now())
+	if lockout == nil {
+		return true
+	}
+
+	c.logger.Info("Login refused, locked out", "scope", lockout.Scope.String(), "until", lockout.Until)
+	c.writeMessage(StatusNotLoggedIn, "Too many failed logins, try again later")
+	c.disconnect(CloseReasonAuthFailure)
+
+	return false
+}
+
+// recordLoginFailure counts a failed login and reports the lockouts it started
+func (c *clientHandler) recordLoginFailure() {
+	for _, lockout := range c.server.recordLoginFailure(c.user, c.remoteIP(), time.Now()) {
+		c.emitSecurityEvent(SecurityEventLoginLockout, fmt.Sprintf("%s %s locked out until %s after %d failed logins",
+			lockout.Scope, lockout.Key, lockout.Until.UTC().Format(time.RFC3339), lockout.Failures))
+	}
+}
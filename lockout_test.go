@@ -0,0 +1,83 @@
+package ftpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLockout(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{MaxLoginFailures: 2},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	login := func(password string) error {
+		c, err := goftp.DialConfig(goftp.Config{User: authUser, Password: password}, s.Addr())
+		require.NoError(t, err, "Couldn't connect")
+
+		defer func() { panicOnError(c.Close()) }()
+
+		raw, err := c.OpenRawConn()
+		if err == nil {
+			require.NoError(t, raw.Close())
+		}
+
+		return err
+	}
+
+	require.Error(t, login("wrong"))
+	require.Empty(t, s.Lockouts())
+	require.Error(t, login("wrong"))
+
+	// the user and the client IP are locked out, even with the right password
+	lockouts := s.Lockouts()
+	require.Len(t, lockouts, 2)
+	require.Equal(t, LockoutScopeUser, lockouts[0].Scope)
+	require.Equal(t, authUser, lockouts[0].Key)
+	require.Equal(t, 2, lockouts[0].Failures)
+	require.WithinDuration(t, time.Now().Add(900*time.Second), lockouts[0].Until, 5*time.Second)
+	require.Equal(t, LockoutScopeIP, lockouts[1].Scope)
+	require.Equal(t, "127.0.0.1", lockouts[1].Key)
+	require.Equal(t, []SecurityEventType{SecurityEventLoginLockout, SecurityEventLoginLockout},
+		driver.getSecurityEvents())
+
+	err := login(authPass)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Too many failed logins")
+
+	require.True(t, s.Unlock(LockoutScopeUser, authUser))
+	require.False(t, s.Unlock(LockoutScopeUser, authUser))
+	require.Error(t, login(authPass))
+
+	require.True(t, s.Unlock(LockoutScopeIP, "127.0.0.1"))
+	require.NoError(t, login(authPass))
+	require.Empty(t, s.Lockouts())
+}
+
+func TestLoginFailuresReset(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{MaxLoginFailures: 2},
+	})
+	now := time.Now()
+
+	require.Empty(t, s.recordLoginFailure(authUser, "192.0.2.1", now))
+
+	// a successful login forgets the failures
+	s.clearLoginFailures(authUser, "192.0.2.1")
+	require.Empty(t, s.recordLoginFailure(authUser, "192.0.2.1", now))
+
+	// the old failures are forgotten too
+	require.Empty(t, s.recordLoginFailure(authUser, "192.0.2.1", now.Add(time.Hour)))
+	require.Len(t, s.recordLoginFailure(authUser, "192.0.2.1", now.Add(time.Hour)), 2)
+	require.NotNil(t, s.getLockout("other", "192.0.2.1", now.Add(time.Hour)))
+	require.Nil(t, s.getLockout("other", "192.0.2.2", now.Add(time.Hour)))
+
+	// the lockouts end
+	require.Nil(t, s.getLockout(authUser, "192.0.2.1", now.Add(2*time.Hour)))
+	require.Empty(t, s.recordLoginFailure(authUser, "192.0.2.1", now.Add(2*time.Hour)))
+}
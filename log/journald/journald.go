@@ -0,0 +1,161 @@
+// Package journald provides a Logger sending the events to systemd-journald with its native protocol.
+// The event is the MESSAGE field, the level gives the PRIORITY and the key-values become fields named
+// after their uppercased keys: "clientId" is CLIENTID, journalctl -o verbose shows them.
+package journald
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/fclairamb/ftpserverlib/log"
+)
+
+// DefaultSocket is the native protocol socket of journald
+const DefaultSocket = "/run/systemd/journal/socket"
+
+// Priorities of the log levels, they are the syslog severities
+const (
+	priorityError   = "3"
+	priorityWarning = "4"
+	priorityInfo    = "6"
+	priorityDebug   = "7"
+)
+
+// Dial connects to the journald socket, DefaultSocket if empty. The identifier is the SYSLOG_IDENTIFIER
+// of the entries, journalctl -t selects them.
+func Dial(socket, identifier string) (log.Logger, io.Closer, error) {
+	if socket == "" {
+		socket = DefaultSocket
+	}
+
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return NewLogger(conn, identifier), conn, nil
+}
+
+// NewLogger creates a logger writing each entry with a single Write, to a datagram connection to journald
+func NewLogger(writer io.Writer, identifier string) log.Logger {
+	return &journalLogger{
+		output:     &output{writer: writer},
+		identifier: identifier,
+	}
+}
+
+// output is shared by a logger and its children
+type output struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+type journalLogger struct {
+	output     *output
+	identifier string
+	keyvals    []interface{} // Context added by With
+}
+
+// Debug logs key-values at debug level
+func (logger *journalLogger) Debug(event string, keyvals ...interface{}) {
+	logger.log(priorityDebug, event, keyvals)
+}
+
+// Info logs key-values at info level
+func (logger *journalLogger) Info(event string, keyvals ...interface{}) {
+	logger.log(priorityInfo, event, keyvals)
+}
+
+// Warn logs key-values at warning level
+func (logger *journalLogger) Warn(event string, keyvals ...interface{}) {
+	logger.log(priorityWarning, event, keyvals)
+}
+
+// Error logs key-values at error level
+func (logger *journalLogger) Error(event string, keyvals ...interface{}) {
+	logger.log(priorityError, event, keyvals)
+}
+
+// With adds key-values
+func (logger *journalLogger) With(keyvals ...interface{}) log.Logger {
+	child := *logger
+	child.keyvals = append(append([]interface{}{}, logger.keyvals...), keyvals...)
+
+	return &child
+}
+
+func (logger *journalLogger) log(priority, event string, keyvals []interface{}) {
+	var entry bytes.Buffer
+
+	writeField(&entry, "MESSAGE", event)
+	writeField(&entry, "PRIORITY", priority)
+
+	if logger.identifier != "" {
+		writeField(&entry, "SYSLOG_IDENTIFIER", logger.identifier)
+	}
+
+	keyvals = append(append([]interface{}{}, logger.keyvals...), keyvals...)
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "(MISSING)")
+	}
+
+	for i := 0; i < len(keyvals); i += 2 {
+		writeField(&entry, fieldName(fmt.Sprint(keyvals[i])), fmt.Sprint(keyvals[i+1]))
+	}
+
+	logger.output.mu.Lock()
+	defer logger.output.mu.Unlock()
+
+	if _, err := logger.output.writer.Write(entry.Bytes()); err != nil {
+		fmt.Println("Logging faced this error: ", err)
+	}
+}
+
+// writeField adds a field to an entry, the values containing a newline are prefixed with their length
+func writeField(entry *bytes.Buffer, name, value string) {
+	entry.WriteString(name)
+
+	if !strings.Contains(value, "\n") {
+		entry.WriteString("=")
+		entry.WriteString(value)
+		entry.WriteString("\n")
+
+		return
+	}
+
+	entry.WriteString("\n")
+	_ = binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value)
+	entry.WriteString("\n")
+}
+
+// fieldName makes a key a valid journald field name: uppercase letters, digits and underscores, not starting
+// with an underscore (reserved to the trusted fields) or a digit
+func fieldName(key string) string {
+	name := strings.Map(func(char rune) rune {
+		switch {
+		case char >= 'a' && char <= 'z':
+			return char - 'a' + 'A'
+		case char >= 'A' && char <= 'Z', char >= '0' && char <= '9':
+			return char
+		default:
+			return '_'
+		}
+	}, key)
+
+	name = strings.TrimLeft(name, "_0123456789")
+	if name == "" {
+		return "FIELD"
+	}
+
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	return name
+}
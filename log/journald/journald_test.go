@@ -0,0 +1,54 @@
+package journald
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var buffer bytes.Buffer
+
+	logger := NewLogger(&buffer, "ftpserver")
+	logger.With("clientId", 3).Warn("Transfer failed", "err", "line 1\nline 2", "_private", "value")
+
+	require.Equal(t, "MESSAGE=Transfer failed\nPRIORITY=4\nSYSLOG_IDENTIFIER=ftpserver\nCLIENTID=3\n"+
+		"ERR\n\x0d\x00\x00\x00\x00\x00\x00\x00line 1\nline 2\nPRIVATE=value\n", buffer.String())
+}
+
+func TestFieldName(t *testing.T) {
+	require.Equal(t, "CLIENT_IP", fieldName("client-ip"))
+	require.Equal(t, "FIELD", fieldName("__"))
+	require.Equal(t, "ABC", fieldName("1abc"))
+}
+
+func TestDial(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, os.RemoveAll(dir)) }()
+
+	socket := filepath.Join(dir, "socket")
+
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, journal.Close()) }()
+
+	logger, conn, err := Dial(socket, "ftpserver")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	logger.Info("User logged in", "user", "alice")
+
+	entry := make([]byte, 1024)
+	n, _, err := journal.ReadFrom(entry)
+	require.NoError(t, err)
+	require.Equal(t, "MESSAGE=User logged in\nPRIORITY=6\nSYSLOG_IDENTIFIER=ftpserver\nUSER=alice\n", string(entry[:n]))
+}
@@ -0,0 +1,48 @@
+package log
+
+// Level is the severity of a log event
+type Level int
+
+// Log levels, in increasing severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Filter drops the events of the logger below a minimum level, for the adapters that log everything
+func Filter(logger Logger, minimum Level) Logger {
+	return &filterLogger{logger: logger, minimum: minimum}
+}
+
+type filterLogger struct {
+	logger  Logger
+	minimum Level
+}
+
+func (fl *filterLogger) Debug(event string, keyvals ...interface{}) {
+	if fl.minimum <= LevelDebug {
+		fl.logger.Debug(event, keyvals...)
+	}
+}
+
+func (fl *filterLogger) Info(event string, keyvals ...interface{}) {
+	if fl.minimum <= LevelInfo {
+		fl.logger.Info(event, keyvals...)
+	}
+}
+
+func (fl *filterLogger) Warn(event string, keyvals ...interface{}) {
+	if fl.minimum <= LevelWarn {
+		fl.logger.Warn(event, keyvals...)
+	}
+}
+
+func (fl *filterLogger) Error(event string, keyvals ...interface{}) {
+	fl.logger.Error(event, keyvals...)
+}
+
+func (fl *filterLogger) With(keyvals ...interface{}) Logger {
+	return &filterLogger{logger: fl.logger.With(keyvals...), minimum: fl.minimum}
+}
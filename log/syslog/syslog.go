@@ -0,0 +1,235 @@
+// Package syslog provides a Logger sending RFC 5424 syslog messages, to a collector or to the local daemon.
+// The event is the message and the key-values are its structured data, for example:
+//
+//	<134>1 2026-10-16T08:12:44.120391Z host ftpserver 4242 - [ftpserver@32473 clientId="3" user="alice"] Client connected
+package syslog
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fclairamb/ftpserverlib/log"
+)
+
+// Facility is the syslog facility of the messages
+type Facility int
+
+// Syslog facilities commonly used by the file transfer services
+const (
+	FacilityDaemon Facility = 3
+	FacilityAuth   Facility = 4
+	FacilityFTP    Facility = 11
+	FacilityLocal0 Facility = 16
+)
+
+// Severities of the log levels
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+	severityDebug   = 7
+)
+
+// DefaultStructuredDataID is the SD-ID of the key-values, 32473 is the enterprise number reserved for
+// the documentation
+const DefaultStructuredDataID = "ftpserver@32473"
+
+// Options defines the header of the messages
+type Options struct {
+	Facility         Facility // FacilityFTP by default
+	AppName          string   // "ftpserver" by default
+	Hostname         string   // os.Hostname() by default
+	StructuredDataID string   // DefaultStructuredDataID by default
+}
+
+// sdEscaper escapes the structured data param values (RFC 5424 section 6.3.3)
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// NewLogger creates a logger writing each message with a single Write, to a datagram connection
+// or to a stream framed like Dial does
+func NewLogger(writer io.Writer, options Options) log.Logger {
+	if options.Facility == 0 {
+		options.Facility = FacilityFTP
+	}
+
+	if options.AppName == "" {
+		options.AppName = "ftpserver"
+	}
+
+	if options.Hostname == "" {
+		options.Hostname, _ = os.Hostname()
+	}
+
+	if options.StructuredDataID == "" {
+		options.StructuredDataID = DefaultStructuredDataID
+	}
+
+	return &sysLogger{
+		output: &output{writer: writer},
+		header: fmt.Sprintf("%s %s %d -",
+			headerField(options.Hostname), headerField(options.AppName), os.Getpid()),
+		facility: options.Facility,
+		sdID:     options.StructuredDataID,
+	}
+}
+
+// Dial connects to a syslog collector ("udp", "tcp" or "unixgram" network). The messages sent on a stream
+// are framed with their length (RFC 6587 octet counting). An empty address is the local daemon, /dev/log.
+func Dial(network, address string, options Options) (log.Logger, io.Closer, error) {
+	if address == "" {
+		network, address = "unixgram", "/dev/log"
+	}
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var writer io.Writer = conn
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+		writer = &octetCountingWriter{writer: conn}
+	}
+
+	return NewLogger(writer, options), conn, nil
+}
+
+// output is shared by a logger and its children
+type output struct {
+	writer io.Writer
+	mu     sync.Mutex
+}
+
+type sysLogger struct {
+	output   *output
+	header   string // HOSTNAME APP-NAME PROCID MSGID
+	facility Facility
+	sdID     string
+	keyvals  []interface{} // Context added by With
+}
+
+// Debug logs key-values at debug level
+func (logger *sysLogger) Debug(event string, keyvals ...interface{}) {
+	logger.log(severityDebug, event, keyvals)
+}
+
+// Info logs key-values at info level
+func (logger *sysLogger) Info(event string, keyvals ...interface{}) {
+	logger.log(severityInfo, event, keyvals)
+}
+
+// Warn logs key-values at warning level
+func (logger *sysLogger) Warn(event string, keyvals ...interface{}) {
+	logger.log(severityWarning, event, keyvals)
+}
+
+// Error logs key-values at error level
+func (logger *sysLogger) Error(event string, keyvals ...interface{}) {
+	logger.log(severityError, event, keyvals)
+}
+
+// With adds key-values
+func (logger *sysLogger) With(keyvals ...interface{}) log.Logger {
+	child := *logger
+	child.keyvals = append(append([]interface{}{}, logger.keyvals...), keyvals...)
+
+	return &child
+}
+
+func (logger *sysLogger) log(severity int, event string, keyvals []interface{}) {
+	var message strings.Builder
+
+	fmt.Fprintf(&message, "<%d>1 %s %s ",
+		int(logger.facility)*8+severity, time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"), logger.header)
+
+	logger.writeStructuredData(&message, append(append([]interface{}{}, logger.keyvals...), keyvals...))
+
+	if event != "" {
+		message.WriteString(" ")
+		message.WriteString(event)
+	}
+
+	logger.output.mu.Lock()
+	defer logger.output.mu.Unlock()
+
+	if _, err := io.WriteString(logger.output.writer, message.String()); err != nil {
+		fmt.Println("Logging faced this error: ", err)
+	}
+}
+
+// writeStructuredData writes the key-values as the params of a single SD-ELEMENT
+func (logger *sysLogger) writeStructuredData(message *strings.Builder, keyvals []interface{}) {
+	if len(keyvals) == 0 {
+		message.WriteString("-")
+
+		return
+	}
+
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "(MISSING)")
+	}
+
+	message.WriteString("[")
+	message.WriteString(logger.sdID)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(message, ` %s="%s"`, paramName(fmt.Sprint(keyvals[i])), sdEscaper.Replace(fmt.Sprint(keyvals[i+1])))
+	}
+
+	message.WriteString("]")
+}
+
+// paramName makes a key a valid SD-NAME: at most 32 printable ASCII characters, except '=', ' ', ']' and '"'
+func paramName(key string) string {
+	name := []byte(key)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+
+	for i, char := range name {
+		if char <= ' ' || char > '~' || char == '=' || char == ']' || char == '"' {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 {
+		return "_"
+	}
+
+	return string(name)
+}
+
+// headerField makes a header value a valid printable ASCII token, "-" if empty
+func headerField(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return strings.Map(func(char rune) rune {
+		if char <= ' ' || char > '~' {
+			return '_'
+		}
+
+		return char
+	}, value)
+}
+
+// octetCountingWriter frames the messages sent on a stream with their length
+type octetCountingWriter struct {
+	writer io.Writer
+}
+
+func (w *octetCountingWriter) Write(p []byte) (int, error) {
+	if _, err := w.writer.Write(append([]byte(strconv.Itoa(len(p))+" "), p...)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
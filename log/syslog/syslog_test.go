@@ -0,0 +1,61 @@
+package syslog
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	var buffer bytes.Buffer
+
+	logger := NewLogger(&buffer, Options{Facility: FacilityLocal0, AppName: "ftp server", Hostname: "host"})
+	logger.With("clientId", 3).Info("Client connected", "user", `al"ice]`, "bad key", "value")
+
+	require.Regexp(t,
+		`^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z host ftp_server \d+ - `+
+			`\[ftpserver@32473 clientId="3" user="al\\"ice\\]" bad_key="value"\] Client connected$`,
+		buffer.String())
+
+	buffer.Reset()
+	logger.Error("Failed")
+	require.Regexp(t, `^<131>1 \S+ host ftp_server \d+ - - Failed$`, buffer.String())
+}
+
+func TestDial(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, collector.Close()) }()
+
+	logger, conn, err := Dial("udp", collector.LocalAddr().String(), Options{})
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	logger.Warn("Transfer failed", "file", "/data.bin")
+
+	message := make([]byte, 1024)
+	n, _, err := collector.ReadFrom(message)
+	require.NoError(t, err)
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	require.Regexp(t, `^<92>1 \S+ `+hostname+` ftpserver \d+ - \[ftpserver@32473 file="/data.bin"\] Transfer failed$`,
+		string(message[:n]))
+}
+
+func TestOctetCounting(t *testing.T) {
+	var buffer bytes.Buffer
+
+	writer := &octetCountingWriter{writer: &buffer}
+
+	n, err := writer.Write([]byte("<134>1 message"))
+	require.NoError(t, err)
+	require.Equal(t, 14, n)
+	require.Equal(t, "14 <134>1 message", buffer.String())
+}
@@ -0,0 +1,227 @@
+package ftpserver
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MLSD/MLST output (RFC 3659). The facts are sent in a stable order, the one of mlsxFactNames unless the
+// MLSxFactsOrder setting changes it. The standard facts are capitalized like in the RFC examples, the
+// extension ones are lower case and prefixed ("unix.owner", "x.etag").
+
+// mlsxFactNames are the facts the server can send, in their default order
+var mlsxFactNames = []string{"Type", "Size", "Modify", "Create", "unix.owner", "unix.group", "x.etag"}
+
+// mlsxHashFactNames are the facts of the digests of ClientDriverExtensionHashFacts, in their default order
+var mlsxHashFactNames = []string{"x.crc32", "x.md5", "x.sha1", "x.sha256", "x.sha512"}
+
+// mlsxFact is a fact of a file
+type mlsxFact struct {
+	name  string
+	value string
+}
+
+func (c *clientHandler) writeMLSxOutput(w io.Writer, filePath string, file os.FileInfo) error {
+	// a LF can't be escaped, the client would take the rest of the name for another entry
+	if strings.Contains(file.Name(), "\n") {
+		c.logger.Warn("File not listed, its name contains a LF", "path", filePath)
+
+		return nil
+	}
+
+	facts := c.formatMLSxFacts(c.getMLSxFacts(filePath, file))
+
+	if len(c.quirks.MLSxFacts) > 0 {
+		facts = filterMLSxFacts(facts, c.quirks.MLSxFacts)
+	}
+
+	_, err := fmt.Fprintf(w, "%s %s\r\n", facts, escapeMLSxName(file.Name()))
+
+	return err
+}
+
+// getMLSxFacts returns the facts of a file in their default order
+func (c *clientHandler) getMLSxFacts(filePath string, file os.FileInfo) []mlsxFact {
+	listType := "file"
+	if file.IsDir() {
+		listType = "dir"
+	} else if file.Mode()&os.ModeSymlink != 0 {
+		listType = "OS.unix=slink"
+
+		// the target can't be sent if it would end the fact
+		if target := c.readLink(filePath, file); target != "" && !strings.ContainsAny(target, "; \r\n") {
+			listType += ":" + target
+		}
+	}
+
+	facts := []mlsxFact{
+		{"Type", listType},
+		{"Size", strconv.FormatInt(file.Size(), 10)},
+		{"Modify", file.ModTime().UTC().Format(dateFormatMLSD)},
+	}
+
+	extended, isExtended := file.(FileInfoExtended)
+	if isExtended {
+		if created := extended.CreationTime(); !created.IsZero() {
+			facts = append(facts, mlsxFact{"Create", created.UTC().Format(dateFormatMLSD)})
+		}
+	}
+
+	if ownership, ok := file.(FileInfoOwnership); ok {
+		facts = append(facts, mlsxFact{"unix.owner", ownership.Owner()}, mlsxFact{"unix.group", ownership.Group()})
+	}
+
+	facts = append(facts, mlsxFact{"x.etag", getFileVersion(file)})
+	facts = append(facts, c.getHashFacts(filePath, file)...)
+
+	if isExtended {
+		facts = append(facts, getCustomFacts(extended)...)
+	}
+
+	return facts
+}
+
+// getCustomFacts returns the facts of a FileInfoExtended sorted by name, without the ones replacing a fact of
+// the server or whose name would break the parsing of the line
+func getCustomFacts(file FileInfoExtended) []mlsxFact {
+	custom := file.Facts()
+	names := make([]string, 0, len(custom))
+
+	for name := range custom {
+		if name == "" || strings.ContainsAny(name, "=; \r\n") || isMLSxFact(name) {
+			continue
+		}
+
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	facts := make([]mlsxFact, len(names))
+	for i, name := range names {
+		facts[i] = mlsxFact{name, custom[name]}
+	}
+
+	return facts
+}
+
+// isMLSxFact tells if a fact name is one of the server, the names are case insensitive
+func isMLSxFact(name string) bool {
+	for _, names := range [][]string{mlsxFactNames, mlsxHashFactNames} {
+		for _, serverName := range names {
+			if strings.EqualFold(name, serverName) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// formatMLSxFacts sorts the facts according to MLSxFactsOrder and formats them as "fact=value;". The facts
+// without value or whose value would break the parsing of the line are left out.
+func (c *clientHandler) formatMLSxFacts(facts []mlsxFact) string {
+	c.sortMLSxFacts(len(facts), func(i int) string { return facts[i].name }, func(i, j int) {
+		facts[i], facts[j] = facts[j], facts[i]
+	})
+
+	var formatted strings.Builder
+
+	for _, fact := range facts {
+		// ";" separates the facts, a space ends them
+		if fact.value == "" || strings.ContainsAny(fact.value, "; \r\n") {
+			continue
+		}
+
+		fmt.Fprintf(&formatted, "%s=%s;", fact.name, fact.value)
+	}
+
+	return formatted.String()
+}
+
+// sortMLSxFacts sorts facts according to MLSxFactsOrder, keeping the default order of the ones not listed
+func (c *clientHandler) sortMLSxFacts(count int, name func(int) string, swap func(i, j int)) {
+	order := c.server.settings.MLSxFactsOrder
+	if len(order) == 0 {
+		return
+	}
+
+	rank := func(i int) int {
+		for r, ordered := range order {
+			if strings.EqualFold(ordered, name(i)) {
+				return r
+			}
+		}
+
+		return len(order)
+	}
+
+	// insertion sort, stable and the lists are short
+	for i := 1; i < count; i++ {
+		for j := i; j > 0 && rank(j) < rank(j-1); j-- {
+			swap(j, j-1)
+		}
+	}
+}
+
+// getMLSTFeature returns the MLST line of the FEAT reply, with the supported facts. They are all enabled.
+func (c *clientHandler) getMLSTFeature() string {
+	names := append([]string{}, mlsxFactNames...)
+	if c.server.settings.EnableHASH {
+		names = append(names, mlsxHashFactNames...)
+	}
+
+	c.sortMLSxFacts(len(names), func(i int) string { return names[i] }, func(i, j int) {
+		names[i], names[j] = names[j], names[i]
+	})
+
+	var feature strings.Builder
+
+	feature.WriteString("MLST ")
+
+	for _, name := range names {
+		fmt.Fprintf(&feature, "%s*;", name)
+	}
+
+	return feature.String()
+}
+
+// escapeMLSxName escapes the CR of a file name with a NUL, the RFC 959 convention for the pathnames. There
+// is none for the LF, the names containing one aren't listed.
+func escapeMLSxName(name string) string {
+	return strings.ReplaceAll(name, "\r", "\r\x00")
+}
+
+// getHashFacts returns the digests facts the driver can provide without computing them
+func (c *clientHandler) getHashFacts(filePath string, file os.FileInfo) []mlsxFact {
+	if !c.server.settings.EnableHASH || !file.Mode().IsRegular() {
+		return nil
+	}
+
+	hashFacts, ok := c.driver.(ClientDriverExtensionHashFacts)
+	if !ok {
+		return nil
+	}
+
+	digests, err := hashFacts.GetHashFacts(filePath)
+	if err != nil {
+		c.logger.Warn("Could not get hash facts", "path", filePath, "err", err)
+
+		return nil
+	}
+
+	var facts []mlsxFact
+
+	for _, algo := range []HASHAlgo{HASHAlgoCRC32, HASHAlgoMD5, HASHAlgoSHA1, HASHAlgoSHA256, HASHAlgoSHA512} {
+		if digest, ok := digests[algo]; ok {
+			name := "x." + strings.ToLower(strings.ReplaceAll(getHashName(algo), "-", ""))
+			facts = append(facts, mlsxFact{name, digest})
+		}
+	}
+
+	return facts
+}
@@ -0,0 +1,94 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPasswordExpired is returned by AuthUser (or AuthUserLazily) when the credentials are right but the
+// password must be changed. If the main driver implements MainDriverExtensionPasswordChange, PASS is refused
+// but the session is kept and restricted to SITE PSWD, the user is logged in once the password is changed.
+// The login fails otherwise.
+var ErrPasswordExpired = errors.New("password expired")
+
+const passwordExpiredMessage = "Password expired, change it with SITE PSWD <old password> <new password>"
+
+// isSitePassword tells if the parameters of a SITE command are those of a password change
+func isSitePassword(param string) bool {
+	return strings.EqualFold(strings.SplitN(param, " ", 2)[0], "PSWD")
+}
+
+// isCredentialCommand tells if the parameter of a command contains a credential
+func isCredentialCommand(command, param string) bool {
+	return credentialCommands[command] || (command == "SITE" && isSitePassword(param))
+}
+
+// canChangePassword tells if an expired password can be changed
+func (c *clientHandler) canChangePassword() bool {
+	_, ok := c.server.driver.(MainDriverExtensionPasswordChange)
+
+	return ok
+}
+
+// expirePassword restricts the session of a user whose password expired to the password change. The login
+// is refused with a 530 reply, the client isn't disconnected so that it can send SITE PSWD.
+func (c *clientHandler) expirePassword() {
+	c.paramsMutex.Lock()
+	c.driver = nil
+	c.driverFactory = nil
+	c.paramsMutex.Unlock()
+
+	c.setState(StatePasswordExpired)
+
+	c.logger.Info("Password expired", "user", c.user)
+	c.writeMessage(StatusNotLoggedIn, passwordExpiredMessage)
+}
+
+// isPasswordChange tells if a command is the password change allowed to the users whose password expired
+func (c *clientHandler) isPasswordChange(command, param string) bool {
+	return c.sessionState() == StatePasswordExpired && command == "SITE" && isSitePassword(param)
+}
+
+// notLoggedInMessage returns the reply to the commands requiring a login
+func (c *clientHandler) notLoggedInMessage() string {
+	if c.sessionState() == StatePasswordExpired {
+		return passwordExpiredMessage
+	}
+
+	return "Please login with USER and PASS"
+}
+
+// handlePSWD changes the password of the user: SITE PSWD <old password> <new password>. If it expired, the user
+// is logged in with the new one.
+func (c *clientHandler) handlePSWD(params string) {
+	changer, ok := c.server.driver.(MainDriverExtensionPasswordChange)
+	if !ok {
+		c.writeMessage(StatusCommandNotImplemented, "Password change isn't supported")
+
+		return
+	}
+
+	args, err := splitParamsValues(params, 2)
+	if err != nil || len(args) != 2 {
+		c.writeMessage(StatusSyntaxErrorParameters, "Usage: SITE PSWD <old password> <new password>")
+
+		return
+	}
+
+	if err = changer.ChangePassword(c, c.user, args[0], args[1]); err != nil {
+		c.writeMessage(StatusActionNotTaken, fmt.Sprintf("Could not change the password: %v", err))
+
+		return
+	}
+
+	c.logger.Info("Password changed", "user", c.user)
+
+	if c.sessionState() != StatePasswordExpired {
+		c.writeMessage(StatusOK, "Password changed")
+
+		return
+	}
+
+	c.login(args[1], "Password changed, continue")
+}
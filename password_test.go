@@ -0,0 +1,76 @@
+package ftpserver
+
+import (
+	"net/textproto"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordExpired(t *testing.T) {
+	s := NewTestServer(t, true)
+
+	// goftp can't log in without sending TYPE I
+	conn, err := textproto.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	sendCommand := func(command string) (int, string, error) {
+		if _, errCmd := conn.Cmd("%s", command); errCmd != nil {
+			return 0, "", errCmd
+		}
+
+		return conn.ReadResponse(0)
+	}
+
+	rc, response, err := conn.ReadResponse(StatusServiceReady)
+	require.NoError(t, err, response)
+
+	rc, response, err = sendCommand("USER " + authUser)
+	require.NoError(t, err)
+	require.Equal(t, StatusUserOK, rc, response)
+
+	rc, response, err = sendCommand("PASS " + expiredPass)
+	require.NoError(t, err)
+	require.Equal(t, StatusNotLoggedIn, rc, response)
+	require.Equal(t, passwordExpiredMessage, response)
+
+	// the session is restricted to the password change
+	rc, response, err = sendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotLoggedIn, rc, response)
+	require.Equal(t, passwordExpiredMessage, response)
+
+	rc, response, err = sendCommand("SITE CHMOD 600 file")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotLoggedIn, rc, response)
+
+	rc, response, err = sendCommand("SITE PSWD " + expiredPass)
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	rc, response, err = sendCommand("SITE PSWD wrong " + authPass)
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+
+	rc, response, err = sendCommand("SITE PSWD " + expiredPass + " " + authPass)
+	require.NoError(t, err)
+	require.Equal(t, StatusUserLoggedIn, rc, response)
+	require.Equal(t, "Password changed, continue", response)
+
+	rc, response, err = sendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+
+	// a logged in user can change its password too
+	rc, response, err = sendCommand("SITE PSWD " + expiredPass + " " + authPass)
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+}
+
+func TestPasswordChangeMasked(t *testing.T) {
+	require.Equal(t, "SITE ****", maskCredentials("SITE PSWD old new"))
+	require.Equal(t, "site ****", maskCredentials("site pswd old new"))
+	require.Equal(t, "SITE CHMOD 600 file", maskCredentials("SITE CHMOD 600 file"))
+}
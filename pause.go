@@ -0,0 +1,73 @@
+package ftpserver
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A paused server refuses the new connections with a 421 reply while the connected clients keep their
+// sessions, to drain a node before a maintenance. The listener stays open: the clients get a clear reply
+// instead of waiting in the listen backlog and the server accepts them again as soon as it is resumed.
+
+// pausedReplyTimeout is the time given to a refused connection to receive the 421 reply
+const pausedReplyTimeout = 5 * time.Second
+
+// PauseAccept makes the server refuse the new connections
+func (server *FtpServer) PauseAccept() {
+	if atomic.CompareAndSwapInt32(&server.paused, 0, 1) {
+		server.Logger.Info("Accepting paused")
+	}
+}
+
+// ResumeAccept makes the server accept the new connections again
+func (server *FtpServer) ResumeAccept() {
+	if atomic.CompareAndSwapInt32(&server.paused, 1, 0) {
+		server.Logger.Info("Accepting resumed")
+	}
+}
+
+// IsAcceptPaused tells if the server refuses the new connections, see PauseAccept
+func (server *FtpServer) IsAcceptPaused() bool {
+	return atomic.LoadInt32(&server.paused) != 0
+}
+
+// Accepting tells if the server accepts new connections: it is listening and it isn't paused. It is meant
+// to be used by the health checks, so that a paused node is taken out of the load balancing.
+func (server *FtpServer) Accepting() bool {
+	listener, stopped := server.getListener()
+
+	return listener != nil && !stopped && !server.IsAcceptPaused()
+}
+
+// maxRefusingConnections is the maximum number of refused connections being replied to at the same time,
+// the next ones are closed without a reply
+const maxRefusingConnections = 64
+
+// refuseConnection replies to a connection received while the server is paused and closes it
+func (server *FtpServer) refuseConnection(conn net.Conn) {
+	server.Logger.Info("Connection refused, accepting is paused", "clientIp", conn.RemoteAddr())
+
+	if atomic.AddInt32(&server.refusing, 1) > maxRefusingConnections {
+		atomic.AddInt32(&server.refusing, -1)
+
+		if err := conn.Close(); err != nil {
+			server.Logger.Warn("Could not close refused connection", "err", err)
+		}
+
+		return
+	}
+
+	go func() {
+		defer atomic.AddInt32(&server.refusing, -1)
+
+		if err := conn.SetWriteDeadline(time.Now().Add(pausedReplyTimeout)); err == nil {
+			_, _ = conn.Write([]byte(NewReply(StatusServiceNotAvailable,
+				"Service not available, the server is under maintenance").String()))
+		}
+
+		if err := conn.Close(); err != nil {
+			server.Logger.Warn("Could not close refused connection", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,129 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+)
+
+// pendingLimiter limits the number of connections in a phase that a client can make last (waiting for the
+// banner, negotiating TLS), the next connections wait for a slot in a bounded queue. It protects the server
+// against the slowloris attacks, opening many connections and never completing them.
+type pendingLimiter struct {
+	slots     chan struct{}
+	queued    int32 // connections waiting for a slot (atomic)
+	maxQueued int32
+}
+
+// newPendingLimiter creates a limiter, nil (no limit) if max is 0
+func newPendingLimiter(max, queueSize int) *pendingLimiter {
+	if max <= 0 {
+		return nil
+	}
+
+	return &pendingLimiter{slots: make(chan struct{}, max), maxQueued: int32(queueSize)}
+}
+
+// acquire waits for a slot for up to timeout, it returns false if the queue is full or if no slot was released
+func (l *pendingLimiter) acquire(timeout time.Duration) bool {
+	if l == nil {
+		return true
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if atomic.AddInt32(&l.queued, 1) > l.maxQueued {
+		atomic.AddInt32(&l.queued, -1)
+
+		return false
+	}
+
+	defer atomic.AddInt32(&l.queued, -1)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// release frees a slot
+func (l *pendingLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+func (server *FtpServer) pendingQueueTimeout() time.Duration {
+	return time.Duration(server.settings.PendingQueueTimeout) * time.Second
+}
+
+// greet sends the banner, once the client is accepted. It returns false if the client is refused.
+func (c *clientHandler) greet() bool {
+	if !c.server.pendingConnections.acquire(c.server.pendingQueueTimeout()) {
+		c.logger.Warn("Too many pending connections, disconnecting client")
+		c.setCloseReason(CloseReasonRefused)
+
+		// the banner of the implicit TLS connections would start a handshake
+		if c.server.settings.TLSRequired != ImplicitEncryption {
+			c.writeMessage(StatusServiceNotAvailable, "Too many pending connections, try again later")
+		}
+
+		return false
+	}
+
+	defer c.server.pendingConnections.release()
+
+	if !c.checkReputation() {
+		c.setCloseReason(CloseReasonRefused)
+		c.writeMessage(StatusServiceNotAvailable, "Service not available, your IP is blocklisted")
+
+		return false
+	}
+
+	if !c.locateClient() {
+		c.setCloseReason(CloseReasonRefused)
+		c.writeMessage(StatusServiceNotAvailable, "Service not available from your location")
+
+		return false
+	}
+
+	msg, err := c.clientConnected()
+	if err != nil {
+		c.setCloseReason(CloseReasonDriverError)
+		c.writeMessage(StatusSyntaxErrorNotRecognised, msg)
+
+		return false
+	}
+
+	// with implicit TLS the handshake is done before the welcome message is sent
+	if c.server.settings.TLSRequired == ImplicitEncryption {
+		if !c.server.pendingHandshakes.acquire(c.server.pendingQueueTimeout()) {
+			c.logger.Warn("Too many pending TLS handshakes, disconnecting client")
+			c.setCloseReason(CloseReasonRefused)
+
+			return false
+		}
+
+		defer c.server.pendingHandshakes.release()
+
+		if tlsConn, ok := c.conn.(*tls.Conn); ok && !c.handshakeTLS(tlsConn) {
+			c.setCloseReason(CloseReasonProtocolViolation)
+
+			return false
+		}
+	}
+
+	c.writeMessage(StatusServiceReady, msg)
+	c.saveTLSState(c.conn, true)
+
+	return true
+}
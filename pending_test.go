@@ -0,0 +1,162 @@
+package ftpserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPendingLimiter(t *testing.T) {
+	require.Nil(t, newPendingLimiter(0, 10))
+
+	var unlimited *pendingLimiter
+	require.True(t, unlimited.acquire(0))
+	unlimited.release()
+
+	limiter := newPendingLimiter(1, 1)
+	require.True(t, limiter.acquire(time.Second))
+	require.False(t, limiter.acquire(10*time.Millisecond))
+
+	// the waiter gets the released slot
+	acquired := make(chan bool)
+
+	go func() { acquired <- limiter.acquire(5 * time.Second) }()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&limiter.queued) == 1 }, time.Second, 10*time.Millisecond)
+	limiter.release()
+	require.True(t, <-acquired)
+
+	// the queue is full
+	queued := make(chan bool)
+
+	go func() { queued <- limiter.acquire(5 * time.Second) }()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&limiter.queued) == 1 }, time.Second, 10*time.Millisecond)
+	require.False(t, limiter.acquire(time.Second))
+	limiter.release()
+	require.True(t, <-queued)
+}
+
+// blockingReputation keeps the connections before their banner until unblock is closed
+func blockingReputation(unblock chan struct{}) func(context.Context) (bool, error) {
+	return func(context.Context) (bool, error) {
+		<-unblock
+
+		return false, nil
+	}
+}
+
+func TestMaxPendingConnections(t *testing.T) {
+	unblock := make(chan struct{})
+	driver := &TestServerDriver{
+		Debug:      true,
+		Reputation: blockingReputation(unblock),
+		Settings:   &Settings{MaxPendingConnections: 1, ReputationCheckTimeout: 5000},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	pending, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, pending.Close()) }()
+
+	require.Eventually(t, func() bool { return len(s.pendingConnections.slots) == 1 }, time.Second, 10*time.Millisecond)
+
+	// no queue: the next connections are refused at once
+	require.Equal(t, "421 Too many pending connections, try again later\r\n", readBanner(t, s))
+
+	close(unblock)
+
+	reply, err := textproto.NewConn(pending).ReadLine()
+	require.NoError(t, err)
+	require.Equal(t, "220 TEST Server", reply)
+	require.Equal(t, "220 TEST Server\r\n", readBanner(t, s))
+}
+
+func TestPendingConnectionsQueue(t *testing.T) {
+	unblock := make(chan struct{})
+	driver := &TestServerDriver{
+		Debug:      true,
+		Reputation: blockingReputation(unblock),
+		Settings: &Settings{
+			MaxPendingConnections:  1,
+			PendingQueueSize:       1,
+			ReputationCheckTimeout: 5000,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	pending, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, pending.Close()) }()
+
+	require.Eventually(t, func() bool { return len(s.pendingConnections.slots) == 1 }, time.Second, 10*time.Millisecond)
+
+	// the queued connection gets its banner once the pending one got its own
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(unblock)
+	}()
+
+	require.Equal(t, "220 TEST Server\r\n", readBanner(t, s))
+}
+
+func TestMaxPendingHandshakes(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		TLS:      true,
+		Settings: &Settings{MaxPendingHandshakes: 1},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	dial := func() (net.Conn, *textproto.Conn) {
+		conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+		require.NoError(t, err)
+
+		control := textproto.NewConn(conn)
+		_, _, err = control.ReadResponse(StatusServiceReady)
+		require.NoError(t, err)
+
+		return conn, control
+	}
+
+	// the handshake of the first client is pending
+	_, pending := dial()
+
+	_, err := pending.Cmd("AUTH TLS")
+	require.NoError(t, err)
+
+	_, _, err = pending.ReadResponse(StatusAuthAccepted)
+	require.NoError(t, err)
+
+	otherConn, other := dial()
+
+	defer func() { require.NoError(t, other.Close()) }()
+
+	_, err = other.Cmd("AUTH TLS")
+	require.NoError(t, err)
+
+	_, message, err := other.ReadResponse(StatusAuthAccepted)
+	require.Error(t, err)
+	require.Equal(t, "Too many TLS negotiations in progress, try again later", message)
+
+	// the slot is released once the handshake fails
+	require.NoError(t, pending.Close())
+	require.Eventually(t, func() bool { return len(s.pendingHandshakes.slots) == 0 }, time.Second, 10*time.Millisecond)
+
+	_, err = other.Cmd("AUTH TLS")
+	require.NoError(t, err)
+
+	_, _, err = other.ReadResponse(StatusAuthAccepted)
+	require.NoError(t, err)
+
+	tlsConn := tls.Client(otherConn, &tls.Config{InsecureSkipVerify: true}) // nolint:gosec
+	require.NoError(t, tlsConn.Handshake())
+}
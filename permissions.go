@@ -0,0 +1,35 @@
+package ftpserver
+
+import "fmt"
+
+// checkPermission asks the MainDriverExtensionPermissionChecker, if the driver implements it, whether the
+// user can apply verb to path. The denials get a 550 reply, the caller has nothing more to send.
+func (c *clientHandler) checkPermission(verb, path string) bool {
+	if err := c.permissionError(verb, path); err != nil {
+		c.writeMessage(StatusActionNotTaken, err.Error())
+
+		return false
+	}
+
+	return true
+}
+
+// permissionError returns the reason of the denial of verb on path, nil if it is allowed
+func (c *clientHandler) permissionError(verb, path string) error {
+	if c.getVirtualEntry(path) != nil {
+		return fmt.Errorf("%s %s: %w", verb, path, errVirtualEntry)
+	}
+
+	checker, ok := c.server.driver.(MainDriverExtensionPermissionChecker)
+	if !ok {
+		return nil
+	}
+
+	if err := checker.CheckPermission(c, c.user, verb, path); err != nil {
+		c.logger.Info("Operation denied", "verb", verb, "path", path, "err", err)
+
+		return fmt.Errorf("%s %s: %w", verb, path, err)
+	}
+
+	return nil
+}
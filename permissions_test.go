@@ -0,0 +1,89 @@
+package ftpserver
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+var errReadOnly = errors.New("read-only area")
+
+func TestPermissionChecker(t *testing.T) {
+	var checksMu sync.Mutex
+
+	var checks []string
+
+	driver := &TestServerDriver{
+		Debug: true,
+		PermissionChecker: func(user, verb, path string) error {
+			checksMu.Lock()
+			defer checksMu.Unlock()
+
+			checks = append(checks, user+" "+verb+" "+path)
+
+			if strings.HasPrefix(path, "/ro") {
+				return errReadOnly
+			}
+
+			return nil
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, driver.fs.Mkdir("/ro", 0750))
+	require.NoError(t, afero.WriteFile(driver.fs, "/ro/file", []byte("content"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.Error(t, c.Store("/ro/upload", bytes.NewReader([]byte("data"))))
+	require.NoError(t, c.Store("/upload", bytes.NewReader([]byte("data"))))
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	for _, command := range []string{
+		"DELE /ro/file", "MKD /ro/dir", "RMD /ro", "RNFR /ro/file", "SITE CHMOD 600 /ro/file",
+		"SITE MKDIR /ro/a/b", "SITE RMDIR /ro",
+	} {
+		rc, response, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusActionNotTaken, rc, command)
+		require.Contains(t, response, errReadOnly.Error(), command)
+	}
+
+	rc, _, err := raw.SendCommand("RNFR /upload")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc)
+
+	rc, _, err = raw.SendCommand("RNTO /ro/upload")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc)
+
+	_, err = driver.fs.Stat("/ro/file")
+	require.NoError(t, err)
+
+	_, err = driver.fs.Stat("/ro/upload")
+	require.Error(t, err)
+
+	checksMu.Lock()
+	defer checksMu.Unlock()
+
+	require.Contains(t, checks, authUser+" STOR /upload")
+	require.Contains(t, checks, authUser+" RNTO /ro/upload")
+	require.Contains(t, checks, authUser+" SITE RMDIR /ro")
+}
@@ -0,0 +1,100 @@
+package ftpserver
+
+import (
+	"strings"
+)
+
+// maxFingerprintCommands is the number of first commands kept to identify a client
+const maxFingerprintCommands = 16
+
+// ClientQuirks are compatibility adjustments applied to the sessions of some clients
+type ClientQuirks struct {
+	DisableEPSV   bool     // Reply 502 to EPSV so that the client falls back to PASV
+	ASCIIAsBinary bool     // Accept TYPE A but transfer the files without line endings conversion
+	MLSxFacts     []string // Facts sent in the MLSD/MLST replies (type, size, modify...), all of them if empty
+}
+
+// ClientProfile identifies a client to apply quirks to its sessions. All the non-empty criteria must match.
+type ClientProfile struct {
+	Name          string       // Name of the profile, logged when a client is identified
+	ClientVersion string       // Case insensitive substring of the CLNT command parameter
+	Commands      []string     // First commands sent by the client (FEAT, CLNT, USER...)
+	Quirks        ClientQuirks // Quirks to apply
+}
+
+// matches returns true if the profile matches the client version and the first commands of a client
+func (p *ClientProfile) matches(clientVersion string, commands []string) bool {
+	if p.ClientVersion == "" && len(p.Commands) == 0 {
+		return false
+	}
+
+	if p.ClientVersion != "" &&
+		!strings.Contains(strings.ToLower(clientVersion), strings.ToLower(p.ClientVersion)) {
+		return false
+	}
+
+	if len(p.Commands) > len(commands) {
+		return false
+	}
+
+	for i, command := range p.Commands {
+		if !strings.EqualFold(command, commands[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// fingerprintCommand records the first commands of the session and looks for the profile of the client
+func (c *clientHandler) fingerprintCommand(command string) {
+	if c.clientProfile != "" || len(c.server.settings.ClientProfiles) == 0 {
+		return
+	}
+
+	if len(c.firstCommands) < maxFingerprintCommands {
+		c.firstCommands = append(c.firstCommands, command)
+	}
+
+	c.identifyClient()
+}
+
+// identifyClient applies the quirks of the first profile matching the client
+func (c *clientHandler) identifyClient() {
+	if c.clientProfile != "" {
+		return
+	}
+
+	clientVersion := c.GetClientVersion()
+
+	for i := range c.server.settings.ClientProfiles {
+		profile := &c.server.settings.ClientProfiles[i]
+
+		if profile.matches(clientVersion, c.firstCommands) {
+			c.logger.Info("Client identified", "profile", profile.Name)
+			c.clientProfile = profile.Name
+			c.quirks = profile.Quirks
+
+			return
+		}
+	}
+}
+
+// filterMLSxFacts keeps only the allowed facts of a "fact=value;" list
+func filterMLSxFacts(facts string, allowed []string) string {
+	var filtered strings.Builder
+
+	for _, fact := range strings.SplitAfter(facts, ";") {
+		name := strings.SplitN(fact, "=", 2)[0]
+
+		for _, allowedName := range allowed {
+			if strings.EqualFold(name, allowedName) {
+				filtered.WriteString(fact)
+
+				break
+			}
+		}
+	}
+
+	return filtered.String()
+}
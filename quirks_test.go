@@ -0,0 +1,102 @@
+package ftpserver
+
+import (
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientProfileMatches(t *testing.T) {
+	profile := &ClientProfile{Commands: []string{"FEAT", "OPTS"}}
+	require.False(t, profile.matches("", []string{"FEAT"}))
+	require.False(t, profile.matches("", []string{"USER", "PASS"}))
+	require.True(t, profile.matches("", []string{"feat", "OPTS", "USER"}))
+
+	profile = &ClientProfile{ClientVersion: "filezilla"}
+	require.False(t, profile.matches("", nil))
+	require.True(t, profile.matches("FileZilla 3.55.0", nil))
+
+	profile = &ClientProfile{ClientVersion: "lftp", Commands: []string{"FEAT"}}
+	require.False(t, profile.matches("lftp/4.9", []string{"USER"}))
+	require.True(t, profile.matches("lftp/4.9", []string{"FEAT"}))
+
+	require.False(t, (&ClientProfile{}).matches("lftp/4.9", []string{"FEAT"}))
+}
+
+func TestFilterMLSxFacts(t *testing.T) {
+	facts := "Type=file;Size=10;Modify=20210101000000;unix.owner=test;"
+	require.Equal(t, "Type=file;Size=10;", filterMLSxFacts(facts, []string{"type", "size"}))
+	require.Equal(t, "unix.owner=test;", filterMLSxFacts(facts, []string{"UNIX.OWNER"}))
+	require.Equal(t, "", filterMLSxFacts(facts, []string{"perm"}))
+}
+
+func TestClientQuirks(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			ClientProfiles: []ClientProfile{
+				{
+					Name:          "legacy PLC",
+					ClientVersion: "LegacyPLC",
+					Quirks: ClientQuirks{
+						DisableEPSV:   true,
+						ASCIIAsBinary: true,
+						MLSxFacts:     []string{"type", "size"},
+					},
+				},
+			},
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	ftpUpload(t, c, createTemporaryFile(t, 10), "file")
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("TYPE A")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response, err = raw.SendCommand("SIZE file")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+
+	rc, response, err = raw.SendCommand("CLNT LegacyPLC firmware 2.1")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response, err = raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusCommandNotImplemented, rc, response)
+
+	rc, response, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc, response)
+	require.NotContains(t, response, "EPSV")
+
+	rc, response, err = raw.SendCommand("TYPE A")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response, err = raw.SendCommand("SIZE file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatus, rc, response)
+	require.Equal(t, "10", response)
+
+	rc, response, err = raw.SendCommand("MLST file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+	require.Contains(t, response, "\nType=file;Size=10; file\n")
+}
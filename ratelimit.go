@@ -0,0 +1,44 @@
+package ftpserver
+
+import (
+	"time"
+)
+
+// tokenBucket is a simple token bucket rate limiter, it isn't safe for concurrent use
+type tokenBucket struct {
+	rate   float64   // tokens added per second
+	burst  float64   // maximum number of tokens
+	tokens float64   // available tokens
+	last   time.Time // last time the tokens were updated
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow consumes a token if one is available
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
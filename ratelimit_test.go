@@ -0,0 +1,29 @@
+package ftpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(2, 3)
+	now := bucket.last
+
+	for i := 0; i < 3; i++ {
+		require.True(t, bucket.allow(now), "burst %d", i)
+	}
+
+	require.False(t, bucket.allow(now))
+	require.True(t, bucket.allow(now.Add(500*time.Millisecond)))
+	require.False(t, bucket.allow(now.Add(500*time.Millisecond)))
+
+	// the bucket can't hold more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.True(t, bucket.allow(now), "burst %d", i)
+	}
+
+	require.False(t, bucket.allow(now))
+}
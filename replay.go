@@ -0,0 +1,377 @@
+package ftpserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Replay of the traces (see ClientContext.SetTrace): the commands of a session recorded on a production server
+// are sent again to a server, usually one created by a test with the driver under test, and its replies are
+// compared to the recorded ones. This reproduces the issues of a client without the client, and detects the
+// behavioral changes of a driver.
+//
+// The passive transfers are replayed without their content: the downloads are discarded and the uploads are
+// empty. The sessions using TLS or active transfers can't be replayed.
+
+var (
+	// ErrInvalidTrace is returned when a trace can't be parsed
+	ErrInvalidTrace = errors.New("invalid trace")
+	// ErrReplayUnsupported is returned when a trace contains a command that can't be replayed
+	ErrReplayUnsupported = errors.New("command can't be replayed")
+	// ErrInvalidReply is returned when the server sends a reply that can't be parsed
+	ErrInvalidReply = errors.New("invalid reply")
+)
+
+// replayUnsupportedCommands are the commands that can't be replayed on a plain connection
+var replayUnsupportedCommands = map[string]bool{"AUTH": true, "PORT": true, "EPRT": true, "LPRT": true}
+
+// replayUploadCommands are the commands whose data connection is closed right away by the replay
+var replayUploadCommands = map[string]bool{"STOR": true, "APPE": true, "STOU": true}
+
+// RecordedCommand is a command of a trace with the replies it got
+type RecordedCommand struct {
+	Line    int      // Line of the command in the trace
+	Command string   // Command line, with the credentials masked
+	Replies []string // Reply lines, until the next command
+}
+
+// ReplayOptions are the options of Replay
+type ReplayOptions struct {
+	Password    string        // Password sent instead of the masked one of the PASS commands
+	CompareText bool          // Compare the text of the replies too, only their codes are compared otherwise
+	Timeout     time.Duration // Maximum time to wait for a reply (10 seconds by default)
+}
+
+// ReplayMismatch is a command whose replies differ from the recorded ones
+type ReplayMismatch struct {
+	Line     int      // Line of the command in the trace
+	Command  string   // Command line
+	Expected []string // Recorded reply lines
+	Actual   []string // Reply lines of the replay
+}
+
+func (m ReplayMismatch) String() string {
+	return fmt.Sprintf("line %d: %s: expected %q, got %q", m.Line, m.Command, m.Expected, m.Actual)
+}
+
+// ParseTrace reads the commands of a trace
+func ParseTrace(r io.Reader) ([]RecordedCommand, error) {
+	var commands []RecordedCommand
+
+	scanner := bufio.NewScanner(r)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// timestamp, direction and line
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("%w: line %d", ErrInvalidTrace, lineNumber)
+		}
+
+		text := ""
+		if len(parts) == 3 {
+			text = parts[2]
+		}
+
+		switch parts[1] {
+		case ">":
+			commands = append(commands, RecordedCommand{Line: lineNumber, Command: text})
+		case "<":
+			// the banner is sent before the first command
+			if len(commands) > 0 {
+				last := &commands[len(commands)-1]
+				last.Replies = append(last.Replies, text)
+			}
+		case "#":
+		default:
+			return nil, fmt.Errorf("%w: line %d", ErrInvalidTrace, lineNumber)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return commands, nil
+}
+
+// replayer replays the commands of a trace on a control connection
+type replayer struct {
+	options   ReplayOptions
+	host      string
+	conn      net.Conn
+	reader    *bufio.Reader
+	dataConns []net.Conn // data connections opened by the replay, closed at its end
+	dataConn  net.Conn   // data connection of the next transfer command
+}
+
+// Replay sends the commands of a trace to the server listening on addr and returns the commands whose replies
+// differ from the recorded ones. An error is returned if the session couldn't be replayed until its end.
+func Replay(addr string, commands []RecordedCommand, options ReplayOptions) ([]ReplayMismatch, error) {
+	for _, command := range commands {
+		if name, _ := parseLine(command.Command); replayUnsupportedCommands[strings.ToUpper(name)] {
+			return nil, fmt.Errorf("%w: line %d: %s", ErrReplayUnsupported, command.Line, command.Command)
+		}
+	}
+
+	if options.Timeout == 0 {
+		options.Timeout = 10 * time.Second
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &replayer{options: options, host: host, conn: conn, reader: bufio.NewReader(conn)}
+	defer r.close()
+
+	// banner
+	if _, err = r.readReplies(); err != nil {
+		return nil, err
+	}
+
+	var mismatches []ReplayMismatch
+
+	for _, command := range commands {
+		actual, errReplay := r.replay(command.Command)
+		if errReplay != nil {
+			return mismatches, fmt.Errorf("line %d: %s: %w", command.Line, command.Command, errReplay)
+		}
+
+		if !r.matches(command.Replies, actual) {
+			mismatches = append(mismatches, ReplayMismatch{
+				Line:     command.Line,
+				Command:  command.Command,
+				Expected: command.Replies,
+				Actual:   actual,
+			})
+		}
+	}
+
+	return mismatches, nil
+}
+
+func (r *replayer) close() {
+	for _, conn := range r.dataConns {
+		_ = conn.Close()
+	}
+
+	_ = r.conn.Close()
+}
+
+// replay sends a command and returns its replies
+func (r *replayer) replay(line string) ([]string, error) {
+	name, param := parseLine(line)
+	name = strings.ToUpper(name)
+
+	if name == "PASS" && param == "****" {
+		line = "PASS " + r.options.Password
+	}
+
+	if err := r.conn.SetWriteDeadline(time.Now().Add(r.options.Timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := r.conn.Write([]byte(line + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	r.useDataConn(name)
+
+	replies, err := r.readReplies()
+	if err != nil {
+		return replies, err
+	}
+
+	if len(replies) > 0 && (strings.HasPrefix(replies[0], "227 ") || strings.HasPrefix(replies[0], "229 ")) {
+		err = r.openDataConn(replies[0])
+	}
+
+	return replies, err
+}
+
+// useDataConn gives the content of the transfer to the data connection opened for it, if any
+func (r *replayer) useDataConn(command string) {
+	conn := r.dataConn
+	if conn == nil {
+		return
+	}
+
+	r.dataConn = nil
+
+	if replayUploadCommands[command] {
+		_ = conn.Close()
+
+		return
+	}
+
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, conn)
+		_ = conn.Close()
+	}()
+}
+
+// openDataConn connects to the port of a PASV or EPSV reply, on the host of the control connection
+func (r *replayer) openDataConn(reply string) error {
+	start, end := strings.LastIndex(reply, "("), strings.LastIndex(reply, ")")
+	if start < 0 || end < start {
+		return fmt.Errorf("%w: no port in %q", ErrInvalidTrace, reply)
+	}
+
+	var port int
+
+	fields := strings.FieldsFunc(reply[start+1:end], func(c rune) bool { return c == ',' || c == '|' })
+
+	switch {
+	case strings.HasPrefix(reply, "227 ") && len(fields) == 6:
+		high, errHigh := strconv.Atoi(fields[4])
+		low, errLow := strconv.Atoi(fields[5])
+
+		if errHigh != nil || errLow != nil {
+			return fmt.Errorf("%w: invalid port in %q", ErrInvalidTrace, reply)
+		}
+
+		port = high<<8 + low
+	case strings.HasPrefix(reply, "229 ") && len(fields) == 1:
+		var err error
+		if port, err = strconv.Atoi(fields[0]); err != nil {
+			return fmt.Errorf("%w: invalid port in %q", ErrInvalidTrace, reply)
+		}
+	default:
+		return fmt.Errorf("%w: no port in %q", ErrInvalidTrace, reply)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(r.host, strconv.Itoa(port)), r.options.Timeout)
+	if err != nil {
+		return err
+	}
+
+	r.dataConns = append(r.dataConns, conn)
+	r.dataConn = conn
+
+	return nil
+}
+
+// readReplies reads the replies of a command until its final (non 1xx) one
+func (r *replayer) readReplies() ([]string, error) {
+	var lines []string
+
+	for {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.options.Timeout)); err != nil {
+			return lines, err
+		}
+
+		reply, err := r.readReply()
+		lines = append(lines, reply...)
+
+		if err != nil {
+			return lines, err
+		}
+
+		if reply[0] == "" {
+			return lines, ErrInvalidReply
+		}
+
+		if reply[0][0] != '1' {
+			return lines, nil
+		}
+	}
+}
+
+// readReply reads a single or multi-line reply
+func (r *replayer) readReply() ([]string, error) {
+	var lines []string
+
+	for {
+		line, err := r.reader.ReadString('\n')
+		if err != nil {
+			return lines, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		lines = append(lines, line)
+
+		if len(lines) == 1 && len(line) < 4 {
+			return lines, nil
+		}
+
+		first := lines[0]
+		if first[3] != '-' || (len(lines) > 1 && strings.HasPrefix(line, first[:3]+" ")) {
+			return lines, nil
+		}
+	}
+}
+
+// matches compares the recorded replies of a command to the ones of the replay
+func (r *replayer) matches(expected, actual []string) bool {
+	if !equalStrings(getReplyCodes(expected), getReplyCodes(actual)) {
+		return false
+	}
+
+	if !r.options.CompareText {
+		return true
+	}
+
+	// the passive replies contain the transfer addresses
+	filter := func(lines []string) []string {
+		filtered := make([]string, 0, len(lines))
+
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "227 ") && !strings.HasPrefix(line, "229 ") {
+				filtered = append(filtered, line)
+			}
+		}
+
+		return filtered
+	}
+
+	return equalStrings(filter(expected), filter(actual))
+}
+
+// getReplyCodes returns the codes of the replies, given by their last line
+func getReplyCodes(lines []string) []string {
+	var codes []string
+
+	for _, line := range lines {
+		if len(line) < 3 || (len(line) > 3 && line[3] != ' ') {
+			continue
+		}
+
+		if _, err := strconv.Atoi(line[:3]); err == nil {
+			codes = append(codes, line[:3])
+		}
+	}
+
+	return codes
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,178 @@
+package ftpserver
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const replayTrace = `# client 1, session 0123456789abcdef, from 192.0.2.1:40000
+2026-01-01T00:00:00Z < 220 Production server
+2026-01-01T00:00:00Z > USER test
+2026-01-01T00:00:00Z < 331 OK
+2026-01-01T00:00:00Z > PASS ****
+2026-01-01T00:00:00Z < 230 Password ok, continue
+2026-01-01T00:00:00Z > MKD dir
+2026-01-01T00:00:00Z < 257 "/dir" created
+2026-01-01T00:00:00Z > CWD dir
+2026-01-01T00:00:00Z < 250 CD worked on /dir
+2026-01-01T00:00:00Z > EPSV
+2026-01-01T00:00:00Z < 229 Entering Extended Passive Mode (|||40001|)
+2026-01-01T00:00:00Z > STOR file
+2026-01-01T00:00:00Z < 150 Using transfer connection
+2026-01-01T00:00:00Z < 226 Closing transfer connection
+2026-01-01T00:00:00Z > EPSV
+2026-01-01T00:00:00Z < 229 Entering Extended Passive Mode (|||40002|)
+2026-01-01T00:00:00Z > LIST
+2026-01-01T00:00:00Z < 150 Using transfer connection
+2026-01-01T00:00:00Z < 226 Closing transfer connection
+2026-01-01T00:00:00Z > SIZE file
+2026-01-01T00:00:00Z < 213 0
+2026-01-01T00:00:00Z > PASV
+2026-01-01T00:00:00Z < 227 Entering Passive Mode (192,0,2,10,156,67)
+2026-01-01T00:00:00Z > RETR file
+2026-01-01T00:00:00Z < 150 Using transfer connection
+2026-01-01T00:00:00Z < 226 Closing transfer connection
+2026-01-01T00:00:00Z > FEAT
+2026-01-01T00:00:00Z < 211- These are my features
+2026-01-01T00:00:00Z <  UTF8
+2026-01-01T00:00:00Z < 211 End
+2026-01-01T00:00:00Z > QUIT
+2026-01-01T00:00:00Z < 221 Goodbye
+`
+
+func TestReplay(t *testing.T) {
+	s := NewTestServer(t, true)
+
+	commands, err := ParseTrace(strings.NewReader(replayTrace))
+	require.NoError(t, err)
+	require.Len(t, commands, 13)
+	require.Equal(t, RecordedCommand{Line: 7, Command: "MKD dir", Replies: []string{`257 "/dir" created`}}, commands[2])
+
+	mismatches, err := Replay(s.Addr(), commands, ReplayOptions{Password: authPass})
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	// the directory now exists
+	mismatches, err = Replay(s.Addr(), commands, ReplayOptions{Password: authPass})
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	require.Equal(t, 7, mismatches[0].Line)
+	require.Equal(t, "MKD dir", mismatches[0].Command)
+	require.Equal(t, []string{`257 "/dir" created`}, mismatches[0].Expected)
+	require.Equal(t, "550", mismatches[0].Actual[0][:3])
+
+	// only the codes are compared by default
+	login := append([]RecordedCommand{}, commands[:2]...)
+	login[0].Replies = []string{"331 User name okay, need password"}
+
+	mismatches, err = Replay(s.Addr(), login, ReplayOptions{Password: authPass})
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+
+	mismatches, err = Replay(s.Addr(), login, ReplayOptions{Password: authPass, CompareText: true})
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	require.Equal(t, []string{"331 OK"}, mismatches[0].Actual)
+}
+
+func TestReplayRecordedSession(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	traceFile, err := ioutil.TempFile("", "ftpserver-replay")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, os.Remove(traceFile.Name())) }()
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	readLine := func() string {
+		line, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return line
+	}
+
+	require.Equal(t, "220 TEST Server\r\n", readLine())
+
+	driver.clientMU.Lock()
+	driver.Clients[0].SetTrace(traceFile)
+	driver.clientMU.Unlock()
+
+	for _, command := range []string{"USER " + authUser, "PASS " + authPass, "MKD recorded", "CWD recorded",
+		"PWD", "QUIT"} {
+		_, err = conn.Write([]byte(command + "\r\n"))
+		require.NoError(t, err)
+		readLine()
+	}
+
+	var trace string
+
+	require.Eventually(t, func() bool {
+		content, errRead := ioutil.ReadFile(traceFile.Name())
+		require.NoError(t, errRead)
+		trace = string(content)
+
+		return strings.Contains(trace, "< 221 Goodbye")
+	}, 2*time.Second, 50*time.Millisecond)
+
+	commands, err := ParseTrace(strings.NewReader(trace))
+	require.NoError(t, err)
+	require.Len(t, commands, 6)
+	require.Equal(t, "PASS ****", commands[1].Command)
+
+	// the same session on another server with the same driver gets the same replies
+	other := newTestServerWithDriver(t, &TestServerDriver{Debug: true})
+
+	mismatches, err := Replay(other.Addr(), commands, ReplayOptions{Password: authPass, CompareText: true})
+	require.NoError(t, err)
+	require.Empty(t, mismatches)
+}
+
+func TestReplayErrors(t *testing.T) {
+	_, err := ParseTrace(strings.NewReader("2026-01-01T00:00:00Z ? NOOP\n"))
+	require.True(t, errors.Is(err, ErrInvalidTrace), err)
+
+	_, err = ParseTrace(strings.NewReader("NOOP\n"))
+	require.True(t, errors.Is(err, ErrInvalidTrace), err)
+
+	commands, err := ParseTrace(strings.NewReader("2026-01-01T00:00:00Z > PORT 192,0,2,1,156,64\n"))
+	require.NoError(t, err)
+
+	_, err = Replay("127.0.0.1:21", commands, ReplayOptions{})
+	require.True(t, errors.Is(err, ErrReplayUnsupported), err)
+}
+
+func TestReplayEmptyReply(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, listener.Close()) }()
+
+	go func() {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			return
+		}
+
+		defer func() { _ = conn.Close() }()
+
+		_, _ = conn.Write([]byte("\r\n"))
+		_, _ = ioutil.ReadAll(conn)
+	}()
+
+	_, err = Replay(listener.Addr().String(), nil, ReplayOptions{Timeout: 5 * time.Second})
+	require.True(t, errors.Is(err, ErrInvalidReply), err)
+}
@@ -0,0 +1,213 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidReplyCode is returned when a reply code isn't a three digits code
+var ErrInvalidReplyCode = errors.New("invalid reply code")
+
+// Reply is a reply of the control connection, formatted as RFC 959 (4.2) requires. A single line reply is
+// "code text". The lines of a multi-line reply are "code-text", except the last one which is "code text".
+// The plain text lines (the FEAT features or the STAT listings) don't have the code, they are padded with
+// a space if they start with a digit so that the clients can't take them for the last line.
+//
+//	reply := NewReply(StatusSystemStatus, "Extensions supported:").Text(" UTF8").Line("End")
+type Reply struct {
+	code  int
+	lines []replyLine
+}
+
+type replyLine struct {
+	text  string
+	plain bool // the line doesn't have the code
+}
+
+// NewReply creates a reply. The line breaks (CRLF, LF or CR) of the message split it into several lines.
+func NewReply(code int, message string) *Reply {
+	return (&Reply{code: code}).Line(message)
+}
+
+// Code returns the code of the reply
+func (r *Reply) Code() int {
+	return r.code
+}
+
+// Line adds lines starting with the code to the reply
+func (r *Reply) Line(message string) *Reply {
+	for _, line := range getMessageLines(message) {
+		r.lines = append(r.lines, replyLine{text: line})
+	}
+
+	return r
+}
+
+// Linef adds a formatted line starting with the code to the reply
+func (r *Reply) Linef(format string, args ...interface{}) *Reply {
+	return r.Line(fmt.Sprintf(format, args...))
+}
+
+// Text adds plain text lines to the reply. The last line of a reply always has the code.
+func (r *Reply) Text(text string) *Reply {
+	for _, line := range getMessageLines(text) {
+		r.lines = append(r.lines, replyLine{text: line, plain: true})
+	}
+
+	return r
+}
+
+// Validate checks the reply code
+func (r *Reply) Validate() error {
+	if r.code < 100 || r.code > 699 {
+		return fmt.Errorf("%w: %d", ErrInvalidReplyCode, r.code)
+	}
+
+	return nil
+}
+
+// Lines returns the formatted lines of the reply, without their CRLF
+func (r *Reply) Lines() []string {
+	if len(r.lines) == 0 {
+		return []string{fmt.Sprintf("%d ", r.code)}
+	}
+
+	lines := make([]string, len(r.lines))
+	last := len(r.lines) - 1
+
+	for idx, line := range r.lines {
+		switch {
+		case idx == last:
+			lines[idx] = fmt.Sprintf("%d %s", r.code, line.text)
+		case line.plain && idx > 0:
+			lines[idx] = padReplyText(line.text)
+		default:
+			lines[idx] = fmt.Sprintf("%d-%s", r.code, line.text)
+		}
+	}
+
+	return lines
+}
+
+// String returns the reply as it is sent
+func (r *Reply) String() string {
+	return strings.Join(r.Lines(), "\r\n") + "\r\n"
+}
+
+// padReplyText pads a plain text line of a multi-line reply starting with a digit (RFC 959, 4.2)
+func padReplyText(text string) string {
+	if text != "" && text[0] >= '0' && text[0] <= '9' {
+		return " " + text
+	}
+
+	return text
+}
+
+// writeReply sends a reply, with the pending notice if any
+func (c *clientHandler) writeReply(reply *Reply) {
+	c.writeCommandReply(reply, false)
+}
+
+// writeCommandReply sends a reply, transfer tells if it is a reply of the transfer of the running transfer
+// command (see commandContext)
+func (c *clientHandler) writeCommandReply(reply *Reply, transfer bool) {
+	if notice := c.takeReplyNotice(); notice != "" {
+		reply = &Reply{code: reply.code, lines: append(NewReply(reply.code, notice).lines, reply.lines...)}
+	}
+
+	if reply = c.filterReply(reply); reply == nil {
+		return
+	}
+
+	c.replyMu.Lock()
+	defer c.replyMu.Unlock()
+
+	c.setReplyCode(reply.code, transfer)
+	c.replyProtection = c.replyProtectionLevel(transfer)
+
+	lines := reply.Lines()
+
+	if len(lines) > 1 {
+		c.startReply()
+		defer c.endReply()
+	}
+
+	for _, line := range lines {
+		c.writeLine(line)
+	}
+}
+
+// writeText sends a plain text line of the multi-line reply started by multilineAnswer
+func (c *clientHandler) writeText(text string) {
+	for _, line := range getMessageLines(text) {
+		c.writeLine(padReplyText(line))
+	}
+}
+
+// SendReply sends a reply on the control connection. It must be called by the driver while a command is
+// handled, for a preliminary (1xx) reply or the informational lines of a custom command for example.
+func (c *clientHandler) SendReply(reply *Reply) error {
+	if err := reply.Validate(); err != nil {
+		return err
+	}
+
+	c.writeReply(reply)
+
+	return nil
+}
+
+// filterReply applies the MainDriverExtensionReplyFilter to each line of a reply, the rewritten lines keep
+// their format. It returns nil if all the lines are suppressed.
+func (c *clientHandler) filterReply(reply *Reply) *Reply {
+	if _, ok := c.server.driver.(MainDriverExtensionReplyFilter); !ok {
+		return reply
+	}
+
+	filtered := &Reply{code: reply.code}
+
+	for _, line := range reply.lines {
+		for _, text := range c.filterLine(reply.code, line.text) {
+			filtered.lines = append(filtered.lines, replyLine{text: text, plain: line.plain})
+		}
+	}
+
+	if len(filtered.lines) == 0 && len(reply.lines) > 0 {
+		if c.debug {
+			c.logger.Debug("Reply suppressed", "code", reply.code)
+		}
+
+		return nil
+	}
+
+	return filtered
+}
+
+// filterLine applies the MainDriverExtensionReplyFilter to a line of a reply, it returns the lines to send
+// instead, none if the line is suppressed
+func (c *clientHandler) filterLine(code int, text string) []string {
+	filter, ok := c.server.driver.(MainDriverExtensionReplyFilter)
+	if !ok {
+		return []string{text}
+	}
+
+	filtered, send := c.callReplyFilter(filter, code, text)
+	if !send {
+		return nil
+	}
+
+	return getMessageLines(filtered)
+}
+
+// callReplyFilter calls the filter, a panic sends the reply unchanged
+func (c *clientHandler) callReplyFilter(filter MainDriverExtensionReplyFilter, code int,
+	message string) (filtered string, send bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.handlePanic("FilterReply", "", r)
+			filtered, send = message, true
+		}
+	}()
+
+	return filter.FilterReply(c, code, message)
+}
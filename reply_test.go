@@ -0,0 +1,169 @@
+package ftpserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplyFormat(t *testing.T) {
+	for _, tc := range []struct {
+		reply *Reply
+		lines []string
+	}{
+		{NewReply(StatusOK, "OK"), []string{"200 OK"}},
+		{NewReply(StatusOK, ""), []string{"200 "}},
+		{&Reply{code: StatusOK}, []string{"200 "}},
+		{NewReply(StatusOK, "first\r\nsecond\rthird\n"), []string{"200-first", "200-second", "200 third"}},
+		{NewReply(StatusOK, "first").Linef("%d files", 2), []string{"200-first", "200 2 files"}},
+		{
+			NewReply(StatusSystemStatus, "Features:").Text(" UTF8\n123 not the end").Text("").Line("End"),
+			[]string{"211-Features:", " UTF8", " 123 not the end", "", "211 End"},
+		},
+		// the last line always has the code, the first one too
+		{(&Reply{code: StatusOK}).Text("only").Text("last"), []string{"200-only", "200 last"}},
+	} {
+		require.Equal(t, tc.lines, tc.reply.Lines())
+		require.Equal(t, strings.Join(tc.lines, "\r\n")+"\r\n", tc.reply.String())
+		require.NoError(t, tc.reply.Validate())
+	}
+
+	for _, code := range []int{0, 99, 700, -200} {
+		err := NewReply(code, "bad").Validate()
+		require.True(t, errors.Is(err, ErrInvalidReplyCode), err)
+	}
+}
+
+// strictReplyEnd is how a picky client finds the last line of a reply: its code followed by a space
+var strictReplyEnd = regexp.MustCompile(`^(\d{3}) `)
+
+// readStrictReply reads a reply as RFC 959 describes it: a multi-line reply ends at the first line starting
+// with the code of its first line followed by a space
+func readStrictReply(t *testing.T, reader *bufio.Reader) []string {
+	var lines []string
+
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.True(t, strings.HasSuffix(line, "\r\n"), "line not ending with CRLF: %q", line)
+
+		line = strings.TrimSuffix(line, "\r\n")
+		require.NotContains(t, line, "\r")
+		lines = append(lines, line)
+
+		if len(lines) == 1 {
+			require.Regexp(t, `^\d{3}[ -]`, line)
+		}
+
+		if match := strictReplyEnd.FindStringSubmatch(line); match != nil && match[1] == lines[0][:3] {
+			return lines
+		}
+	}
+}
+
+func TestReplyStrictClient(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			// a banner that could end the STAT reply early
+			Banner: "211 is not the end\r\nof the STAT reply",
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	command := func(line string) []string {
+		_, errWrite := fmt.Fprintf(conn, "%s\r\n", line)
+		require.NoError(t, errWrite)
+
+		return readStrictReply(t, reader)
+	}
+
+	readStrictReply(t, reader)
+	require.Equal(t, []string{"331 OK"}, command("USER "+authUser))
+	require.Equal(t, []string{"230 Password ok, continue"}, command("PASS "+authPass))
+
+	stat := command("STAT")
+	require.Equal(t, "211-Server status", stat[0])
+	require.Equal(t, []string{" 211 is not the end", "of the STAT reply", "211 End"}, stat[len(stat)-3:])
+
+	feat := command("FEAT")
+	require.Equal(t, "211- These are my features", feat[0])
+	require.Contains(t, feat, " UTF8")
+	require.Equal(t, "211 end", feat[len(feat)-1])
+
+	require.Equal(t, []string{"150-Parameters:", "a", " 2", "150 End"}, command("XREPLY a 2"))
+	require.Equal(t, []string{"200 Done"}, readStrictReply(t, reader))
+}
+
+func TestReplyFilter(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		ReplyFilter: func(code int, message string) (string, bool) {
+			switch {
+			case code == StatusServiceReady:
+				return "Authorized use only\n" + message, true
+			case message == " MDTM":
+				return "", false
+			case code == StatusSystemStatus:
+				return strings.ToUpper(message), true
+			case strings.HasSuffix(message, "drop"):
+				return "", false
+			case strings.HasSuffix(message, "panic"):
+				panic("filter failure")
+			default:
+				return strings.ReplaceAll(message, "secret", "******"), true
+			}
+		},
+	})
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	command := func(line string) []string {
+		_, errWrite := fmt.Fprintf(conn, "%s\r\n", line)
+		require.NoError(t, errWrite)
+
+		return readStrictReply(t, reader)
+	}
+
+	require.Equal(t, []string{"220-Authorized use only", "220 TEST Server"}, readStrictReply(t, reader))
+	require.Equal(t, []string{"200 custom command: ******"}, command("XCUSTOM secret"))
+
+	// the suppressed reply is never sent
+	_, err = fmt.Fprintf(conn, "XCUSTOM drop\r\n")
+	require.NoError(t, err)
+	require.Equal(t, []string{"200 custom command: next"}, command("XCUSTOM next"))
+
+	// the reply is sent unchanged if the filter panics
+	require.Equal(t, []string{"200 custom command: panic"}, command("XCUSTOM panic"))
+
+	// the lines are filtered one by one, the plain text ones stay plain
+	feat := command("FEAT")
+	require.Equal(t, "211- THESE ARE MY FEATURES", feat[0])
+	require.Contains(t, feat, " UTF8")
+	require.NotContains(t, feat, " MDTM")
+	require.Equal(t, "211 END", feat[len(feat)-1])
+
+	require.Equal(t, []string{"331 OK"}, command("USER "+authUser))
+	require.Equal(t, []string{"230 Password ok, continue"}, command("PASS "+authPass))
+
+	stat := command("STAT")
+	require.Equal(t, "211-SERVER STATUS", stat[0])
+	require.Equal(t, "211 END", stat[len(stat)-1])
+}
@@ -0,0 +1,148 @@
+package ftpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNSBL checks the clients IP against DNS blocklists, the MainDriverExtensionReputation implementations can
+// use it. An IP is flagged if it is listed by one of the zones ("zen.spamhaus.org" for example).
+type DNSBL struct {
+	Zones    []string      // Blocklists DNS zones
+	Resolver *net.Resolver // net.DefaultResolver if nil
+}
+
+// CheckReputation queries the zones in parallel, the first listing flags the IP
+func (d *DNSBL) CheckReputation(ctx context.Context, ip net.IP) (bool, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan error, len(d.Zones))
+
+	for _, zone := range d.Zones {
+		go func(name string) {
+			_, err := resolver.LookupHost(ctx, name)
+			results <- err
+		}(dnsblName(ip, zone))
+	}
+
+	var lastErr error
+
+	for range d.Zones {
+		err := <-results
+		if err == nil {
+			return true, nil
+		}
+
+		// not listed
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue
+		}
+
+		lastErr = err
+	}
+
+	return false, lastErr
+}
+
+// dnsblName returns the name to look up in a DNSBL zone: the reversed octets of an IPv4 or the reversed
+// nibbles of an IPv6, followed by the zone
+func dnsblName(ip net.IP, zone string) string {
+	var labels []string
+
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", ip4[i]))
+		}
+	} else {
+		ip16 := ip.To16()
+		for i := len(ip16) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", ip16[i]&0x0f), fmt.Sprintf("%x", ip16[i]>>4))
+		}
+	}
+
+	return strings.Join(append(labels, zone), ".")
+}
+
+// reputationResult is the result of a MainDriverExtensionReputation check
+type reputationResult struct {
+	flagged bool
+	err     error
+}
+
+// checkReputation consults the MainDriverExtensionReputation before the banner is sent, for at most
+// ReputationCheckTimeout milliseconds. It returns false if the client must be rejected. The clients are
+// accepted if the check fails or doesn't answer in time.
+func (c *clientHandler) checkReputation() bool {
+	checker, ok := c.server.driver.(MainDriverExtensionReputation)
+	if !ok {
+		return true
+	}
+
+	ip := getIPFromAddr(c.RemoteAddr())
+	if ip == nil {
+		return true
+	}
+
+	budget := time.Duration(c.server.settings.ReputationCheckTimeout) * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), budget)
+
+	defer cancel()
+
+	// the result channel is buffered, a check ignoring the context doesn't leak the goroutine forever
+	results := make(chan reputationResult, 1)
+
+	c.trackResource(resourceGoroutine, 1)
+
+	go func() {
+		defer c.trackResource(resourceGoroutine, -1)
+
+		results <- c.callReputationCheck(ctx, checker, ip)
+	}()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			c.logger.Warn("Could not check the reputation of the client, accepting it", "err", result.err)
+
+			return true
+		}
+
+		if result.flagged {
+			c.emitSecurityEvent(SecurityEventBadReputation, fmt.Sprintf("connection from %s refused", ip))
+
+			return false
+		}
+
+		return true
+	case <-ctx.Done():
+		c.logger.Warn("The reputation check of the client timed out, accepting it", "timeout", budget)
+
+		return true
+	}
+}
+
+// callReputationCheck calls the driver, a panic accepts the client
+func (c *clientHandler) callReputationCheck(ctx context.Context, checker MainDriverExtensionReputation,
+	ip net.IP) (result reputationResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.handlePanic("CheckReputation", "", r)
+			result = reputationResult{err: errDriverPanic}
+		}
+	}()
+
+	flagged, err := checker.CheckReputation(ctx, ip)
+
+	return reputationResult{flagged: flagged, err: err}
+}
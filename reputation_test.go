@@ -0,0 +1,70 @@
+package ftpserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readBanner(t *testing.T, s *FtpServer) string {
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	buf := make([]byte, 128)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+
+	return string(buf[:n])
+}
+
+func TestReputationCheck(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:      true,
+		Reputation: func(context.Context) (bool, error) { return true, nil },
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.Equal(t, "421 Service not available, your IP is blocklisted\r\n", readBanner(t, s))
+	require.Equal(t, []SecurityEventType{SecurityEventBadReputation}, driver.getSecurityEvents())
+
+	// the clients are accepted when the check fails
+	driver = &TestServerDriver{
+		Debug:      true,
+		Reputation: func(context.Context) (bool, error) { return true, errors.New("unreachable") }, // nolint: goerr113
+	}
+	s = newTestServerWithDriver(t, driver)
+
+	require.Equal(t, "220 TEST Server\r\n", readBanner(t, s))
+}
+
+func TestReputationCheckTimeout(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Reputation: func(ctx context.Context) (bool, error) {
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond)
+
+			return true, ctx.Err()
+		},
+		Settings: &Settings{ReputationCheckTimeout: 100},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	start := time.Now()
+	require.Equal(t, "220 TEST Server\r\n", readBanner(t, s))
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+	require.Empty(t, driver.getSecurityEvents())
+}
+
+func TestDNSBLName(t *testing.T) {
+	require.Equal(t, "2.0.0.127.zen.example.org", dnsblName(net.ParseIP("127.0.0.2"), "zen.example.org"))
+	require.Equal(t,
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.bl.example.org",
+		dnsblName(net.ParseIP("2001:db8::1"), "bl.example.org"))
+}
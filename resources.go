@@ -0,0 +1,84 @@
+package ftpserver
+
+import (
+	"sync/atomic"
+)
+
+// resourceKind is a kind of resource accounted per session
+type resourceKind int
+
+const (
+	resourceGoroutine    resourceKind = iota // goroutines started for the session
+	resourceOpenFile                         // files and directories opened with the driver
+	resourceDataListener                     // passive data connections listeners
+	nbResourceKinds
+)
+
+var resourceNames = [nbResourceKinds]string{"goroutines", "open files", "data listeners"}
+
+// ResourceCounters are the resources in use by a session, or by all the sessions of a server
+type ResourceCounters struct {
+	Goroutines    int // Goroutines, including the one handling the control connection
+	OpenFiles     int // Files and directories opened with the driver
+	DataListeners int // Passive data connections listeners
+}
+
+// resourceCounters counts the resources in use, it is safe for concurrent use
+type resourceCounters struct {
+	counts [nbResourceKinds]int32
+}
+
+func (r *resourceCounters) add(kind resourceKind, delta int32) int32 {
+	return atomic.AddInt32(&r.counts[kind], delta)
+}
+
+func (r *resourceCounters) get() ResourceCounters {
+	return ResourceCounters{
+		Goroutines:    int(atomic.LoadInt32(&r.counts[resourceGoroutine])),
+		OpenFiles:     int(atomic.LoadInt32(&r.counts[resourceOpenFile])),
+		DataListeners: int(atomic.LoadInt32(&r.counts[resourceDataListener])),
+	}
+}
+
+// GetResources returns the resources in use by the session
+func (c *clientHandler) GetResources() ResourceCounters {
+	return c.resources.get()
+}
+
+// trackResource accounts the acquisition (delta > 0) or the release (delta < 0) of a resource.
+// A session exceeding its limits is leaking, its control connection is closed to end it.
+func (c *clientHandler) trackResource(kind resourceKind, delta int32) {
+	c.server.resources.add(kind, delta)
+	count := c.resources.add(kind, delta)
+
+	if delta <= 0 {
+		return
+	}
+
+	if limit := c.getResourceLimit(kind); limit > 0 && int(count) > limit {
+		c.logger.Warn(
+			"Session resources limit exceeded, closing it",
+			"resource", resourceNames[kind],
+			"count", count,
+			"limit", limit,
+		)
+
+		// closing the connection from a different goroutine is safe, see Close
+		if err := c.conn.Close(); err != nil {
+			c.logger.Debug("Problem closing control connection", "err", err)
+		}
+	}
+}
+
+func (c *clientHandler) getResourceLimit(kind resourceKind) int {
+	switch kind {
+	case resourceGoroutine:
+		return c.server.settings.MaxSessionGoroutines
+	case resourceOpenFile:
+		return c.server.settings.MaxSessionOpenFiles
+	case resourceDataListener:
+		return c.server.settings.MaxSessionDataListeners
+	default:
+		return 0
+	}
+}
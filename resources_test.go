@@ -0,0 +1,81 @@
+package ftpserver
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionResources(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.NoError(t, c.Store("file", bytes.NewReader(make([]byte, 1024))))
+	require.NoError(t, c.Retrieve("file", &bytes.Buffer{}))
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+
+	driver.clientMU.Lock()
+	require.Len(t, driver.Clients, 1)
+	cc := driver.Clients[0]
+	driver.clientMU.Unlock()
+
+	// only the control connection goroutine remains once the transfers are done
+	idle := ResourceCounters{Goroutines: 1}
+
+	require.Eventually(t, func() bool {
+		return cc.GetResources() == idle && s.Resources() == idle
+	}, 2*time.Second, 50*time.Millisecond)
+}
+
+func TestSessionResourcesLimit(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			MaxSessionDataListeners: 1,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	// the server closed the connection, the close result doesn't matter
+	defer func() { _ = raw.Close() }()
+
+	rc, response, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, response)
+
+	// the first listener is never used, the session is considered as leaking
+	_, _, err = raw.SendCommand("PASV")
+	require.Error(t, err)
+
+	require.Eventually(t, func() bool {
+		driver.clientMU.Lock()
+		defer driver.clientMU.Unlock()
+
+		return len(driver.Clients) == 0
+	}, 2*time.Second, 50*time.Millisecond)
+}
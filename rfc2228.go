@@ -0,0 +1,273 @@
+package ftpserver
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// RFC 2228 security mechanisms other than TLS (GSSAPI/Kerberos for example) are implemented by the
+// MainDriverExtensionSecurityMechanism. The server routes the AUTH and ADAT commands of the security data
+// exchange to the SecurityContext, then decodes the MIC, CONF and ENC commands and protects their replies
+// (631, 632 and 633 replies) with it. The protection of the transfer connections (PROT S and E) isn't supported.
+
+// ProtectionLevel is the protection of a command and of its replies
+type ProtectionLevel int32
+
+// Protection levels of the commands
+const (
+	ProtectionNone         ProtectionLevel = iota // Clear command
+	ProtectionIntegrity                           // MIC, integrity protected
+	ProtectionConfidential                        // CONF, confidentiality protected
+	ProtectionPrivate                             // ENC, integrity and confidentiality protected
+)
+
+func (l ProtectionLevel) String() string {
+	switch l {
+	case ProtectionNone:
+		return "none"
+	case ProtectionIntegrity:
+		return "MIC"
+	case ProtectionConfidential:
+		return "CONF"
+	case ProtectionPrivate:
+		return "ENC"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(l))
+	}
+}
+
+// replyCode returns the code of the protected replies
+func (l ProtectionLevel) replyCode() int {
+	switch l {
+	case ProtectionIntegrity:
+		return StatusProtectedIntegrity
+	case ProtectionConfidential:
+		return StatusProtectedConfidential
+	default:
+		return StatusProtectedPrivate
+	}
+}
+
+// SecurityContext is the state of a RFC 2228 security mechanism for a session
+type SecurityContext interface {
+
+	// Accept processes a token of the security data exchange (ADAT). It returns the token to send back, if
+	// any, and true once the exchange is complete. An error fails the exchange, the client can start again.
+	Accept(token []byte) (reply []byte, complete bool, err error)
+
+	// Unwrap decodes a protected command
+	Unwrap(level ProtectionLevel, data []byte) ([]byte, error)
+
+	// Wrap protects a reply, the lines separated by CRLF
+	Wrap(level ProtectionLevel, data []byte) ([]byte, error)
+}
+
+// tlsMechanisms are the AUTH mechanisms of the TLS layer (RFC 4217 and its drafts)
+var tlsMechanisms = map[string]bool{"TLS": true, "TLS-C": true, "TLS-P": true, "SSL": true}
+
+// handleAUTHMechanism starts the security data exchange of a mechanism of the driver, it returns false
+// if the mechanism is TLS
+func (c *clientHandler) handleAUTHMechanism(param string) bool {
+	mechanisms, ok := c.server.driver.(MainDriverExtensionSecurityMechanism)
+	mechanism := strings.ToUpper(strings.TrimSpace(param))
+
+	if !ok || tlsMechanisms[mechanism] {
+		return false
+	}
+
+	context, err := mechanisms.NewSecurityContext(c, mechanism)
+
+	switch {
+	case err != nil:
+		c.writeMessage(StatusRequestDenied, fmt.Sprintf("Could not start the %s security mechanism: %v", mechanism, err))
+	case context == nil:
+		c.writeMessage(StatusNotImplementedParam, fmt.Sprintf("Unsupported security mechanism %s", mechanism))
+	default:
+		c.securityMechanism = context
+		c.securityComplete = false
+		c.writeMessage(StatusSecurityDataNeeded, fmt.Sprintf("Using authentication type %s; ADAT must follow", mechanism))
+	}
+
+	return true
+}
+
+// handleADAT processes a token of the security data exchange
+func (c *clientHandler) handleADAT(param string) error {
+	if c.securityMechanism == nil || c.securityComplete {
+		c.writeMessage(StatusBadCommandSequence, "No security data exchange in progress, use AUTH first")
+
+		return nil
+	}
+
+	token, err := base64.StdEncoding.DecodeString(strings.TrimSpace(param))
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, "The security data must be base64 encoded")
+
+		return nil
+	}
+
+	reply, complete, err := c.securityMechanism.Accept(token)
+	if err != nil {
+		c.logger.Warn("Security data exchange failed", "err", err)
+		c.securityMechanism = nil
+		c.writeMessage(StatusSecurityDataRejected, "Security data is unacceptable")
+
+		return nil
+	}
+
+	code := StatusSecurityDataAccepted
+	if complete {
+		code = StatusSecurityDataComplete
+		c.securityComplete = true
+	}
+
+	switch {
+	case len(reply) > 0:
+		c.writeMessage(code, "ADAT="+base64.StdEncoding.EncodeToString(reply))
+	case complete:
+		c.writeMessage(code, "Security data exchange complete")
+	default:
+		c.writeMessage(code, "Security data accepted, send more")
+	}
+
+	return nil
+}
+
+func (c *clientHandler) handleMIC(param string) error {
+	return c.handleProtectedCommand(ProtectionIntegrity, param)
+}
+
+func (c *clientHandler) handleCONF(param string) error {
+	return c.handleProtectedCommand(ProtectionConfidential, param)
+}
+
+func (c *clientHandler) handleENC(param string) error {
+	return c.handleProtectedCommand(ProtectionPrivate, param)
+}
+
+// handleProtectedCommand decodes a protected command, it is handled next with its replies protected with
+// the same level
+func (c *clientHandler) handleProtectedCommand(level ProtectionLevel, param string) error {
+	if c.securityMechanism == nil || !c.securityComplete {
+		c.writeMessage(StatusBadCommandSequence, "The security data exchange isn't complete")
+
+		return nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(param))
+	if err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, "The protected command must be base64 encoded")
+
+		return nil
+	}
+
+	line, err := c.securityMechanism.Unwrap(level, data)
+	if err != nil {
+		c.logger.Warn("Could not decode a protected command", "level", level.String(), "err", err)
+		c.writeMessage(StatusSecurityDataRejected, "Failed security check")
+
+		return nil
+	}
+
+	command := strings.TrimRight(string(line), "\r\n")
+	c.traceLine(">", command)
+
+	if name, _ := parseLine(command); securityCommands[strings.ToUpper(name)] {
+		c.setCommandProtection(level)
+		c.writeMessage(StatusProtectionDenied, "Security commands can't be protected")
+
+		return nil
+	}
+
+	// the command is handled by the commands loop once this one is done, see handleProtectedCommandLine
+	c.protectedCommand = command
+	c.protectedLevel = level
+
+	return nil
+}
+
+// handleProtectedCommandLine handles the command decoded by the last MIC, CONF or ENC command, if any
+func (c *clientHandler) handleProtectedCommandLine() {
+	if c.protectedCommand == "" {
+		return
+	}
+
+	command := c.protectedCommand
+	c.protectedCommand = ""
+
+	c.setCommandProtection(c.protectedLevel)
+	c.handleCommand(command)
+}
+
+// securityCommands are the RFC 2228 commands that can't be protected themselves
+var securityCommands = map[string]bool{"AUTH": true, "ADAT": true, "MIC": true, "CONF": true, "ENC": true}
+
+// setCommandProtection sets the protection of the command being handled and of its replies
+func (c *clientHandler) setCommandProtection(level ProtectionLevel) {
+	c.replyMu.Lock()
+	defer c.replyMu.Unlock()
+
+	c.commandProtection = level
+}
+
+// replyProtectionLevel returns the protection of a reply: the transfer command one for the replies going
+// to the transfer command, the one of the command being handled otherwise. replyMu must be held.
+func (c *clientHandler) replyProtectionLevel(transfer bool) ProtectionLevel {
+	if cmd := c.replyCommand(transfer); cmd != nil && cmd == c.transferCommand {
+		return cmd.protection
+	}
+
+	return c.commandProtection
+}
+
+// protectReply buffers a line of a protected reply, it returns false if the reply isn't protected.
+// replyMu must be held.
+func (c *clientHandler) protectReply(line string) bool {
+	if c.replyProtection == ProtectionNone {
+		return false
+	}
+
+	c.protectedLines = append(c.protectedLines, line)
+
+	return true
+}
+
+// writeProtectedReply sends the buffered lines of a protected reply, once its last line ("code text") is
+// written. replyMu must be held.
+func (c *clientHandler) writeProtectedReply() {
+	if len(c.protectedLines) == 0 || !isLastReplyLine(c.protectedLines[len(c.protectedLines)-1]) {
+		return
+	}
+
+	level := c.replyProtection
+	data := []byte(strings.Join(c.protectedLines, "\r\n") + "\r\n")
+	c.protectedLines = c.protectedLines[:0]
+
+	line := fmt.Sprintf("%d Failed to protect the reply", StatusSecurityDataRejected)
+
+	if wrapped, err := c.securityMechanism.Wrap(level, data); err == nil {
+		line = fmt.Sprintf("%d %s", level.replyCode(), base64.StdEncoding.EncodeToString(wrapped))
+	} else {
+		c.logger.Warn("Could not protect a reply", "level", level.String(), "err", err)
+	}
+
+	if _, err := c.writer.WriteString(line + "\r\n"); err != nil {
+		c.logger.Warn("Answer couldn't be sent", "line", line, "err", err)
+	}
+}
+
+// isLastReplyLine tells if a line ends a reply, the code is followed by a space
+func isLastReplyLine(line string) bool {
+	if len(line) < 4 || line[3] != ' ' {
+		return false
+	}
+
+	for _, digit := range line[:3] {
+		if digit < '0' || digit > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,178 @@
+package ftpserver
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errBadSecurityToken = errors.New("bad security token")
+
+// xorSecurityContext is a toy mechanism: the exchange is "hello" then "done", the protected messages are
+// prefixed by their level and XORed
+type xorSecurityContext struct{}
+
+func (xorSecurityContext) Accept(token []byte) ([]byte, bool, error) {
+	switch string(token) {
+	case "hello":
+		return []byte("world"), false, nil
+	case "done":
+		return nil, true, nil
+	default:
+		return nil, false, errBadSecurityToken
+	}
+}
+
+func (xorSecurityContext) Unwrap(level ProtectionLevel, data []byte) ([]byte, error) {
+	if len(data) == 0 || ProtectionLevel(data[0]) != level {
+		return nil, errBadSecurityToken
+	}
+
+	return xorBytes(data[1:]), nil
+}
+
+func (xorSecurityContext) Wrap(level ProtectionLevel, data []byte) ([]byte, error) {
+	return append([]byte{byte(level)}, xorBytes(data)...), nil
+}
+
+func xorBytes(data []byte) []byte {
+	result := make([]byte, len(data))
+	for i, b := range data {
+		result[i] = b ^ 0x5a
+	}
+
+	return result
+}
+
+func TestSecurityMechanism(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:              true,
+		SecurityMechanisms: map[string]func() SecurityContext{"XOR": func() SecurityContext { return xorSecurityContext{} }},
+	})
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	command := func(line string) string {
+		if line != "" {
+			_, errWrite := conn.Write([]byte(line + "\r\n"))
+			require.NoError(t, errWrite)
+		}
+
+		reply, errRead := reader.ReadString('\n')
+		require.NoError(t, errRead)
+
+		return strings.TrimRight(reply, "\r\n")
+	}
+	encode := func(data string) string {
+		return base64.StdEncoding.EncodeToString([]byte(data))
+	}
+	var unprotect func(level ProtectionLevel, reply string) string
+	protected := func(name string, level ProtectionLevel, line string) string {
+		wrapped, errWrap := xorSecurityContext{}.Wrap(level, []byte(line))
+		require.NoError(t, errWrap)
+
+		return unprotect(level, command(name+" "+base64.StdEncoding.EncodeToString(wrapped)))
+	}
+	unprotect = func(level ProtectionLevel, reply string) string {
+		require.Equal(t, strconv.Itoa(level.replyCode())+" ", reply[:4], reply)
+
+		data, errDecode := base64.StdEncoding.DecodeString(reply[4:])
+		require.NoError(t, errDecode)
+
+		clear, errUnwrap := xorSecurityContext{}.Unwrap(level, data)
+		require.NoError(t, errUnwrap)
+
+		return string(clear)
+	}
+
+	require.Equal(t, "220 TEST Server", command(""))
+	require.Equal(t, "504 Unsupported security mechanism KERBEROS_V4", command("AUTH KERBEROS_V4"))
+	require.Equal(t, "503 No security data exchange in progress, use AUTH first", command("ADAT "+encode("hello")))
+	require.Equal(t, "503 The security data exchange isn't complete", command("MIC "+encode("NOOP")))
+
+	// a failed exchange can be started again
+	require.Equal(t, "334 Using authentication type XOR; ADAT must follow", command("AUTH XOR"))
+	require.Equal(t, "501 The security data must be base64 encoded", command("ADAT !"))
+	require.Equal(t, "535 Security data is unacceptable", command("ADAT "+encode("bye")))
+	require.Equal(t, "334 Using authentication type XOR; ADAT must follow", command("AUTH xor"))
+	require.Equal(t, "335 ADAT="+encode("world"), command("ADAT "+encode("hello")))
+	require.Equal(t, "235 Security data exchange complete", command("ADAT "+encode("done")))
+
+	require.Equal(t, "331 OK\r\n", protected("ENC", ProtectionPrivate, "USER "+authUser))
+	require.Equal(t, "230 Password ok, continue\r\n", protected("ENC", ProtectionPrivate, "PASS "+authPass))
+	require.Equal(t, "257 \"/\" is the current directory\r\n", protected("MIC", ProtectionIntegrity, "PWD"))
+
+	// the multi-line replies are protected as a whole
+	feat := protected("CONF", ProtectionConfidential, "FEAT")
+	require.True(t, strings.HasPrefix(feat, "211- These are my features\r\n"), feat)
+	require.True(t, strings.HasSuffix(feat, "\r\n211 end\r\n"), feat)
+
+	require.Equal(t, "533 Security commands can't be protected\r\n", protected("MIC", ProtectionIntegrity, "ADAT x"))
+	require.Equal(t, "535 Failed security check", command("MIC "+encode("\x02PWD")))
+	require.Equal(t, "501 The protected command must be base64 encoded", command("ENC !"))
+
+	// the replies of the clear commands aren't protected
+	require.Equal(t, "257 \"/\" is the current directory", command("PWD"))
+
+	// the transfer replies are protected like the transfer command, not like the commands sent meanwhile
+	require.Equal(t, "200 Type set to binary\r\n", protected("ENC", ProtectionPrivate, "TYPE I"))
+	pasv := protected("ENC", ProtectionPrivate, "PASV")
+	require.True(t, strings.HasPrefix(pasv, "227 "), pasv)
+
+	address := strings.Split(pasv[strings.Index(pasv, "(")+1:strings.Index(pasv, ")")], ",")
+	portHigh, err := strconv.Atoi(address[4])
+	require.NoError(t, err)
+	portLow, err := strconv.Atoi(address[5])
+	require.NoError(t, err)
+
+	dataAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(portHigh*256+portLow))
+	dataConn, err := net.DialTimeout("tcp", dataAddr, 5*time.Second)
+	require.NoError(t, err)
+
+	stor := protected("ENC", ProtectionPrivate, "STOR protected.bin")
+	require.True(t, strings.HasPrefix(stor, "150 "), stor)
+
+	require.True(t, strings.HasPrefix(command("STAT"), "211-"))
+
+	for reply := command(""); !strings.HasPrefix(reply, "211 "); reply = command("") {
+		require.NotEqual(t, strconv.Itoa(StatusProtectedPrivate), reply[:3], reply)
+	}
+
+	_, err = dataConn.Write([]byte("protected data"))
+	require.NoError(t, err)
+	require.NoError(t, dataConn.Close())
+
+	stored := unprotect(ProtectionPrivate, command(""))
+	require.True(t, strings.HasPrefix(stored, "226 "), stored)
+}
+
+func TestSecurityMechanismWithoutExtension(t *testing.T) {
+	s := NewTestServer(t, true)
+
+	conn, err := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, conn.Close()) }()
+
+	reader := bufio.NewReader(conn)
+	_, err = reader.ReadString('\n')
+	require.NoError(t, err)
+
+	_, err = conn.Write([]byte("ADAT " + base64.StdEncoding.EncodeToString([]byte("hello")) + "\r\n"))
+	require.NoError(t, err)
+
+	reply, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(reply, "503 "), reply)
+}
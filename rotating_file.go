@@ -0,0 +1,292 @@
+package ftpserver
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedFileTimeFormat is the suffix of the rotated files, they sort in the rotation order
+const rotatedFileTimeFormat = "20060102-150405"
+
+// ErrRotatingFileClosed is returned by the writes to a closed RotatingFile
+var ErrRotatingFileClosed = errors.New("rotating file closed")
+
+// RotatingFile is a log file, like the AccessLog, rotated once it reaches MaxSize bytes or when a new
+// RotateInterval period starts (a day at midnight UTC for 24 hours). The rotated files are renamed with
+// the rotation date, access.log.20261016-000000, and gzipped in the background with Compress. The oldest
+// ones are removed beyond MaxBackups, 0 keeps them all. The file is opened at the first write.
+type RotatingFile struct {
+	Path           string        // Path of the current file
+	MaxSize        int64         // Size in bytes triggering a rotation, 0 for unlimited
+	RotateInterval time.Duration // Period of the time-based rotation, 0 disables it
+	Compress       bool          // Gzip the rotated files
+	MaxBackups     int           // Number of rotated files kept, 0 keeps them all
+
+	header   string           // Written at the top of each file, see AccessLog
+	file     *os.File         // Current file, nil until the first write
+	size     int64            // Size of the current file
+	openedAt time.Time        // Opening date of the current file
+	closed   bool             // Close was called
+	now      func() time.Time // Current time, replaced by the tests
+	mu       sync.Mutex       // Protects the current file
+
+	backgroundWg  sync.WaitGroup // Compressions and cleanups in progress
+	backgroundMu  sync.Mutex     // Serializes the compressions and cleanups
+	backgroundErr error          // Last compression or cleanup error, returned by Close
+}
+
+// setHeader sets the header written at the top of each new file
+func (f *RotatingFile) setHeader(header string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.header = header
+}
+
+func (f *RotatingFile) currentTime() time.Time {
+	if f.now != nil {
+		return f.now()
+	}
+
+	return time.Now()
+}
+
+// Write writes to the current file, rotating it first if needed
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, ErrRotatingFileClosed
+	}
+
+	now := f.currentTime()
+
+	if f.file != nil && f.needsRotation(now, int64(len(p))) {
+		if err := f.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.file == nil {
+		if err := f.open(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// needsRotation tells if the current file must be rotated before writing size bytes
+func (f *RotatingFile) needsRotation(now time.Time, size int64) bool {
+	// a write bigger than MaxSize still goes to a new file
+	if f.MaxSize > 0 && f.size > 0 && f.size+size > f.MaxSize {
+		return true
+	}
+
+	return f.RotateInterval > 0 &&
+		!now.UTC().Truncate(f.RotateInterval).Equal(f.openedAt.UTC().Truncate(f.RotateInterval))
+}
+
+// open opens the current file, writing the header if it is a new one
+func (f *RotatingFile) open(now time.Time) error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = now
+
+	// an existing file keeps its date, it is rotated if it is from a previous period
+	if f.size > 0 {
+		f.openedAt = info.ModTime()
+	}
+
+	if f.size == 0 && f.header != "" {
+		n, err := io.WriteString(file, f.header)
+		f.size += int64(n)
+
+		return err
+	}
+
+	return nil
+}
+
+// rotate renames the current file, the next write opens a new one
+func (f *RotatingFile) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	f.file = nil
+
+	rotatedPath, err := f.rotatedPath(now)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(f.Path, rotatedPath); err != nil {
+		return err
+	}
+
+	f.backgroundWg.Add(1)
+
+	go f.finishRotation(rotatedPath)
+
+	return nil
+}
+
+// rotatedPath returns an unused path for the file rotated at this date
+func (f *RotatingFile) rotatedPath(now time.Time) (string, error) {
+	base := f.Path + "." + now.UTC().Format(rotatedFileTimeFormat)
+
+	for i := 0; ; i++ {
+		path := base
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", base, i)
+		}
+
+		_, errStat := os.Stat(path)
+		_, errStatGz := os.Stat(path + ".gz")
+
+		if os.IsNotExist(errStat) && os.IsNotExist(errStatGz) {
+			return path, nil
+		}
+
+		if errStat != nil && !os.IsNotExist(errStat) {
+			return "", errStat
+		}
+	}
+}
+
+// finishRotation compresses the rotated file and removes the oldest ones
+func (f *RotatingFile) finishRotation(rotatedPath string) {
+	defer f.backgroundWg.Done()
+
+	f.backgroundMu.Lock()
+	defer f.backgroundMu.Unlock()
+
+	// the file can have been removed by the cleanup of a later rotation
+	if f.Compress {
+		if err := compressFile(rotatedPath); err != nil && !os.IsNotExist(err) {
+			f.backgroundErr = err
+		}
+	}
+
+	if f.MaxBackups > 0 {
+		if err := f.removeOldBackups(); err != nil {
+			f.backgroundErr = err
+		}
+	}
+}
+
+// compressFile gzips a file and removes it
+func compressFile(path string) error {
+	source, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = source.Close() }()
+
+	target, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(target)
+
+	if _, err = io.Copy(writer, source); err == nil {
+		err = writer.Close()
+	}
+
+	if errClose := target.Close(); err == nil {
+		err = errClose
+	}
+
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// removeOldBackups removes the oldest rotated files beyond MaxBackups
+func (f *RotatingFile) removeOldBackups() error {
+	matches, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return err
+	}
+
+	prefix := f.Path + "."
+	backups := matches[:0]
+
+	for _, path := range matches {
+		// the other files sharing the prefix aren't rotated files
+		suffix := strings.TrimPrefix(path, prefix)
+		if len(suffix) >= len(rotatedFileTimeFormat) {
+			if _, errParse := time.Parse(rotatedFileTimeFormat, suffix[:len(rotatedFileTimeFormat)]); errParse == nil {
+				backups = append(backups, path)
+			}
+		}
+	}
+
+	if len(backups) <= f.MaxBackups {
+		return nil
+	}
+
+	sort.Strings(backups)
+
+	for _, path := range backups[:len(backups)-f.MaxBackups] {
+		if errRemove := os.Remove(path); errRemove != nil && !os.IsNotExist(errRemove) {
+			err = errRemove
+		}
+	}
+
+	return err
+}
+
+// Close closes the current file once the rotated files are compressed
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+
+	var err error
+
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+
+	f.closed = true
+	f.mu.Unlock()
+
+	f.backgroundWg.Wait()
+
+	if err == nil {
+		err = f.backgroundErr
+	}
+
+	return err
+}
@@ -0,0 +1,195 @@
+package ftpserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// AccessSchedule restricts the times at which a user can be connected, see ClientContext.SetAccessSchedule.
+// The logins outside of its windows are refused and the sessions are closed when their window ends, once
+// the current transfer is over.
+type AccessSchedule struct {
+	Windows  []AccessWindow // The access is allowed during any of these windows
+	Location *time.Location // Time zone of the windows, UTC if nil
+	Warning  time.Duration  // The client is warned from this time before the end of the access
+}
+
+// AccessWindow is a daily time range
+type AccessWindow struct {
+	Days  []time.Weekday // Days on which the window starts, every day if empty
+	Start time.Duration  // Start time of the window, from midnight
+	End   time.Duration  // End time of the window, from midnight. It is the next day if it isn't after Start.
+}
+
+// startsOn returns true if the window starts on a week day
+func (w *AccessWindow) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+
+	return false
+}
+
+// span returns the start and the end of the window including date, false if it doesn't include it. The
+// window is in the location of date.
+func (w *AccessWindow) span(date time.Time) (time.Time, time.Time, bool) {
+	// the windows of the day before can span midnight
+	for _, dayShift := range []int{-1, 0} {
+		day := time.Date(date.Year(), date.Month(), date.Day()+dayShift, 0, 0, 0, 0, date.Location())
+		if !w.startsOn(day.Weekday()) {
+			continue
+		}
+
+		start, end := day.Add(w.Start), day.Add(w.End)
+		if w.End <= w.Start {
+			end = end.Add(24 * time.Hour)
+		}
+
+		if !date.Before(start) && date.Before(end) {
+			return start, end, true
+		}
+	}
+
+	return time.Time{}, time.Time{}, false
+}
+
+// accessEnd returns the end of the windows including date, false if the access isn't allowed at this date
+func (s *AccessSchedule) accessEnd(date time.Time) (time.Time, bool) {
+	loc := s.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	date = date.In(loc)
+
+	var end time.Time
+
+	for i := range s.Windows {
+		if _, windowEnd, ok := s.Windows[i].span(date); ok && windowEnd.After(end) {
+			end = windowEnd
+		}
+	}
+
+	return end, !end.IsZero()
+}
+
+// SetAccessSchedule restricts the times at which the user can be connected
+func (c *clientHandler) SetAccessSchedule(schedule *AccessSchedule) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.accessSchedule = schedule
+}
+
+func (c *clientHandler) getAccessSchedule() *AccessSchedule {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.accessSchedule
+}
+
+// checkAccessSchedule saves the end of the access of a just authenticated client, it returns false if
+// the access isn't allowed now
+func (c *clientHandler) checkAccessSchedule() bool {
+	schedule := c.getAccessSchedule()
+	if schedule == nil {
+		return true
+	}
+
+	end, allowed := schedule.accessEnd(time.Now())
+	c.accessEnd = end
+
+	return allowed
+}
+
+// extendAccess moves the end of the access to the end of the next window, if it is adjacent. It returns
+// false if the access is over.
+func (c *clientHandler) extendAccess() bool {
+	schedule := c.getAccessSchedule()
+	if schedule == nil {
+		// the restriction was removed
+		c.accessEnd = time.Time{}
+
+		return true
+	}
+
+	end, allowed := schedule.accessEnd(time.Now())
+	if allowed {
+		c.accessEnd = end
+		c.accessWarned = false
+	}
+
+	return allowed
+}
+
+// accessWarningDeadline returns the time at which the client is warned of the end of its access, zero if
+// it isn't or already was
+func (c *clientHandler) accessWarningDeadline() time.Time {
+	schedule := c.getAccessSchedule()
+	if schedule == nil || schedule.Warning <= 0 || c.accessEnd.IsZero() || c.accessWarned {
+		return time.Time{}
+	}
+
+	return c.accessEnd.Add(-schedule.Warning)
+}
+
+// accessEndNotice is the warning sent to the client when the end of its access is near
+func (c *clientHandler) accessEndNotice() string {
+	return fmt.Sprintf("Your access ends at %s", c.accessEnd.Format("15:04 MST"))
+}
+
+// warnAccessEnd adds a notice to the next reply if the end of the access is near
+func (c *clientHandler) warnAccessEnd() {
+	deadline := c.accessWarningDeadline()
+	if deadline.IsZero() || time.Now().Before(deadline) {
+		return
+	}
+
+	c.accessWarned = true
+	c.setReplyNotice(c.accessEndNotice())
+}
+
+// sendAccessWarning sends the warning of the end of the access if the read error is its deadline, for the
+// clients that are idle or in a long transfer. It returns false if the error isn't this deadline.
+func (c *clientHandler) sendAccessWarning(err error) bool {
+	var netErr net.Error
+
+	deadline := c.accessWarningDeadline()
+	if deadline.IsZero() || !errors.As(err, &netErr) || !netErr.Timeout() || time.Now().Before(deadline) {
+		return false
+	}
+
+	// the deadline applies to the writes too
+	c.accessWarned = true
+	c.setIdleDeadline()
+	c.writeMessage(StatusServiceNotAvailable, c.accessEndNotice())
+
+	return true
+}
+
+// setReplyNotice sets a notice to add to the next reply
+func (c *clientHandler) setReplyNotice(notice string) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.replyNotice = notice
+}
+
+// takeReplyNotice returns the notice to add to the next reply, if any
+func (c *clientHandler) takeReplyNotice() string {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	notice := c.replyNotice
+	c.replyNotice = ""
+
+	return notice
+}
@@ -0,0 +1,124 @@
+package ftpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessScheduleWindows(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	require.NoError(t, err)
+
+	schedule := &AccessSchedule{
+		Windows: []AccessWindow{
+			{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: 9 * time.Hour, End: 17 * time.Hour},
+			{Days: []time.Weekday{time.Friday}, Start: 22 * time.Hour, End: 6 * time.Hour},
+		},
+		Location: paris,
+	}
+
+	for _, tc := range []struct {
+		date    time.Time
+		allowed bool
+		end     time.Time
+	}{
+		// Monday
+		{time.Date(2021, 3, 1, 8, 59, 0, 0, paris), false, time.Time{}},
+		{time.Date(2021, 3, 1, 9, 0, 0, 0, paris), true, time.Date(2021, 3, 1, 17, 0, 0, 0, paris)},
+		{time.Date(2021, 3, 1, 16, 0, 0, 0, time.UTC), false, time.Time{}},
+		// Wednesday
+		{time.Date(2021, 3, 3, 10, 0, 0, 0, paris), false, time.Time{}},
+		// Friday night to Saturday morning
+		{time.Date(2021, 3, 5, 23, 0, 0, 0, paris), true, time.Date(2021, 3, 6, 6, 0, 0, 0, paris)},
+		{time.Date(2021, 3, 6, 5, 0, 0, 0, paris), true, time.Date(2021, 3, 6, 6, 0, 0, 0, paris)},
+		{time.Date(2021, 3, 6, 6, 0, 0, 0, paris), false, time.Time{}},
+	} {
+		end, allowed := schedule.accessEnd(tc.date)
+		require.Equal(t, tc.allowed, allowed, tc.date)
+		require.True(t, tc.end.Equal(end), tc.date)
+	}
+}
+
+// timeOfDay returns the time elapsed since midnight UTC
+func timeOfDay(date time.Time) time.Duration {
+	date = date.UTC()
+
+	return date.Sub(time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC))
+}
+
+func TestAccessScheduleLoginRefused(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	now := time.Now()
+	driver.AccessSchedule = &AccessSchedule{Windows: []AccessWindow{{
+		Start: timeOfDay(now.Add(time.Hour)),
+		End:   timeOfDay(now.Add(2 * time.Hour)),
+	}}}
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.OpenRawConn()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Access isn't allowed at this time")
+}
+
+func TestAccessScheduleEnd(t *testing.T) {
+	driver := &TestServerDriver{Debug: true}
+	s := NewTestServerWithDriver(t, driver)
+
+	// the window is set once the parallel test is resumed
+	now := time.Now()
+	driver.AccessSchedule = &AccessSchedule{
+		Windows: []AccessWindow{{
+			Start: timeOfDay(now.Add(-time.Hour)),
+			End:   timeOfDay(now.Add(4 * time.Second)),
+		}},
+		Warning: 2 * time.Second,
+	}
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+	require.NotContains(t, response, "Your access ends at")
+
+	// an idle client is warned as well, only once
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc)
+	require.Contains(t, response, "Your access ends at")
+
+	rc, response, err = raw.SendCommand("NOOP")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc)
+	require.NotContains(t, response, "Your access ends at")
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc)
+	require.Contains(t, response, "access time is over")
+}
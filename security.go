@@ -0,0 +1,93 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+)
+
+// SecurityEventType is the type of a SecurityEvent
+type SecurityEventType int
+
+// Security events types
+const (
+	// SecurityEventWeakTLS is emitted when a connection negotiates a TLS version below TLSVersionAlertThreshold
+	SecurityEventWeakTLS SecurityEventType = iota
+	// SecurityEventClearTransfers is emitted when a client protecting its control connection asks for clear
+	// transfer connections (PROT C)
+	SecurityEventClearTransfers
+	// SecurityEventPlaintextLogin is emitted when a plaintext login is refused because the client IP recently
+	// logged in over TLS (see TLSDowngradeProtectionWindow)
+	SecurityEventPlaintextLogin
+	// SecurityEventCountryRejected is emitted when a connection is refused because of the country of the client
+	// (see AllowedCountries and DeniedCountries)
+	SecurityEventCountryRejected
+	// SecurityEventBadReputation is emitted when a connection is refused because MainDriverExtensionReputation
+	// flagged the IP of the client
+	SecurityEventBadReputation
+	// SecurityEventContentTypeDenied is emitted when an upload is refused because of its content type (see
+	// ContentTypePolicy)
+	SecurityEventContentTypeDenied
+	// SecurityEventLoginLockout is emitted when a user or a client IP is locked out after too many failed logins
+	// (see MaxLoginFailures)
+	SecurityEventLoginLockout
+)
+
+func (t SecurityEventType) String() string {
+	switch t {
+	case SecurityEventWeakTLS:
+		return "weak-tls"
+	case SecurityEventClearTransfers:
+		return "clear-transfers"
+	case SecurityEventPlaintextLogin:
+		return "plaintext-login"
+	case SecurityEventCountryRejected:
+		return "country-rejected"
+	case SecurityEventBadReputation:
+		return "bad-reputation"
+	case SecurityEventContentTypeDenied:
+		return "content-type-denied"
+	case SecurityEventLoginLockout:
+		return "login-lockout"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// SecurityEvent is a security policy violation of a session
+type SecurityEvent struct {
+	Type    SecurityEventType
+	Time    time.Time
+	User    string // User of the session, empty if not known yet
+	Details string // Human readable description
+}
+
+// emitSecurityEvent logs a security event and gives it to the MainDriverExtensionSecurityEvents, if implemented
+func (c *clientHandler) emitSecurityEvent(eventType SecurityEventType, details string) {
+	c.logger.Warn("Security event", "type", eventType.String(), "details", details)
+
+	if notifier, ok := c.server.driver.(MainDriverExtensionSecurityEvents); ok {
+		notifier.SecurityEvent(c, SecurityEvent{
+			Type:    eventType,
+			Time:    time.Now().UTC(),
+			User:    c.user,
+			Details: details,
+		})
+	}
+}
+
+// checkTLSVersion reports the connections negotiating a TLS version below TLSVersionAlertThreshold
+func (c *clientHandler) checkTLSVersion(state *tls.ConnectionState, control bool) {
+	threshold := c.server.settings.TLSVersionAlertThreshold
+	if threshold == 0 || state.Version >= threshold {
+		return
+	}
+
+	connection := "transfer"
+	if control {
+		connection = "control"
+	}
+
+	c.emitSecurityEvent(SecurityEventWeakTLS, fmt.Sprintf("%s negotiated on the %s connection, below %s",
+		getTLSVersionName(state.Version), connection, getTLSVersionName(threshold)))
+}
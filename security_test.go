@@ -0,0 +1,55 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecurityEvents(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:              true,
+		TLS:                true,
+		transferTLSVersion: tls.VersionTLS12,
+		Settings:           &Settings{TLSVersionAlertThreshold: tls.VersionTLS13},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			// nolint:gosec
+			InsecureSkipVerify: true,
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	// the control connection uses TLS 1.3, the transfer connections TLS 1.2
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+	require.Equal(t, []SecurityEventType{SecurityEventWeakTLS}, driver.getSecurityEvents())
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the mode is case-insensitive
+	rc, response, err := raw.SendCommand("PROT c")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	require.Equal(t, []SecurityEventType{SecurityEventWeakTLS, SecurityEventClearTransfers}, driver.getSecurityEvents())
+	require.Equal(t, "clear-transfers", SecurityEventClearTransfers.String())
+
+	driver.securityEventsMu.Lock()
+	require.Equal(t, authUser, driver.securityEvents[1].User)
+	driver.securityEventsMu.Unlock()
+}
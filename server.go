@@ -6,6 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/fclairamb/ftpserverlib/log"
@@ -14,6 +18,12 @@ import (
 var (
 	// ErrNotListening is returned when we are performing an action that is only valid while listening
 	ErrNotListening = errors.New("we aren't listening")
+
+	// ErrInvalidIPNet is returned when an IP or a CIDR network defined in the settings can't be parsed
+	ErrInvalidIPNet = errors.New("invalid IP or network")
+
+	// ErrInvalidSettings is returned when the settings are inconsistent, see Settings.Validate
+	ErrInvalidSettings = errors.New("invalid settings")
 )
 
 // CommandDescription defines which function should be used and if it should be open to anyone or only logged in users
@@ -30,11 +40,19 @@ var commandsMap = map[string]*CommandDescription{
 	// Authentication
 	"USER": {Fn: (*clientHandler).handleUSER, Open: true},
 	"PASS": {Fn: (*clientHandler).handlePASS, Open: true},
+	"REIN": {Fn: (*clientHandler).handleREIN, Open: true},
 
 	// TLS handling
 	"AUTH": {Fn: (*clientHandler).handleAUTH, Open: true},
 	"PROT": {Fn: (*clientHandler).handlePROT, Open: true},
 	"PBSZ": {Fn: (*clientHandler).handlePBSZ, Open: true},
+	"CCC":  {Fn: (*clientHandler).handleCCC},
+
+	// RFC 2228 security mechanisms, the protected commands are serialized once decoded
+	"ADAT": {Fn: (*clientHandler).handleADAT, Open: true},
+	"MIC":  {Fn: (*clientHandler).handleMIC, Open: true, SpecialAction: true},
+	"CONF": {Fn: (*clientHandler).handleCONF, Open: true, SpecialAction: true},
+	"ENC":  {Fn: (*clientHandler).handleENC, Open: true, SpecialAction: true},
 
 	// Misc
 	"CLNT": {Fn: (*clientHandler).handleCLNT, Open: true},
@@ -87,6 +105,7 @@ var commandsMap = map[string]*CommandDescription{
 
 	// Connection handling
 	"TYPE": {Fn: (*clientHandler).handleTYPE},
+	"MODE": {Fn: (*clientHandler).handleMODE},
 	"PASV": {Fn: (*clientHandler).handlePASV},
 	"EPSV": {Fn: (*clientHandler).handlePASV},
 	"PORT": {Fn: (*clientHandler).handlePORT},
@@ -103,8 +122,34 @@ type FtpServer struct {
 	Logger        log.Logger   // Go-Kit logger
 	settings      *Settings    // General settings
 	listener      net.Listener // listener used to receive files
+	listenerMu    sync.Mutex   // Protects the listener, which can be re-created by Serve
+	stopped       bool         // Stop was called, the listener must not be re-created
+	paused        int32        // The new connections are refused, see PauseAccept (atomic)
+	refusing      int32        // Refused connections being replied to, see refuseConnection (atomic)
 	clientCounter uint32       // Clients counter
 	driver        MainDriver   // Driver to handle the client authentication and the file access driver selection
+
+	dataConnAllowList  []*net.IPNet        // Parsed DataConnectionAllowList setting
+	passiveIPRules     []passiveIPRule     // Parsed PassiveIPRules setting
+	bufferPool         *bufferPool         // Buffers shared by the data copies
+	pendingConnections *pendingLimiter     // Connections waiting for their banner (MaxPendingConnections)
+	pendingHandshakes  *pendingLimiter     // TLS handshakes in progress (MaxPendingHandshakes)
+	bandwidth          *bandwidthScheduler // Divides TransferBandwidth between the users
+	transferTemplate   *template.Template  // TransferCompleteTemplate, nil if not set
+	quitTemplate       *template.Template  // QuitTemplate, nil if not set
+	accessLog          *accessLog          // AccessLog, nil if not set
+
+	tlsLogins   map[string]time.Time // Last TLS login time per client IP (TLS downgrade protection)
+	tlsLoginsMu sync.Mutex           // Protects tlsLogins
+
+	loginFailures   map[lockoutKey]*loginFailures // Failed logins per user and per client IP (MaxLoginFailures)
+	loginFailuresMu sync.Mutex                    // Protects loginFailures
+
+	userSessions   map[string][]*clientHandler // Logged in sessions per user, oldest first (DuplicateSessionPolicy)
+	userSessionsMu sync.Mutex                  // Protects userSessions
+
+	resources resourceCounters  // Resources in use by all the sessions
+	countries countriesCounters // Connections per country, see MainDriverExtensionGeoLocator
 }
 
 func (server *FtpServer) loadSettings() error {
@@ -127,15 +172,323 @@ func (server *FtpServer) loadSettings() error {
 		s.ConnectionTimeout = 30
 	}
 
+	if s.TLSHandshakeTimeout == 0 {
+		s.TLSHandshakeTimeout = 10
+	}
+
+	if s.PartialUploadSuffix == "" {
+		s.PartialUploadSuffix = ".part"
+	}
+
+	if s.HideTempUploads && len(s.TempUploadSuffixes) == 0 {
+		s.TempUploadSuffixes = []string{s.PartialUploadSuffix}
+	}
+
+	if s.PassivePortLeaseTimeout == 0 {
+		s.PassivePortLeaseTimeout = 5
+	}
+
+	if s.RenameTimeout == 0 {
+		s.RenameTimeout = 60
+	}
+
+	if s.ReputationCheckTimeout == 0 {
+		s.ReputationCheckTimeout = 1000
+	}
+
+	if s.PendingQueueTimeout == 0 {
+		s.PendingQueueTimeout = 10
+	}
+
+	if s.MaxExtractEntrySize == 0 {
+		s.MaxExtractEntrySize = defaultMaxExtractEntrySize
+	}
+
+	if s.MaxExtractEntries == 0 {
+		s.MaxExtractEntries = defaultMaxExtractEntries
+	}
+
+	if s.LoginLockoutDuration == 0 {
+		s.LoginLockoutDuration = 900
+	}
+
+	if s.DriverRetryDelay == 0 {
+		s.DriverRetryDelay = 100
+	}
+
+	if s.MaxCommandLength == 0 {
+		s.MaxCommandLength = defaultMaxCommandSize
+	}
+
+	if s.MaxPathLength == 0 {
+		s.MaxPathLength = defaultMaxCommandSize
+	}
+
 	if s.Banner == "" {
 		s.Banner = "ftpserver - golang FTP server"
 	}
 
+	if err = s.Validate(); err != nil {
+		return err
+	}
+
+	// the TLS config is only requested at the first TLS connection otherwise
+	if s.TLSRequired != ClearOrEncrypted {
+		if _, err = server.driver.GetTLSConfig(); err != nil {
+			return fmt.Errorf("%w: TLS is required but the driver has no TLS config: %v", ErrInvalidSettings, err)
+		}
+	}
+
+	server.dataConnAllowList, err = parseIPNets(s.DataConnectionAllowList)
+	if err != nil {
+		return err
+	}
+
+	if server.passiveIPRules, err = parsePassiveIPRules(s.PassiveIPRules); err != nil {
+		return err
+	}
+
+	server.bufferPool = newBufferPool(s.TransferBufferSize, s.TransferBuffersMaxMemory)
+	server.pendingConnections = newPendingLimiter(s.MaxPendingConnections, s.PendingQueueSize)
+	server.pendingHandshakes = newPendingLimiter(s.MaxPendingHandshakes, s.PendingQueueSize)
+	server.bandwidth = newBandwidthScheduler(s.TransferBandwidth, s.TransferBandwidthSchedule)
+
+	// the templates were validated
+	server.transferTemplate, _ = parseStatsTemplate("TransferCompleteTemplate", s.TransferCompleteTemplate)
+	server.quitTemplate, _ = parseStatsTemplate("QuitTemplate", s.QuitTemplate)
+	server.accessLog = newAccessLog(s.AccessLog)
+
 	server.settings = s
 
 	return nil
 }
 
+// Validate checks that the settings are consistent, all the problems found are reported in the returned
+// error, which wraps ErrInvalidSettings. It is called when the server starts listening, after the defaults
+// are applied, so that a misconfiguration is reported before the first client connects.
+func (s *Settings) Validate() error {
+	var problems []string
+
+	if r := s.PassiveTransferPortRange; r != nil {
+		problems = append(problems, validatePorts("passive port range", r.Start, r.End)...)
+
+		if s.PassivePortMapping != nil {
+			problems = append(problems, "the passive port range is ignored when a passive port mapping is set")
+		}
+	}
+
+	if m := s.PassivePortMapping; m != nil {
+		if m.NbPorts < 1 {
+			problems = append(problems, "the passive port mapping has no ports")
+		} else {
+			problems = append(problems, validatePorts("listened port mapping", m.ListenedStart, m.ListenedStart+m.NbPorts-1)...)
+			problems = append(problems, validatePorts("exposed port mapping", m.ExposedStart, m.ExposedStart+m.NbPorts-1)...)
+		}
+
+		// the server can't guess the public IP behind a NAT
+		if s.PublicHost == "" && s.PublicIPResolver == nil {
+			problems = append(problems, "a passive port mapping (NAT) requires PublicHost or PublicIPResolver")
+		}
+	}
+
+	if s.PublicHost != "" && net.ParseIP(s.PublicHost) == nil {
+		problems = append(problems, fmt.Sprintf("PublicHost %#v isn't an IP address", s.PublicHost))
+	}
+
+	if _, err := parseIPNets(s.DataConnectionAllowList); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if _, err := parsePassiveIPRules(s.PassiveIPRules); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for name, value := range map[string]int{
+		"IdleWarning":             s.IdleWarning,
+		"MaxSessionDuration":      s.MaxSessionDuration,
+		"ConnectionTimeout":       s.ConnectionTimeout,
+		"PassivePortLeaseTimeout": s.PassivePortLeaseTimeout,
+		"RenameTimeout":           s.RenameTimeout,
+		"ReputationCheckTimeout":  s.ReputationCheckTimeout,
+		"TransferStallTimeout":    s.TransferStallTimeout,
+		"FileOpenTimeout":         s.FileOpenTimeout,
+		"VersionRetention":        s.VersionRetention,
+		"ListingCacheTTL":         s.ListingCacheTTL,
+		"DriverRetries":           s.DriverRetries,
+		"MaxCommandLength":        s.MaxCommandLength,
+		"MaxPathLength":           s.MaxPathLength,
+	} {
+		if value < 0 {
+			problems = append(problems, fmt.Sprintf("%s can't be negative", name))
+		}
+	}
+
+	if s.FilenamePolicy != nil {
+		if err := s.FilenamePolicy.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if s.ContentTypePolicy != nil {
+		if err := s.ContentTypePolicy.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if s.Faults != nil {
+		if err := s.Faults.validate(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	// a negative IdleTimeout disables the idle disconnection, and its warning
+	if s.IdleWarning > 0 && s.IdleTimeout > 0 && s.IdleWarning >= s.IdleTimeout {
+		problems = append(problems, "IdleWarning must be shorter than IdleTimeout")
+	}
+
+	if s.TransferQuota < 0 {
+		problems = append(problems, "TransferQuota can't be negative")
+	}
+
+	if s.TransferQuota > 0 && s.TransferAccounting == nil {
+		problems = append(problems, "a TransferQuota requires a TransferAccounting")
+	}
+
+	// the blocks of the parallel transfers are made of a buffer
+	if s.TransferBufferSize != 0 && s.TransferBufferSize <= extendedHeaderSize {
+		problems = append(problems, fmt.Sprintf("TransferBufferSize must be larger than %d bytes", extendedHeaderSize))
+	}
+
+	if s.TransferBandwidth < 0 {
+		problems = append(problems, "TransferBandwidth can't be negative")
+	}
+
+	if _, err := parseStatsTemplate("TransferCompleteTemplate", s.TransferCompleteTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid TransferCompleteTemplate: %v", err))
+	}
+
+	if _, err := parseStatsTemplate("QuitTemplate", s.QuitTemplate); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid QuitTemplate: %v", err))
+	}
+
+	if s.TransferBandwidthSchedule != nil && !s.TransferBandwidthSchedule.valid() {
+		problems = append(problems, "TransferBandwidthSchedule bandwidths can't be negative")
+	}
+
+	if s.BlockRestartMarkerInterval < 0 {
+		problems = append(problems, "BlockRestartMarkerInterval can't be negative")
+	}
+
+	problems = append(problems, validateCountries("AllowedCountries", s.AllowedCountries)...)
+	problems = append(problems, validateCountries("DeniedCountries", s.DeniedCountries)...)
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// map iterations are random, the report must be stable
+	sort.Strings(problems)
+
+	return fmt.Errorf("%w: %s", ErrInvalidSettings, strings.Join(problems, "; "))
+}
+
+// validatePorts checks that a ports range isn't empty and is within the TCP ports
+func validatePorts(name string, start, end int) []string {
+	switch {
+	case end < start:
+		return []string{fmt.Sprintf("the %s %d-%d is empty", name, start, end)}
+	case start < 1 || end > 65535:
+		return []string{fmt.Sprintf("the %s %d-%d isn't within 1-65535", name, start, end)}
+	default:
+		return nil
+	}
+}
+
+// parseIPNets parses a list of IPs or CIDR networks
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, 0, len(entries))
+
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %#v: %w", entry, ErrInvalidIPNet)
+			}
+
+			if ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %#v: %w", entry, err)
+		}
+
+		ipNets = append(ipNets, ipNet)
+	}
+
+	return ipNets, nil
+}
+
+// recordTLSLogin remembers that a client IP logged in over TLS
+func (server *FtpServer) recordTLSLogin(ip string) {
+	window := time.Duration(server.settings.TLSDowngradeProtectionWindow) * time.Second
+	if window <= 0 {
+		return
+	}
+
+	server.tlsLoginsMu.Lock()
+	defer server.tlsLoginsMu.Unlock()
+
+	now := time.Now()
+
+	if server.tlsLogins == nil {
+		server.tlsLogins = make(map[string]time.Time)
+	}
+
+	// we don't want this map to grow forever
+	for clientIP, loginTime := range server.tlsLogins {
+		if now.Sub(loginTime) > window {
+			delete(server.tlsLogins, clientIP)
+		}
+	}
+
+	server.tlsLogins[ip] = now
+}
+
+// hasRecentTLSLogin tells if a client IP logged in over TLS within the TLS downgrade protection window
+func (server *FtpServer) hasRecentTLSLogin(ip string) bool {
+	window := time.Duration(server.settings.TLSDowngradeProtectionWindow) * time.Second
+	if window <= 0 {
+		return false
+	}
+
+	server.tlsLoginsMu.Lock()
+	defer server.tlsLoginsMu.Unlock()
+
+	loginTime, ok := server.tlsLogins[ip]
+
+	return ok && time.Since(loginTime) <= window
+}
+
+// CopyPathCounters returns how many data copies were done through each copy path,
+// which is useful to check that sendfile is used when it should be
+func (server *FtpServer) CopyPathCounters() CopyPathCounters {
+	if server.bufferPool == nil {
+		return CopyPathCounters{}
+	}
+
+	return server.bufferPool.getCounters()
+}
+
+// Resources returns the resources in use by all the sessions, the leaks show up as ever growing counters
+func (server *FtpServer) Resources() ResourceCounters {
+	return server.resources.get()
+}
+
 // Listen starts the listening
 // It's not a blocking call
 func (server *FtpServer) Listen() error {
@@ -145,35 +498,70 @@ func (server *FtpServer) Listen() error {
 		return fmt.Errorf("could not load settings: %w", err)
 	}
 
+	var listener net.Listener
+
 	// The driver can provide its own listener implementation
 	if server.settings.Listener != nil {
-		server.listener = server.settings.Listener
+		listener = server.settings.Listener
 	} else {
 		// Otherwise, it's what we currently use
-		server.listener, err = net.Listen("tcp", server.settings.ListenAddr)
-
+		listener, err = server.createListener(server.settings.ListenAddr)
 		if err != nil {
-			server.Logger.Error("Cannot listen", "err", err)
-
 			return err
 		}
-		if server.settings.TLSRequired == ImplicitEncryption {
-			// implicit TLS
-			var tlsConfig *tls.Config
+	}
+
+	server.listenerMu.Lock()
+	server.listener = listener
+	server.stopped = false
+	server.listenerMu.Unlock()
+
+	server.Logger.Info("Listening...", "address", listener.Addr())
+
+	return err
+}
 
-			tlsConfig, err = server.driver.GetTLSConfig()
-			if err != nil {
-				server.Logger.Error("Cannot get tls config", "err", err)
+// unixListenPrefix is the prefix of the ListenAddr of the unix sockets
+const unixListenPrefix = "unix:"
+
+// createListener listens on an address, with implicit TLS if required
+func (server *FtpServer) createListener(address string) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, unixListenPrefix) {
+		network, address = "unix", strings.TrimPrefix(address, unixListenPrefix)
+	}
 
-				return err
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		server.Logger.Error("Cannot listen", "err", err)
+
+		return nil, err
+	}
+
+	if server.settings.TLSRequired == ImplicitEncryption {
+		tlsConfig, err := server.getTLSConfig()
+		if err != nil {
+			server.Logger.Error("Cannot get tls config", "err", err)
+
+			if errClose := listener.Close(); errClose != nil {
+				server.Logger.Warn("Could not close listener", "err", errClose)
 			}
-			server.listener = tls.NewListener(server.listener, tlsConfig)
+
+			return nil, err
 		}
+
+		listener = tls.NewListener(listener, tlsConfig)
 	}
 
-	server.Logger.Info("Listening...", "address", server.listener.Addr())
+	return listener, nil
+}
+
+// getListener returns the current listener and tells if Stop was called
+func (server *FtpServer) getListener() (net.Listener, bool) {
+	server.listenerMu.Lock()
+	defer server.listenerMu.Unlock()
 
-	return err
+	return server.listener, server.stopped
 }
 
 // Serve accepts and processes any new incoming client
@@ -181,46 +569,131 @@ func (server *FtpServer) Serve() error {
 	var tempDelay time.Duration // how long to sleep on accept failure
 
 	for {
-		connection, err := server.listener.Accept()
+		listener, _ := server.getListener()
+		connection, err := listener.Accept()
 
 		if err != nil {
-			if errOp, ok := err.(*net.OpError); ok {
-				// This means we just closed the connection and it's OK
-				if errOp.Err.Error() == "use of closed network connection" {
-					server.listener = nil
+			// the temporary errors (like EMFILE) and the listener failures are retried with an exponential backoff
+			if tempDelay == 0 {
+				tempDelay = 5 * time.Millisecond
+			} else {
+				tempDelay *= 2
+			}
 
-					return nil
-				}
+			if max := 1 * time.Second; tempDelay > max {
+				tempDelay = max
 			}
 
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
-				if tempDelay == 0 {
-					tempDelay = 5 * time.Millisecond
-				} else {
-					tempDelay *= 2
-				}
-
-				if max := 1 * time.Second; tempDelay > max {
-					tempDelay = max
-				}
-
 				server.Logger.Warn(
-					"accept error", err,
-					"retry delay", tempDelay)
+					"Listener accept error",
+					"err", err,
+					"retryDelay", tempDelay)
 				time.Sleep(tempDelay)
 
 				continue
 			}
 
-			server.Logger.Error("Listener accept error", "err", err)
+			if recreated, errServe := server.handleListenerFailure(listener, err, tempDelay); !recreated {
+				return errServe
+			}
 
-			return err
+			continue
+		}
+
+		tempDelay = 0
+
+		if server.IsAcceptPaused() {
+			server.refuseConnection(connection)
+
+			continue
 		}
 
 		server.clientArrival(connection)
 	}
 }
 
+// handleListenerFailure re-creates a failed listener if possible. Otherwise, it returns the error Serve
+// shall return, nil if the listener was simply closed by Stop.
+func (server *FtpServer) handleListenerFailure(listener net.Listener, err error, delay time.Duration) (bool, error) {
+	closed := false
+	if errOp, ok := err.(*net.OpError); ok {
+		// This means we just closed the connection and it's OK
+		closed = errOp.Err.Error() == "use of closed network connection"
+	}
+
+	_, stopped := server.getListener()
+	recreatable := server.settings != nil && server.settings.Listener == nil &&
+		server.settings.ListenerRecreateAttempts > 0
+
+	if stopped || (closed && !recreatable) {
+		server.listenerMu.Lock()
+		server.listener = nil
+		server.listenerMu.Unlock()
+
+		return false, nil
+	}
+
+	server.Logger.Error("Listener accept error", "err", err)
+
+	if !recreatable {
+		return false, err
+	}
+
+	address := listener.Addr().String()
+
+	for attempt := 1; attempt <= server.settings.ListenerRecreateAttempts; attempt++ {
+		time.Sleep(delay)
+
+		newListener, errListen := server.createListener(address)
+		if errListen == nil {
+			errListen = server.replaceListener(newListener)
+		}
+
+		if monitor, ok := server.driver.(MainDriverExtensionListenerMonitor); ok {
+			monitor.ListenerRecreated(err, attempt, errListen)
+		}
+
+		if errListen == nil {
+			server.Logger.Info("Listener re-created", "address", address, "attempt", attempt)
+
+			return true, nil
+		}
+
+		if errors.Is(errListen, ErrNotListening) {
+			return false, nil
+		}
+
+		if delay *= 2; delay > time.Second {
+			delay = time.Second
+		}
+	}
+
+	return false, err
+}
+
+// replaceListener installs a re-created listener, unless the server was stopped in the meantime
+func (server *FtpServer) replaceListener(listener net.Listener) error {
+	server.listenerMu.Lock()
+	defer server.listenerMu.Unlock()
+
+	if server.stopped {
+		if err := listener.Close(); err != nil {
+			server.Logger.Warn("Could not close listener", "err", err)
+		}
+
+		server.listener = nil
+
+		return ErrNotListening
+	}
+
+	_ = server.listener.Close() // it already failed, it may still hold the port
+
+	server.listener = listener
+
+	return nil
+}
+
 // ListenAndServe simply chains the Listen and Serve method calls
 func (server *FtpServer) ListenAndServe() error {
 	if err := server.Listen(); err != nil {
@@ -242,8 +715,8 @@ func NewFtpServer(driver MainDriver) *FtpServer {
 
 // Addr shows the listening address
 func (server *FtpServer) Addr() string {
-	if server.listener != nil {
-		return server.listener.Addr().String()
+	if listener, _ := server.getListener(); listener != nil {
+		return listener.Addr().String()
 	}
 
 	return ""
@@ -251,11 +724,16 @@ func (server *FtpServer) Addr() string {
 
 // Stop closes the listener
 func (server *FtpServer) Stop() error {
-	if server.listener == nil {
+	server.listenerMu.Lock()
+	listener := server.listener
+	server.stopped = true
+	server.listenerMu.Unlock()
+
+	if listener == nil {
 		return ErrNotListening
 	}
 
-	err := server.listener.Close()
+	err := listener.Close()
 	if err != nil {
 		server.Logger.Warn(
 			"Could not close listener",
@@ -272,12 +750,13 @@ func (server *FtpServer) clientArrival(conn net.Conn) {
 	id := server.clientCounter
 
 	c := server.newClientHandler(conn, id, server.settings.DefaultTransferType)
-	go c.HandleCommands()
-
 	c.logger.Info("Client connected", "clientIp", conn.RemoteAddr())
+
+	// the session logger is annotated by HandleCommands (see MainDriverExtensionGeoLocator)
+	go c.HandleCommands()
 }
 
 // clientDeparture
 func (server *FtpServer) clientDeparture(c *clientHandler) {
-	c.logger.Info("Client disconnected", "clientIp", c.conn.RemoteAddr())
+	c.logger.Info("Client disconnected", "clientIp", c.conn.RemoteAddr(), "reason", c.GetCloseReason().String())
 }
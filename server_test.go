@@ -1,13 +1,18 @@
 package ftpserver
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/secsy/goftp"
 	"github.com/stretchr/testify/require"
 
 	"github.com/fclairamb/ftpserverlib/log"
@@ -93,6 +98,184 @@ func TestListenerAcceptErrors(t *testing.T) {
 	require.EqualError(t, err, errListenerAccept.Error())
 }
 
+func TestListenerRecreation(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			ListenerRecreateAttempts: 3,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	addr := s.Addr()
+
+	// the listener dies
+	listener, _ := s.getListener()
+	require.NoError(t, listener.Close())
+
+	require.Eventually(t, func() bool {
+		driver.listenerMu.Lock()
+		defer driver.listenerMu.Unlock()
+
+		return len(driver.listenerRecreations) == 1 && driver.listenerRecreations[0] == nil
+	}, 2*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, addr, s.Addr())
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+}
+
+func TestPauseAccept(t *testing.T) {
+	s := NewTestServer(t, true)
+	require.True(t, s.Accepting())
+
+	c, err := goftp.DialConfig(goftp.Config{User: authUser, Password: authPass}, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+
+	banner := func() string {
+		conn, errDial := net.DialTimeout("tcp", s.Addr(), 5*time.Second)
+		require.NoError(t, errDial)
+
+		defer func() { require.NoError(t, conn.Close()) }()
+
+		line, errRead := textproto.NewReader(bufio.NewReader(conn)).ReadLine()
+		require.NoError(t, errRead)
+
+		return line
+	}
+
+	s.PauseAccept()
+	require.True(t, s.IsAcceptPaused())
+	require.False(t, s.Accepting())
+	require.Equal(t, "421 Service not available, the server is under maintenance", banner())
+
+	// the connected clients keep their sessions
+	_, err = c.ReadDir("/")
+	require.NoError(t, err)
+
+	s.ResumeAccept()
+	require.True(t, s.Accepting())
+	require.Equal(t, "220 TEST Server", banner())
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "ftpserver-unix")
+	require.NoError(t, err)
+
+	// the servers are stopped before
+	t.Cleanup(func() { require.NoError(t, os.RemoveAll(dir)) })
+
+	for _, disablePassive := range []bool{false, true} {
+		socketPath := filepath.Join(dir, fmt.Sprintf("ftp-%v.sock", disablePassive))
+		driver := &TestServerDriver{
+			Debug: true,
+			Settings: &Settings{
+				ListenAddr:               unixListenPrefix + socketPath,
+				PublicHost:               "127.0.0.1",
+				DisableUnixSocketPassive: disablePassive,
+			},
+		}
+		s := newTestServerWithDriver(t, driver)
+		require.Equal(t, socketPath, s.Addr())
+
+		conn, err := net.Dial("unix", socketPath)
+		require.NoError(t, err)
+
+		tc := textproto.NewConn(conn)
+
+		command := func(expectedCode int, format string, args ...interface{}) string {
+			if format != "" {
+				_, err = tc.Cmd(format, args...)
+				require.NoError(t, err)
+			}
+
+			_, message, err := tc.ReadResponse(expectedCode)
+			require.NoError(t, err, message)
+
+			return message
+		}
+
+		command(StatusServiceReady, "")
+		command(StatusUserOK, "USER %s", authUser)
+		command(StatusUserLoggedIn, "PASS %s", authPass)
+		command(StatusPathCreated, "PWD")
+
+		if disablePassive {
+			command(StatusCommandNotImplemented, "PASV")
+		} else {
+			require.Contains(t, command(StatusEnteringPASV, "PASV"), "(127,0,0,1,")
+		}
+
+		require.NoError(t, tc.Close())
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	require.NoError(t, (&Settings{}).Validate())
+	require.NoError(t, (&Settings{IdleTimeout: -1}).Validate())
+	require.NoError(t, (&Settings{
+		PassivePortMapping: &PortMapping{ExposedStart: 30000, ListenedStart: 50000, NbPorts: 100},
+		PublicHost:         "192.0.2.1",
+	}).Validate())
+
+	for _, tc := range []struct {
+		settings *Settings
+		problem  string
+	}{
+		{&Settings{PassiveTransferPortRange: &PortRange{Start: 3000, End: 2000}}, "range 3000-2000 is empty"},
+		{&Settings{PassiveTransferPortRange: &PortRange{Start: 0, End: 70000}}, "isn't within 1-65535"},
+		{&Settings{PassivePortMapping: &PortMapping{ExposedStart: 1, ListenedStart: 1, NbPorts: 10}}, "requires PublicHost"},
+		{&Settings{PublicHost: "ftp.example.com"}, "isn't an IP address"},
+		{&Settings{DataConnectionAllowList: []string{"nope"}}, "invalid IP"},
+		{&Settings{PassiveIPRules: []PassiveIPRule{{Network: "10.0.0.0/33", IP: "10.0.0.1"}}}, "passive IP rule"},
+		{&Settings{PassiveIPRules: []PassiveIPRule{{Network: "10.0.0.0/8", IP: "::1"}}}, "invalid IPv4 \"::1\""},
+		{&Settings{IdleTimeout: 10, IdleWarning: 10}, "IdleWarning must be shorter than IdleTimeout"},
+		{&Settings{TransferQuota: 1000}, "a TransferQuota requires a TransferAccounting"},
+		{&Settings{MaxSessionDuration: -1}, "MaxSessionDuration can't be negative"},
+		{&Settings{TransferBufferSize: 16}, "TransferBufferSize must be larger than 17 bytes"},
+	} {
+		err := tc.settings.Validate()
+		require.ErrorIs(t, err, ErrInvalidSettings)
+		require.Contains(t, err.Error(), tc.problem)
+	}
+
+	// all the problems are reported at once
+	err := (&Settings{PublicHost: "ftp.example.com", ConnectionTimeout: -1}).Validate()
+	require.EqualError(t, err,
+		`invalid settings: ConnectionTimeout can't be negative; PublicHost "ftp.example.com" isn't an IP address`)
+}
+
+func TestListenInvalidSettings(t *testing.T) {
+	server := NewFtpServer(&TestServerDriver{
+		Settings: &Settings{
+			ListenAddr:  "127.0.0.1:0",
+			TLSRequired: MandatoryEncryption,
+		},
+	})
+
+	err := server.Listen()
+	require.ErrorIs(t, err, ErrInvalidSettings)
+	require.Contains(t, err.Error(), "TLS is required")
+	require.Equal(t, "", server.Addr())
+}
+
 func TestPortCommandFormatOK(t *testing.T) {
 	net, err := parsePORTAddr("127,0,0,1,239,163")
 	require.NoError(t, err, "Problem parsing")
@@ -134,3 +317,24 @@ func TestQuoteDoubling(t *testing.T) {
 		})
 	}
 }
+
+func TestInvalidDataConnectionAllowList(t *testing.T) {
+	for _, entry := range []string{"not an IP", "10.0.0.1/33"} {
+		driver := &TestServerDriver{
+			Settings: &Settings{
+				ListenAddr:              "127.0.0.1:0",
+				DataConnectionAllowList: []string{entry},
+			},
+		}
+		s := NewFtpServer(driver)
+		require.Error(t, s.Listen(), entry)
+	}
+
+	ipNets, err := parseIPNets([]string{"127.0.0.1", "::1", "192.168.0.0/16"})
+	require.NoError(t, err)
+	require.Len(t, ipNets, 3)
+	require.True(t, ipNets[0].Contains(net.ParseIP("127.0.0.1")))
+	require.False(t, ipNets[0].Contains(net.ParseIP("127.0.0.2")))
+	require.True(t, ipNets[1].Contains(net.ParseIP("::1")))
+	require.True(t, ipNets[2].Contains(net.ParseIP("192.168.20.1")))
+}
@@ -0,0 +1,303 @@
+package ftpserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// newSessionID generates a random ID, unique across all the server instances
+func newSessionID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// the system random generator is broken, there is nothing sensible to do
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// SessionID returns the unique ID of the session
+func (c *clientHandler) SessionID() string {
+	return c.sessionID
+}
+
+// acceptSession checks the concurrency limits of the just authenticated user and publishes the session.
+// It replies and disconnects the client if the session is refused.
+func (c *clientHandler) acceptSession() bool {
+	if !c.checkAccessSchedule() {
+		c.logger.Info("Login refused outside of the access schedule", "user", c.user)
+		c.refuseSession(StatusNotLoggedIn, "Access isn't allowed at this time")
+
+		return false
+	}
+
+	if duration := c.getMaxSessionDuration(); duration > 0 {
+		c.sessionEnd = time.Now().Add(duration)
+	}
+
+	replaced, ok := c.checkDuplicateSession()
+	if !ok {
+		return false
+	}
+
+	// the previous session of the user is only taken over once the new one is accepted
+	if !c.checkSessionLimits(replaced != nil) {
+		c.server.restoreSession(replaced)
+
+		return false
+	}
+
+	if replaced != nil {
+		c.logger.Info("Taking over the previous session of the user", "user", c.user,
+			"previousSessionId", replaced.sessionID)
+		replaced.takeOver()
+	}
+
+	if _, ok = c.server.driver.(MainDriverExtensionSessionStore); !ok {
+		return true
+	}
+
+	c.sessionMu.Lock()
+	c.sessionPublished = true
+	c.sessionMu.Unlock()
+
+	c.publishSession(nil)
+
+	return true
+}
+
+// checkSessionLimits applies the concurrency limiter and MaxSessionsPerUser to the session, replacing telling
+// if it replaces another one of the user. It replies and disconnects the client if the session is refused.
+func (c *clientHandler) checkSessionLimits(replacing bool) bool {
+	if limiter, isLimiter := c.server.driver.(MainDriverExtensionConcurrencyLimiter); isLimiter {
+		release, err := limiter.AcquireLogin(c, c.user)
+		if err != nil {
+			c.logger.Info("Login refused by the concurrency limiter", "user", c.user, "err", err)
+			c.refuseSession(getErrorCode(err, StatusServiceNotAvailable), "Could not log in: "+err.Error())
+
+			return false
+		}
+
+		c.loginRelease = release
+	}
+
+	store, ok := c.server.driver.(MainDriverExtensionSessionStore)
+	maxSessions := c.server.settings.MaxSessionsPerUser
+
+	if !ok || maxSessions <= 0 {
+		return true
+	}
+
+	count, err := store.CountUserSessions(c.user)
+
+	// the session taken over is still published until it is closed
+	if replacing {
+		count--
+	}
+
+	switch {
+	case err != nil:
+		c.logger.Warn("Could not count the user sessions, the limit isn't enforced", "user", c.user, "err", err)
+	case count >= maxSessions:
+		c.logger.Info("Too many sessions for the user", "user", c.user, "sessions", count)
+		c.refuseSession(StatusServiceNotAvailable, "Too many sessions for this user")
+
+		return false
+	}
+
+	return true
+}
+
+// refuseSession logs out and disconnects a just authenticated client
+func (c *clientHandler) refuseSession(code int, message string) {
+	c.logout()
+	c.writeMessage(code, message)
+	c.disconnect(CloseReasonRefused)
+}
+
+// acquireTransfer gets a transfer slot from the concurrency limiter, the returned function releases it
+// and can be called several times
+func (c *clientHandler) acquireTransfer() (func(), error) {
+	limiter, ok := c.server.driver.(MainDriverExtensionConcurrencyLimiter)
+	if !ok {
+		return func() {}, nil
+	}
+
+	release, err := limiter.AcquireTransfer(c, c.user)
+	if err != nil {
+		return nil, err
+	}
+
+	if release == nil {
+		return func() {}, nil
+	}
+
+	var once sync.Once
+
+	return func() { once.Do(release) }, nil
+}
+
+// publishSession publishes the state of a logged in session, transfer is nil if there is no transfer.
+// The lock is held during the call so that a transfer ending late can't publish an unpublished session.
+func (c *clientHandler) publishSession(transfer *SessionTransfer) {
+	store, ok := c.server.driver.(MainDriverExtensionSessionStore)
+	if !ok {
+		return
+	}
+
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if !c.sessionPublished {
+		return
+	}
+
+	state := &SessionState{
+		SessionID:  c.sessionID,
+		User:       c.user,
+		RemoteAddr: c.RemoteAddr().String(),
+		StartTime:  c.connectedAt,
+		Location:   c.GetGeoLocation(),
+		Transfer:   transfer,
+	}
+
+	if err := store.PublishSession(state); err != nil {
+		c.logger.Warn("Could not publish the session", "err", err)
+	}
+}
+
+// publishTransfer publishes the start of a transfer
+func (c *clientHandler) publishTransfer(command, path string) {
+	c.publishSession(&SessionTransfer{
+		Command:   command,
+		Path:      path,
+		StartTime: time.Now().UTC(),
+	})
+}
+
+// releaseLogin gives back the login slot of the concurrency limiter when the session ends
+func (c *clientHandler) releaseLogin() {
+	if c.loginRelease != nil {
+		c.loginRelease()
+		c.loginRelease = nil
+	}
+}
+
+// unpublishSession removes the session from the store when it ends
+func (c *clientHandler) unpublishSession() {
+	store, ok := c.server.driver.(MainDriverExtensionSessionStore)
+	if !ok {
+		return
+	}
+
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+
+	if !c.sessionPublished {
+		return
+	}
+
+	c.sessionPublished = false
+
+	if err := store.UnpublishSession(c.sessionID); err != nil {
+		c.logger.Warn("Could not unpublish the session", "err", err)
+	}
+}
+
+// SetMaxSessionDuration changes the time the user can stay logged in, see MaxSessionDuration
+func (c *clientHandler) SetMaxSessionDuration(duration time.Duration) {
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.maxSessionDuration = duration
+}
+
+func (c *clientHandler) getMaxSessionDuration() time.Duration {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.maxSessionDuration
+}
+
+// loginDeadline returns the time at which the login ends, zero if it doesn't
+func (c *clientHandler) loginDeadline() time.Time {
+	if c.sessionEnd.IsZero() || (!c.accessEnd.IsZero() && c.accessEnd.Before(c.sessionEnd)) {
+		return c.accessEnd
+	}
+
+	return c.sessionEnd
+}
+
+// isLoginDeadline returns true if a read error is the end of the login
+func (c *clientHandler) isLoginDeadline(err error) bool {
+	var netErr net.Error
+
+	deadline := c.loginDeadline()
+
+	return errors.As(err, &netErr) && netErr.Timeout() && !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// handleLoginDeadline ends the login of the session at its maximum duration or at the end of its access
+// window, once the current transfer is over. It returns false if the session is closed.
+func (c *clientHandler) handleLoginDeadline() bool {
+	if c.sessionEnd.IsZero() || time.Now().Before(c.sessionEnd) {
+		if c.extendAccess() {
+			return true
+		}
+
+		c.logger.Info("Access window over, closing the session", "user", c.user)
+		c.closeSession(CloseReasonSessionExpired, "Your access time is over, closing control connection")
+
+		return false
+	}
+
+	c.logger.Info("Session expired", "user", c.user)
+
+	if c.server.settings.SessionExpiry != SessionExpiryRelogin {
+		c.closeSession(CloseReasonSessionExpired, "Session expired, closing control connection")
+
+		return false
+	}
+
+	c.transferWg.Wait()
+	c.endLogin()
+	c.setReplyNotice("Session expired, please log in again")
+
+	return true
+}
+
+// closeSession sends a last 421 reply, HandleCommands then closes the connection
+func (c *clientHandler) closeSession(reason CloseReason, message string) {
+	c.setCloseReason(reason)
+	c.transferWg.Wait()
+
+	// the deadline applies to the writes too
+	if err := c.conn.SetDeadline(time.Now().Add(time.Minute)); err != nil {
+		c.logger.Error("Network error", "err", err)
+	}
+
+	c.writeMessage(StatusServiceNotAvailable, message)
+}
+
+// endLogin logs the user out, the client stays connected and can log in again
+func (c *clientHandler) endLogin() {
+	c.unregisterSession()
+	c.unpublishSession()
+	c.releaseLogin()
+	c.logout()
+	c.SetPath("/")
+	c.SetAccessSchedule(nil)
+	c.SetMaxSessionDuration(time.Duration(c.server.settings.MaxSessionDuration) * time.Second)
+
+	c.user = ""
+	c.setState(StateConnected)
+	c.ctxRest = 0
+	c.clearListingCache()
+	c.accessEnd = time.Time{}
+	c.accessWarned = false
+	c.sessionEnd = time.Time{}
+}
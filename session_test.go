@@ -0,0 +1,304 @@
+package ftpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStore(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			MaxSessionsPerUser: 1,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	// closed by the test to end the session
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	require.NoError(t, c.Store("file", bytes.NewReader(make([]byte, 10))))
+
+	sessions, transfers := driver.getSessions()
+	require.Len(t, sessions, 1)
+	require.Equal(t, []string{"STOR /file"}, transfers)
+
+	driver.clientMU.Lock()
+	sessionID := driver.Clients[0].SessionID()
+	driver.clientMU.Unlock()
+
+	require.Len(t, sessionID, 32)
+	require.Equal(t, authUser, sessions[sessionID].User)
+	require.Nil(t, sessions[sessionID].Transfer)
+
+	// the user already has a session
+	c2, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c2.Close()) }()
+
+	_, err = c2.OpenRawConn()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Too many sessions for this user")
+
+	require.NoError(t, c.Close())
+
+	require.Eventually(t, func() bool {
+		sessions, _ := driver.getSessions()
+
+		return len(sessions) == 0
+	}, 1*time.Second, 50*time.Millisecond)
+}
+
+func TestConcurrencyLimiterLogins(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:     true,
+		maxLogins: 1,
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err)
+
+	_, err = c.OpenRawConn()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Could not log in: too many logins")
+
+	// the slot is released at the end of the session
+	require.NoError(t, raw.Close())
+
+	require.Eventually(t, func() bool {
+		raw, err := c.OpenRawConn()
+		if err != nil {
+			return false
+		}
+
+		return raw.Close() == nil
+	}, 1*time.Second, 50*time.Millisecond)
+}
+
+func TestConcurrencyLimiterTransfers(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:        true,
+		maxTransfers: 1,
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.NoError(t, c.Store("delay-io.bin", bytes.NewReader(make([]byte, 10))))
+
+	raw1, err := c.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw1.Close()) }()
+
+	raw2, err := c.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw2.Close()) }()
+
+	dcGetter, err := raw1.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw1.SendCommand("RETR delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	_, err = raw2.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw2.SendCommand("RETR delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionNotTaken, rc, response)
+	require.Equal(t, "Could not start transfer: too many transfers", response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw1.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	// the slot was released
+	dcGetter, err = raw2.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw2.SendCommand("RETR delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err = dcGetter()
+	require.NoError(t, err)
+
+	_, err = ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw2.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{MaxSessionDuration: 1},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc, response)
+	require.Contains(t, response, "Session expired")
+}
+
+func TestMaxSessionDurationWithoutIdleTimeout(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{IdleTimeout: -1, MaxSessionDuration: 1},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc, response)
+	require.Contains(t, response, "Session expired")
+}
+
+// relogin logs in again on a raw connection
+func relogin(t *testing.T, raw goftp.RawConn) {
+	rc, response, err := raw.SendCommand("USER " + authUser)
+	require.NoError(t, err)
+	require.Equal(t, StatusUserOK, rc, response)
+
+	rc, response, err = raw.SendCommand("PASS " + authPass)
+	require.NoError(t, err)
+	require.Equal(t, StatusUserLoggedIn, rc, response)
+}
+
+func TestSessionExpiryRelogin(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{MaxSessionDuration: 1, SessionExpiry: SessionExpiryRelogin},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	time.Sleep(1500 * time.Millisecond)
+
+	rc, response, err := raw.SendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotLoggedIn, rc, response)
+	require.Contains(t, response, "Session expired")
+
+	relogin(t, raw)
+
+	rc, response, err = raw.SendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+}
+
+func TestREIN(t *testing.T) {
+	s := NewTestServer(t, true)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("CWD /")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileOK, rc, response)
+
+	rc, response, err = raw.SendCommand("REIN")
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceReady, rc, response)
+
+	rc, response, err = raw.SendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotLoggedIn, rc, response)
+
+	relogin(t, raw)
+
+	rc, response, err = raw.SendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+}
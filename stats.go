@@ -0,0 +1,149 @@
+package ftpserver
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Transfer statistics, sent in the 226 reply of the file transfers and in the QUIT reply with
+// TransferCompleteTemplate and QuitTemplate. The templates use the fields and the methods of TransferStats
+// and SessionStats, for example:
+//
+//	Transfer complete. {{.Size}} in {{.Seconds}}, {{.Rate}}
+//	Goodbye. {{.FilesUploaded}} files uploaded ({{.UploadedSize}}), {{.FilesDownloaded}} downloaded ({{.DownloadedSize}})
+
+// TransferStats are the statistics of a file transfer
+type TransferStats struct {
+	Upload   bool          // The file was uploaded (STOR, APPE)
+	Bytes    int64         // Transferred bytes
+	Duration time.Duration // Duration of the data copy
+	// Content type detected from the first bytes of an upload, see ContentTypePolicy and FileTransferContentType
+	ContentType string
+}
+
+// Size returns the transferred size, like "14.2 MB"
+func (s TransferStats) Size() string {
+	return formatSize(s.Bytes)
+}
+
+// Seconds returns the duration of the transfer, like "3.1 s"
+func (s TransferStats) Seconds() string {
+	return fmt.Sprintf("%.1f s", s.Duration.Seconds())
+}
+
+// Rate returns the transfer rate, like "4.6 MB/s"
+func (s TransferStats) Rate() string {
+	seconds := s.Duration.Seconds()
+	if seconds <= 0 {
+		return formatSize(s.Bytes) + "/s"
+	}
+
+	return formatSize(int64(float64(s.Bytes)/seconds)) + "/s"
+}
+
+// SessionStats are the statistics of the transfers of a session
+type SessionStats struct {
+	FilesUploaded   int           // Files uploaded completely
+	FilesDownloaded int           // Files downloaded completely
+	BytesUploaded   int64         // Bytes uploaded, including the failed transfers
+	BytesDownloaded int64         // Bytes downloaded, including the failed transfers
+	Duration        time.Duration // Duration of the session
+}
+
+// UploadedSize returns the uploaded size, like "14.2 MB"
+func (s SessionStats) UploadedSize() string {
+	return formatSize(s.BytesUploaded)
+}
+
+// DownloadedSize returns the downloaded size, like "14.2 MB"
+func (s SessionStats) DownloadedSize() string {
+	return formatSize(s.BytesDownloaded)
+}
+
+// formatSize formats a number of bytes with the binary multiples
+func formatSize(bytes int64) string {
+	const unit = 1024
+
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value := float64(bytes) / unit
+	units := []string{"KB", "MB", "GB", "TB"}
+
+	i := 0
+	for ; value >= unit && i < len(units)-1; i++ {
+		value /= unit
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+// parseStatsTemplate parses a template of the settings, nil if it is empty
+func parseStatsTemplate(name, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	return template.New(name).Parse(text)
+}
+
+// executeStatsTemplate formats the statistics with a template, it returns defaultMessage if the template
+// is nil or fails
+func (c *clientHandler) executeStatsTemplate(tmpl *template.Template, stats interface{},
+	defaultMessage string) string {
+	if tmpl == nil {
+		return defaultMessage
+	}
+
+	var message strings.Builder
+
+	if err := tmpl.Execute(&message, stats); err != nil {
+		c.logger.Warn("Could not format the statistics", "template", tmpl.Name(), "err", err)
+
+		return defaultMessage
+	}
+
+	return message.String()
+}
+
+// countTransfer adds a file transfer to the statistics of the session
+func (c *clientHandler) countTransfer(upload bool, bytes int64, complete bool) {
+	c.replyMu.Lock()
+	if cmd := c.transferCommand; cmd != nil {
+		cmd.bytes += bytes
+	}
+	c.replyMu.Unlock()
+
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	if upload {
+		c.stats.BytesUploaded += bytes
+	} else {
+		c.stats.BytesDownloaded += bytes
+	}
+
+	if !complete {
+		return
+	}
+
+	if upload {
+		c.stats.FilesUploaded++
+	} else {
+		c.stats.FilesDownloaded++
+	}
+}
+
+// getSessionStats returns the statistics of the transfers of the session
+func (c *clientHandler) getSessionStats() SessionStats {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	stats := c.stats
+	stats.Duration = time.Since(c.connectedAt)
+
+	return stats
+}
@@ -0,0 +1,77 @@
+package ftpserver
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatSize(t *testing.T) {
+	require.Equal(t, "0 B", formatSize(0))
+	require.Equal(t, "1023 B", formatSize(1023))
+	require.Equal(t, "1.0 KB", formatSize(1024))
+	require.Equal(t, "14.2 MB", formatSize(14890000))
+	require.Equal(t, "2048.0 TB", formatSize(2048*1024*1024*1024*1024))
+
+	stats := TransferStats{Bytes: 14890000, Duration: 3100 * time.Millisecond}
+	require.Equal(t, "3.1 s", stats.Seconds())
+	require.Equal(t, "4.6 MB/s", stats.Rate())
+}
+
+func TestTransferStatsTemplates(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			TransferCompleteTemplate: "Transfer complete. {{.Size}} in {{.Seconds}}, {{.Rate}}",
+			QuitTemplate: "Goodbye.\n{{.FilesUploaded}} files uploaded ({{.UploadedSize}})\n" +
+				"{{.FilesDownloaded}} files downloaded ({{.DownloadedSize}})",
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("STOR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dc.Write(make([]byte, 2048))
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+	require.Regexp(t, `^Transfer complete\. 2\.0 KB in \d+\.\d s, \d+\.\d [KMG]?B/s$`, response)
+
+	rc, response, err = raw.SendCommand("QUIT")
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingControlConn, rc)
+	require.Equal(t, "Goodbye.\n1 files uploaded (2.0 KB)\n0 files downloaded (0 B)", response)
+
+	require.NoError(t, raw.Close())
+}
+
+func TestStatsTemplatesValidation(t *testing.T) {
+	err := (&Settings{QuitTemplate: "{{.Unclosed"}).Validate()
+	require.True(t, errors.Is(err, ErrInvalidSettings), err)
+	require.Contains(t, err.Error(), "invalid QuitTemplate")
+}
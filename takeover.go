@@ -0,0 +1,140 @@
+package ftpserver
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DuplicateSessionPolicy is the enumerable that represents what happens when a user logs in while already
+// having a session on the server
+type DuplicateSessionPolicy int
+
+// Duplicate session policies
+const (
+	// DuplicateSessionAllow lets the users have several sessions
+	DuplicateSessionAllow DuplicateSessionPolicy = iota
+	// DuplicateSessionReject refuses the new login with a 421 reply
+	DuplicateSessionReject
+	// DuplicateSessionTakeover closes the oldest session of the user with a 421 reply, once its current
+	// transfer is over. It suits the clients reconnecting without closing their previous connection.
+	DuplicateSessionTakeover
+)
+
+// takeoverMessage is the last reply of a session replaced by a new login of its user
+const takeoverMessage = "Your account logged in from another session, closing control connection"
+
+// getDuplicateSessionPolicy returns the policy of the user
+func (c *clientHandler) getDuplicateSessionPolicy() DuplicateSessionPolicy {
+	if provider, ok := c.driver.(ClientDriverExtensionDuplicateSessions); ok {
+		return provider.GetDuplicateSessionPolicy()
+	}
+
+	return c.server.settings.DuplicateSessionPolicy
+}
+
+// checkDuplicateSession applies the duplicate session policy to a just authenticated user and registers the
+// session. It returns the session to take over once the login is accepted, if any, or replies, disconnects
+// the client and returns false if the session is refused.
+func (c *clientHandler) checkDuplicateSession() (*clientHandler, bool) {
+	policy := c.getDuplicateSessionPolicy()
+
+	replaced, ok := c.server.registerSession(c, policy)
+	if !ok {
+		c.logger.Info("Login refused, the user already has a session", "user", c.user)
+		c.refuseSession(StatusServiceNotAvailable, "This user is already logged in")
+
+		return nil, false
+	}
+
+	return replaced, true
+}
+
+// registerSession adds a session to the sessions of its user, unless the policy refuses it. It returns the
+// session to take over, if any.
+func (server *FtpServer) registerSession(c *clientHandler, policy DuplicateSessionPolicy) (*clientHandler, bool) {
+	server.userSessionsMu.Lock()
+	defer server.userSessionsMu.Unlock()
+
+	var replaced *clientHandler
+
+	sessions := server.userSessions[c.user]
+
+	if len(sessions) > 0 {
+		switch policy {
+		case DuplicateSessionReject:
+			return nil, false
+		case DuplicateSessionTakeover:
+			replaced, sessions = sessions[0], sessions[1:]
+		case DuplicateSessionAllow:
+		}
+	}
+
+	if server.userSessions == nil {
+		server.userSessions = make(map[string][]*clientHandler)
+	}
+
+	server.userSessions[c.user] = append(sessions, c)
+
+	return replaced, true
+}
+
+// restoreSession gives back its place to a session that was to be taken over by a refused login
+func (server *FtpServer) restoreSession(c *clientHandler) {
+	if c == nil {
+		return
+	}
+
+	server.userSessionsMu.Lock()
+	defer server.userSessionsMu.Unlock()
+
+	// a session closed meanwhile already unregistered itself
+	if c.GetLifecycleState() == StateClosed {
+		return
+	}
+
+	if server.userSessions == nil {
+		server.userSessions = make(map[string][]*clientHandler)
+	}
+
+	server.userSessions[c.user] = append([]*clientHandler{c}, server.userSessions[c.user]...)
+}
+
+// unregisterSession removes the session from the sessions of its user
+func (c *clientHandler) unregisterSession() {
+	server := c.server
+
+	server.userSessionsMu.Lock()
+	defer server.userSessionsMu.Unlock()
+
+	sessions := server.userSessions[c.user]
+
+	for i, session := range sessions {
+		if session == c {
+			sessions = append(sessions[:i:i], sessions[i+1:]...)
+
+			break
+		}
+	}
+
+	if len(sessions) == 0 {
+		delete(server.userSessions, c.user)
+	} else {
+		server.userSessions[c.user] = sessions
+	}
+}
+
+// takeOver ends a session replaced by a new login of its user: the command reader is woken up by an
+// expired deadline, it then closes the session. It is called from the new session, the deadline is set on
+// netConn as conn changes with AUTH TLS and CCC.
+func (c *clientHandler) takeOver() {
+	atomic.StoreInt32(&c.takenOver, 1)
+
+	if err := c.netConn.SetReadDeadline(time.Now()); err != nil {
+		c.logger.Debug("Could not interrupt the command read", "err", err)
+	}
+}
+
+// isTakenOver tells if a new login of the user replaced the session
+func (c *clientHandler) isTakenOver() bool {
+	return atomic.LoadInt32(&c.takenOver) != 0
+}
@@ -0,0 +1,128 @@
+package ftpserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/secsy/goftp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateSessionTakeover(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{DuplicateSessionPolicy: DuplicateSessionTakeover},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	first, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, first.Close()) }()
+
+	second, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, second.Close()) }()
+
+	// the first session is closed without having sent anything
+	rc, response, err := first.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusServiceNotAvailable, rc, response)
+	require.Equal(t, takeoverMessage, response)
+
+	rc, response, err = second.SendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+
+	// the sessions of a user are tracked until they end
+	require.Eventually(t, func() bool {
+		s.userSessionsMu.Lock()
+		defer s.userSessionsMu.Unlock()
+
+		return len(s.userSessions[authUser]) == 1
+	}, time.Second*5, time.Millisecond*50)
+}
+
+func TestDuplicateSessionTakeoverRefused(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:     true,
+		Settings:  &Settings{DuplicateSessionPolicy: DuplicateSessionTakeover},
+		maxLogins: 1,
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	first, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, first.Close()) }()
+
+	// the login refused by the concurrency limiter doesn't take over the first session
+	_, err = c.OpenRawConn()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), errTooManyLogins.Error())
+
+	rc, response, err := first.SendCommand("PWD")
+	require.NoError(t, err)
+	require.Equal(t, StatusPathCreated, rc, response)
+
+	require.Eventually(t, func() bool {
+		s.userSessionsMu.Lock()
+		defer s.userSessionsMu.Unlock()
+
+		return len(s.userSessions[authUser]) == 1
+	}, time.Second*5, time.Millisecond*50)
+}
+
+func TestDuplicateSessionReject(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{DuplicateSessionPolicy: DuplicateSessionReject},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	first, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	_, err = c.OpenRawConn()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "This user is already logged in")
+
+	// the user can log in again once the session is closed
+	require.NoError(t, first.Close())
+
+	require.Eventually(t, func() bool {
+		raw, errOpen := c.OpenRawConn()
+		if errOpen != nil {
+			return false
+		}
+
+		require.NoError(t, raw.Close())
+
+		return true
+	}, time.Second*5, time.Millisecond*50)
+}
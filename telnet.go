@@ -0,0 +1,91 @@
+package ftpserver
+
+import (
+	"io"
+)
+
+// Telnet commands (RFC 854) that can be found on the control connection
+const (
+	telnetSE   = 240 // End of subnegotiation parameters
+	telnetSB   = 250 // Start of subnegotiation
+	telnetWILL = 251
+	telnetDONT = 254
+	telnetIAC  = 255 // Interpret As Command
+)
+
+type telnetState int
+
+const (
+	telnetStateData      telnetState = iota // regular data
+	telnetStateCommand                      // IAC received
+	telnetStateOption                       // WILL, WONT, DO or DONT received, the option byte is expected
+	telnetStateSubneg                       // inside a subnegotiation
+	telnetStateSubnegIAC                    // IAC received inside a subnegotiation
+)
+
+// telnetReader strips the Telnet sequences from the control connection. Some clients send
+// IAC IP IAC DM before ABOR (RFC 959, 4.1.3), they would corrupt the command parsing otherwise.
+type telnetReader struct {
+	reader io.Reader
+	state  telnetState
+}
+
+func newTelnetReader(r io.Reader) *telnetReader {
+	return &telnetReader{reader: r}
+}
+
+func (t *telnetReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.reader.Read(p)
+		n = t.strip(p[:n])
+
+		// a read containing only Telnet sequences must not be seen as an empty read
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// strip removes the Telnet sequences in place and returns the size of the remaining data
+func (t *telnetReader) strip(data []byte) int {
+	n := 0
+
+	for _, b := range data {
+		switch t.state {
+		case telnetStateData:
+			if b == telnetIAC {
+				t.state = telnetStateCommand
+			} else {
+				data[n] = b
+				n++
+			}
+		case telnetStateCommand:
+			switch {
+			case b == telnetIAC: // escaped 255 byte
+				data[n] = b
+				n++
+				t.state = telnetStateData
+			case b == telnetSB:
+				t.state = telnetStateSubneg
+			case b >= telnetWILL && b <= telnetDONT:
+				t.state = telnetStateOption
+			default: // IP, DM, AO, AYT...
+				t.state = telnetStateData
+			}
+		case telnetStateOption:
+			t.state = telnetStateData
+		case telnetStateSubneg:
+			if b == telnetIAC {
+				t.state = telnetStateSubnegIAC
+			}
+		case telnetStateSubnegIAC:
+			if b == telnetSE {
+				t.state = telnetStateData
+			} else {
+				t.state = telnetStateSubneg
+			}
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,39 @@
+package ftpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTelnetReader(t *testing.T) {
+	tests := []struct {
+		input    []byte
+		expected []byte
+	}{
+		{[]byte("NOOP\r\n"), []byte("NOOP\r\n")},
+		// IAC IP IAC DM before ABOR
+		{[]byte("\xff\xf4\xff\xf2ABOR\r\n"), []byte("ABOR\r\n")},
+		// escaped 255 byte
+		{[]byte("STOR a\xff\xffb\r\n"), []byte("STOR a\xffb\r\n")},
+		// option negotiation
+		{[]byte("\xff\xfb\x01\xff\xfe\x03NOOP\r\n"), []byte("NOOP\r\n")},
+		// subnegotiation
+		{[]byte("\xff\xfa\x18\x00ab\xff\xff\xff\xf0NOOP\r\n"), []byte("NOOP\r\n")},
+	}
+
+	for _, test := range tests {
+		// reading one byte at a time checks that the state is kept between the reads
+		for _, reader := range []*telnetReader{
+			newTelnetReader(bytes.NewReader(test.input)),
+			newTelnetReader(iotest.OneByteReader(bytes.NewReader(test.input))),
+		} {
+			data, err := ioutil.ReadAll(reader)
+			require.NoError(t, err)
+			require.Equal(t, test.expected, data, "%q", test.input)
+		}
+	}
+}
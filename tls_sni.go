@@ -0,0 +1,38 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+)
+
+// getTLSConfig returns the TLS config of the control connections and of the default transfer ones. With
+// MainDriverExtensionTLSServerName, the config is selected during the handshake from the server name the
+// client sends (SNI), so that one server can terminate TLS for several domains. The selected config negotiates
+// its own ALPN protocols (NextProtos).
+func (server *FtpServer) getTLSConfig() (*tls.Config, error) {
+	tlsConfig, err := server.driver.GetTLSConfig()
+	if err != nil || tlsConfig == nil {
+		return tlsConfig, err
+	}
+
+	selector, ok := server.driver.(MainDriverExtensionTLSServerName)
+
+	// a config already doing its own selection is left untouched
+	if !ok || tlsConfig.GetConfigForClient != nil {
+		return tlsConfig, nil
+	}
+
+	routed := tlsConfig.Clone()
+	routed.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverConfig, errSelect := selector.GetTLSConfigForServerName(hello.ServerName)
+		if errSelect != nil {
+			server.Logger.Warn("No TLS config for the server name", "serverName", hello.ServerName, "err", errSelect)
+
+			return nil, errSelect
+		}
+
+		// nil keeps the default config
+		return serverConfig, nil
+	}
+
+	return routed, nil
+}
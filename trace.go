@@ -0,0 +1,74 @@
+package ftpserver
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// credentialCommands are the commands whose parameter is a credential that must not appear in traces or logs
+var credentialCommands = map[string]bool{"PASS": true, "ACCT": true}
+
+// SetTrace starts writing the protocol trace of the session to w, the previous trace is stopped.
+// If the writer is also an io.Closer, it is closed when the trace is stopped or when the session ends.
+// A nil writer stops the trace.
+func (c *clientHandler) SetTrace(w io.Writer) {
+	c.traceMu.Lock()
+	defer c.traceMu.Unlock()
+
+	c.stopTrace()
+
+	if w == nil {
+		return
+	}
+
+	c.trace = w
+	c.writeTrace(fmt.Sprintf("# client %d, session %s, from %s", c.id, c.sessionID, c.conn.RemoteAddr()))
+}
+
+// traceLine adds a line received from (">") or sent to ("<") the client to the trace, if any
+func (c *clientHandler) traceLine(direction, line string) {
+	c.traceMu.Lock()
+	defer c.traceMu.Unlock()
+
+	if c.trace == nil {
+		return
+	}
+
+	if direction == ">" {
+		line = maskCredentials(line)
+	}
+
+	c.writeTrace(direction + " " + line)
+}
+
+// writeTrace writes a timestamped line to the trace, it stops the trace if it can't be written.
+// It must be called with traceMu held.
+func (c *clientHandler) writeTrace(line string) {
+	if _, err := fmt.Fprintf(c.trace, "%s %s\n", time.Now().UTC().Format(time.RFC3339Nano), line); err != nil {
+		c.logger.Warn("Couldn't write the trace, stopping it", "err", err)
+		c.stopTrace()
+	}
+}
+
+// stopTrace closes the current trace, it must be called with traceMu held
+func (c *clientHandler) stopTrace() {
+	if closer, ok := c.trace.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			c.logger.Warn("Couldn't close the trace", "err", err)
+		}
+	}
+
+	c.trace = nil
+}
+
+// maskCredentials hides the credentials of a command line
+func maskCredentials(line string) string {
+	command, param := parseLine(line)
+	if param != "" && isCredentialCommand(strings.ToUpper(command), param) {
+		return command + " ****"
+	}
+
+	return line
+}
@@ -35,23 +35,17 @@ func (c *clientHandler) handlePORT(param string) error {
 		return nil
 	}
 
-	var tlsConfig *tls.Config
+	if err = c.checkDataConnectionPeer(raddr.IP, c.server.settings.ActiveConnectionsCheck); err != nil {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("%v command rejected: %v", command, err))
 
-	if c.HasTLSForTransfers() || c.server.settings.TLSRequired == ImplicitEncryption {
-		tlsConfig, err = c.server.driver.GetTLSConfig()
-		if err != nil {
-			c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Cannot get a TLS config for active connection: %v", err))
-
-			return nil
-		}
+		return nil
 	}
 
 	c.transferMu.Lock()
 
 	c.transfer = &activeTransferHandler{
-		raddr:     raddr,
-		settings:  c.server.settings,
-		tlsConfig: tlsConfig,
+		raddr:    raddr,
+		settings: c.server.settings,
 	}
 
 	c.transferMu.Unlock()
@@ -78,8 +72,11 @@ func (a *activeTransferHandler) SetInfo(info string) {
 	a.info = info
 }
 
-func (a *activeTransferHandler) Open() (net.Conn, error) {
-	timeout := time.Duration(time.Second.Nanoseconds() * int64(a.settings.ConnectionTimeout))
+func (a *activeTransferHandler) SetTLSConfig(tlsConfig *tls.Config) {
+	a.tlsConfig = tlsConfig
+}
+
+func (a *activeTransferHandler) Open(timeout time.Duration) (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: timeout}
 
 	if !a.settings.ActiveTransferPortNon20 {
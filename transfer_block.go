@@ -0,0 +1,196 @@
+package ftpserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Block mode (MODE B, RFC 959 3.4.2) framing of the transfer connections. Each block starts with a
+// descriptor byte and a 16 bits byte count. The end of the file is given by a block with the EOF
+// descriptor, and the restart markers are blocks with the restart marker descriptor: the markers the
+// server sends and accepts are decimal byte offsets, they can be given as is to the REST command.
+
+// The end of record and suspected errors descriptors don't change the way the data is written to files,
+// they are ignored.
+const (
+	blockDescriptorEOF     byte = 64 // end of file
+	blockDescriptorRestart byte = 16 // the data block is a restart marker
+
+	blockHeaderSize  = 3
+	blockMaxDataSize = 1<<16 - 1
+)
+
+var (
+	// errBlockTruncated is returned when the transfer connection is closed before the EOF block
+	errBlockTruncated = errors.New("block mode transfer closed before the end of file")
+	// errBlockMarker is returned for the restart markers that aren't printable
+	errBlockMarker = errors.New("invalid block mode restart marker")
+)
+
+// newBlockWriter creates the block mode encoder of a download. The restart markers are only sent in
+// binary type, the offsets of the ASCII transfers can't be given to REST.
+func (c *clientHandler) newBlockWriter(dst io.Writer, offset int64) *blockWriter {
+	markerInterval := c.server.settings.BlockRestartMarkerInterval
+	if c.currentTransferType == TransferTypeASCII {
+		markerInterval = 0
+	}
+
+	return newBlockWriter(dst, offset, markerInterval)
+}
+
+// replyRestartMarker acknowledges a restart marker received during an upload, the data before it is
+// written to the file. The marker to give to REST to resume the upload from there is our offset.
+func (c *clientHandler) replyRestartMarker(marker string, offset int64) {
+	c.transferMu.Lock()
+	defer c.transferMu.Unlock()
+
+	c.writeMessage(StatusRestartMarker, fmt.Sprintf("MARK %s = %d", marker, offset))
+}
+
+// blockReader decodes the blocks received on a transfer connection
+type blockReader struct {
+	src       io.Reader
+	offset    int64                             // offset in the file of the next data byte
+	onRestart func(marker string, offset int64) // called for each restart marker received
+	remaining int                               // data bytes remaining in the current block
+	last      bool                              // the current block is the last one
+	header    [blockHeaderSize]byte
+}
+
+func newBlockReader(src io.Reader, offset int64, onRestart func(marker string, offset int64)) *blockReader {
+	return &blockReader{src: src, offset: offset, onRestart: onRestart}
+}
+
+func (r *blockReader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+
+		if err := r.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.src.Read(p)
+	r.remaining -= n
+	r.offset += int64(n)
+
+	if errors.Is(err, io.EOF) {
+		err = errBlockTruncated
+	}
+
+	return n, err
+}
+
+// nextBlock reads the header of the next block, the restart markers are handled here
+func (r *blockReader) nextBlock() error {
+	if _, err := io.ReadFull(r.src, r.header[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return errBlockTruncated
+		}
+
+		return err
+	}
+
+	descriptor := r.header[0]
+	size := int(binary.BigEndian.Uint16(r.header[1:]))
+	r.last = descriptor&blockDescriptorEOF != 0
+
+	if descriptor&blockDescriptorRestart == 0 {
+		r.remaining = size
+
+		return nil
+	}
+
+	marker := make([]byte, size)
+	if _, err := io.ReadFull(r.src, marker); err != nil {
+		return errBlockTruncated
+	}
+
+	for _, b := range marker {
+		if b < ' ' || b > '~' {
+			return errBlockMarker
+		}
+	}
+
+	if r.onRestart != nil {
+		r.onRestart(string(marker), r.offset)
+	}
+
+	return nil
+}
+
+// blockWriter encodes the data sent on a transfer connection in blocks
+type blockWriter struct {
+	dst            io.Writer
+	offset         int64 // offset in the file of the next data byte
+	markerInterval int64 // bytes between two restart markers, 0 to send none
+	nextMarker     int64 // offset of the next restart marker
+	buf            []byte
+}
+
+func newBlockWriter(dst io.Writer, offset, markerInterval int64) *blockWriter {
+	return &blockWriter{
+		dst:            dst,
+		offset:         offset,
+		markerInterval: markerInterval,
+		nextMarker:     offset + markerInterval,
+	}
+}
+
+func (w *blockWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		size := len(p)
+		if size > blockMaxDataSize {
+			size = blockMaxDataSize
+		}
+
+		// the blocks are cut at the restart markers
+		if w.markerInterval > 0 && int64(size) > w.nextMarker-w.offset {
+			size = int(w.nextMarker - w.offset)
+		}
+
+		if err := w.writeBlock(0, p[:size]); err != nil {
+			return written, err
+		}
+
+		written += size
+		w.offset += int64(size)
+		p = p[size:]
+
+		if w.markerInterval > 0 && w.offset == w.nextMarker {
+			if err := w.writeBlock(blockDescriptorRestart, []byte(strconv.FormatInt(w.offset, 10))); err != nil {
+				return written, err
+			}
+
+			w.nextMarker += w.markerInterval
+		}
+	}
+
+	return written, nil
+}
+
+// Close sends the EOF block, it doesn't close the transfer connection
+func (w *blockWriter) Close() error {
+	return w.writeBlock(blockDescriptorEOF, nil)
+}
+
+func (w *blockWriter) writeBlock(descriptor byte, data []byte) error {
+	w.buf = append(w.buf[:0], descriptor, 0, 0)
+	binary.BigEndian.PutUint16(w.buf[1:], uint16(len(data)))
+	w.buf = append(w.buf, data...)
+
+	_, err := w.dst.Write(w.buf)
+
+	return err
+}
@@ -0,0 +1,142 @@
+package ftpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCodec(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+
+	var encoded bytes.Buffer
+
+	writer := newBlockWriter(&encoded, 100, 30000)
+	n, err := writer.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+	require.NoError(t, writer.Close())
+
+	var markers []string
+
+	reader := newBlockReader(bytes.NewReader(encoded.Bytes()), 100, func(marker string, offset int64) {
+		require.Equal(t, marker, strconv.FormatInt(offset, 10))
+		markers = append(markers, marker)
+	})
+	decoded, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, data, decoded)
+	require.Equal(t, []string{"30100", "60100", "90100"}, markers)
+
+	// the connection is closed before the EOF block
+	truncated := encoded.Bytes()[:encoded.Len()-blockHeaderSize]
+	_, err = ioutil.ReadAll(newBlockReader(bytes.NewReader(truncated), 0, nil))
+	require.ErrorIs(t, err, errBlockTruncated)
+
+	_, err = ioutil.ReadAll(newBlockReader(bytes.NewReader([]byte{blockDescriptorRestart, 0, 1, 0}), 0, nil))
+	require.ErrorIs(t, err, errBlockMarker)
+}
+
+func TestBlockMode(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EnableBlockMode: true, BlockRestartMarkerInterval: 4},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	for _, command := range []string{"TYPE I", "MODE B"} {
+		rc, response, err := raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusOK, rc, response)
+	}
+
+	// the server acknowledges the restart markers of the uploads
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("STOR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	writer := newBlockWriter(dc, 0, 4)
+	_, err = writer.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	require.NoError(t, dc.Close())
+
+	for _, expected := range []string{"MARK 4 = 4", "MARK 8 = 8"} {
+		rc, response, err = raw.ReadResponse()
+		require.NoError(t, err)
+		require.Equal(t, StatusRestartMarker, rc)
+		require.Equal(t, expected, response)
+	}
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	content, err := afero.ReadFile(driver.fs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, "0123456789", string(content))
+
+	// the markers of the downloads can be given to REST
+	data, markers := retrieveBlocks(t, raw, "RETR file")
+	require.Equal(t, "0123456789", data)
+	require.Equal(t, []string{"4", "8"}, markers)
+
+	rc, response, err = raw.SendCommand("REST " + markers[0])
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	data, markers = retrieveBlocks(t, raw, "RETR file")
+	require.Equal(t, "456789", data)
+	require.Equal(t, []string{"8"}, markers)
+}
+
+func retrieveBlocks(t *testing.T, raw goftp.RawConn, command string) (string, []string) {
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand(command)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	var markers []string
+
+	data, err := ioutil.ReadAll(newBlockReader(dc, 0, func(marker string, _ int64) {
+		markers = append(markers, marker)
+	}))
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	return string(data), markers
+}
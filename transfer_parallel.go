@@ -0,0 +1,352 @@
+package ftpserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Parallel transfers in extended block mode (MODE E), in the style of the GridFTP extensions (GFD.20): a RETR
+// or a STOR is spread over several passive data connections, which keeps a long fat link busy when a single
+// TCP connection is limited by its window. The client sets the number of connections with
+// "OPTS RETR Parallelism=<n>,<n>,<n>;" (the second value is used) and opens them all to the passive port.
+// Each block carries its offset in the file so that the connections are independent. Every connection
+// ends with an EOD block, the EOF block gives the number of connections of the transfer.
+
+// Extended block header: the descriptor, the data size and the offset of the data in the file
+const (
+	extendedDescriptorEOF byte = 64 // the offset field is the number of EOD blocks of the transfer
+	extendedDescriptorEOD byte = 8  // end of the data of the connection
+
+	extendedHeaderSize = 17
+)
+
+var (
+	// errParallelActive is returned for the parallel transfers in active mode
+	errParallelActive = errors.New("parallel transfers require the passive mode")
+	// errParallelUnsupported is returned for the ASCII transfers, the files that can't seek and the uploads
+	// with a trailer or whose content type must be detected
+	errParallelUnsupported = errors.New("parallel transfers require the binary type and a seekable file")
+	// errParallelEODCount is returned when the EOF block doesn't count the connections of the transfer
+	errParallelEODCount = errors.New("extended block mode EOD count mismatch")
+	// errParallelOffset is returned for the blocks whose offset is outside of the possible file sizes
+	errParallelOffset = errors.New("extended block mode invalid offset")
+)
+
+// parallelTransferHandler is a transferHandler supporting the parallel transfers
+type parallelTransferHandler interface {
+	// OpenStreams waits for the connections of a parallel transfer after the first one
+	OpenStreams(count int, timeout time.Duration) ([]net.Conn, error)
+}
+
+// handleOPTSParallelism sets the number of connections of the parallel transfers
+func (c *clientHandler) handleOPTSParallelism(option string) {
+	// Parallelism=<starting>,<minimum>,<maximum>;
+	values := strings.Split(strings.TrimSuffix(option[len("Parallelism="):], ";"), ",")
+	parallelism, err := strconv.Atoi(values[0])
+
+	if len(values) > 1 {
+		parallelism, err = strconv.Atoi(values[1])
+	}
+
+	if err != nil || parallelism < 1 {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("Invalid parallelism %#v", option))
+
+		return
+	}
+
+	if max := c.server.settings.MaxParallelStreams; parallelism > max {
+		parallelism = max
+	}
+
+	c.parallelism = parallelism
+	c.writeMessage(StatusOK, fmt.Sprintf("Parallelism set to %d", parallelism))
+}
+
+// doParallelTransfer transfers a file over the connection already opened and the other ones of the transfer
+func (c *clientHandler) doParallelTransfer(tr net.Conn, file io.ReadWriter, write bool, offset int64) (int64, error) {
+	seeker, ok := file.(io.ReadWriteSeeker)
+	if !ok || c.currentTransferType == TransferTypeASCII ||
+		(write && (c.uploadTrailer != "" || c.newContentTypeWriter(file) != nil)) {
+		return 0, errParallelUnsupported
+	}
+
+	c.transferMu.Lock()
+	transfer := c.transfer
+	c.transferMu.Unlock()
+
+	parallel, ok := transfer.(parallelTransferHandler)
+	if !ok {
+		return 0, errParallelActive
+	}
+
+	conns := []net.Conn{tr}
+
+	if c.parallelism > 1 {
+		timeout := time.Duration(c.server.settings.ConnectionTimeout) * time.Second
+
+		streams, err := parallel.OpenStreams(c.parallelism-1, timeout)
+		if err != nil {
+			return 0, fmt.Errorf("could not open the parallel connections: %w", err)
+		}
+
+		for _, stream := range streams {
+			conns = append(conns, c.watchTransferConn(stream))
+		}
+	}
+
+	// the connections share the bandwidth of a single transfer
+	if share, endThrottling := c.joinBandwidthShare(); share != nil {
+		defer endThrottling()
+
+		for i, conn := range conns {
+			conns[i] = &throttledConn{Conn: conn, scheduler: c.server.bandwidth, share: share}
+		}
+	}
+
+	if write {
+		return receiveParallel(c.server.bufferPool, conns, fileWriterAt(seeker))
+	}
+
+	return sendParallel(c.server.bufferPool, conns, fileReaderAt(seeker), offset)
+}
+
+// parallelStreams runs a function per connection, the first error closes all the connections
+func parallelStreams(conns []net.Conn, stream func(index int, conn net.Conn) error) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for i, conn := range conns {
+		wg.Add(1)
+
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+
+			if err := stream(i, conn); err != nil {
+				once.Do(func() {
+					firstErr = err
+
+					for _, other := range conns {
+						_ = other.Close() // the other streams fail at once
+					}
+				})
+			}
+		}(i, conn)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// sendParallel sends the file from offset, each connection sends the next block available. The blocks are
+// the buffers of the pool less the header.
+func sendParallel(pool *bufferPool, conns []net.Conn, src io.ReaderAt, offset int64) (int64, error) {
+	var written int64
+
+	next := offset
+
+	err := parallelStreams(conns, func(index int, conn net.Conn) error {
+		pooled := pool.get()
+		defer pool.put(pooled)
+
+		buf := *pooled
+		blockSize := len(buf) - extendedHeaderSize
+
+		for {
+			blockOffset := atomic.AddInt64(&next, int64(blockSize)) - int64(blockSize)
+
+			n, err := src.ReadAt(buf[extendedHeaderSize:], blockOffset)
+			if n > 0 {
+				putExtendedHeader(buf, 0, uint64(n), uint64(blockOffset))
+
+				if _, errWrite := conn.Write(buf[:extendedHeaderSize+n]); errWrite != nil {
+					return errWrite
+				}
+
+				atomic.AddInt64(&written, int64(n))
+			}
+
+			if errors.Is(err, io.EOF) || (err == nil && n < blockSize) {
+				break
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		// the first connection also tells how many EOD blocks there are
+		descriptor, count := extendedDescriptorEOD, uint64(0)
+		if index == 0 {
+			descriptor, count = extendedDescriptorEOF|extendedDescriptorEOD, uint64(len(conns))
+		}
+
+		putExtendedHeader(buf, descriptor, 0, count)
+		_, err := conn.Write(buf[:extendedHeaderSize])
+
+		return err
+	})
+
+	return atomic.LoadInt64(&written), err
+}
+
+// receiveParallel writes the blocks received on the connections at their offset
+func receiveParallel(pool *bufferPool, conns []net.Conn, dst io.WriterAt) (int64, error) {
+	var written int64
+	var eodCount int64 = -1
+
+	err := parallelStreams(conns, func(_ int, conn net.Conn) error {
+		pooled := pool.get()
+		defer pool.put(pooled)
+
+		header := make([]byte, extendedHeaderSize)
+		buf := *pooled
+
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return errBlockTruncated
+			}
+
+			descriptor := header[0]
+			size := binary.BigEndian.Uint64(header[1:9])
+			offset := int64(binary.BigEndian.Uint64(header[9:]))
+
+			if descriptor&extendedDescriptorEOF != 0 {
+				atomic.StoreInt64(&eodCount, offset)
+			} else if err := receiveBlock(conn, dst, buf, size, offset); err != nil {
+				return err
+			} else {
+				atomic.AddInt64(&written, int64(size))
+			}
+
+			if descriptor&extendedDescriptorEOD != 0 {
+				return nil
+			}
+		}
+	})
+
+	if err == nil && atomic.LoadInt64(&eodCount) != int64(len(conns)) {
+		err = fmt.Errorf("%w: %d connections", errParallelEODCount, len(conns))
+	}
+
+	return atomic.LoadInt64(&written), err
+}
+
+// receiveBlock writes the data of a block at its offset
+func receiveBlock(conn net.Conn, dst io.WriterAt, buf []byte, size uint64, offset int64) error {
+	if offset < 0 || size > math.MaxInt64-uint64(offset) {
+		return fmt.Errorf("%w: %d bytes at %d", errParallelOffset, size, offset)
+	}
+
+	for size > 0 {
+		chunk := buf
+		if uint64(len(chunk)) > size {
+			chunk = chunk[:size]
+		}
+
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return errBlockTruncated
+		}
+
+		if _, err := dst.WriteAt(chunk, offset); err != nil {
+			return err
+		}
+
+		size -= uint64(len(chunk))
+		offset += int64(len(chunk))
+	}
+
+	return nil
+}
+
+// throttledConn is a connection of a parallel transfer, its reads and writes take from the bandwidth share
+// of the transfer
+type throttledConn struct {
+	net.Conn
+	scheduler *bandwidthScheduler
+	share     *bandwidthShare
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(c.scheduler.reserve(c.share, n, time.Now()))
+	}
+
+	return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+	writer := &throttledWriter{writer: c.Conn, scheduler: c.scheduler, share: c.share}
+
+	return writer.Write(p)
+}
+
+func putExtendedHeader(buf []byte, descriptor byte, size, offset uint64) {
+	buf[0] = descriptor
+	binary.BigEndian.PutUint64(buf[1:9], size)
+	binary.BigEndian.PutUint64(buf[9:extendedHeaderSize], offset)
+}
+
+// lockedFile gives random access to a file that can only seek, the accesses are serialized
+type lockedFile struct {
+	mu   sync.Mutex
+	file io.ReadWriteSeeker
+}
+
+func (f *lockedFile) ReadAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(f.file, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF // io.ReaderAt reports a short read this way
+	}
+
+	return n, err
+}
+
+func (f *lockedFile) WriteAt(p []byte, offset int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return f.file.Write(p)
+}
+
+func fileReaderAt(file io.ReadWriteSeeker) io.ReaderAt {
+	if readerAt, ok := file.(io.ReaderAt); ok {
+		return readerAt
+	}
+
+	return &lockedFile{file: file}
+}
+
+func fileWriterAt(file io.ReadWriteSeeker) io.WriterAt {
+	if writerAt, ok := file.(io.WriterAt); ok {
+		return writerAt
+	}
+
+	return &lockedFile{file: file}
+}
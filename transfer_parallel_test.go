@@ -0,0 +1,188 @@
+package ftpserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryWriterAt is an io.WriterAt growing as needed
+type memoryWriterAt struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (w *memoryWriterAt) WriteAt(p []byte, offset int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if end := int(offset) + len(p); end > len(w.data) {
+		w.data = append(w.data, make([]byte, end-len(w.data))...)
+	}
+
+	return copy(w.data[offset:], p), nil
+}
+
+var epsvPort = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+
+// openParallelStreams prepares a passive transfer and opens its connections
+func openParallelStreams(t *testing.T, raw goftp.RawConn, host string, count int) []net.Conn {
+	rc, response, err := raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringEPSV, rc, response)
+
+	port := epsvPort.FindStringSubmatch(response)
+	require.NotNil(t, port, response)
+
+	conns := make([]net.Conn, count)
+
+	for i := range conns {
+		conns[i], err = net.Dial("tcp", net.JoinHostPort(host, port[1]))
+		require.NoError(t, err)
+	}
+
+	return conns
+}
+
+func TestParallelTransfer(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{MaxParallelStreams: 3},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc, response)
+	require.Contains(t, response, "PARALLEL")
+
+	// the parallelism is limited by the settings
+	for command, expected := range map[string]string{
+		"OPTS RETR Parallelism=8,8,8;": "Parallelism set to 3",
+		"OPTS RETR Parallelism=2,2,2;": "Parallelism set to 2",
+	} {
+		rc, response, err = raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusOK, rc, response)
+		require.Equal(t, expected, response)
+	}
+
+	rc, response, err = raw.SendCommand("OPTS RETR Parallelism=a,b,c;")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	for _, command := range []string{"OPTS RETR Parallelism=3,3,3;", "TYPE I", "MODE E"} {
+		rc, response, err = raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusOK, rc, response)
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr())
+	require.NoError(t, err)
+
+	data := make([]byte, 3*defaultTransferBufferSize+1000)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	// upload
+	conns := openParallelStreams(t, raw, host, 3)
+
+	rc, response, err = raw.SendCommand("STOR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	written, err := sendParallel(newBufferPool(0, 0), conns, bytes.NewReader(data), 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)), written)
+
+	for _, conn := range conns {
+		require.NoError(t, conn.Close())
+	}
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	content, err := afero.ReadFile(driver.fs, "/file")
+	require.NoError(t, err)
+	require.Equal(t, data, content)
+
+	// download from an offset
+	rc, response, err = raw.SendCommand("REST 1000")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileActionPending, rc, response)
+
+	conns = openParallelStreams(t, raw, host, 3)
+
+	rc, response, err = raw.SendCommand("RETR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	received := &memoryWriterAt{}
+	written, err = receiveParallel(newBufferPool(0, 0), conns, received)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(data)-1000), written)
+	require.Equal(t, data[1000:], received.data[1000:])
+
+	for _, conn := range conns {
+		require.NoError(t, conn.Close())
+	}
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	// the blocks can't be appended
+	rc, response, err = raw.SendCommand("APPE file")
+	require.NoError(t, err)
+	require.Equal(t, StatusNotImplementedParam, rc, response)
+}
+
+func TestParallelTransferEODCount(t *testing.T) {
+	server, client := net.Pipe()
+
+	go func() {
+		// the EOF block announces two connections
+		buf := make([]byte, extendedHeaderSize)
+		putExtendedHeader(buf, extendedDescriptorEOF|extendedDescriptorEOD, 0, 2)
+		_, _ = client.Write(buf)
+	}()
+
+	_, err := receiveParallel(newBufferPool(0, 0), []net.Conn{server}, &memoryWriterAt{})
+	require.ErrorIs(t, err, errParallelEODCount)
+}
+
+func TestParallelTransferOffset(t *testing.T) {
+	server, client := net.Pipe()
+
+	go func() {
+		// the offset doesn't fit in a file
+		buf := make([]byte, extendedHeaderSize)
+		putExtendedHeader(buf, 0, 10, 1<<63)
+		_, _ = client.Write(buf)
+	}()
+
+	_, err := receiveParallel(newBufferPool(0, 0), []net.Conn{server}, &memoryWriterAt{})
+	require.ErrorIs(t, err, errParallelOffset)
+}
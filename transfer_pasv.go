@@ -1,12 +1,15 @@
 package ftpserver // nolint
 
 import (
+	"crypto/subtle"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fclairamb/ftpserverlib/log"
@@ -14,12 +17,15 @@ import (
 
 // Active/Passive transfer connection handler
 type transferHandler interface {
-	// Get the connection to transfer data on
-	Open() (net.Conn, error)
+	// Get the connection to transfer data on, waiting at most timeout for it
+	Open(timeout time.Duration) (net.Conn, error)
 
 	// Close the connection (and any associated resource)
 	Close() error
 
+	// Set the TLS config of the connection, nil for a plain TCP connection. It is given before Open.
+	SetTLSConfig(*tls.Config)
+
 	// Set info about the transfer to return in STAT response
 	SetInfo(string)
 	// Info about the transfer to return in STAT response
@@ -28,13 +34,24 @@ type transferHandler interface {
 
 // Passive connection
 type passiveTransferHandler struct {
-	listener    net.Listener     // TCP or SSL Listener
-	tcpListener *net.TCPListener // TCP Listener (only keeping it to define a deadline during the accept)
-	Port        int              // TCP Port we are listening on
-	connection  net.Conn         // TCP Connection established
-	settings    *Settings        // Settings
-	info        string           // transfer info
-	logger      log.Logger       // Logger
+	tcpListener *net.TCPListener   // TCP Listener
+	tlsConfig   *tls.Config        // not nil if the passive connection requires TLS
+	Port        int                // TCP Port we are listening on
+	connection  net.Conn           // TCP Connection established
+	settings    *Settings          // Settings
+	info        string             // transfer info
+	logger      log.Logger         // Logger
+	releasePort func()             // Releases the leased passive port, if any
+	closed      func()             // Called once when the handler is closed
+	checkPeer   func(net.IP) error // Checks the peer of the accepted connections
+	token       string             // Token the client must send first, see PassiveConnectionToken
+	streams     []net.Conn         // Other connections of a parallel transfer
+	streamsMu   sync.Mutex         // Protects streams, closed by ABOR during the transfer
+	acceptOnce  sync.Once          // Starts acceptConnections
+	accepted    chan net.Conn      // Connections accepted and checked by acceptConnections
+	acceptDone  chan struct{}      // Closed once the listener can't accept connections anymore
+	acceptErr   error              // Error that stopped the listener, set before acceptDone is closed
+	closing     chan struct{}      // Closed with the handler, the connections being checked are dropped
 }
 
 type ipValidationError struct {
@@ -45,9 +62,54 @@ func (e *ipValidationError) Error() string {
 	return e.error
 }
 
+// passiveIPRule is a parsed PassiveIPRule
+type passiveIPRule struct {
+	network *net.IPNet
+	ip      string
+}
+
+// parsePassiveIPRules parses the PassiveIPRules setting
+func parsePassiveIPRules(rules []PassiveIPRule) ([]passiveIPRule, error) {
+	parsed := make([]passiveIPRule, 0, len(rules))
+
+	for _, rule := range rules {
+		networks, err := parseIPNets([]string{rule.Network})
+		if err != nil {
+			return nil, fmt.Errorf("passive IP rule: %w", err)
+		}
+
+		if ip := net.ParseIP(rule.IP); ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("passive IP rule for %s: invalid IPv4 %#v: %w", rule.Network, rule.IP, ErrInvalidIPNet)
+		}
+
+		parsed = append(parsed, passiveIPRule{network: networks[0], ip: rule.IP})
+	}
+
+	return parsed, nil
+}
+
+// getPassiveIPRule returns the passive IP of the first rule matching the client, an empty string if none does
+func (c *clientHandler) getPassiveIPRule() string {
+	remoteIP := getIPFromAddr(c.RemoteAddr())
+	if remoteIP == nil {
+		return ""
+	}
+
+	for _, rule := range c.server.passiveIPRules {
+		if rule.network.Contains(remoteIP) {
+			return rule.ip
+		}
+	}
+
+	return ""
+}
+
 func (c *clientHandler) getCurrentIP() ([]string, error) {
 	// Provide our external IP address so the ftp client can connect back to us
-	ip := c.server.settings.PublicHost
+	ip := c.getPassiveIPRule()
+	if ip == "" {
+		ip = c.server.settings.PublicHost
+	}
 
 	// If we don't have an IP address, we can take the one that was used for the current connection
 	if ip == "" {
@@ -59,8 +121,10 @@ func (c *clientHandler) getCurrentIP() ([]string, error) {
 			if err != nil {
 				return nil, fmt.Errorf("couldn't fetch public IP: %w", err)
 			}
-		} else {
-			ip = strings.Split(c.conn.LocalAddr().String(), ":")[0]
+		} else if localIP := getIPFromAddr(c.conn.LocalAddr()); localIP != nil {
+			ip = localIP.String()
+		} else if c.isUnixSocket() {
+			return nil, &ipValidationError{error: "no passive IP over a unix socket, PublicHost must be set"}
 		}
 	}
 
@@ -77,9 +141,46 @@ func (c *clientHandler) getCurrentIP() ([]string, error) {
 	return strings.Split(parsedIP.String(), "."), nil
 }
 
+// getPASVQuads returns the IPv4 address to advertise in the PASV reply.
+// It returns nil if the reply must be EPSV-like, for clients connected over IPv6.
+func (c *clientHandler) getPASVQuads() ([]string, error) {
+	if remoteIP := getIPFromAddr(c.RemoteAddr()); remoteIP == nil || remoteIP.To4() != nil {
+		return c.getCurrentIP()
+	}
+
+	switch c.server.settings.PASVOverIPv6 {
+	case PASVOverIPv6EPSV:
+		return nil, nil
+	case PASVOverIPv6Refuse:
+		return nil, ErrPASVOverIPv6
+	default:
+		quads, err := c.getCurrentIP()
+		if err != nil {
+			return nil, fmt.Errorf("%w (%v)", ErrPASVOverIPv6, err)
+		}
+
+		return quads, nil
+	}
+}
+
+// ErrPASVOverIPv6 is returned when PASV, which only supports IPv4, is refused to a client connected over IPv6
+var ErrPASVOverIPv6 = errors.New("PASV isn't available over IPv6, use EPSV")
+
 // ErrNoAvailableListeningPort is returned when no port could be found to accept incoming connection
 var ErrNoAvailableListeningPort = errors.New("could not find any port to listen to")
 
+// errPassiveTokenMismatch is returned when a passive connection doesn't send the expected token
+var errPassiveTokenMismatch = errors.New("wrong passive token")
+
+// errPassiveTimeout is returned when the passive connections aren't opened in time
+var errPassiveTimeout net.Error = &passiveTimeoutError{}
+
+type passiveTimeoutError struct{}
+
+func (e *passiveTimeoutError) Error() string   { return "timeout waiting for the passive connection" }
+func (e *passiveTimeoutError) Timeout() bool   { return true }
+func (e *passiveTimeoutError) Temporary() bool { return true }
+
 func (c *clientHandler) findListenerWithinPortRange(portRange *PortRange) (*net.TCPListener, error) {
 	nbAttempts := portRange.End - portRange.Start
 
@@ -117,18 +218,65 @@ func (c *clientHandler) findListenerWithinPortRange(portRange *PortRange) (*net.
 	return nil, ErrNoAvailableListeningPort
 }
 
+// listenedRange returns the range of ports we shall listen on
+func (m *PortMapping) listenedRange() *PortRange {
+	return &PortRange{
+		Start: m.ListenedStart,
+		End:   m.ListenedStart + m.NbPorts - 1,
+	}
+}
+
+// exposedPort converts a listened port to the port advertised to the clients
+func (m *PortMapping) exposedPort(listenedPort int) int {
+	return m.ExposedStart + listenedPort - m.ListenedStart
+}
+
 func (c *clientHandler) handlePASV(param string) error {
 	command := c.GetLastCommand()
+
+	if command == "EPSV" && c.quirks.DisableEPSV {
+		c.writeMessage(StatusCommandNotImplemented, "EPSV is disabled for this client, use PASV")
+
+		return nil
+	}
+
+	if c.server.settings.DisableUnixSocketPassive && c.isUnixSocket() {
+		c.writeMessage(StatusCommandNotImplemented, "Passive transfers are disabled over unix sockets")
+
+		return nil
+	}
+
+	// The PASV reply address is checked before listening, there is nothing to clean up if it fails
+	var quads []string
+
+	if command == "PASV" {
+		var err error
+
+		if quads, err = c.getPASVQuads(); err != nil {
+			if errors.Is(err, ErrPASVOverIPv6) {
+				c.writeMessage(StatusCannotOpenDataConnection, err.Error())
+			} else {
+				c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Could not listen for passive connection: %v", err))
+			}
+
+			return nil
+		}
+	}
+
 	addr, _ := net.ResolveTCPAddr("tcp", ":0")
 
 	var tcpListener *net.TCPListener
 	var err error
 
 	portRange := c.server.settings.PassiveTransferPortRange
+	portMapping := c.server.settings.PassivePortMapping
 
-	if portRange != nil {
+	switch {
+	case portMapping != nil:
+		tcpListener, err = c.findListenerWithinPortRange(portMapping.listenedRange())
+	case portRange != nil:
 		tcpListener, err = c.findListenerWithinPortRange(portRange)
-	} else {
+	default:
 		tcpListener, err = net.ListenTCP("tcp", addr)
 	}
 
@@ -139,46 +287,49 @@ func (c *clientHandler) handlePASV(param string) error {
 		return nil
 	}
 
-	// The listener will either be plain TCP or TLS
-	var listener net.Listener
-
-	if c.HasTLSForTransfers() || c.server.settings.TLSRequired == ImplicitEncryption {
-		if tlsConfig, err := c.server.driver.GetTLSConfig(); err == nil {
-			listener = tls.NewListener(tcpListener, tlsConfig)
-		} else {
-			c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Cannot get a TLS config: %v", err))
-
-			return nil
-		}
-	} else {
-		listener = tcpListener
-	}
+	c.trackResource(resourceDataListener, 1)
 
 	p := &passiveTransferHandler{
 		tcpListener: tcpListener,
-		listener:    listener,
 		Port:        tcpListener.Addr().(*net.TCPAddr).Port,
 		settings:    c.server.settings,
 		logger:      c.logger,
+		checkPeer: func(peerIP net.IP) error {
+			return c.checkDataConnectionPeer(peerIP, c.server.settings.PasvConnectionsCheck)
+		},
+		closed: func() {
+			c.trackResource(resourceDataListener, -1)
+		},
+		accepted:   make(chan net.Conn),
+		acceptDone: make(chan struct{}),
+		closing:    make(chan struct{}),
 	}
 
-	// We should rewrite this part
-	if command == "PASV" {
-		p1 := p.Port / 256
-		p2 := p.Port - (p1 * 256)
-		quads, err2 := c.getCurrentIP()
+	// The port we advertise might not be the one we listen on if we are behind a NAT
+	exposedPort := p.Port
+	if portMapping != nil {
+		exposedPort = portMapping.exposedPort(p.Port)
+	}
 
-		if err2 != nil {
-			c.writeMessage(StatusServiceNotAvailable, fmt.Sprintf("Could not listen for passive connection: %v", err2))
+	exposedPort, p.releasePort = c.leasePassivePort(p.Port, exposedPort)
 
-			return nil
-		}
+	tokenNotice := ""
+	if c.server.settings.PassiveConnectionToken {
+		p.token = newPassiveToken()
+		tokenNotice = ". Token: " + p.token
+	}
+
+	if quads != nil {
+		p1 := exposedPort / 256
+		p2 := exposedPort - (p1 * 256)
 
 		c.writeMessage(
 			StatusEnteringPASV,
-			fmt.Sprintf("Entering Passive Mode (%s,%s,%s,%s,%d,%d)", quads[0], quads[1], quads[2], quads[3], p1, p2))
+			fmt.Sprintf("Entering Passive Mode (%s,%s,%s,%s,%d,%d)%s",
+				quads[0], quads[1], quads[2], quads[3], p1, p2, tokenNotice))
 	} else {
-		c.writeMessage(StatusEnteringEPSV, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", p.Port))
+		c.writeMessage(StatusEnteringEPSV,
+			fmt.Sprintf("Entering Extended Passive Mode (|||%d|)%s", exposedPort, tokenNotice))
 	}
 
 	c.transferMu.Lock()
@@ -188,23 +339,186 @@ func (c *clientHandler) handlePASV(param string) error {
 	return nil
 }
 
-func (p *passiveTransferHandler) ConnectionWait(wait time.Duration) (net.Conn, error) {
-	if p.connection == nil {
-		var err error
-		if err = p.tcpListener.SetDeadline(time.Now().Add(wait)); err != nil {
-			return nil, fmt.Errorf("failed to set deadline: %w", err)
+type passivePortLease struct {
+	port int
+	err  error
+}
+
+// leasePassivePort asks the main driver, if it supports it, which port shall be advertised to the
+// client. It returns the port to advertise and the function to call to release the lease.
+func (c *clientHandler) leasePassivePort(listenedPort, exposedPort int) (int, func()) {
+	leaser, ok := c.server.driver.(MainDriverExtensionPassivePortLeaser)
+	if !ok {
+		return exposedPort, nil
+	}
+
+	// buffered so that a late lease doesn't block the goroutine forever
+	leaseChan := make(chan passivePortLease, 1)
+
+	c.trackResource(resourceGoroutine, 1)
+
+	go func() {
+		defer c.trackResource(resourceGoroutine, -1)
+
+		port, err := leaser.LeasePassivePort(c, listenedPort, exposedPort)
+		leaseChan <- passivePortLease{port: port, err: err}
+	}()
+
+	timeout := time.Duration(c.server.settings.PassivePortLeaseTimeout) * time.Second
+
+	select {
+	case lease := <-leaseChan:
+		if lease.err != nil {
+			c.logger.Warn(
+				"Could not lease passive port, falling back",
+				"listenedPort", listenedPort,
+				"exposedPort", exposedPort,
+				"err", lease.err,
+			)
+
+			return exposedPort, nil
+		}
+
+		return lease.port, func() {
+			leaser.ReleasePassivePort(c, listenedPort)
 		}
+	case <-time.After(timeout):
+		c.logger.Warn(
+			"Passive port lease timed out, falling back",
+			"listenedPort", listenedPort,
+			"exposedPort", exposedPort,
+			"timeout", timeout,
+		)
+
+		// we won't use it but a late lease must still be released
+		c.trackResource(resourceGoroutine, 1)
+
+		go func() {
+			defer c.trackResource(resourceGoroutine, -1)
+
+			if lease := <-leaseChan; lease.err == nil {
+				leaser.ReleasePassivePort(c, listenedPort)
+			}
+		}()
 
-		p.connection, err = p.listener.Accept()
+		return exposedPort, nil
+	}
+}
 
+func (p *passiveTransferHandler) ConnectionWait(wait time.Duration) (net.Conn, error) {
+	if p.connection == nil {
+		conns, err := p.accept(1, time.Now().Add(wait))
 		if err != nil {
 			return nil, err
 		}
+
+		p.connection = conns[0]
 	}
 
 	return p.connection, nil
 }
 
+// OpenStreams waits for the other connections of a parallel transfer, they are closed with the handler
+func (p *passiveTransferHandler) OpenStreams(count int, timeout time.Duration) ([]net.Conn, error) {
+	streams, err := p.accept(count, time.Now().Add(timeout))
+
+	p.streamsMu.Lock()
+	p.streams = append(p.streams, streams...)
+	p.streamsMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return streams, nil
+}
+
+// accept waits for count connections of the legitimate peer until the deadline is reached. The connections
+// accepted on failure are returned with the error.
+func (p *passiveTransferHandler) accept(count int, deadline time.Time) ([]net.Conn, error) {
+	p.acceptOnce.Do(func() {
+		go p.acceptConnections()
+	})
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	conns := make([]net.Conn, 0, count)
+
+	for len(conns) < count {
+		select {
+		case conn := <-p.accepted:
+			conns = append(conns, conn)
+		case <-p.acceptDone:
+			return conns, p.acceptErr
+		case <-timer.C:
+			return conns, errPassiveTimeout
+		}
+	}
+
+	return conns, nil
+}
+
+// acceptConnections accepts the connections until the listener is closed. They are checked concurrently, a
+// peer that doesn't send the passive token doesn't delay the other connections.
+func (p *passiveTransferHandler) acceptConnections() {
+	for {
+		conn, err := p.tcpListener.Accept()
+		if err != nil {
+			p.acceptErr = err
+			close(p.acceptDone)
+
+			return
+		}
+
+		go func() {
+			if conn = p.checkConnection(conn); conn == nil {
+				return
+			}
+
+			select {
+			case p.accepted <- conn:
+			case <-p.closing:
+				p.closeRejected(conn)
+			}
+		}()
+	}
+}
+
+// checkConnection checks the peer and the token of an accepted connection, it returns nil if it's rejected
+func (p *passiveTransferHandler) checkConnection(conn net.Conn) net.Conn {
+	err := p.checkPeer(getIPFromAddr(conn.RemoteAddr()))
+	if err == nil {
+		if p.tlsConfig != nil {
+			conn = tls.Server(conn, p.tlsConfig)
+		}
+
+		if err = p.checkToken(conn); err == nil {
+			return conn
+		}
+	}
+
+	p.logger.Warn(
+		"Rejected passive connection",
+		"remoteAddr", conn.RemoteAddr().String(),
+		"err", err,
+	)
+
+	p.closeRejected(conn)
+
+	return nil
+}
+
+func (p *passiveTransferHandler) closeRejected(conn net.Conn) {
+	if errClose := conn.Close(); errClose != nil {
+		p.logger.Debug("Problem closing rejected passive connection", "err", errClose)
+	}
+}
+
+func (p *passiveTransferHandler) SetTLSConfig(tlsConfig *tls.Config) {
+	p.tlsConfig = tlsConfig
+}
+
 func (p *passiveTransferHandler) GetInfo() string {
 	return p.info
 }
@@ -213,9 +527,7 @@ func (p *passiveTransferHandler) SetInfo(info string) {
 	p.info = info
 }
 
-func (p *passiveTransferHandler) Open() (net.Conn, error) {
-	timeout := time.Duration(time.Second.Nanoseconds() * int64(p.settings.ConnectionTimeout))
-
+func (p *passiveTransferHandler) Open(timeout time.Duration) (net.Conn, error) {
 	return p.ConnectionWait(timeout)
 }
 
@@ -239,5 +551,54 @@ func (p *passiveTransferHandler) Close() error {
 		}
 	}
 
+	p.streamsMu.Lock()
+	for _, stream := range p.streams {
+		if err := stream.Close(); err != nil {
+			p.logger.Debug("Problem closing parallel transfer connection", "err", err)
+		}
+	}
+	p.streamsMu.Unlock()
+
+	if p.releasePort != nil {
+		p.releasePort()
+		p.releasePort = nil
+	}
+
+	if p.closed != nil {
+		p.closed()
+		p.closed = nil
+		close(p.closing)
+	}
+
 	return nil
 }
+
+// passiveTokenTimeout is the maximum time a connection has to send the passive token before being dropped
+const passiveTokenTimeout = 5 * time.Second
+
+// newPassiveToken returns a random one-time token for PassiveConnectionToken
+func newPassiveToken() string {
+	return newSessionID()[:16]
+}
+
+// checkToken reads the token the client must send first on the passive connection, if one is required
+func (p *passiveTransferHandler) checkToken(conn net.Conn) error {
+	if p.token == "" {
+		return nil
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(passiveTokenTimeout)); err != nil {
+		return err
+	}
+
+	token := make([]byte, len(p.token))
+	if _, err := io.ReadFull(conn, token); err != nil {
+		return fmt.Errorf("could not read the passive token: %w", err)
+	}
+
+	if subtle.ConstantTimeCompare(token, []byte(p.token)) != 1 {
+		return errPassiveTokenMismatch
+	}
+
+	return conn.SetReadDeadline(time.Time{})
+}
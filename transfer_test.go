@@ -5,16 +5,22 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +33,7 @@ func getABORCmd() string {
 	return str + "ABOR"
 }
 
-func createTemporaryFile(t *testing.T, targetSize int) *os.File {
+func createTemporaryFile(t testing.TB, targetSize int) *os.File {
 	var file *os.File
 
 	var fileErr error
@@ -423,6 +429,226 @@ func TestFailingFileTransfer(t *testing.T) {
 	})
 }
 
+func TestSyncUploads(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			SyncUploads: true,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	require.NoError(t, c.Store("file.bin", bytes.NewReader(make([]byte, 1024))))
+
+	err = c.Store("fail-to-sync.bin", bytes.NewReader(make([]byte, 1024)))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), errFailSync.Error())
+
+	s.settings.SyncUploads = false
+
+	require.NoError(t, c.Store("fail-to-sync.bin", bytes.NewReader(make([]byte, 1024))))
+}
+
+func TestPartialUploadPolicy(t *testing.T) {
+	upload := func(t *testing.T, policy PartialUploadPolicy, name string) *TestServerDriver {
+		driver := &TestServerDriver{
+			Debug: true,
+			Settings: &Settings{
+				PartialUploadPolicy: policy,
+			},
+		}
+		s := NewTestServerWithDriver(t, driver)
+		conf := goftp.Config{
+			User:     authUser,
+			Password: authPass,
+		}
+
+		c, err := goftp.DialConfig(conf, s.Addr())
+		require.NoError(t, err)
+
+		defer func() { require.NoError(t, c.Close()) }()
+
+		// a raw connection, goftp would retry the failed upload
+		raw, err := c.OpenRawConn()
+		require.NoError(t, err)
+
+		defer func() { require.NoError(t, raw.Close()) }()
+
+		dcGetter, err := raw.PrepareDataConn()
+		require.NoError(t, err)
+
+		rc, response, err := raw.SendCommand("STOR " + name)
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatusOK, rc, response)
+
+		dc, err := dcGetter()
+		require.NoError(t, err)
+
+		// the server may close the connection once the write failed
+		_, _ = dc.Write(make([]byte, 1024))
+		require.NoError(t, dc.Close())
+
+		rc, response, err = raw.ReadResponse()
+		require.NoError(t, err)
+		require.NotEqual(t, StatusClosingDataConn, rc, response)
+
+		return driver
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		driver := upload(t, PartialUploadKeep, "fail-to-write.bin")
+		_, err := driver.fs.Stat("fail-to-write.bin")
+		require.NoError(t, err)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		driver := upload(t, PartialUploadDelete, "fail-to-write.bin")
+		_, err := driver.fs.Stat("fail-to-write.bin")
+		require.True(t, os.IsNotExist(err), err)
+
+		driver.partialUploadsMu.Lock()
+		defer driver.partialUploadsMu.Unlock()
+
+		require.Len(t, driver.partialUploadCauses, 1)
+		require.ErrorIs(t, driver.partialUploadCauses[0], errFailWrite)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		driver := upload(t, PartialUploadRename, "fail-to-write.bin")
+		_, err := driver.fs.Stat("fail-to-write.bin")
+		require.True(t, os.IsNotExist(err), err)
+		_, err = driver.fs.Stat("fail-to-write.bin.part")
+		require.NoError(t, err)
+	})
+
+	t.Run("driver", func(t *testing.T) {
+		driver := upload(t, PartialUploadDelete, "keep-partial-fail-to-write.bin")
+		_, err := driver.fs.Stat("keep-partial-fail-to-write.bin")
+		require.NoError(t, err)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		driver := &TestServerDriver{
+			Debug: true,
+			Settings: &Settings{
+				PartialUploadPolicy: PartialUploadDelete,
+			},
+		}
+		s := NewTestServerWithDriver(t, driver)
+		conf := goftp.Config{
+			User:     authUser,
+			Password: authPass,
+		}
+
+		c, err := goftp.DialConfig(conf, s.Addr())
+		require.NoError(t, err)
+
+		defer func() { require.NoError(t, c.Close()) }()
+
+		raw, err := c.OpenRawConn()
+		require.NoError(t, err)
+
+		defer func() { require.NoError(t, raw.Close()) }()
+
+		dcGetter, err := raw.PrepareDataConn()
+		require.NoError(t, err)
+
+		rc, response, err := raw.SendCommand("STOR delay-io.bin")
+		require.NoError(t, err)
+		require.Equal(t, StatusFileStatusOK, rc, response)
+
+		dc, err := dcGetter()
+		require.NoError(t, err)
+
+		_, err = dc.Write(make([]byte, 1024))
+		require.NoError(t, err)
+
+		rc, response, err = raw.SendCommand(getABORCmd())
+		require.NoError(t, err)
+		require.Equal(t, StatusTransferAborted, rc, response)
+
+		rc, response, err = raw.ReadResponse()
+		require.NoError(t, err)
+		require.Equal(t, StatusClosingDataConn, rc, response)
+
+		require.Eventually(t, func() bool {
+			driver.partialUploadsMu.Lock()
+			defer driver.partialUploadsMu.Unlock()
+
+			return len(driver.partialUploadCauses) == 1 && errors.Is(driver.partialUploadCauses[0], ErrTransferAborted)
+		}, 2*time.Second, 50*time.Millisecond)
+
+		_, err = driver.fs.Stat("delay-io.bin")
+		require.True(t, os.IsNotExist(err), err)
+	})
+}
+
+func TestTransferPipeliningReject(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			TransferPipelining: TransferPipeliningReject,
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/delay-io.bin", make([]byte, 1024), 0600))
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("RETR delay-io.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	// the client tries to prepare the next transfer before the end of the current one
+	for _, command := range []string{"PASV", "REST 10", "RETR delay-io.bin"} {
+		rc, response, err = raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusFileActionNotTaken, rc, response)
+	}
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	data, err := ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.Len(t, data, 1024)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	// once the transfer is complete, the commands are accepted again
+	rc, response, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, response)
+}
+
 func TestTransfersFromOffset(t *testing.T) {
 	driver := &TestServerDriver{
 		Debug: true,
@@ -860,3 +1086,666 @@ func TestPASVInvalidPublicHost(t *testing.T) {
 	require.Equal(t, StatusServiceNotAvailable, rc)
 	require.Contains(t, resp, "invalid passive IP")
 }
+
+func TestPassiveIPRules(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			PublicHost: "192.0.2.1",
+			PassiveIPRules: []PassiveIPRule{
+				{Network: "192.168.0.0/16", IP: "192.168.1.1"},
+				{Network: "127.0.0.1", IP: "10.0.0.1"},
+				{Network: "127.0.0.0/8", IP: "10.0.0.2"},
+			},
+		},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the first matching rule wins
+	rc, resp, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, resp)
+	require.Contains(t, resp, "(10,0,0,1,")
+
+	// the other clients get the public IP
+	s.passiveIPRules = s.passiveIPRules[:1]
+	rc, resp, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, resp)
+	require.Contains(t, resp, "(192,0,2,1,")
+}
+
+func TestPASVOverIPv6(t *testing.T) {
+	sendPASV := func(t *testing.T, settings *Settings) (int, string) {
+		settings.ListenAddr = "[::1]:0"
+		s := NewTestServerWithDriver(t, &TestServerDriver{Debug: true, Settings: settings})
+
+		if s == nil {
+			t.Skip("IPv6 is not supported here")
+		}
+
+		conf := goftp.Config{
+			User:     authUser,
+			Password: authPass,
+		}
+
+		c, err := goftp.DialConfig(conf, s.Addr())
+		require.NoError(t, err, "Couldn't connect")
+
+		defer func() { require.NoError(t, c.Close()) }()
+
+		raw, err := c.OpenRawConn()
+		require.NoError(t, err, "Couldn't open raw connection")
+
+		defer func() { require.NoError(t, raw.Close()) }()
+
+		rc, resp, err := raw.SendCommand("PASV")
+		require.NoError(t, err)
+
+		return rc, resp
+	}
+
+	t.Run("public-ipv4", func(t *testing.T) {
+		rc, resp := sendPASV(t, &Settings{PublicHost: "127.0.0.1"})
+		require.Equal(t, StatusEnteringPASV, rc, resp)
+		require.Contains(t, resp, "(127,0,0,1,")
+	})
+
+	t.Run("no-public-ipv4", func(t *testing.T) {
+		rc, resp := sendPASV(t, &Settings{})
+		require.Equal(t, StatusCannotOpenDataConnection, rc, resp)
+		require.Contains(t, resp, ErrPASVOverIPv6.Error())
+	})
+
+	t.Run("epsv", func(t *testing.T) {
+		rc, resp := sendPASV(t, &Settings{PASVOverIPv6: PASVOverIPv6EPSV})
+		require.Equal(t, StatusEnteringEPSV, rc, resp)
+		require.Contains(t, resp, "(|||")
+	})
+
+	t.Run("refuse", func(t *testing.T) {
+		rc, resp := sendPASV(t, &Settings{PublicHost: "127.0.0.1", PASVOverIPv6: PASVOverIPv6Refuse})
+		require.Equal(t, StatusCannotOpenDataConnection, rc, resp)
+		require.Equal(t, ErrPASVOverIPv6.Error(), resp)
+	})
+}
+
+func TestDataConnectionPolicies(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			DataConnectionPolicies: map[string]DataConnectionPolicy{
+				"LIST": {FailFast: true},
+				"NLST": {Timeout: 1},
+			},
+		},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the client didn't connect before sending the command
+	rc, resp, err := raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, resp)
+
+	rc, resp, err = raw.SendCommand("LIST")
+	require.NoError(t, err)
+	require.Equal(t, StatusCannotOpenDataConnection, rc, resp)
+	require.Equal(t, errDataConnNotReady.Error(), resp)
+
+	// the client connects right after the PASV reply
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	rc, resp, err = raw.SendCommand("LIST")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, resp)
+
+	_, err = ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, resp, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, resp)
+
+	// the timeout is shorter than ConnectionTimeout
+	rc, resp, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, resp)
+
+	start := time.Now()
+	rc, resp, err = raw.SendCommand("NLST")
+	require.NoError(t, err)
+	require.Equal(t, StatusCannotOpenDataConnection, rc, resp)
+	require.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestPASVPortMapping(t *testing.T) {
+	s := NewTestServer(t, true)
+	s.settings.PassivePortMapping = &PortMapping{
+		ExposedStart:  30000,
+		ListenedStart: 50000,
+		NbPorts:       100,
+	}
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, resp, err := raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringEPSV, rc, resp)
+
+	port, err := strconv.Atoi(strings.TrimSuffix(strings.Split(resp, "|||")[1], "|)"))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, port, 30000)
+	require.Less(t, port, 30100)
+
+	rc, resp, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, resp)
+
+	quads := strings.Split(strings.TrimSuffix(strings.Split(resp, "(")[1], ")"), ",")
+	require.Len(t, quads, 6)
+
+	p1, err := strconv.Atoi(quads[4])
+	require.NoError(t, err)
+	p2, err := strconv.Atoi(quads[5])
+	require.NoError(t, err)
+
+	port = p1*256 + p2
+	require.GreaterOrEqual(t, port, 30000)
+	require.Less(t, port, 30100)
+}
+
+var errPortLeaseFailed = errors.New("port lease failed")
+
+func TestPASVPortLease(t *testing.T) {
+	t.Run("leased", func(t *testing.T) {
+		s := NewTestServerWithDriver(t, &TestServerDriver{
+			Debug: true,
+			PassivePortLeaser: func(exposedPort int) (int, error) {
+				return 12345, nil
+			},
+		})
+		require.Equal(t, 12345, getEPSVPort(t, s))
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		s := NewTestServerWithDriver(t, &TestServerDriver{
+			Debug: true,
+			PassivePortLeaser: func(exposedPort int) (int, error) {
+				return 0, errPortLeaseFailed
+			},
+		})
+		require.NotEqual(t, 0, getEPSVPort(t, s))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		s := NewTestServerWithDriver(t, &TestServerDriver{
+			Debug:    true,
+			Settings: &Settings{PassivePortLeaseTimeout: 1},
+			PassivePortLeaser: func(exposedPort int) (int, error) {
+				time.Sleep(2 * time.Second)
+
+				return 12345, nil
+			},
+		})
+		port := getEPSVPort(t, s)
+		require.NotEqual(t, 12345, port)
+		require.NotEqual(t, 0, port)
+	})
+}
+
+func getEPSVPort(t *testing.T, s *FtpServer) int {
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, resp, err := raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringEPSV, rc, resp)
+
+	port, err := strconv.Atoi(strings.TrimSuffix(strings.Split(resp, "|||")[1], "|)"))
+	require.NoError(t, err)
+
+	return port
+}
+
+func TestDataConnectionsCheck(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug: true,
+		Settings: &Settings{
+			ActiveTransferPortNon20: true,
+			PasvConnectionsCheck:    IPMatchRequired,
+			ActiveConnectionsCheck:  IPMatchRequired,
+			DataConnectionAllowList: []string{"192.168.1.0/24", "10.0.0.1"},
+		},
+	})
+
+	// the peer matches the control connection one
+	testTransferOnConnection(t, s, false, false, false)
+	testTransferOnConnection(t, s, true, false, false)
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, resp, err := raw.SendCommand("PORT 1,2,3,4,7,208")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, resp)
+	require.Contains(t, resp, errDataConnectionPeer.Error())
+
+	rc, resp, err = raw.SendCommand("EPRT |1|10.0.0.2|2000|")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, resp)
+
+	rc, resp, err = raw.SendCommand("EPRT |1|10.0.0.1|2000|")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, resp)
+
+	rc, resp, err = raw.SendCommand("PORT 192,168,1,20,7,208")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, resp)
+}
+
+func TestDataConnectionsCheckFXP(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:     true,
+		EnableFXP: true,
+		Settings: &Settings{
+			ActiveConnectionsCheck: IPMatchRequired,
+		},
+	})
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { require.NoError(t, c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, resp, err := raw.SendCommand("PORT 1,2,3,4,7,208")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, resp)
+}
+
+func benchmarkTransferServer(b *testing.B) (*FtpServer, *goftp.Client) {
+	s := newTestServerWithDriver(b, &TestServerDriver{})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(b, err, "Couldn't connect")
+
+	b.Cleanup(func() { panicOnError(c.Close()) })
+
+	return s, c
+}
+
+func BenchmarkRETR(b *testing.B) {
+	const size = 10 * 1024 * 1024
+
+	s, c := benchmarkTransferServer(b)
+
+	file := createTemporaryFile(b, size)
+
+	_, err := file.Seek(0, io.SeekStart)
+	require.NoError(b, err)
+	require.NoError(b, c.Store("file.bin", file))
+
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, c.Retrieve("file.bin", ioutil.Discard))
+	}
+
+	b.StopTimer()
+	b.Logf("copy paths: %+v", s.CopyPathCounters())
+}
+
+func BenchmarkSTOR(b *testing.B) {
+	const size = 10 * 1024 * 1024
+
+	s, c := benchmarkTransferServer(b)
+	file := createTemporaryFile(b, size)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		_, err := file.Seek(0, io.SeekStart)
+		require.NoError(b, err)
+		require.NoError(b, c.Store("file.bin", file))
+	}
+
+	b.StopTimer()
+	b.Logf("copy paths: %+v", s.CopyPathCounters())
+}
+
+func TestEarlyTransferReply(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EarlyTransferReply: true, FileOpenTimeout: 30},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	start := time.Now()
+
+	require.NoError(t, c.Store("record-deadline", bytes.NewReader([]byte("data"))))
+
+	driver.clientMU.Lock()
+	deadline := driver.fileOpenDeadline
+	require.Len(t, driver.Clients, 1)
+	require.True(t, driver.Clients[0].GetFileOpenDeadline().IsZero())
+	driver.clientMU.Unlock()
+
+	require.WithinDuration(t, start.Add(30*time.Second), deadline, 5*time.Second)
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the error of the opening comes after the 150 reply
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("STOR quota-exceeded")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionAborted, rc, response)
+	require.NoError(t, dc.Close())
+
+	// the downloads aren't affected
+	rc, response, err = raw.SendCommand("PASV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringPASV, rc, response)
+
+	rc, response, err = raw.SendCommand("RETR fail-to-open")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc, response)
+}
+
+func TestTransferTLSConfig(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:              true,
+		TLS:                true,
+		transferTLSVersion: tls.VersionTLS12,
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", []byte("content"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+		TLSConfig: &tls.Config{
+			// nolint:gosec
+			InsecureSkipVerify: true,
+		},
+		TLSMode: goftp.TLSExplicit,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// the protection level is the one in effect when the transfer starts
+	rc, response, err := raw.SendCommand("PROT C")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err = raw.SendCommand("PROT P")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response, err = raw.SendCommand("RETR file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadAll(dc)
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	driver.clientMU.Lock()
+	defer driver.clientMU.Unlock()
+
+	cc := driver.Clients[len(driver.Clients)-1]
+	require.Equal(t, uint16(tls.VersionTLS13), cc.GetTLSControlState().Version)
+	require.Equal(t, uint16(tls.VersionTLS12), cc.GetTLSTransferState().Version)
+}
+
+func TestPassiveConnectionToken(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{PassiveConnectionToken: true},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("EPSV")
+	require.NoError(t, err)
+	require.Equal(t, StatusEnteringEPSV, rc, response)
+
+	matches := regexp.MustCompile(`^Entering Extended Passive Mode \(\|\|\|(\d+)\|\)\. Token: ([0-9a-f]{16})$`).
+		FindStringSubmatch(response)
+	require.NotNil(t, matches, response)
+
+	dataAddr := net.JoinHostPort("127.0.0.1", matches[1])
+
+	// a client that doesn't send anything doesn't delay the other connections
+	silent, err := net.DialTimeout("tcp", dataAddr, 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, silent.Close()) }()
+
+	// another client connects first, without the token
+	thief, err := net.DialTimeout("tcp", dataAddr, 5*time.Second)
+	require.NoError(t, err)
+
+	defer func() { require.NoError(t, thief.Close()) }()
+
+	_, err = thief.Write([]byte("0000000000000000"))
+	require.NoError(t, err)
+
+	dc, err := net.DialTimeout("tcp", dataAddr, 5*time.Second)
+	require.NoError(t, err)
+
+	_, err = dc.Write([]byte(matches[2]))
+	require.NoError(t, err)
+
+	start := time.Now()
+	rc, response, err = raw.SendCommand("STOR token.bin")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+	require.Less(t, int64(time.Since(start)), int64(passiveTokenTimeout))
+
+	_, err = dc.Write([]byte("content"))
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	// the connection without the token was closed
+	_, err = thief.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	size, err := c.Stat("token.bin")
+	require.NoError(t, err)
+	require.Equal(t, int64(7), size.Size())
+}
+
+func TestUploadRejection(t *testing.T) {
+	s := NewTestServerWithDriver(t, &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{PartialUploadPolicy: PartialUploadDelete},
+	})
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand("STOR sniffed-file")
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	// the client sends much more than the server reads before rejecting the content
+	payload := append([]byte("\x7fELF"), make([]byte, 8*1024*1024)...)
+	sent := make(chan error, 1)
+
+	go func() {
+		_, errWrite := dc.Write(payload)
+		sent <- errWrite
+	}()
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTakenNoFile, rc, response)
+	require.Contains(t, response, "content not allowed: executable")
+
+	// the data connection was drained instead of being reset
+	require.NoError(t, <-sent)
+	require.NoError(t, dc.Close())
+
+	// the refused upload is deleted
+	rc, _, err = raw.SendCommand("SIZE sniffed-file")
+	require.NoError(t, err)
+	require.Equal(t, StatusActionNotTaken, rc)
+}
@@ -0,0 +1,122 @@
+package ftpserver
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// Upload trailers: after "OPTS STOR TRAILER <algo>", the data of the uploads ends with the binary digest of
+// the content sent (4 bytes for CRC32, 32 for SHA-256...). The server checks it before replying 226, this
+// gives an end-to-end integrity check without the HASH round trip. "OPTS STOR TRAILER NONE" disables it.
+
+// handleOPTSTrailer selects the digest algorithm of the upload trailers
+func (c *clientHandler) handleOPTSTrailer(name string) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+
+	if name == "NONE" {
+		c.uploadTrailer = ""
+		c.writeMessage(StatusOK, "Upload trailer disabled")
+
+		return
+	}
+
+	if _, ok := getHashMapping()[name]; !ok {
+		c.writeMessage(StatusSyntaxErrorParameters, fmt.Sprintf("%v: %v", name, errUnknowHash))
+
+		return
+	}
+
+	c.uploadTrailer = name
+	c.writeMessage(StatusOK, "Upload trailer set to "+name)
+}
+
+// getTrailerFeature returns the FEAT line of the upload trailers, the selected algorithm has a star
+func (c *clientHandler) getTrailerFeature() string {
+	var feature strings.Builder
+
+	feature.WriteString("TRAILER ")
+
+	for _, algo := range []HASHAlgo{HASHAlgoCRC32, HASHAlgoMD5, HASHAlgoSHA1, HASHAlgoSHA256, HASHAlgoSHA512} {
+		name := getHashName(algo)
+		feature.WriteString(name)
+
+		if name == c.uploadTrailer {
+			feature.WriteString("*")
+		}
+
+		feature.WriteString(";")
+	}
+
+	return feature.String()
+}
+
+// newUploadReader removes and checks the trailer of the upload data, if one was negotiated
+func (c *clientHandler) newUploadReader(reader io.Reader) io.Reader {
+	if c.uploadTrailer == "" {
+		return reader
+	}
+
+	h, err := newHash(getHashMapping()[c.uploadTrailer])
+	if err != nil {
+		return reader
+	}
+
+	return newTrailerReader(reader, h)
+}
+
+// trailerReader holds back the last bytes of a stream, they are the digest of the data before them
+type trailerReader struct {
+	reader  io.Reader
+	hash    hash.Hash
+	size    int    // size of the trailer
+	buf     []byte // read buffer
+	pending []byte // data read but not returned yet, the last size bytes might be the trailer
+	err     error  // error of the last read
+}
+
+func newTrailerReader(reader io.Reader, h hash.Hash) *trailerReader {
+	return &trailerReader{
+		reader: reader,
+		hash:   h,
+		size:   h.Size(),
+		buf:    make([]byte, h.Size()+32*1024),
+	}
+}
+
+func (r *trailerReader) Read(p []byte) (int, error) {
+	for {
+		// the bytes followed by at least a trailer size can be returned
+		if available := len(r.pending) - r.size; available > 0 {
+			n := copy(p, r.pending[:available])
+			r.hash.Write(p[:n]) //nolint:errcheck // never fails
+			r.pending = r.pending[n:]
+
+			return n, nil
+		}
+
+		if r.err == io.EOF {
+			return 0, r.verify()
+		}
+
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		kept := copy(r.buf, r.pending)
+		n, err := r.reader.Read(r.buf[kept:])
+		r.pending = r.buf[:kept+n]
+		r.err = err
+	}
+}
+
+// verify checks the trailer at the end of the stream
+func (r *trailerReader) verify() error {
+	if len(r.pending) < r.size || !bytes.Equal(r.pending, r.hash.Sum(nil)) {
+		return ErrUploadDigestMismatch
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,149 @@
+package ftpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+	"testing/iotest"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrailerReader(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	digest := sha256.Sum256(data)
+	stream := append(append([]byte{}, data...), digest[:]...)
+
+	content, err := ioutil.ReadAll(newTrailerReader(bytes.NewReader(stream), sha256.New()))
+	require.NoError(t, err)
+	require.Equal(t, data, content)
+
+	// the trailer can arrive in several reads
+	content, err = ioutil.ReadAll(newTrailerReader(iotest.OneByteReader(bytes.NewReader(stream)), sha256.New()))
+	require.NoError(t, err)
+	require.Equal(t, data, content)
+
+	stream[0] = 'X'
+	_, err = ioutil.ReadAll(newTrailerReader(bytes.NewReader(stream), sha256.New()))
+	require.ErrorIs(t, err, ErrUploadDigestMismatch)
+
+	// shorter than a trailer
+	_, err = ioutil.ReadAll(newTrailerReader(bytes.NewReader([]byte{1, 2}), crc32.NewIEEE()))
+	require.ErrorIs(t, err, ErrUploadDigestMismatch)
+
+	// an empty content has a trailer too
+	empty := crc32.NewIEEE().Sum(nil)
+	content, err = ioutil.ReadAll(newTrailerReader(bytes.NewReader(empty), crc32.NewIEEE()))
+	require.NoError(t, err)
+	require.Empty(t, content)
+}
+
+func storeRawData(t *testing.T, raw goftp.RawConn, name string, data []byte) (int, string) {
+	return sendRawData(t, raw, "STOR "+name, data)
+}
+
+// sendRawData sends data with an upload command (STOR, APPE) and returns its final reply
+func sendRawData(t *testing.T, raw goftp.RawConn, command string, data []byte) (int, string) {
+	dcGetter, err := raw.PrepareDataConn()
+	require.NoError(t, err)
+
+	rc, response, err := raw.SendCommand(command)
+	require.NoError(t, err)
+	require.Equal(t, StatusFileStatusOK, rc, response)
+
+	dc, err := dcGetter()
+	require.NoError(t, err)
+
+	_, err = dc.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, dc.Close())
+
+	rc, response, err = raw.ReadResponse()
+	require.NoError(t, err)
+
+	return rc, response
+}
+
+func TestUploadTrailer(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{EnableUploadTrailer: true},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	rc, response, err := raw.SendCommand("OPTS STOR TRAILER SHA-3")
+	require.NoError(t, err)
+	require.Equal(t, StatusSyntaxErrorParameters, rc, response)
+
+	for _, command := range []string{"TYPE I", "OPTS STOR TRAILER sha-256"} {
+		rc, response, err = raw.SendCommand(command)
+		require.NoError(t, err)
+		require.Equal(t, StatusOK, rc, response)
+	}
+
+	rc, response, err = raw.SendCommand("FEAT")
+	require.NoError(t, err)
+	require.Equal(t, StatusSystemStatus, rc, response)
+	require.Contains(t, response, "TRAILER CRC32;MD5;SHA-1;SHA-256*;SHA-512;")
+
+	data := []byte("some important content")
+	digest := sha256.Sum256(data)
+
+	rc, response = storeRawData(t, raw, "good", append(append([]byte{}, data...), digest[:]...))
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	content, err := afero.ReadFile(driver.fs, "/good")
+	require.NoError(t, err)
+	require.Equal(t, data, content)
+
+	// a corrupted upload fails and the partial file is removed, whatever the PartialUploadPolicy
+	data[0] = 'S'
+	rc, response = storeRawData(t, raw, "bad", append(append([]byte{}, data...), digest[:]...))
+	require.Equal(t, StatusActionNotTaken, rc, response)
+	require.Contains(t, response, ErrUploadDigestMismatch.Error())
+
+	_, err = driver.fs.Stat("/bad")
+	require.True(t, os.IsNotExist(err), err)
+
+	// the file of a corrupted append is kept aside
+	rc, response = sendRawData(t, raw, "APPE good", append(append([]byte{}, data...), digest[:]...))
+	require.Equal(t, StatusActionNotTaken, rc, response)
+
+	_, err = driver.fs.Stat("/good")
+	require.True(t, os.IsNotExist(err), err)
+
+	content, err = afero.ReadFile(driver.fs, "/good.part")
+	require.NoError(t, err)
+	require.Equal(t, "some important contentSome important content", string(content))
+
+	// without trailer the content is stored as is
+	rc, response, err = raw.SendCommand("OPTS STOR TRAILER NONE")
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response = storeRawData(t, raw, "plain", data)
+	require.Equal(t, StatusClosingDataConn, rc, response)
+
+	content, err = afero.ReadFile(driver.fs, "/plain")
+	require.NoError(t, err)
+	require.Equal(t, data, content)
+}
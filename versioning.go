@@ -0,0 +1,64 @@
+package ftpserver
+
+import (
+	"fmt"
+)
+
+// getVersionPath returns the path of a previous version of a file, version 1 being the most recent one
+func getVersionPath(filePath string, version int) string {
+	return fmt.Sprintf("%s;%d", filePath, version)
+}
+
+// isVersioned tells if the file an upload is about to replace must be kept as a previous version (see
+// VersionRetention)
+func (c *clientHandler) isVersioned(filePath string) bool {
+	if c.server.settings.VersionRetention <= 0 {
+		return false
+	}
+
+	info, err := c.stat(filePath)
+
+	return err == nil && info.Mode().IsRegular()
+}
+
+// keepPreviousVersion keeps the file an upload is about to replace as a previous version. It is called once
+// the data connection is opened, the file isn't touched by the uploads failing before.
+func (c *clientHandler) keepPreviousVersion(filePath string) error {
+	retention := c.server.settings.VersionRetention
+
+	var err error
+
+	if versioner, ok := c.driver.(ClientDriverExtensionVersioning); ok {
+		err = versioner.SnapshotVersion(filePath, retention)
+	} else {
+		err = c.rotateVersions(filePath, retention)
+	}
+
+	if err != nil {
+		return fmt.Errorf("could not keep the previous version of %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// rotateVersions renames a file to its version 1 ("file.txt;1"), after shifting its previous versions and
+// removing the oldest one
+func (c *clientHandler) rotateVersions(filePath string, retention int) error {
+	if _, err := c.stat(getVersionPath(filePath, retention)); err == nil {
+		if err = c.driver.Remove(getVersionPath(filePath, retention)); err != nil {
+			return err
+		}
+	}
+
+	for version := retention - 1; version > 0; version-- {
+		if _, err := c.stat(getVersionPath(filePath, version)); err != nil {
+			continue
+		}
+
+		if err := c.driver.Rename(getVersionPath(filePath, version), getVersionPath(filePath, version+1)); err != nil {
+			return err
+		}
+	}
+
+	return c.driver.Rename(filePath, getVersionPath(filePath, 1))
+}
@@ -0,0 +1,91 @@
+package ftpserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionRetention(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{VersionRetention: 2},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	for _, content := range []string{"v1", "v2", "v3", "v4"} {
+		require.NoError(t, c.Store("file.txt", bytes.NewReader([]byte(content))))
+	}
+
+	for name, expected := range map[string]string{
+		"/file.txt":   "v4",
+		"/file.txt;1": "v3",
+		"/file.txt;2": "v2",
+	} {
+		content, err := afero.ReadFile(driver.fs, name)
+		require.NoError(t, err)
+		require.Equal(t, expected, string(content), name)
+	}
+
+	_, err = driver.fs.Stat("/file.txt;3")
+	require.True(t, os.IsNotExist(err), err)
+}
+
+func TestVersionRetentionTransferFailure(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug:    true,
+		Settings: &Settings{VersionRetention: 2},
+	}
+	s := NewTestServerWithDriver(t, driver)
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/file.txt", []byte("v1"), 0600))
+
+	raw, err := c.OpenRawConn()
+	require.NoError(t, err, "Couldn't open raw connection")
+
+	defer func() { require.NoError(t, raw.Close()) }()
+
+	// nothing listens on this port anymore, the data connection can't be opened
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	rc, response, err := raw.SendCommand(fmt.Sprintf("EPRT |1|127.0.0.1|%d|", listener.Addr().(*net.TCPAddr).Port))
+	require.NoError(t, err)
+	require.Equal(t, StatusOK, rc, response)
+
+	rc, response, err = raw.SendCommand("STOR file.txt")
+	require.NoError(t, err)
+	require.Equal(t, StatusCannotOpenDataConnection, rc, response)
+
+	content, err := afero.ReadFile(driver.fs, "/file.txt")
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(content))
+
+	_, err = driver.fs.Stat("/file.txt;1")
+	require.True(t, os.IsNotExist(err), err)
+}
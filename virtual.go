@@ -0,0 +1,112 @@
+package ftpserver
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"time"
+)
+
+// errVirtualEntry is returned when a client tries to modify a virtual entry
+var errVirtualEntry = errors.New("virtual entries are read-only")
+
+// VirtualEntry is a file or a directory added to the listings by MainDriverExtensionVirtualEntries.
+// The files are served from memory, the directories list the virtual entries given for their path.
+type VirtualEntry struct {
+	Name    string    // Name of the entry in its directory
+	IsDir   bool      // The entry is a directory
+	Content []byte    // Content of a file
+	ModTime time.Time // Modification time of the entry
+}
+
+// virtualFileInfo is the os.FileInfo of a virtual entry
+type virtualFileInfo struct {
+	entry *VirtualEntry
+}
+
+func (info *virtualFileInfo) Name() string       { return info.entry.Name }
+func (info *virtualFileInfo) Size() int64        { return int64(len(info.entry.Content)) }
+func (info *virtualFileInfo) ModTime() time.Time { return info.entry.ModTime }
+func (info *virtualFileInfo) IsDir() bool        { return info.entry.IsDir }
+func (info *virtualFileInfo) Sys() interface{}   { return nil }
+
+func (info *virtualFileInfo) Mode() os.FileMode {
+	if info.entry.IsDir {
+		return os.ModeDir | 0555
+	}
+
+	return 0444
+}
+
+// virtualFile serves the content of a virtual file
+type virtualFile struct {
+	*bytes.Reader
+}
+
+func newVirtualFile(entry *VirtualEntry) *virtualFile {
+	return &virtualFile{Reader: bytes.NewReader(entry.Content)}
+}
+
+func (f *virtualFile) Write([]byte) (int, error) {
+	return 0, errVirtualEntry
+}
+
+func (f *virtualFile) Close() error {
+	return nil
+}
+
+// getVirtualEntries returns the virtual entries of a directory
+func (c *clientHandler) getVirtualEntries(dirPath string) []VirtualEntry {
+	if provider, ok := c.server.driver.(MainDriverExtensionVirtualEntries); ok {
+		return provider.GetVirtualEntries(c, dirPath)
+	}
+
+	return nil
+}
+
+// getVirtualEntry returns the virtual entry of a path, nil if it isn't one
+func (c *clientHandler) getVirtualEntry(name string) *VirtualEntry {
+	if _, ok := c.server.driver.(MainDriverExtensionVirtualEntries); !ok || name == "/" {
+		return nil
+	}
+
+	dir, base := path.Split(name)
+	entries := c.getVirtualEntries(path.Clean(dir))
+
+	for i := range entries {
+		if entries[i].Name == base {
+			return &entries[i]
+		}
+	}
+
+	return nil
+}
+
+// addVirtualEntries adds the virtual entries of a directory to its listing, they replace the files
+// having the same name
+func (c *clientHandler) addVirtualEntries(dirPath string, files []os.FileInfo) []os.FileInfo {
+	entries := c.getVirtualEntries(dirPath)
+	if len(entries) == 0 {
+		return files
+	}
+
+	virtualNames := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		virtualNames[entry.Name] = true
+	}
+
+	listing := make([]os.FileInfo, 0, len(files)+len(entries))
+
+	for _, file := range files {
+		if !virtualNames[file.Name()] {
+			listing = append(listing, file)
+		}
+	}
+
+	for i := range entries {
+		listing = append(listing, &virtualFileInfo{entry: &entries[i]})
+	}
+
+	return listing
+}
@@ -0,0 +1,64 @@
+package ftpserver
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/secsy/goftp"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualEntries(t *testing.T) {
+	driver := &TestServerDriver{
+		Debug: true,
+		VirtualEntries: map[string][]VirtualEntry{
+			"/":       {{Name: "README.txt", Content: []byte("read me")}, {Name: "shared", IsDir: true}},
+			"/shared": {{Name: "info.txt", Content: []byte("shared info")}},
+		},
+	}
+	s := NewTestServerWithDriver(t, driver)
+
+	require.NoError(t, afero.WriteFile(driver.fs, "/file", []byte("content"), 0600))
+	require.NoError(t, afero.WriteFile(driver.fs, "/README.txt", []byte("hidden"), 0600))
+
+	conf := goftp.Config{
+		User:     authUser,
+		Password: authPass,
+	}
+	c, err := goftp.DialConfig(conf, s.Addr())
+	require.NoError(t, err, "Couldn't connect")
+
+	defer func() { panicOnError(c.Close()) }()
+
+	// the virtual entries replace the files having the same name
+	files, err := c.ReadDir("/")
+	require.NoError(t, err)
+
+	names := make(map[string]int64)
+	for _, file := range files {
+		names[file.Name()] = file.Size()
+	}
+
+	require.Equal(t, map[string]int64{"file": 7, "README.txt": 7, "shared": 0}, names)
+
+	files, err = c.ReadDir("/shared")
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "info.txt", files[0].Name())
+
+	info, err := c.Stat("/shared")
+	require.NoError(t, err)
+	require.True(t, info.IsDir())
+
+	for name, content := range map[string]string{"/README.txt": "read me", "/shared/info.txt": "shared info"} {
+		buf := &bytes.Buffer{}
+		require.NoError(t, c.Retrieve(name, buf))
+		require.Equal(t, content, buf.String())
+	}
+
+	// they can't be modified
+	require.Error(t, c.Delete("/README.txt"))
+	require.Error(t, c.Store("/README.txt", bytes.NewReader([]byte("new"))))
+	require.Error(t, c.Rename("/shared", "/other"))
+}